@@ -14,6 +14,7 @@ type User struct {
 	Name      string `json:"name"`
 	Token     string `json:"token"`
 	MaxPoints int64  `json:"max_points,omitempty"` // max stored data points; 0 = unlimited
+	Retention int64  `json:"retention,omitempty"`  // seconds of data to keep; 0 = server default, <0 = forever
 }
 
 var (
@@ -43,6 +44,8 @@ func loadUsers() {
 	usersMutex.Lock()
 	defer usersMutex.Unlock()
 
+	users = make(map[string]User)
+
 	if _, err := os.Stat(usersFile); os.IsNotExist(err) {
 		return
 	}
@@ -157,6 +160,22 @@ func SetUserQuota(name string, max int64) error {
 	return nil
 }
 
+// SetUserRetention updates a user's retention override in seconds
+// (0 = fall back to the server default, negative = keep forever).
+func SetUserRetention(name string, seconds int64) error {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+
+	user, exists := users[name]
+	if !exists {
+		return errors.New("user not found")
+	}
+	user.Retention = seconds
+	users[name] = user
+	saveUsers()
+	return nil
+}
+
 func ResetUserToken(name string) (string, error) {
 	usersMutex.Lock()
 	defer usersMutex.Unlock()
@@ -195,3 +214,15 @@ func GetUser(name string) (User, bool) {
 	u, ok := users[name]
 	return u, ok
 }
+
+// SnapshotUsers returns the content of users.json, or nil when it has not
+// been written.
+func SnapshotUsers() ([]byte, error) {
+	usersMutex.RLock()
+	defer usersMutex.RUnlock()
+	data, err := os.ReadFile(usersFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
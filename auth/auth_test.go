@@ -320,3 +320,33 @@ func TestSaveUsers(t *testing.T) {
 		t.Error("Expected 'test-save' with token 'save-token' in saved file")
 	}
 }
+
+func TestSetUserRetention(t *testing.T) {
+	dir := setupTestDir(t)
+	defer cleanupTestDir(t, dir)
+
+	users = make(map[string]User)
+	Init(dir)
+
+	if _, err := CreateUser("retention-user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUserRetention("retention-user", 86400); err != nil {
+		t.Fatalf("SetUserRetention failed: %v", err)
+	}
+	user, _ := GetUser("retention-user")
+	if user.Retention != 86400 {
+		t.Errorf("Expected retention 86400, got %d", user.Retention)
+	}
+
+	// Persisted across reloads
+	users = make(map[string]User)
+	loadUsers()
+	if users["retention-user"].Retention != 86400 {
+		t.Errorf("Expected persisted retention 86400, got %d", users["retention-user"].Retention)
+	}
+
+	if err := SetUserRetention("missing-user", 10); err == nil {
+		t.Error("Expected error for unknown user")
+	}
+}
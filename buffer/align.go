@@ -0,0 +1,136 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"math"
+	"sync"
+	"time"
+	_ "time/tzdata" // zones for devices without a zone database
+)
+
+// Alignment places the buckets of a downsampled read. The zero value
+// starts each bucket at the first point it holds (downsampleDataPoints).
+// "epoch" starts buckets at multiples of the downsampling width since the
+// epoch; a calendar unit (minute, hour, day, week, month) makes each
+// bucket one unit of the wall clock of Location, and needs no width. Weeks
+// start on Monday. Aligned buckets are labelled with their start.
+type Alignment struct {
+	Unit     string
+	Location *time.Location // calendar units; nil means UTC
+}
+
+var calendarUnits = map[string]bool{"minute": true, "hour": true, "day": true, "week": true, "month": true}
+
+// locations caches time.LoadLocation, which reads the zone database.
+var locations sync.Map // name -> *time.Location
+
+// ParseAlignment returns the alignment named unit ("", "epoch" or a
+// calendar unit) in the IANA time zone timezone ("" = UTC). A time zone
+// is only meaningful for calendar units.
+func ParseAlignment(unit, timezone string) (Alignment, error) {
+	if unit != "" && unit != "epoch" && !calendarUnits[unit] {
+		return Alignment{}, fmt.Errorf("align must be epoch, minute, hour, day, week or month")
+	}
+	if timezone == "" {
+		return Alignment{Unit: unit}, nil
+	}
+	if !calendarUnits[unit] {
+		return Alignment{}, fmt.Errorf("timezone requires a calendar align unit")
+	}
+	if loc, ok := locations.Load(timezone); ok {
+		return Alignment{Unit: unit, Location: loc.(*time.Location)}, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return Alignment{}, fmt.Errorf("unknown timezone %s", timezone)
+	}
+	locations.Store(timezone, loc)
+	return Alignment{Unit: unit, Location: loc}, nil
+}
+
+// Calendar reports whether buckets are calendar units, which downsample
+// without a width.
+func (a Alignment) Calendar() bool {
+	return calendarUnits[a.Unit]
+}
+
+// Downsamples reports whether a read with this alignment and width is
+// downsampled.
+func (a Alignment) Downsamples(downsample int) bool {
+	return downsample > 1 || a.Calendar()
+}
+
+// bucketStart returns the start of the bucket holding ts, a timestamp in
+// units of 1/perSecond seconds.
+func (a Alignment) bucketStart(ts int64, downsample int, perSecond int64) int64 {
+	if !a.Calendar() {
+		return floorDiv(ts, int64(downsample)) * int64(downsample)
+	}
+	sec := floorDiv(ts, perSecond)
+	loc := a.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := time.Unix(sec, 0).In(loc)
+	var start int64
+	switch a.Unit {
+	case "minute", "hour":
+		// On the zone's clock at t, which DST shifts by whole hours
+		width := int64(60)
+		if a.Unit == "hour" {
+			width = 3600
+		}
+		_, offset := t.Zone()
+		local := sec + int64(offset)
+		start = floorDiv(local, width)*width - int64(offset)
+	case "day":
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc).Unix()
+	case "week":
+		monday := t.Day() - (int(t.Weekday())+6)%7
+		start = time.Date(t.Year(), t.Month(), monday, 0, 0, 0, 0, loc).Unix()
+	case "month":
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc).Unix()
+	}
+	return start * perSecond
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// downsampleAligned downsamples sorted points of one key into the buckets
+// of align; with the zero alignment, into first-point buckets.
+func downsampleAligned(dataPoints []models.DataPoint, downsample int, aggregation string, align Alignment) []models.DataPoint {
+	if align.Unit == "" {
+		return downsampleDataPoints(dataPoints, downsample, aggregation)
+	}
+	if len(dataPoints) == 0 {
+		return dataPoints
+	}
+	perSecond := KeyPrecision(dataPoints[0].Key).PerSecond()
+	var downsampled []models.DataPoint
+	for i := 0; i < len(dataPoints); {
+		start := align.bucketStart(dataPoints[i].Timestamp, downsample, perSecond)
+		j := i + 1
+		for j < len(dataPoints) && align.bucketStart(dataPoints[j].Timestamp, downsample, perSecond) == start {
+			j++
+		}
+		// One first-point interval wide enough for the whole bucket
+		point := downsampleDataPoints(dataPoints[i:j], math.MaxInt, aggregation)[0]
+		point.Timestamp = start
+		downsampled = append(downsampled, point)
+		i = j
+	}
+	return downsampled
+}
+
+// Downsample downsamples sorted points of one key as a read with these
+// parameters does, for callers that filter or combine the points first.
+func Downsample(dataPoints []models.DataPoint, downsample int, aggregation string, align Alignment) []models.DataPoint {
+	return downsampleAligned(dataPoints, downsample, aggregation, align)
+}
@@ -0,0 +1,83 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"testing"
+	"time"
+)
+
+func TestBucketStart(t *testing.T) {
+	berlin, err := ParseAlignment("day", "Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kolkata, err := ParseAlignment("hour", "Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(s string) int64 {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts.Unix()
+	}
+	for _, tc := range []struct {
+		align      Alignment
+		downsample int
+		ts         string
+		want       string
+	}{
+		{Alignment{Unit: "epoch"}, 3600, "2024-03-05T10:17:43Z", "2024-03-05T10:00:00Z"},
+		{Alignment{Unit: "minute"}, 0, "2024-03-05T10:17:43Z", "2024-03-05T10:17:00Z"},
+		{Alignment{Unit: "week"}, 0, "2024-03-10T23:59:59Z", "2024-03-04T00:00:00Z"},
+		{Alignment{Unit: "month"}, 0, "2024-02-29T12:00:00Z", "2024-02-01T00:00:00Z"},
+		{berlin, 0, "2024-03-05T23:30:00Z", "2024-03-05T23:00:00Z"}, // 00:30 on the 6th in Berlin
+		{berlin, 0, "2024-03-31T12:00:00Z", "2024-03-30T23:00:00Z"}, // the DST switch day
+		{berlin, 0, "2024-04-01T12:00:00Z", "2024-03-31T22:00:00Z"},
+		{kolkata, 0, "2024-03-05T10:17:43Z", "2024-03-05T09:30:00Z"}, // 15:47 IST
+	} {
+		got := tc.align.bucketStart(at(tc.ts), tc.downsample, 1)
+		if got != at(tc.want) {
+			t.Errorf("%s %s: expected %s, got %s", tc.align.Unit, tc.ts, tc.want, time.Unix(got, 0).UTC().Format(time.RFC3339))
+		}
+	}
+
+	for _, bad := range [][2]string{{"fortnight", ""}, {"day", "Mars/Olympus"}, {"epoch", "Europe/Berlin"}} {
+		if _, err := ParseAlignment(bad[0], bad[1]); err == nil {
+			t.Errorf("Expected %v rejected", bad)
+		}
+	}
+}
+
+func TestReadAlignedDataPoints(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	key := "TestReadAlignedDataPoints"
+	start := int64(1709633863) // 2024-03-05T10:17:43Z
+	var points []models.DataPoint
+	for i := int64(0); i < 3*3600; i += 60 {
+		points = append(points, models.DataPoint{Key: key, Timestamp: start + i, Value: 1})
+	}
+	StoreDataPointsBuffer(points)
+	end := start + 3*3600
+
+	// First-point buckets start at 10:17:43, aligned ones on the hour
+	unaligned := ReadDataPoints(key, start, end, 3600, "count")
+	if len(unaligned) != 3 || unaligned[0].Timestamp != start {
+		t.Errorf("Unexpected first-point buckets %v", unaligned)
+	}
+	for _, align := range []Alignment{{Unit: "epoch"}, {Unit: "hour"}} {
+		buckets := ReadAlignedDataPoints(key, start, end, 3600, "count", align)
+		if len(buckets) != 4 || buckets[0].Timestamp != 1709632800 || buckets[0].Value != 43 || buckets[1].Value != 60 {
+			t.Errorf("%s: unexpected buckets %v", align.Unit, buckets)
+		}
+		var streamed []models.DataPoint
+		c := NewCursor(key, start, end, 3600, "count", align)
+		for chunk := c.Next(50); chunk != nil; chunk = c.Next(50) {
+			streamed = append(streamed, chunk...)
+		}
+		samePoints(t, streamed, buckets)
+	}
+}
@@ -0,0 +1,307 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"gtsdb/utils"
+	"io"
+	"math"
+	"slices"
+)
+
+// Cursor reads a timestamp range of a key in chunks, so that large reads
+// and exports can be streamed without holding the whole range in memory.
+// Each chunk is read from the WAL (which holds every point of the key)
+// from where the previous one stopped, merged with the staged points it
+// covers. A compaction in between is detected and the position found
+// again through the index.
+//
+// With downsampling, a chunk holds the buckets completed so far: the
+// points of the last, possibly incomplete bucket are carried to the next
+// chunk. Bucket boundaries therefore match ReadAlignedDataPoints.
+type Cursor struct {
+	id          string
+	end         int64
+	from        int64 // next timestamp to read
+	pos         int64 // WAL offset after the last record read; 0 = seek
+	walLast     int64 // timestamp of the record before pos
+	done        bool
+	downsample  int
+	aggregation string
+	align       Alignment
+	carry       []models.DataPoint // points of the open bucket
+	rolled      []models.DataPoint // rollup answering the read, if any
+}
+
+// NewCursor returns a cursor over [startTime, endTime] of id, downsampled
+// as for ReadAlignedDataPoints.
+func NewCursor(id string, startTime, endTime int64, downsample int, aggregation string, align Alignment) *Cursor {
+	c := &Cursor{id: id, end: endTime, from: startTime, downsample: downsample, aggregation: aggregation, align: align}
+	if downsample > 1 && !align.Calendar() {
+		// A rollup is already downsampled, and small enough to hold
+		if rolled, ok := readRollup(id, startTime, endTime, downsample, aggregation, align); ok {
+			if len(rolled) > 0 {
+				c.rolled = rolled
+			}
+			c.done = true
+		}
+	}
+	if startTime > endTime {
+		c.done = true
+	}
+	return c
+}
+
+// Next returns the next chunk of about max points; nil once the range is
+// exhausted.
+func (c *Cursor) Next(max int) []models.DataPoint {
+	if max <= 0 {
+		max = 1000
+	}
+	if c.rolled != nil {
+		n := min(max, len(c.rolled))
+		chunk := c.rolled[:n:n]
+		if c.rolled = c.rolled[n:]; len(c.rolled) == 0 {
+			c.rolled = nil
+		}
+		return chunk
+	}
+	if !c.align.Downsamples(c.downsample) {
+		return c.next(max)
+	}
+	for {
+		points := c.next(max)
+		if points == nil {
+			if c.carry == nil {
+				return nil
+			}
+			last := downsampleAligned(c.carry, c.downsample, c.aggregation, c.align)
+			c.carry = nil
+			return last
+		}
+		points = append(c.carry, points...)
+		buckets := downsampleAligned(points, c.downsample, c.aggregation, c.align)
+		open := buckets[len(buckets)-1].Timestamp
+		i := len(points)
+		for i > 0 && points[i-1].Timestamp >= open {
+			i--
+		}
+		c.carry = append([]models.DataPoint(nil), points[i:]...)
+		if len(buckets) > 1 {
+			return buckets[:len(buckets)-1]
+		}
+	}
+}
+
+// next reads the next chunk of raw points.
+func (c *Cursor) next(max int) []models.DataPoint {
+	if c.done {
+		return nil
+	}
+	points, exhausted := c.readWAL(max)
+	upper := c.end
+	if !exhausted {
+		upper = points[len(points)-1].Timestamp
+	}
+	points = mergeStaged(c.id, points, c.from, upper)
+	if exhausted || upper == math.MaxInt64 {
+		c.done = true
+	}
+	c.from = upper + 1
+	if len(points) == 0 {
+		return nil
+	}
+	return points
+}
+
+// readWAL reads up to max WAL records in [c.from, c.end]. exhausted
+// reports whether the end of the range or of the file was reached.
+func (c *Cursor) readWAL(max int) (points []models.DataPoint, exhausted bool) {
+	dataRef, ok := acquireFileHandle(c.id+".aof", dataFileHandles)
+	if !ok {
+		return nil, true
+	}
+	defer dataRef.release()
+
+	count := int64(0)
+	if cv, ok := idToCountMap.Load(c.id); ok {
+		count = cv.Load()
+	}
+	layout := layoutOf(c.id)
+	rs := int(layout.recordSize)
+	endOffset := layout.offsetOf(count)
+
+	pos := c.pos
+	if pos <= layout.headerSize || pos > endOffset || !c.recordBefore(dataRef, layout, pos) {
+		pos = findStartOffset(c.id, c.from)
+	}
+
+	buf := layout.readBuffer()
+	for pos < endOffset {
+		toRead := min(int64(len(buf)), endOffset-pos)
+		n, err := dataRef.file.ReadAt(buf[:toRead], pos)
+		if err != nil && err != io.EOF {
+			utils.Error("Error reading file %s: %v", c.id, err)
+			return points, true
+		}
+		for i := 0; i+rs <= n; i += rs {
+			if !layout.verify(buf[i : i+rs]) {
+				reportCorruptRecord(c.id, pos+int64(i))
+				continue
+			}
+			ts := timestampAt(buf[i:])
+			if ts > c.end {
+				return points, true
+			}
+			if ts < c.from {
+				continue
+			}
+			points = append(points, layout.decode(c.id, buf[i:i+rs]))
+			if len(points) == max {
+				c.pos, c.walLast = pos+int64(i+rs), ts
+				return points, false
+			}
+		}
+		if int64(n) < toRead {
+			break
+		}
+		pos += int64(n)
+	}
+	return points, true
+}
+
+// recordBefore reports whether the record before pos is still the last one
+// read, i.e. the WAL was not rewritten since.
+func (c *Cursor) recordBefore(dataRef *refFile, layout *walLayout, pos int64) bool {
+	record := make([]byte, layout.recordSize)
+	if _, err := dataRef.file.ReadAt(record, pos-layout.recordSize); err != nil {
+		return false
+	}
+	return layout.verify(record) && timestampAt(record) == c.walLast
+}
+
+// ReadPage reads up to limit points of [startTime, endTime] of id, from the
+// start of the range or, when desc is set, from its end (in descending
+// order), downsampled as for ReadAlignedDataPoints. more reports whether points
+// are left; next is then where the range of the following page starts
+// (ascending) or ends (descending).
+func ReadPage(id string, startTime, endTime int64, limit int, desc bool, downsample int, aggregation string, align Alignment) (points []models.DataPoint, next int64, more bool) {
+	var page []models.DataPoint
+	switch {
+	case desc && align.Downsamples(downsample):
+		// Buckets may start at the first point of the range: they are
+		// computed from there
+		all := ReadAlignedDataPoints(id, startTime, endTime, downsample, aggregation, align)
+		for i := len(all) - 1; i >= 0 && len(page) <= limit; i-- {
+			page = append(page, all[i])
+		}
+	case desc:
+		page = readPageBackward(id, startTime, endTime, limit+1)
+	default:
+		c := NewCursor(id, startTime, endTime, downsample, aggregation, align)
+		for len(page) <= limit {
+			chunk := c.Next(limit + 1 - len(page))
+			if chunk == nil {
+				break
+			}
+			page = append(page, chunk...)
+		}
+	}
+	if len(page) <= limit {
+		return page, 0, false
+	}
+	if desc {
+		return page[:limit], page[limit-1].Timestamp - 1, true
+	}
+	// The first point left starts the next page (and its bucket, if
+	// downsampled)
+	return page[:limit], page[limit].Timestamp, true
+}
+
+// readPageBackward reads the last limit points of [startTime, endTime] of id,
+// in descending order: the WAL is read backwards from the end of the range,
+// then merged with the staged points the records read cover.
+func readPageBackward(id string, startTime, endTime int64, limit int) []models.DataPoint {
+	wal, exhausted := readWALBackward(id, startTime, endTime, limit)
+	lower := startTime
+	if !exhausted {
+		lower = wal[len(wal)-1].Timestamp
+	}
+	slices.Reverse(wal)
+	points := mergeStaged(id, wal, lower, endTime)
+	if len(points) > limit {
+		points = points[len(points)-limit:]
+	}
+	slices.Reverse(points)
+	return points
+}
+
+// readWALBackward reads up to limit WAL records in [startTime, endTime],
+// the last first. exhausted reports whether the start of the range or of the
+// file was reached.
+func readWALBackward(id string, startTime, endTime int64, limit int) (points []models.DataPoint, exhausted bool) {
+	dataRef, ok := acquireFileHandle(id+".aof", dataFileHandles)
+	if !ok {
+		return nil, true
+	}
+	defer dataRef.release()
+
+	count := int64(0)
+	if cv, ok := idToCountMap.Load(id); ok {
+		count = cv.Load()
+	}
+	layout := layoutOf(id)
+	rs := layout.recordSize
+	fileEnd := layout.offsetOf(count)
+	buf := layout.readBuffer()
+
+	// The range ends before the first record past endTime, found by
+	// scanning forward from the index entry before it
+	end := findStartOffset(id, endTime)
+scan:
+	for end < fileEnd {
+		n, err := dataRef.file.ReadAt(buf[:min(int64(len(buf)), fileEnd-end)], end)
+		if err != nil && err != io.EOF {
+			utils.Error("Error reading file %s: %v", id, err)
+			return nil, true
+		}
+		if int64(n) < rs {
+			break
+		}
+		for i := int64(0); i+rs <= int64(n); i += rs {
+			if layout.verify(buf[i:i+rs]) && timestampAt(buf[i:]) > endTime {
+				end += i
+				break scan
+			}
+		}
+		end += int64(n) / rs * rs
+	}
+
+	for end > layout.headerSize {
+		from := max(layout.headerSize, end-int64(len(buf)))
+		n, err := dataRef.file.ReadAt(buf[:end-from], from)
+		if err != nil && err != io.EOF {
+			utils.Error("Error reading file %s: %v", id, err)
+			return points, true
+		}
+		for i := int64(n) - rs; i >= 0; i -= rs {
+			record := buf[i : i+rs]
+			if !layout.verify(record) {
+				reportCorruptRecord(id, from+i)
+				continue
+			}
+			ts := timestampAt(record)
+			if ts < startTime {
+				return points, true
+			}
+			if ts > endTime {
+				continue
+			}
+			points = append(points, layout.decode(id, record))
+			if len(points) == limit {
+				return points, false
+			}
+		}
+		end = from
+	}
+	return points, true
+}
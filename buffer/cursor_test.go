@@ -0,0 +1,127 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"slices"
+	"testing"
+)
+
+func drainCursor(c *Cursor, max int, each func()) []models.DataPoint {
+	var all []models.DataPoint
+	for chunk := c.Next(max); chunk != nil; chunk = c.Next(max) {
+		all = append(all, chunk...)
+		if each != nil {
+			each()
+		}
+	}
+	return all
+}
+
+func samePoints(t *testing.T, got, want []models.DataPoint) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %d points, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Timestamp != want[i].Timestamp || got[i].Value != want[i].Value {
+			t.Fatalf("At index %d: expected %d=%v, got %d=%v", i, want[i].Timestamp, want[i].Value, got[i].Timestamp, got[i].Value)
+		}
+	}
+}
+
+func TestCursor(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	key := "TestCursor"
+	base := int64(1700000000)
+	var points []models.DataPoint
+	for i := int64(0); i < 12000; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + 2*i, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+	// Patched out-of-order points are staged, not appended to the WAL
+	PatchDataPoints([]models.DataPoint{
+		{Key: key, Timestamp: base + 1, Value: -1},
+		{Key: key, Timestamp: base + 9001, Value: -2},
+		{Key: key, Timestamp: base + 20001, Value: -3},
+	}, key)
+	if StagedPointCount(key) != 3 {
+		t.Fatalf("Expected 3 staged points, got %d", StagedPointCount(key))
+	}
+
+	start, end := base+1000, base+22000
+	want := ReadDataPoints(key, start, end, 0, "")
+	samePoints(t, drainCursor(NewCursor(key, start, end, 0, "", Alignment{}), 700, nil), want)
+
+	// A compaction while the cursor is open moves the records
+	chunks := 0
+	got := drainCursor(NewCursor(key, start, end, 0, "", Alignment{}), 700, func() {
+		if chunks++; chunks == 3 {
+			if err := CompactKey(key); err != nil {
+				t.Fatalf("CompactKey failed: %v", err)
+			}
+		}
+	})
+	samePoints(t, got, want)
+
+	for _, agg := range []string{"avg", "p95", "count"} {
+		want := ReadDataPoints(key, start, end, 7, agg)
+		samePoints(t, drainCursor(NewCursor(key, start, end, 7, agg, Alignment{}), 333, nil), want)
+	}
+
+	if chunk := NewCursor(key, base+30000, base+40000, 0, "", Alignment{}).Next(100); chunk != nil {
+		t.Errorf("Expected no points past the end, got %d", len(chunk))
+	}
+}
+
+func TestReadPage(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	key := "TestReadPage"
+	base := int64(1700000000)
+	var points []models.DataPoint
+	for i := int64(0); i < 12000; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + 2*i, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+	PatchDataPoints([]models.DataPoint{
+		{Key: key, Timestamp: base + 1, Value: -1},
+		{Key: key, Timestamp: base + 20001, Value: -3},
+	}, key)
+
+	start, end := base, base+22001
+	for _, tc := range []struct {
+		desc       bool
+		limit      int
+		downsample int
+	}{{false, 700, 0}, {true, 700, 0}, {true, 1, 0}, {false, 97, 7}, {true, 97, 7}} {
+		want := ReadDataPoints(key, start, end, tc.downsample, "avg")
+		if tc.desc {
+			want = append([]models.DataPoint(nil), want...)
+			slices.Reverse(want)
+		}
+		var got []models.DataPoint
+		from, to := start, end
+		for pages := 0; ; pages++ {
+			if pages > len(want) {
+				t.Fatalf("%+v: paging does not end", tc)
+			}
+			page, next, more := ReadPage(key, from, to, tc.limit, tc.desc, tc.downsample, "avg", Alignment{})
+			if len(page) > tc.limit || more && len(page) != tc.limit {
+				t.Fatalf("%+v: page of %d points, more=%v", tc, len(page), more)
+			}
+			got = append(got, page...)
+			if !more {
+				break
+			}
+			if tc.desc {
+				to = next
+			} else {
+				from = next
+			}
+		}
+		samePoints(t, got, want)
+	}
+}
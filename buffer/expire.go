@@ -0,0 +1,310 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/utils"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// ExpireDataPoints drops every data point older than cutoff from the front of
+// a key's WAL. Only the surviving suffix is copied into a fresh .aof/.idx pair
+// (swapped in with the same tmp+rename dance as CompactKey), so the cost is
+// proportional to what is kept rather than to the whole series. A key whose
+// points have all expired is deleted. Returns the number of points removed.
+func ExpireDataPoints(key string, cutoff int64) (int, error) {
+	if key == "" || !allIds.Contains(key) {
+		return 0, nil
+	}
+
+	lock, _ := dataPatchLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.Lock()
+	defer lock.Unlock()
+	renameLock.Lock() // a key whose points all expired is deleted
+	defer renameLock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+
+	// Staged out-of-order points may be older than the cutoff; fold them
+	// into the WAL first so the suffix copy sees every point.
+	if existingStage(key).size() > 0 {
+		if err := compactKeyLocked(key); err != nil {
+			return 0, err
+		}
+	}
+
+	// Block appends while the file is swapped; otherwise a write landing
+	// between the copy and the rename would be lost.
+	writeLock, _ := fileWriteLocks.LoadOrStore(key, &sync.Mutex{})
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	dropped, total, err := countExpiredRecords(key, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	if dropped == 0 {
+		return 0, nil
+	}
+	markRollupsStale(key, cutoff-1)
+
+	layout := layoutOf(key)
+	if dropped == total {
+		deleteKeyLocked(key)
+		os.Remove(utils.DataDir + "/" + key + ".aof.gor")
+		os.Remove(utils.DataDir + "/" + key + ".aof.gor.idx")
+		// A multi-field, typed or precision key keeps its schema.
+		if layout.hasSchema() {
+			if _, err := writeWALHeader(key, layout.header); err != nil {
+				utils.Error("Failed to restore WAL header for %s: %v", key, err)
+			} else {
+				allIds.Add(key)
+			}
+		}
+		report(Mutation{Op: OpExpire, Key: key, Cutoff: cutoff})
+		return int(dropped), nil
+	}
+
+	if err := rewriteWALSuffix(key, layout, layout.offsetOf(dropped), layout.offsetOf(total)); err != nil {
+		return 0, err
+	}
+
+	if err := expireCompressedWAL(key, cutoff); err != nil {
+		utils.Error("Failed to expire compressed WAL for %s: %v", key, err)
+	}
+
+	// Cached points may include expired ones; let the cache refill on write.
+	idToRingBufferMap.Delete(key)
+
+	newCount := &atomic.Int64{}
+	newCount.Store(total - dropped)
+	idToCountMap.Store(key, newCount)
+	totalDataPoints.Add(-dropped)
+	report(Mutation{Op: OpExpire, Key: key, Cutoff: cutoff})
+
+	utils.Log("Expired %d points from key %s (cutoff %d)", dropped, key, cutoff)
+	return int(dropped), nil
+}
+
+// countExpiredRecords returns how many leading records of a key's WAL have a
+// timestamp before cutoff, together with the total record count. The sparse
+// index narrows the scan to the last indexInterval records before the
+// boundary.
+func countExpiredRecords(key string, cutoff int64) (int64, int64, error) {
+	dataRef, ok := acquireFileHandle(key+".aof", dataFileHandles)
+	if !ok {
+		return 0, 0, fmt.Errorf("cannot open data file for %s", key)
+	}
+	defer dataRef.release()
+
+	total := int64(0)
+	if cv, ok := idToCountMap.Load(key); ok {
+		total = cv.Load()
+	}
+	layout := layoutOf(key)
+	rs := int(layout.recordSize)
+	endOffset := layout.offsetOf(total)
+
+	// Every record before an index entry with ts < cutoff is itself < cutoff.
+	pos := layout.headerSize
+	if cutoff > math.MinInt64 {
+		pos = findStartOffset(key, cutoff-1)
+	}
+
+	buf := layout.readBuffer()
+	for pos < endOffset {
+		toRead := int64(len(buf))
+		if endOffset-pos < toRead {
+			toRead = endOffset - pos
+		}
+		n, err := dataRef.file.ReadAt(buf[:toRead], pos)
+		if err != nil && err != io.EOF {
+			return 0, 0, fmt.Errorf("error reading file %s: %w", key, err)
+		}
+		for i := 0; i+rs <= n; i += rs {
+			if timestampAt(buf[i:]) >= cutoff {
+				return (pos + int64(i) - layout.headerSize) / layout.recordSize, total, nil
+			}
+		}
+		if int64(n) < toRead {
+			break
+		}
+		pos += int64(n)
+	}
+	return total, total, nil
+}
+
+// rewriteWALSuffix replaces a key's .aof with its header plus the byte range
+// [from, to) of itself and rebuilds the sparse index for the new record
+// positions.
+func rewriteWALSuffix(key string, layout *walLayout, from, to int64) error {
+	realDataFile := utils.DataDir + "/" + key + ".aof"
+	realIdxFile := utils.DataDir + "/" + key + ".idx"
+	tmpDataFile := realDataFile + ".tmp"
+	tmpIdxFile := realIdxFile + ".tmp"
+
+	os.Remove(tmpDataFile)
+	os.Remove(tmpIdxFile)
+
+	src, err := os.Open(realDataFile)
+	if err != nil {
+		return fmt.Errorf("failed to open data file: %w", err)
+	}
+	dst, err := os.OpenFile(tmpDataFile, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		src.Close()
+		return fmt.Errorf("failed to create temp data file: %w", err)
+	}
+	idx, err := os.OpenFile(tmpIdxFile, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		src.Close()
+		dst.Close()
+		os.Remove(tmpDataFile)
+		return fmt.Errorf("failed to create temp index file: %w", err)
+	}
+
+	if layout.headerSize > 0 {
+		_, raw, herr := newWALLayout(layout.header)
+		if herr == nil {
+			_, herr = dst.Write(raw)
+		}
+		if herr != nil {
+			src.Close()
+			dst.Close()
+			idx.Close()
+			os.Remove(tmpDataFile)
+			os.Remove(tmpIdxFile)
+			return fmt.Errorf("failed to write data file header: %w", herr)
+		}
+	}
+	err = copyWALRange(src, dst, idx, layout, from, to)
+	src.Close()
+	dst.Close()
+	idx.Close()
+	if err != nil {
+		os.Remove(tmpDataFile)
+		os.Remove(tmpIdxFile)
+		return err
+	}
+
+	// Close existing handles (the eviction callback closes when idle)
+	dataFileHandles.Delete(key + ".aof")
+	indexFileHandles.Delete(key + ".idx")
+
+	if err := renameWithRetry(tmpIdxFile, realIdxFile); err != nil {
+		os.Remove(tmpDataFile)
+		os.Remove(tmpIdxFile)
+		return fmt.Errorf("failed to rename index file: %w", err)
+	}
+	if err := renameWithRetry(tmpDataFile, realDataFile); err != nil {
+		os.Remove(tmpDataFile)
+		// The old data file is intact; rebuild its index to match it again.
+		rebuildIndexFile(key)
+		return fmt.Errorf("failed to rename data file: %w", err)
+	}
+
+	primeFileHandle(key+".aof", dataFileHandles)
+	primeFileHandle(key+".idx", indexFileHandles)
+	return nil
+}
+
+// copyWALRange copies the records in [from, to) of src to dst (skipped when
+// dst is nil) and writes one idx entry per indexInterval records, with
+// offsets as if the copy started right after the layout's header.
+func copyWALRange(src, dst, idx *os.File, layout *walLayout, from, to int64) error {
+	buf := layout.readBuffer()
+	rs := int(layout.recordSize)
+	count := int64(0)
+	for pos := from; pos < to; {
+		toRead := int64(len(buf))
+		if to-pos < toRead {
+			toRead = to - pos
+		}
+		n, err := src.ReadAt(buf[:toRead], pos)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read data file: %w", err)
+		}
+		n -= n % rs
+		if n == 0 {
+			break
+		}
+		if dst != nil {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return fmt.Errorf("failed to write data file: %w", err)
+			}
+		}
+		for i := 0; i < n; i += rs {
+			count++
+			if count%indexInterval == 0 {
+				if err := writeIndexEntry(idx, timestampAt(buf[i:]), layout.offsetOf(count-1)); err != nil {
+					return fmt.Errorf("failed to write index: %w", err)
+				}
+			}
+		}
+		pos += int64(n)
+	}
+	return nil
+}
+
+// rebuildIndexFile regenerates a key's sparse .idx from its .aof.
+func rebuildIndexFile(key string) {
+	realDataFile := utils.DataDir + "/" + key + ".aof"
+	realIdxFile := utils.DataDir + "/" + key + ".idx"
+	tmpIdxFile := realIdxFile + ".tmp"
+
+	src, err := os.Open(realDataFile)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return
+	}
+
+	os.Remove(tmpIdxFile)
+	idx, err := os.OpenFile(tmpIdxFile, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	layout, err := readWALLayout(src)
+	if err != nil {
+		utils.Error("Failed to rebuild index for %s: %v", key, err)
+		idx.Close()
+		os.Remove(tmpIdxFile)
+		return
+	}
+	err = copyWALRange(src, nil, idx, layout, layout.headerSize, info.Size())
+	idx.Close()
+	if err != nil {
+		utils.Error("Failed to rebuild index for %s: %v", key, err)
+		os.Remove(tmpIdxFile)
+		return
+	}
+	indexFileHandles.Delete(key + ".idx")
+	if err := renameWithRetry(tmpIdxFile, realIdxFile); err != nil {
+		utils.Error("Failed to replace index for %s: %v", key, err)
+		os.Remove(tmpIdxFile)
+	}
+}
+
+// expireCompressedWAL drops expired points from a key's Gorilla-compressed
+// copy, if one exists, rewriting both .aof.gor and .aof.gor.idx.
+func expireCompressedWAL(key string, cutoff int64) error {
+	if _, err := os.Stat(utils.DataDir + "/" + key + ".aof.gor"); os.IsNotExist(err) {
+		return nil
+	}
+	points, err := readCompressedDataPoints(key, cutoff, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		os.Remove(utils.DataDir + "/" + key + ".aof.gor")
+		os.Remove(utils.DataDir + "/" + key + ".aof.gor.idx")
+		return nil
+	}
+	return writeCompressedWAL(key, points)
+}
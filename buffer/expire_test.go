@@ -0,0 +1,115 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"gtsdb/utils"
+	"os"
+	"testing"
+)
+
+func TestExpireDataPoints(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	key := "TestExpireDataPoints"
+	base := int64(1700000000)
+	n := indexInterval*2 + 123
+	points := make([]models.DataPoint, n)
+	for i := 0; i < n; i++ {
+		points[i] = models.DataPoint{Key: key, Timestamp: base + int64(i), Value: float64(i)}
+	}
+	StoreDataPointsBuffer(points)
+	totalBefore := GetTotalDataPoints()
+
+	cutoff := base + int64(indexInterval) + 10
+	removed, err := ExpireDataPoints(key, cutoff)
+	if err != nil {
+		t.Fatalf("ExpireDataPoints failed: %v", err)
+	}
+	wantRemoved := indexInterval + 10
+	if removed != wantRemoved {
+		t.Fatalf("Expected %d removed, got %d", wantRemoved, removed)
+	}
+	if cnt, _ := GetKeyCount(key); cnt != n-wantRemoved {
+		t.Errorf("Expected count %d, got %d", n-wantRemoved, cnt)
+	}
+	if got := GetTotalDataPoints(); got != totalBefore-int64(wantRemoved) {
+		t.Errorf("Expected total %d, got %d", totalBefore-int64(wantRemoved), got)
+	}
+
+	// Range reads use the rebuilt index
+	result := ReadDataPoints(key, base+int64(n)-50, base+int64(n), 0, "")
+	if len(result) != 50 || result[0].Value != float64(n-50) {
+		t.Errorf("Unexpected range read after expiry: %d points", len(result))
+	}
+	all := ReadDataPoints(key, 0, base+int64(n), 0, "")
+	if len(all) != n-wantRemoved || all[0].Timestamp != cutoff {
+		t.Errorf("Expected first surviving timestamp %d, got %d points", cutoff, len(all))
+	}
+
+	// Nothing more to expire at the same cutoff
+	if removed, _ := ExpireDataPoints(key, cutoff); removed != 0 {
+		t.Errorf("Expected idempotent expiry, removed %d", removed)
+	}
+
+	// Appends keep working on the rewritten file
+	StoreDataPointBuffer(models.DataPoint{Key: key, Timestamp: base + int64(n), Value: 1})
+	if cnt, _ := GetKeyCount(key); cnt != n-wantRemoved+1 {
+		t.Errorf("Expected count %d after append, got %d", n-wantRemoved+1, cnt)
+	}
+}
+
+func TestExpireDataPointsAllExpired(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	key := "TestExpireAll"
+	for i := 0; i < 10; i++ {
+		StoreDataPointBuffer(models.DataPoint{Key: key, Timestamp: 1700000000 + int64(i), Value: 1})
+	}
+	removed, err := ExpireDataPoints(key, 1800000000)
+	if err != nil || removed != 10 {
+		t.Fatalf("Expected 10 removed, got %d (%v)", removed, err)
+	}
+	if allIds.Contains(key) {
+		t.Error("Fully expired key should be deleted")
+	}
+	if _, err := os.Stat(utils.DataDir + "/" + key + ".aof"); !os.IsNotExist(err) {
+		t.Error("Fully expired key's data file should be removed")
+	}
+}
+
+func TestExpireDataPointsCompressed(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	key := "TestExpireCompressed"
+	points := make([]models.DataPoint, 100)
+	for i := range points {
+		points[i] = models.DataPoint{Key: key, Timestamp: 1700000000 + int64(i), Value: float64(i)}
+	}
+	StoreDataPointsBuffer(points)
+	if err := writeCompressedWAL(key, points); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ExpireDataPoints(key, 1700000060); err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := readCompressedDataPoints(key, 0, 1800000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compressed) != 40 || compressed[0].Timestamp != 1700000060 {
+		t.Errorf("Expected 40 compressed points from 1700000060, got %d", len(compressed))
+	}
+}
+
+func TestExpireDataPointsUnknownKey(t *testing.T) {
+	if removed, err := ExpireDataPoints("TestExpireMissing", 1); removed != 0 || err != nil {
+		t.Errorf("Expected no-op for unknown key, got %d, %v", removed, err)
+	}
+	if removed, err := ExpireDataPoints("", 1); removed != 0 || err != nil {
+		t.Errorf("Expected no-op for empty key, got %d, %v", removed, err)
+	}
+}
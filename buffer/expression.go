@@ -0,0 +1,281 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"math"
+	"slices"
+	"strconv"
+	"unicode"
+)
+
+// Expression is an arithmetic expression over named series: numbers,
+// variables, + - * /, unary minus, parentheses and the functions abs(x),
+// sqrt(x), min(x, y) and max(x, y). It is evaluated at the timestamps all
+// its variables have a point at.
+type Expression struct {
+	root exprNode
+	vars []string // in order of first use
+}
+
+type exprNode interface {
+	eval(values map[string]float64) float64
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) float64 { return float64(n) }
+
+type varNode string
+
+func (v varNode) eval(values map[string]float64) float64 { return values[string(v)] }
+
+type negNode struct{ x exprNode }
+
+func (n negNode) eval(values map[string]float64) float64 { return -n.x.eval(values) }
+
+type binaryNode struct {
+	op   byte
+	l, r exprNode
+}
+
+func (b binaryNode) eval(values map[string]float64) float64 {
+	l, r := b.l.eval(values), b.r.eval(values)
+	switch b.op {
+	case '+':
+		return l + r
+	case '-':
+		return l - r
+	case '*':
+		return l * r
+	}
+	return l / r
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (c callNode) eval(values map[string]float64) float64 {
+	x := c.args[0].eval(values)
+	switch c.name {
+	case "abs":
+		return math.Abs(x)
+	case "sqrt":
+		return math.Sqrt(x)
+	case "min":
+		return math.Min(x, c.args[1].eval(values))
+	}
+	return math.Max(x, c.args[1].eval(values))
+}
+
+// exprFunctions are the functions of an expression, by argument count.
+var exprFunctions = map[string]int{"abs": 1, "sqrt": 1, "min": 2, "max": 2}
+
+// Limits of an expression, so that parsing and evaluating it cannot
+// exhaust the stack: its length, and how deeply parentheses, function
+// calls and unary minuses nest.
+const (
+	maxExpressionLength = 4096
+	maxExpressionDepth  = 64
+)
+
+// ParseExpression parses text. It must use at least one variable.
+func ParseExpression(text string) (*Expression, error) {
+	if len(text) > maxExpressionLength {
+		return nil, fmt.Errorf("expression longer than %d characters", maxExpressionLength)
+	}
+	p := &exprParser{text: text}
+	root, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return nil, fmt.Errorf("unexpected %q at %d in expression", p.text[p.pos], p.pos)
+	}
+	if len(p.vars) == 0 {
+		return nil, fmt.Errorf("expression uses no variable")
+	}
+	return &Expression{root: root, vars: p.vars}, nil
+}
+
+// Vars returns the variables of the expression.
+func (e *Expression) Vars() []string {
+	return e.vars
+}
+
+// Evaluate joins the sorted series of each variable by timestamp and
+// returns the value of the expression at each timestamp they all have a
+// point at, as points of key. Non-finite results (a division by zero) are
+// left out.
+func (e *Expression) Evaluate(key string, series map[string][]models.DataPoint) []models.DataPoint {
+	lead := series[e.vars[0]]
+	next := make(map[string]int, len(e.vars))
+	values := make(map[string]float64, len(e.vars))
+	var result []models.DataPoint
+points:
+	for _, p := range lead {
+		values[e.vars[0]] = p.Value
+		for _, name := range e.vars[1:] {
+			s, i := series[name], next[name]
+			for i < len(s) && s[i].Timestamp < p.Timestamp {
+				i++
+			}
+			next[name] = i
+			if i == len(s) || s[i].Timestamp != p.Timestamp {
+				continue points
+			}
+			values[name] = s[i].Value
+		}
+		v := e.root.eval(values)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		result = append(result, models.DataPoint{Key: key, Timestamp: p.Timestamp, Value: v})
+	}
+	return result
+}
+
+// exprParser is a recursive-descent parser of expressions.
+type exprParser struct {
+	text  string
+	pos   int
+	vars  []string
+	depth int // of parseUnary calls
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next byte after spaces, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos == len(p.text) {
+		return 0
+	}
+	return p.text[p.pos]
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	l, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryNode{op: op, l: l, r: r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.depth++; p.depth > maxExpressionDepth {
+		return nil, fmt.Errorf("expression nested deeper than %d levels", maxExpressionDepth)
+	}
+	defer func() { p.depth-- }()
+	if p.peek() == '-' {
+		p.pos++
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return negNode{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	c := p.peek()
+	start := p.pos
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at %d in expression", p.pos)
+		}
+		p.pos++
+		return x, nil
+	case c == '.' || c >= '0' && c <= '9':
+		for p.pos < len(p.text) && (p.text[p.pos] == '.' || p.text[p.pos] >= '0' && p.text[p.pos] <= '9' ||
+			p.text[p.pos] == 'e' || p.text[p.pos] == 'E' ||
+			(p.text[p.pos] == '+' || p.text[p.pos] == '-') && (p.text[p.pos-1] == 'e' || p.text[p.pos-1] == 'E')) {
+			p.pos++
+		}
+		v, err := strconv.ParseFloat(p.text[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s in expression", p.text[start:p.pos])
+		}
+		return numberNode(v), nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for p.pos < len(p.text) && (p.text[p.pos] == '_' || unicode.IsLetter(rune(p.text[p.pos])) || unicode.IsDigit(rune(p.text[p.pos]))) {
+			p.pos++
+		}
+		name := p.text[start:p.pos]
+		if p.peek() == '(' {
+			return p.parseCall(name)
+		}
+		if !slices.Contains(p.vars, name) {
+			p.vars = append(p.vars, name)
+		}
+		return varNode(name), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at %d in expression", c, p.pos)
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	arity, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s in expression", name)
+	}
+	p.pos++ // (
+	var args []exprNode
+	for {
+		x, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, x)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing ) at %d in expression", p.pos)
+	}
+	p.pos++
+	if len(args) != arity {
+		return nil, fmt.Errorf("%s takes %d argument(s)", name, arity)
+	}
+	return callNode{name: name, args: args}, nil
+}
@@ -0,0 +1,57 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"strings"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	values := map[string]float64{"a": 3, "b": -4, "x_1": 2}
+	for text, want := range map[string]float64{
+		"a + b * x_1":        -5,
+		"(a + b) * x_1":      -2,
+		"-a - -b":            -7,
+		"a / x_1 / 2":        0.75,
+		"sqrt(a*a + b*b)":    5,
+		"max(a, abs(b)) - 1": 3,
+		"1.5e1 - min(a, b)":  19,
+	} {
+		expr, err := ParseExpression(text)
+		if err != nil {
+			t.Fatalf("ParseExpression(%q): %v", text, err)
+		}
+		if got := expr.root.eval(values); got != want {
+			t.Errorf("%s = %v, expected %v", text, got, want)
+		}
+	}
+	for _, text := range []string{"", "a +", "(a", "a b", "2 * 3", "pow(a, 2)", "abs(a, b)", "a $ b",
+		strings.Repeat("(", 100) + "a" + strings.Repeat(")", 100), strings.Repeat("-", 100) + "a",
+		strings.Repeat("a+", 3000) + "a"} {
+		if _, err := ParseExpression(text); err == nil {
+			t.Errorf("Expected %.20q rejected", text)
+		}
+	}
+	if _, err := ParseExpression(strings.Repeat("abs(", 30) + "a" + strings.Repeat(")", 30)); err != nil {
+		t.Errorf("Expected 30 nested calls accepted: %v", err)
+	}
+}
+
+func TestEvaluateExpression(t *testing.T) {
+	expr, err := ParseExpression("in - out / out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars := expr.Vars(); len(vars) != 2 || vars[0] != "in" || vars[1] != "out" {
+		t.Fatalf("Unexpected vars %v", vars)
+	}
+	series := map[string][]models.DataPoint{
+		"in":  {{Timestamp: 1, Value: 5}, {Timestamp: 2, Value: 6}, {Timestamp: 4, Value: 7}, {Timestamp: 5, Value: 8}},
+		"out": {{Timestamp: 2, Value: 2}, {Timestamp: 3, Value: 1}, {Timestamp: 4, Value: 0}, {Timestamp: 5, Value: 4}},
+	}
+	// 4 divides by zero
+	got := expr.Evaluate("diff", series)
+	if len(got) != 2 || got[0].Timestamp != 2 || got[0].Value != 5 || got[1].Timestamp != 5 || got[1].Value != 7 || got[1].Key != "diff" {
+		t.Errorf("Unexpected result %+v", got)
+	}
+}
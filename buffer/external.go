@@ -2,7 +2,6 @@ package buffer
 
 import (
 	"bufio"
-	"encoding/binary"
 	"fmt"
 	"gtsdb/models"
 	"gtsdb/synchronous"
@@ -51,9 +50,12 @@ func InitKey(dataPointId string) {
 	if dataPointId == "" {
 		return
 	}
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
 	primeFileHandle(dataPointId+".aof", dataFileHandles)
 	primeFileHandle(dataPointId+".idx", indexFileHandles)
 	allIds.Add(dataPointId)
+	report(Mutation{Op: OpInitKey, Key: dataPointId})
 }
 func RenameKey(dataPointId, newId string) {
 	if newId == "" || dataPointId == "" {
@@ -62,7 +64,16 @@ func RenameKey(dataPointId, newId string) {
 	utils.Log("Renaming key: %v to %v", dataPointId, newId)
 	renameLock.Lock()
 	defer renameLock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+	if renameKeyLocked(dataPointId, newId) {
+		report(Mutation{Op: OpRenameKey, Key: dataPointId, NewKey: newId})
+	}
+}
 
+// renameKeyLocked is RenameKey for a caller holding renameLock and the
+// mutation gate. Returns false when the files could not be renamed.
+func renameKeyLocked(dataPointId, newId string) bool {
 	dfk := dataPointId + ".aof"
 	ifk := dataPointId + ".idx"
 	newDfk := newId + ".aof"
@@ -71,6 +82,9 @@ func RenameKey(dataPointId, newId string) {
 	// Close and remove old file handles (the eviction callback closes when idle)
 	dataFileHandles.Delete(dfk)
 	indexFileHandles.Delete(ifk)
+	keyLayouts.Delete(dataPointId)
+	keyDicts.Delete(dataPointId)
+	keyStages.Delete(dataPointId)
 
 	// Remove from allIds before renaming
 	allIds.Remove(dataPointId)
@@ -82,8 +96,10 @@ func RenameKey(dataPointId, newId string) {
 	if err1 != nil || err2 != nil {
 		utils.Errorln("Error renaming files:", err1, err2)
 		allIds.Add(dataPointId) // restore old ID on failure
-		return
+		return false
 	}
+	renameDict(dataPointId, newId)
+	renameStage(dataPointId, newId)
 
 	// Transfer in-memory state from old key to new key
 	if count, ok := idToCountMap.Load(dataPointId); ok {
@@ -119,6 +135,7 @@ func RenameKey(dataPointId, newId string) {
 
 	// Add new ID
 	allIds.Add(newId)
+	return true
 }
 
 func DeleteKey(dataPointId string) {
@@ -129,13 +146,22 @@ func DeleteKey(dataPointId string) {
 
 	renameLock.Lock()
 	defer renameLock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+	deleteKeyLocked(dataPointId)
+	report(Mutation{Op: OpDeleteKey, Key: dataPointId})
+}
 
+// deleteKeyLocked is DeleteKey for a caller holding renameLock and the
+// mutation gate.
+func deleteKeyLocked(dataPointId string) {
 	dfk := dataPointId + ".aof"
 	ifk := dataPointId + ".idx"
 
 	// Close file handles if they are open (the eviction callback closes when idle)
 	dataFileHandles.Delete(dfk)
 	indexFileHandles.Delete(ifk)
+	keyLayouts.Delete(dataPointId)
 	idToRingBufferMap.Delete(dataPointId)
 	// Subtract deleted points from global counter before clearing the per-key count
 	if cnt, ok := idToCountMap.Load(dataPointId); ok {
@@ -155,6 +181,8 @@ func DeleteKey(dataPointId string) {
 	if err != nil && !os.IsNotExist(err) {
 		utils.Errorln(err)
 	}
+	removeDict(dataPointId)
+	removeStage(dataPointId)
 }
 
 func ReloadKey(dataPointId string) bool {
@@ -176,6 +204,9 @@ func ReloadKey(dataPointId string) bool {
 	}
 	dataFileHandles.Delete(dfk)
 	indexFileHandles.Delete(ifk)
+	keyLayouts.Delete(dataPointId)
+	keyDicts.Delete(dataPointId)
+	forgetStage(dataPointId)
 	idToRingBufferMap.Delete(dataPointId)
 	// Subtract old count before reloading (prepareFileHandles will re-add from file size)
 	if cnt, ok := idToCountMap.Load(dataPointId); ok {
@@ -204,7 +235,17 @@ func ReloadKey(dataPointId string) bool {
 }
 
 func StoreDataPointBuffer(dataPoint models.DataPoint) {
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+	storeDataPointBuffer(dataPoint)
+	if mutationHook.Load() != nil {
+		report(Mutation{Op: OpWrite, Key: dataPoint.Key, Points: []models.DataPoint{dataPoint}})
+	}
+}
+
+func storeDataPointBuffer(dataPoint models.DataPoint) {
 	allIds.Add(dataPoint.Key)
+	updateRollups(dataPoint.Key, []models.DataPoint{dataPoint})
 
 	if cacheSize == 0 {
 		storeDataPoints(dataPoint.Key, []models.DataPoint{dataPoint})
@@ -235,9 +276,13 @@ func StoreDataPointsBuffer(dataPoints []models.DataPoint) {
 		return
 	}
 
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+	defer report(Mutation{Op: OpWrite, Points: dataPoints}) // points of any keys
+
 	// Fast path: single point delegates to existing function
 	if len(dataPoints) == 1 {
-		StoreDataPointBuffer(dataPoints[0])
+		storeDataPointBuffer(dataPoints[0])
 		return
 	}
 
@@ -250,6 +295,7 @@ func StoreDataPointsBuffer(dataPoints []models.DataPoint) {
 
 	// Write each key's points in one call, then update caches
 	for key, points := range keyGroups {
+		updateRollups(key, points)
 		storeDataPoints(key, points)
 
 		// Update ring buffer cache if enabled
@@ -274,96 +320,82 @@ func StoreDataPointsBuffer(dataPoints []models.DataPoint) {
 func PatchDataPoints(dataPoints []models.DataPoint, key string) {
 	/*
 		1. sort input data points by timestamp
-		2. get all data points from key
-		3. merge input data points with existing data points
-		4. write merged data points to file
-		5. rebuild index file
+		2. append points newer than the current tail to the WAL
+		3. overwrite a single existing timestamp in place, or
+		4. stage older points in the key's .aof.ooo (see staging.go)
 	*/
 
 	lock, _ := dataPatchLocks.LoadOrStore(key, &sync.Mutex{}) //ignore the second return value because we don't care if it was loaded
 	lock.Lock()
 	defer lock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
 
 	// sort input data points by timestamp
 	sort.Slice(dataPoints, func(i, j int) bool {
 		return dataPoints[i].Timestamp < dataPoints[j].Timestamp
 	})
+	if len(dataPoints) == 0 {
+		return
+	}
+	if !patchDataPointsLocked(dataPoints, key) {
+		return
+	}
+	report(Mutation{Op: OpPatch, Key: key, Points: dataPoints})
 
-	// Fast path: if patch points are strictly newer than current tail, append directly.
-	// This avoids full file read + rewrite for common single-point patch usage.
-	if len(dataPoints) > 0 {
-		lastTs := int64(0)
-		if ts, ok := lastTimestamp.Load(key); ok {
-			lastTs = ts
-		} else {
-			last := ReadLastDataPoints(key, 1)
-			if len(last) > 0 {
-				lastTs = last[0].Timestamp
-			}
-		}
-
-		canAppend := true
-		for _, p := range dataPoints {
-			if p.Timestamp <= lastTs {
-				canAppend = false
-				break
-			}
-		}
-		if canAppend {
-			storeDataPoints(key, dataPoints)
-			allIds.Add(key)
-			lastValue.Store(key, dataPoints[len(dataPoints)-1].Value)
-			lastTimestamp.Store(key, dataPoints[len(dataPoints)-1].Timestamp)
-			return
+	if stageFor(key).size() >= maxStagedPoints {
+		if err := compactKeyLocked(key); err != nil {
+			utils.Error("Failed to fold staged points into %s: %v", key, err)
 		}
 	}
+}
 
-	// Fast path: single-point overwrite when timestamp already exists.
-	// This updates one 16-byte record in-place instead of full rewrite.
-	if len(dataPoints) == 1 {
-		if overwritten := tryOverwriteSingleTimestampValue(key, dataPoints[0]); overwritten {
-			return
+// patchDataPointsLocked stores sorted points for PatchDataPoints, which holds
+// the key's data patch lock and the mutation gate. Returns false when
+// nothing was stored.
+func patchDataPointsLocked(dataPoints []models.DataPoint, key string) bool {
+
+	lastTs := int64(0)
+	if ts, ok := lastTimestamp.Load(key); ok {
+		lastTs = ts
+	} else {
+		last := ReadLastDataPoints(key, 1)
+		if len(last) > 0 {
+			lastTs = last[0].Timestamp
 		}
 	}
 
-	// get all data points from key
-	existingDataPoints := readFiledDataPoints(key, 0, math.MaxInt64)
-
-	// merge input data points with existing data points
-	newDataCursor := 0
-	existingDataCursor := 0
-
-	var mergedDataPoints []models.DataPoint
-
-	for newDataCursor < len(dataPoints) && existingDataCursor < len(existingDataPoints) {
-		newDataPoint := dataPoints[newDataCursor]
-		existingDataPoint := existingDataPoints[existingDataCursor]
+	// Points strictly newer than the current tail are appended directly.
+	split := sort.Search(len(dataPoints), func(i int) bool { return dataPoints[i].Timestamp > lastTs })
+	late, fresh := dataPoints[:split], dataPoints[split:]
 
-		if newDataPoint.Timestamp < existingDataPoint.Timestamp {
-			mergedDataPoints = append(mergedDataPoints, newDataPoint)
-			newDataCursor++
-		} else if newDataPoint.Timestamp > existingDataPoint.Timestamp {
-			mergedDataPoints = append(mergedDataPoints, existingDataPoint)
-			existingDataCursor++
-		} else {
-			// Overwrite old data with new data if timestamps are the same
-			mergedDataPoints = append(mergedDataPoints, newDataPoint)
-			newDataCursor++
-			existingDataCursor++
+	// Fast path: single-point overwrite when timestamp already exists.
+	// This updates one record in-place; a staged timestamp must stay staged.
+	if len(dataPoints) == 1 && len(late) == 1 && !stageFor(key).contains(late[0].Timestamp) {
+		if overwritten := tryOverwriteSingleTimestampValue(key, late[0]); overwritten {
+			markRollupsStale(key, late[0].Timestamp)
+			return true
 		}
 	}
 
-	for newDataCursor < len(dataPoints) {
-		mergedDataPoints = append(mergedDataPoints, dataPoints[newDataCursor])
-		newDataCursor++
+	allIds.Add(key)
+	if len(late) > 0 {
+		if err := stageFor(key).add(late); err != nil {
+			utils.Error("Failed to stage out-of-order points for %s: %v", key, err)
+			return false
+		}
+		if tail := late[len(late)-1]; tail.Timestamp == lastTs && len(fresh) == 0 {
+			lastValue.Store(key, tail.Value)
+		}
+		markRollupsStale(key, late[len(late)-1].Timestamp)
 	}
-
-	for existingDataCursor < len(existingDataPoints) {
-		mergedDataPoints = append(mergedDataPoints, existingDataPoints[existingDataCursor])
-		existingDataCursor++
+	if len(fresh) > 0 {
+		updateRollups(key, fresh)
+		storeDataPoints(key, fresh)
+		lastValue.Store(key, fresh[len(fresh)-1].Value)
+		lastTimestamp.Store(key, fresh[len(fresh)-1].Timestamp)
 	}
-
-	rewriteDataPoints(key, mergedDataPoints)
+	return true
 }
 
 func tryOverwriteSingleTimestampValue(key string, point models.DataPoint) bool {
@@ -374,6 +406,7 @@ func tryOverwriteSingleTimestampValue(key string, point models.DataPoint) bool {
 	}
 	defer dataFile.Close()
 
+	layout := layoutOf(key)
 	startOffset := findStartOffset(key, point.Timestamp)
 
 	if _, err := dataFile.Seek(startOffset, io.SeekStart); err != nil {
@@ -381,20 +414,25 @@ func tryOverwriteSingleTimestampValue(key string, point models.DataPoint) bool {
 	}
 
 	reader := bufio.NewReader(dataFile)
+	record := make([]byte, layout.recordSize)
 	offset := startOffset
 	for {
-		var ts int64
-		var val float64
-		err := readRecord(reader, &ts, &val)
-		if err != nil {
+		if _, err := io.ReadFull(reader, record); err != nil {
 			return false
 		}
+		if !layout.verify(record) {
+			reportCorruptRecord(key, offset)
+			offset += layout.recordSize
+			continue
+		}
+		ts := timestampAt(record)
 
 		if ts == point.Timestamp {
 			// Use WriteAt to write at the exact byte offset, bypassing O_APPEND
-			var valBuf [8]byte
-			binary.LittleEndian.PutUint64(valBuf[:], math.Float64bits(point.Value))
-			if _, err := dataFile.WriteAt(valBuf[:], offset+int64(binary.Size(ts))); err != nil {
+			if err := layout.encode(key, record, point); err != nil {
+				return false
+			}
+			if _, err := dataFile.WriteAt(record, offset); err != nil {
 				return false
 			}
 			if err := dataFile.Sync(); err != nil {
@@ -410,7 +448,7 @@ func tryOverwriteSingleTimestampValue(key string, point models.DataPoint) bool {
 			return false
 		}
 
-		offset += int64(binary.Size(ts) + binary.Size(val))
+		offset += layout.recordSize
 	}
 }
 
@@ -425,6 +463,10 @@ func DeleteDataPoints(key, operator string, value float64, hasValue bool, timest
 	lock, _ := dataPatchLocks.LoadOrStore(key, &sync.Mutex{})
 	lock.Lock()
 	defer lock.Unlock()
+	renameLock.Lock() // the rewrite deletes and recreates the key
+	defer renameLock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
 
 	if !allIds.Contains(key) {
 		return 0
@@ -437,6 +479,7 @@ func DeleteDataPoints(key, operator string, value float64, hasValue bool, timest
 
 	filteredDataPoints := make([]models.DataPoint, 0, len(existingDataPoints))
 	removedCount := 0
+	lastRemoved := int64(0)
 
 	for _, dataPoint := range existingDataPoints {
 		inTimeRange := true
@@ -453,6 +496,7 @@ func DeleteDataPoints(key, operator string, value float64, hasValue bool, timest
 		}
 		if shouldDelete {
 			removedCount++
+			lastRemoved = dataPoint.Timestamp
 			continue
 		}
 		filteredDataPoints = append(filteredDataPoints, dataPoint)
@@ -463,12 +507,28 @@ func DeleteDataPoints(key, operator string, value float64, hasValue bool, timest
 	}
 
 	rewriteDataPoints(key, filteredDataPoints)
+	markRollupsStale(key, lastRemoved)
+	report(Mutation{Op: OpDeletePoints, Key: key, Operator: operator, Value: value, HasValue: hasValue, From: timestampFrom, To: timestampTo})
 	return removedCount
 }
 
+// rewriteDataPoints replaces a key's points. Caller must hold renameLock and
+// the mutation gate.
 func rewriteDataPoints(key string, dataPoints []models.DataPoint) {
-	DeleteKey(key)
+	layout := layoutOf(key)
+	deleteKeyLocked(key)
 
+	// A multi-field or typed key keeps its schema even when no points remain.
+	restoreWALHeader(key, layout)
+	if layout.valueType == models.TypeString {
+		// The rebuilt dictionary assigns new ids, so a compressed copy no
+		// longer decodes.
+		os.Remove(utils.DataDir + "/" + key + ".aof.gor")
+		os.Remove(utils.DataDir + "/" + key + ".aof.gor.idx")
+	}
+	if layout.hasSchema() {
+		allIds.Add(key)
+	}
 	if len(dataPoints) == 0 {
 		return
 	}
@@ -481,19 +541,34 @@ func rewriteDataPoints(key string, dataPoints []models.DataPoint) {
 }
 
 func ReadDataPoints(id string, startTime, endTime int64, downsample int, aggregation string) []models.DataPoint {
+	return ReadAlignedDataPoints(id, startTime, endTime, downsample, aggregation, Alignment{})
+}
+
+// ReadAlignedDataPoints is ReadDataPoints with the downsampling buckets
+// placed by align.
+func ReadAlignedDataPoints(id string, startTime, endTime int64, downsample int, aggregation string, align Alignment) []models.DataPoint {
+
+	// A rollup with the same interval and aggregation may already hold the answer
+	if downsample > 1 && !align.Calendar() {
+		if rolled, ok := readRollup(id, startTime, endTime, downsample, aggregation, align); ok {
+			return rolled
+		}
+	}
 
 	dataPoints := readBufferedDataPoints(id, startTime, endTime)
-	if len(dataPoints) == 0 {
+	if len(dataPoints) > 0 {
+		dataPoints = mergeStaged(id, dataPoints, startTime, endTime)
+	} else {
 		// Try compressed WAL first, fall back to raw AOF
 		if compressed, err := readCompressedDataPoints(id, startTime, endTime); err == nil && len(compressed) > 0 {
-			dataPoints = compressed
+			dataPoints = mergeStaged(id, compressed, startTime, endTime)
 		} else {
 			dataPoints = readFiledDataPoints(id, startTime, endTime)
 		}
 	}
 
-	if downsample > 1 {
-		dataPoints = downsampleDataPoints(dataPoints, downsample, aggregation)
+	if align.Downsamples(downsample) {
+		dataPoints = downsampleAligned(dataPoints, downsample, aggregation, align)
 	}
 
 	return dataPoints
@@ -502,7 +577,7 @@ func ReadDataPoints(id string, startTime, endTime int64, downsample int, aggrega
 func ReadLastDataPoints(id string, count int) []models.DataPoint {
 
 	if checkIfBufferHasEnoughDataPoints(id, count) {
-		return readLastBufferedDataPoints(id, count)
+		return mergeLastStaged(id, readLastBufferedDataPoints(id, count), count)
 	}
 
 	dataPoints, err := readLastFiledDataPoints(id, count)
@@ -511,7 +586,7 @@ func ReadLastDataPoints(id string, count int) []models.DataPoint {
 		return []models.DataPoint{}
 	}
 
-	return dataPoints
+	return mergeLastStaged(id, dataPoints, count)
 }
 
 func FlushRemainingDataPoints() {
@@ -522,10 +597,16 @@ func GetAllIds() []string {
 	return allIds.Items()
 }
 
-// GetKeyCount returns the number of data points for a given key
+// KeyExists reports whether key has been created or written.
+func KeyExists(key string) bool {
+	return allIds.Contains(key)
+}
+
+// GetKeyCount returns the number of data points for a given key, staged
+// ones included.
 func GetKeyCount(key string) (int, bool) {
 	if cnt, ok := idToCountMap.Load(key); ok {
-		return int(cnt.Load()), true
+		return int(cnt.Load() + existingStage(key).extraCount()), true
 	}
 	return 0, false
 }
@@ -536,7 +617,7 @@ func GetTotalDataPoints() int64 {
 	return totalDataPoints.Load()
 }
 
-// fileKeyCount returns the number of 16-byte records in a key's data file,
+// fileKeyCount returns the number of records in a key's data file,
 // opening the file if needed so evicted handles still report real counts.
 // Extracted so the acquire/release pairing uses defer without accumulating
 // deferred releases inside the caller's loop.
@@ -550,7 +631,7 @@ func fileKeyCount(key string) int {
 	if err != nil {
 		return 0
 	}
-	return int(fileStat.Size() / 16)
+	return int(layoutOf(key).recordCount(fileStat.Size()))
 }
 
 func GetAllIdsWithCount() []models.KeyCount {
@@ -558,14 +639,15 @@ func GetAllIdsWithCount() []models.KeyCount {
 
 	var keyCount = []models.KeyCount{}
 	for _, key := range keys {
-		keyCount = append(keyCount, models.KeyCount{Key: key, Count: fileKeyCount(key)})
+		keyCount = append(keyCount, models.KeyCount{Key: key, Count: fileKeyCount(key) + int(existingStage(key).extraCount())})
 	}
 
 	return keyCount
 }
 
 // CompactKey reads all data points for a key and rewrites them to a compacted file.
-// This removes gaps left by deleted data points and reduces file size.
+// This removes gaps left by deleted data points, folds in staged out-of-order
+// points and reduces file size.
 func CompactKey(key string) error {
 	if key == "" || !allIds.Contains(key) {
 		return fmt.Errorf("key not found: %s", key)
@@ -574,8 +656,25 @@ func CompactKey(key string) error {
 	lock, _ := dataPatchLocks.LoadOrStore(key, &sync.Mutex{})
 	lock.Lock()
 	defer lock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+	if err := compactKeyLocked(key); err != nil {
+		return err
+	}
+	report(Mutation{Op: OpCompact, Key: key})
+	return nil
+}
 
-	// Read all existing data points
+// compactKeyLocked is CompactKey for a caller holding the key's data patch
+// lock.
+func compactKeyLocked(key string) error {
+	// Block appends while the file is rewritten; otherwise a write landing
+	// between the read and the rename would be lost.
+	writeLock, _ := fileWriteLocks.LoadOrStore(key, &sync.Mutex{})
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	// Read all existing data points, staged ones included
 	dataPoints := readFiledDataPoints(key, 0, math.MaxInt64)
 	if dataPoints == nil {
 		return nil // empty file, nothing to compact
@@ -609,10 +708,35 @@ func CompactKey(key string) error {
 		return fmt.Errorf("failed to create temp index file: %w", err)
 	}
 
-	// Write data points and rebuild index
+	// Write the header (if any), data points and rebuild index. Compaction
+	// rewrites every record, so it also adds checksums to older files.
+	layout := layoutOf(key)
+	if utils.WALChecksums && !layout.checksum {
+		if l, _, err := newWALLayout(checksumHeader(layout.header)); err == nil {
+			layout = l
+		}
+	}
+	if layout.headerSize > 0 {
+		_, raw, err := newWALLayout(layout.header)
+		if err == nil {
+			_, err = tmpDataFileHandle.Write(raw)
+		}
+		if err != nil {
+			tmpDataFileHandle.Close()
+			tmpIdxFileHandle.Close()
+			os.Remove(tmpDataFile)
+			os.Remove(tmpIdxFile)
+			return fmt.Errorf("failed to write compact header: %w", err)
+		}
+	}
+	record := make([]byte, layout.recordSize)
 	count := int64(0)
 	for _, dp := range dataPoints {
-		if err := writeRecord(tmpDataFileHandle, dp.Timestamp, dp.Value); err != nil {
+		err := layout.encode(key, record, dp)
+		if err == nil {
+			_, err = tmpDataFileHandle.Write(record)
+		}
+		if err != nil {
 			tmpDataFileHandle.Close()
 			tmpIdxFileHandle.Close()
 			os.Remove(tmpDataFile)
@@ -621,7 +745,7 @@ func CompactKey(key string) error {
 		}
 		count++
 		if count%indexInterval == 0 {
-			offset := (count - 1) * 16
+			offset := layout.offsetOf(count - 1)
 			if err := writeIndexEntry(tmpIdxFileHandle, dp.Timestamp, offset); err != nil {
 				tmpDataFileHandle.Close()
 				tmpIdxFileHandle.Close()
@@ -654,11 +778,15 @@ func CompactKey(key string) error {
 	}
 
 	// Re-open file handles and update caches
+	keyLayouts.Store(key, layout)
 	primeFileHandle(key+".aof", dataFileHandles)
 	primeFileHandle(key+".idx", indexFileHandles)
+	if s := existingStage(key); s != nil {
+		s.clear()
+	}
 
-	// Write Gorilla-compressed version if enabled
-	if utils.CompactionCompression {
+	// Write Gorilla-compressed version if enabled (single-value keys only)
+	if utils.CompactionCompression && len(layout.header.Fields) == 0 {
 		if err := writeCompressedWAL(key, dataPoints); err != nil {
 			utils.Error("Failed to write compressed WAL for %s: %v", key, err)
 		}
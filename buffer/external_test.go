@@ -656,8 +656,8 @@ func TestGetDataFileSize(t *testing.T) {
 	if !ok {
 		t.Error("Expected size for existing key")
 	}
-	if size != 16 {
-		t.Errorf("Expected size 16 for one record, got %d", size)
+	if want := layoutOf(testID).offsetOf(1); size != want {
+		t.Errorf("Expected size %d for one record, got %d", want, size)
 	}
 
 	// Test getting size of a non-existent file (truly unique name)
@@ -736,6 +736,41 @@ func TestCompactKey(t *testing.T) {
 	}
 }
 
+func TestCompactKeyConcurrentWrites(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	testID := "TestCompactKeyConcurrentWrites"
+	base := int64(1700000000)
+	StoreDataPointBuffer(models.DataPoint{Key: testID, Timestamp: base, Value: 0})
+
+	// Appends racing the rewrite must all survive it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int64(1); i < 2000; i++ {
+			StoreDataPointBuffer(models.DataPoint{Key: testID, Timestamp: base + i, Value: float64(i)})
+		}
+	}()
+	for compacting := true; compacting; {
+		select {
+		case <-done:
+			compacting = false
+		default:
+			if err := CompactKey(testID); err != nil {
+				t.Fatalf("CompactKey failed: %v", err)
+			}
+		}
+	}
+
+	if points := readFiledDataPoints(testID, 0, base+2000); len(points) != 2000 {
+		t.Errorf("Expected 2000 points after concurrent compaction, got %d", len(points))
+	}
+	if count, _ := GetKeyCount(testID); count != 2000 {
+		t.Errorf("Expected count 2000, got %d", count)
+	}
+}
+
 func TestCompactKeyNonExistent(t *testing.T) {
 	cleanup()
 	defer cleanup()
@@ -0,0 +1,286 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"math"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Multi-field keys store several named float columns per timestamp in one
+// record, so a reading (temperature, humidity, battery) is written
+// atomically. The schema lives in the key's WAL header.
+
+// validFieldName allows names that need no escaping in JSON or CSV output.
+func validFieldName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// InitKeyFields creates a multi-field key with the given field names. It is
+// a no-op when the key already has exactly these fields; a key that already
+// holds data cannot change its layout.
+func InitKeyFields(key string, fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("fields required")
+	}
+	return InitKeyWithOptions(key, KeyOptions{Fields: fields})
+}
+
+// KeyOptions is the layout requested by initkey. The zero value is a plain
+// float key with second timestamps.
+type KeyOptions struct {
+	Fields    []string
+	Type      models.ValueType
+	Precision models.Precision
+}
+
+// InitKeyWithOptions creates a key with the given layout. Like
+// InitKeyFields it is a no-op when the key already has this layout and
+// fails once the key holds data of another one.
+func InitKeyWithOptions(key string, opts KeyOptions) error {
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+	if err := initKeyWithOptions(key, opts); err != nil {
+		return err
+	}
+	report(Mutation{Op: OpInitKey, Key: key, Options: &opts})
+	return nil
+}
+
+// initKeyWithOptions is InitKeyWithOptions for a caller holding the
+// mutation gate.
+func initKeyWithOptions(key string, opts KeyOptions) error {
+	if key == "" {
+		return fmt.Errorf("key required")
+	}
+	seen := make(map[string]bool, len(opts.Fields))
+	for _, name := range opts.Fields {
+		if !validFieldName(name) {
+			return fmt.Errorf("invalid field name %q: use letters, digits, '_', '-' or '.'", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("duplicate field: %s", name)
+		}
+		seen[name] = true
+	}
+
+	h := walHeader{Version: walVersion, Fields: append([]string(nil), opts.Fields...)}
+	if opts.Type != models.TypeFloat {
+		h.Type = opts.Type.String()
+	}
+	if opts.Precision != models.PrecisionSecond {
+		h.Precision = opts.Precision.String()
+	}
+	return initKeyLayout(key, checksumHeader(h))
+}
+
+// initKeyLayout gives an empty key the header h. It is a no-op when the key
+// already has this layout; a key that already holds data cannot change it.
+func initKeyLayout(key string, h walHeader) error {
+	lock, _ := fileWriteLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.Lock()
+	defer lock.Unlock()
+
+	primeFileHandle(key+".aof", dataFileHandles)
+	current := layoutOf(key)
+	if sameFields(current.header.Fields, h.Fields) && current.header.Type == h.Type && current.header.Precision == h.Precision {
+		allIds.Add(key)
+		return nil
+	}
+	if count, ok := GetKeyCount(key); ok && count > 0 {
+		return fmt.Errorf("key %s already holds %s data", key, describeLayout(current))
+	}
+
+	if _, err := writeWALHeader(key, h); err != nil {
+		return err
+	}
+	// A compressed copy or string dictionary of an earlier series no longer
+	// applies.
+	os.Remove(utils.DataDir + "/" + key + ".aof.gor")
+	os.Remove(utils.DataDir + "/" + key + ".aof.gor.idx")
+	removeDict(key)
+	primeFileHandle(key+".idx", indexFileHandles)
+	allIds.Add(key)
+	return nil
+}
+
+// describeLayout names a layout in error messages.
+func describeLayout(l *walLayout) string {
+	switch {
+	case len(l.header.Fields) > 0:
+		return "multi-field [" + strings.Join(l.header.Fields, ",") + "]"
+	case l.valueType != models.TypeFloat:
+		return l.valueType.String()
+	case l.precision != models.PrecisionSecond:
+		return l.precision.String() + "-precision"
+	}
+	return "single-value"
+}
+
+func sameFields(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// KeyFields returns a key's field names, or nil for a single-value key.
+func KeyFields(key string) []string {
+	fields := layoutOf(key).header.Fields
+	if len(fields) == 0 {
+		return nil
+	}
+	return append([]string(nil), fields...)
+}
+
+// NewDataPoint builds a point for key, checking it against the key's
+// layout: multi-field keys take fields (a subset of the schema), single-value
+// keys take value. For multi-field points Value is the first schema field
+// (NaN when it is not written).
+func NewDataPoint(key string, timestamp int64, value float64, fields map[string]float64) (models.DataPoint, error) {
+	dp := models.DataPoint{Key: key, Timestamp: timestamp, Value: value}
+	layout := layoutOf(key)
+	schema := layout.header.Fields
+	if len(schema) == 0 {
+		if len(fields) > 0 {
+			return dp, fmt.Errorf("key %s has no fields; initkey with fields first", key)
+		}
+		if layout.valueType != models.TypeFloat {
+			return typedPoint(key, timestamp, layout.valueType, value)
+		}
+		return dp, nil
+	}
+	if len(fields) == 0 {
+		return dp, fmt.Errorf("key %s requires fields [%s]", key, strings.Join(schema, ","))
+	}
+	for name, v := range fields {
+		if !containsField(schema, name) {
+			return dp, fmt.Errorf("unknown field %s for key %s", name, key)
+		}
+		if math.IsNaN(v) {
+			return dp, fmt.Errorf("field %s: NaN is not a valid value", name)
+		}
+	}
+	dp.Fields = make(map[string]float64, len(fields))
+	for name, v := range fields {
+		dp.Fields[name] = v
+	}
+	dp.Value = math.NaN()
+	if v, ok := fields[schema[0]]; ok {
+		dp.Value = v
+	}
+	return dp, nil
+}
+
+func containsField(fields []string, name string) bool {
+	for _, f := range fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ProjectFields keeps only the named fields of multi-field points. Value
+// becomes the first selected field (NaN when the point lacks it). Points
+// without fields are returned unchanged.
+func ProjectFields(points []models.DataPoint, fields []string) []models.DataPoint {
+	if len(fields) == 0 {
+		return points
+	}
+	projected := make([]models.DataPoint, len(points))
+	for i, p := range points {
+		projected[i] = p
+		if p.Fields == nil {
+			continue
+		}
+		kept := make(map[string]float64, len(fields))
+		for _, name := range fields {
+			if v, ok := p.Fields[name]; ok {
+				kept[name] = v
+			}
+		}
+		projected[i].Fields = kept
+		projected[i].Value = math.NaN()
+		if v, ok := kept[fields[0]]; ok {
+			projected[i].Value = v
+		}
+	}
+	return projected
+}
+
+// downsampleFieldPoints downsamples multi-field points with the same
+// first-point-aligned intervals as downsampleDataPoints, aggregating each
+// field over the points that carry it.
+func downsampleFieldPoints(dataPoints []models.DataPoint, downsample int, aggregation string) []models.DataPoint {
+	schema := layoutOf(dataPoints[0].Key).header.Fields
+	if len(schema) == 0 {
+		schema = []string{""}
+	}
+	var downsampled []models.DataPoint
+	for _, r := range bucketRanges(dataPoints, downsample) {
+		start, end := r[0], r[1]
+		intervalStart := dataPoints[start].Timestamp
+		names := make(map[string]bool)
+		for _, p := range dataPoints[start:end] {
+			for name := range p.Fields {
+				names[name] = true
+			}
+		}
+		fields := make(map[string]float64, len(names))
+		for name := range names {
+			var values []float64
+			sum, min, max := 0.0, math.Inf(1), math.Inf(-1)
+			for _, p := range dataPoints[start:end] {
+				v, ok := p.Fields[name]
+				if !ok {
+					continue
+				}
+				values = append(values, v)
+				sum += v
+				min = math.Min(min, v)
+				max = math.Max(max, v)
+			}
+			fields[name] = computeAggregate(aggregation, sum, float64(len(values)), min, max, values[0], values[len(values)-1], values)
+		}
+
+		point := models.DataPoint{Key: dataPoints[start].Key, Timestamp: intervalStart, Value: math.NaN(), Fields: fields}
+		if v, ok := fields[schema[0]]; ok {
+			point.Value = v
+		}
+		downsampled = append(downsampled, point)
+	}
+	return downsampled
+}
+
+// bucketRanges splits sorted points into the first-point-aligned intervals
+// used by downsampleDataPoints, as [start, end) index pairs.
+func bucketRanges(dataPoints []models.DataPoint, downsample int) [][2]int {
+	var ranges [][2]int
+	for start := 0; start < len(dataPoints); {
+		intervalStart := dataPoints[start].Timestamp
+		end := start + 1
+		for end < len(dataPoints) && dataPoints[end].Timestamp-intervalStart < int64(downsample) {
+			end++
+		}
+		ranges = append(ranges, [2]int{start, end})
+		start = end
+	}
+	return ranges
+}
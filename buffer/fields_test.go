@@ -0,0 +1,203 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"gtsdb/utils"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func fieldPoint(t *testing.T, key string, ts int64, fields map[string]float64) models.DataPoint {
+	t.Helper()
+	dp, err := NewDataPoint(key, ts, 0, fields)
+	if err != nil {
+		t.Fatalf("NewDataPoint failed: %v", err)
+	}
+	return dp
+}
+
+func TestInitKeyFields(t *testing.T) {
+	cleanup()
+	key := "TestInitKeyFields"
+
+	if err := InitKeyFields(key, []string{"temp", "temp"}); err == nil {
+		t.Error("Expected duplicate field to fail")
+	}
+	if err := InitKeyFields(key, []string{"bad name"}); err == nil {
+		t.Error("Expected invalid field name to fail")
+	}
+	if err := InitKeyFields(key, []string{"temp", "hum"}); err != nil {
+		t.Fatalf("InitKeyFields failed: %v", err)
+	}
+	if err := InitKeyFields(key, []string{"temp", "hum"}); err != nil {
+		t.Errorf("Re-initializing with the same fields should succeed: %v", err)
+	}
+	if got := KeyFields(key); !reflect.DeepEqual(got, []string{"temp", "hum"}) {
+		t.Errorf("KeyFields = %v", got)
+	}
+
+	StoreDataPointBuffer(fieldPoint(t, key, 1700000000, map[string]float64{"temp": 21.5}))
+	if err := InitKeyFields(key, []string{"temp"}); err == nil {
+		t.Error("Expected changing the fields of a key with data to fail")
+	}
+
+	legacy := "TestInitKeyFieldsLegacy"
+	StoreDataPointBuffer(models.DataPoint{Key: legacy, Timestamp: 1700000000, Value: 1})
+	if err := InitKeyFields(legacy, []string{"temp"}); err == nil {
+		t.Error("Expected a single-value key with data to reject fields")
+	}
+	if KeyFields(legacy) != nil {
+		t.Error("Single-value key should have no fields")
+	}
+}
+
+func TestNewDataPointValidation(t *testing.T) {
+	cleanup()
+	key := "TestNewDataPointValidation"
+	if _, err := NewDataPoint(key, 1700000000, 0, map[string]float64{"temp": 1}); err == nil {
+		t.Error("Expected fields on a single-value key to fail")
+	}
+	if err := InitKeyFields(key, []string{"temp", "hum"}); err != nil {
+		t.Fatalf("InitKeyFields failed: %v", err)
+	}
+	if _, err := NewDataPoint(key, 1700000000, 5, nil); err == nil {
+		t.Error("Expected a plain value on a multi-field key to fail")
+	}
+	if _, err := NewDataPoint(key, 1700000000, 0, map[string]float64{"pressure": 1}); err == nil {
+		t.Error("Expected an unknown field to fail")
+	}
+	dp, err := NewDataPoint(key, 1700000000, 0, map[string]float64{"hum": 40})
+	if err != nil {
+		t.Fatalf("NewDataPoint failed: %v", err)
+	}
+	if !math.IsNaN(dp.Value) {
+		t.Errorf("Value should be NaN when the first field is missing, got %v", dp.Value)
+	}
+}
+
+func TestMultiFieldStoreAndRead(t *testing.T) {
+	cleanup()
+	key := "TestMultiFieldStoreAndRead"
+	if err := InitKeyFields(key, []string{"temp", "hum", "battery"}); err != nil {
+		t.Fatalf("InitKeyFields failed: %v", err)
+	}
+
+	base := int64(1700000000)
+	StoreDataPointBuffer(fieldPoint(t, key, base, map[string]float64{"temp": 20, "hum": 40, "battery": 99}))
+	batch := make([]models.DataPoint, 0, 9)
+	for i := int64(1); i < 10; i++ {
+		batch = append(batch, fieldPoint(t, key, base+i, map[string]float64{"temp": 20 + float64(i), "hum": 40 - float64(i)}))
+	}
+	StoreDataPointsBuffer(batch)
+
+	points := ReadDataPoints(key, base, base+9, 0, "")
+	if len(points) != 10 {
+		t.Fatalf("Expected 10 points, got %d", len(points))
+	}
+	if !reflect.DeepEqual(points[0].Fields, map[string]float64{"temp": 20, "hum": 40, "battery": 99}) || points[0].Value != 20 {
+		t.Errorf("Unexpected first point: %+v", points[0])
+	}
+	if _, ok := points[5].Fields["battery"]; ok || points[5].Fields["hum"] != 35 {
+		t.Errorf("Unexpected partial point: %+v", points[5])
+	}
+
+	last := ReadLastDataPoints(key, 2)
+	if len(last) != 2 || last[1].Timestamp != base+9 || last[1].Fields["temp"] != 29 {
+		t.Errorf("Unexpected last points: %+v", last)
+	}
+	if count, _ := GetKeyCount(key); count != 10 {
+		t.Errorf("Expected count 10, got %d", count)
+	}
+
+	projected := ProjectFields(points[:1], []string{"hum"})
+	if !reflect.DeepEqual(projected[0].Fields, map[string]float64{"hum": 40}) || projected[0].Value != 40 {
+		t.Errorf("Unexpected projection: %+v", projected[0])
+	}
+
+	down := ReadDataPoints(key, base, base+9, 5, "avg")
+	if len(down) != 2 || down[0].Fields["temp"] != 22 || down[0].Fields["battery"] != 99 || down[1].Fields["hum"] != 33 {
+		t.Errorf("Unexpected downsampled points: %+v", down)
+	}
+	if _, ok := down[1].Fields["battery"]; ok {
+		t.Errorf("Field missing from every point of a bucket should be omitted: %+v", down[1])
+	}
+
+	// Reopening the file re-reads the header and derives the same count
+	if !ReloadKey(key) {
+		t.Fatal("ReloadKey failed")
+	}
+	if count := fileKeyCount(key); count != 10 {
+		t.Errorf("Expected 10 records after reload, got %d", count)
+	}
+	if got := ReadDataPoints(key, base, base+9, 0, ""); !reflect.DeepEqual(got, points) {
+		t.Errorf("Points changed after reload")
+	}
+}
+
+func TestMultiFieldPatchCompactAndExpire(t *testing.T) {
+	cleanup()
+	key := "TestMultiFieldPatchCompactAndExpire"
+	if err := InitKeyFields(key, []string{"a", "b"}); err != nil {
+		t.Fatalf("InitKeyFields failed: %v", err)
+	}
+	base := int64(1700000000)
+	points := make([]models.DataPoint, 0, 12000)
+	for i := int64(0); i < 12000; i++ {
+		points = append(points, fieldPoint(t, key, base+i*2, map[string]float64{"a": float64(i), "b": -float64(i)}))
+	}
+	StoreDataPointsBuffer(points)
+
+	// In-place overwrite of an existing timestamp
+	PatchDataPoints([]models.DataPoint{fieldPoint(t, key, base+20, map[string]float64{"a": 100, "b": 200})}, key)
+	// Out-of-order insert forces a full rewrite, which must keep the header
+	PatchDataPoints([]models.DataPoint{fieldPoint(t, key, base+21, map[string]float64{"b": 7})}, key)
+
+	got := ReadDataPoints(key, base+20, base+22, 0, "")
+	if len(got) != 3 || got[0].Fields["a"] != 100 || got[1].Fields["b"] != 7 || got[2].Fields["a"] != 11 {
+		t.Fatalf("Unexpected patched points: %+v", got)
+	}
+	if KeyFields(key) == nil {
+		t.Fatal("Rewrite lost the field schema")
+	}
+
+	utils.CompactionCompression = true
+	err := CompactKey(key)
+	utils.CompactionCompression = false
+	if err != nil {
+		t.Fatalf("CompactKey failed: %v", err)
+	}
+	if count, _ := GetKeyCount(key); count != 12001 {
+		t.Errorf("Expected 12001 points after compaction, got %d", count)
+	}
+	// Index entries past the header must land on record boundaries
+	got = ReadDataPoints(key, base+20000, base+20002, 0, "")
+	if len(got) != 2 || got[0].Fields["a"] != 10000 || got[1].Fields["b"] != -10001 {
+		t.Errorf("Unexpected points after compaction: %+v", got)
+	}
+	if _, err := os.Stat(utils.DataDir + "/" + key + ".aof.gor"); err == nil {
+		t.Error("Multi-field keys should not get a Gorilla copy")
+	}
+
+	dropped, err := ExpireDataPoints(key, base+12000)
+	if err != nil || dropped != 6001 {
+		t.Fatalf("ExpireDataPoints = %d, %v", dropped, err)
+	}
+	got = ReadDataPoints(key, 0, math.MaxInt64, 0, "")
+	if len(got) != 6000 || got[0].Timestamp != base+12000 || got[0].Fields["a"] != 6000 {
+		t.Errorf("Unexpected points after expiry: %d, first %+v", len(got), got[0])
+	}
+	got = ReadDataPoints(key, base+22000, base+22000, 0, "")
+	if len(got) != 1 || got[0].Fields["a"] != 11000 {
+		t.Errorf("Unexpected indexed read after expiry: %+v", got)
+	}
+
+	// Expiring everything keeps the (empty) key and its schema
+	if _, err := ExpireDataPoints(key, math.MaxInt64); err != nil {
+		t.Fatalf("ExpireDataPoints failed: %v", err)
+	}
+	if KeyFields(key) == nil || !allIds.Contains(key) {
+		t.Error("Expected the emptied multi-field key to keep its schema")
+	}
+}
@@ -0,0 +1,154 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Fill says what a downsampled read emits for the buckets of its range that
+// hold no points. The zero value omits them.
+type Fill struct {
+	Mode  string  // "none", "null", "previous", "linear" or "value"
+	Value float64 // Mode "value"
+}
+
+// MaxFillBuckets bounds the buckets a filled read may emit.
+const MaxFillBuckets = 1_000_000
+
+// ParseFill parses a fill option: none, null, previous, linear, or a
+// number to fill with.
+func ParseFill(s string) (Fill, error) {
+	switch s {
+	case "", "none":
+		return Fill{}, nil
+	case "null", "previous", "linear":
+		return Fill{Mode: s}, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Fill{}, fmt.Errorf("fill must be none, null, previous, linear or a number")
+	}
+	return Fill{Mode: "value", Value: v}, nil
+}
+
+// Active reports whether empty buckets are emitted.
+func (f Fill) Active() bool {
+	return f.Mode != "" && f.Mode != "none"
+}
+
+// ValidateFill checks that fill can be applied to the downsampled buckets
+// of key in [startTime, endTime]: linear and value fills need a float key
+// without fields, and the range may hold at most MaxFillBuckets buckets.
+func ValidateFill(key string, fill Fill, startTime, endTime int64, downsample int, align Alignment) error {
+	if !fill.Active() {
+		return nil
+	}
+	if (fill.Mode == "linear" || fill.Mode == "value") && (KeyType(key) != models.TypeFloat || KeyFields(key) != nil) {
+		return fmt.Errorf("fill %s needs a float key without fields", fill.Mode)
+	}
+	// The shortest bucket of each unit gives an upper bound
+	width := int64(downsample)
+	if align.Calendar() {
+		seconds := map[string]int64{"minute": 60, "hour": 3600, "day": 23 * 3600, "week": 7*24*3600 - 3600, "month": 28*24*3600 - 3600}
+		width = seconds[align.Unit] * KeyPrecision(key).PerSecond()
+	}
+	if width <= 0 || (endTime-startTime)/width >= MaxFillBuckets {
+		return fmt.Errorf("fill would emit more than %d buckets", MaxFillBuckets)
+	}
+	return nil
+}
+
+// nullPoint is an empty bucket filled with null: a NaN value.
+func nullPoint(key string, ts int64) models.DataPoint {
+	return models.DataPoint{Key: key, Timestamp: ts, Value: math.NaN()}
+}
+
+// FillBuckets returns the buckets of align in [startTime, endTime] (from
+// the one holding startTime), taking the downsampled points of key where
+// they exist and filling the others.
+func FillBuckets(key string, points []models.DataPoint, startTime, endTime int64, downsample int, align Alignment, fill Fill) []models.DataPoint {
+	if !fill.Active() {
+		return points
+	}
+	perSecond := KeyPrecision(key).PerSecond()
+	var filled []models.DataPoint
+	i := 0
+	for ts := align.bucketStart(startTime, downsample, perSecond); ts <= endTime; ts = align.nextBucket(ts, downsample, perSecond) {
+		for i < len(points) && points[i].Timestamp < ts {
+			i++ // not on the grid; cannot happen for aligned buckets
+		}
+		if i < len(points) && points[i].Timestamp == ts {
+			filled = append(filled, points[i])
+			i++
+			continue
+		}
+		p := nullPoint(key, ts)
+		switch fill.Mode {
+		case "value":
+			p.Value = fill.Value
+		case "previous":
+			if n := len(filled); n > 0 {
+				p = filled[n-1]
+				p.Timestamp = ts
+			}
+		}
+		filled = append(filled, p)
+	}
+	if fill.Mode == "linear" {
+		interpolate(filled, points)
+	}
+	return filled
+}
+
+// interpolate replaces the null buckets of filled that lie between two
+// buckets holding points by the linear interpolation of their values.
+func interpolate(filled, points []models.DataPoint) {
+	present := make(map[int64]bool, len(points))
+	for _, p := range points {
+		present[p.Timestamp] = true
+	}
+	prev := -1
+	for i, p := range filled {
+		if !present[p.Timestamp] {
+			continue
+		}
+		if prev >= 0 && i > prev+1 {
+			t0, v0 := filled[prev].Timestamp, filled[prev].Value
+			t1, v1 := p.Timestamp, p.Value
+			for j := prev + 1; j < i; j++ {
+				frac := float64(filled[j].Timestamp-t0) / float64(t1-t0)
+				filled[j].Value = v0 + (v1-v0)*frac
+			}
+		}
+		prev = i
+	}
+}
+
+// nextBucket returns the start of the bucket after the one starting at ts.
+func (a Alignment) nextBucket(ts int64, downsample int, perSecond int64) int64 {
+	if !a.Calendar() {
+		return ts + int64(downsample)
+	}
+	loc := a.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := time.Unix(floorDiv(ts, perSecond), 0).In(loc)
+	var next time.Time
+	switch a.Unit {
+	case "minute":
+		next = t.Add(time.Minute)
+	case "hour":
+		next = t.Add(time.Hour)
+	case "day":
+		next = t.AddDate(0, 0, 1)
+	case "week":
+		next = t.AddDate(0, 0, 7)
+	case "month":
+		next = t.AddDate(0, 1, 0)
+	}
+	return a.bucketStart(next.Unix()*perSecond, downsample, perSecond)
+}
@@ -0,0 +1,56 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"math"
+	"testing"
+)
+
+func TestFillBuckets(t *testing.T) {
+	key := "TestFillBuckets"
+	// Buckets of 10 over [100, 159]: 110 and 140 hold points
+	points := []models.DataPoint{{Key: key, Timestamp: 110, Value: 1}, {Key: key, Timestamp: 140, Value: 4}}
+	epoch := Alignment{Unit: "epoch"}
+	nan := math.NaN()
+	for _, tc := range []struct {
+		fill string
+		want []float64
+	}{
+		{"null", []float64{nan, 1, nan, nan, 4, nan}},
+		{"previous", []float64{nan, 1, 1, 1, 4, 4}},
+		{"linear", []float64{nan, 1, 2, 3, 4, nan}},
+		{"-1.5", []float64{-1.5, 1, -1.5, -1.5, 4, -1.5}},
+	} {
+		fill, err := ParseFill(tc.fill)
+		if err != nil {
+			t.Fatalf("ParseFill(%q): %v", tc.fill, err)
+		}
+		got := FillBuckets(key, points, 105, 159, 10, epoch, fill)
+		if len(got) != len(tc.want) {
+			t.Fatalf("fill %s: expected %d buckets, got %d", tc.fill, len(tc.want), len(got))
+		}
+		for i, p := range got {
+			want := tc.want[i]
+			if p.Timestamp != 100+10*int64(i) || p.Value != want && !(math.IsNaN(want) && math.IsNaN(p.Value)) {
+				t.Errorf("fill %s: bucket %d is %d=%v, expected %d=%v", tc.fill, i, p.Timestamp, p.Value, 100+10*i, want)
+			}
+		}
+	}
+
+	if got := FillBuckets(key, points, 105, 159, 10, epoch, Fill{}); len(got) != 2 {
+		t.Errorf("Expected fill none to keep the points, got %d", len(got))
+	}
+	if _, err := ParseFill("zero"); err == nil {
+		t.Error("Expected fill zero rejected")
+	}
+
+	// Calendar months of 2024 in UTC
+	month := Alignment{Unit: "month"}
+	got := FillBuckets(key, nil, 1704067200, 1735689599, 0, month, Fill{Mode: "null"})
+	if len(got) != 12 || got[1].Timestamp != 1706745600 || got[11].Timestamp != 1733011200 {
+		t.Errorf("Unexpected months %+v", got)
+	}
+	if err := ValidateFill(key, Fill{Mode: "null"}, 0, 2*MaxFillBuckets, 1, epoch); err == nil {
+		t.Error("Expected too many buckets rejected")
+	}
+}
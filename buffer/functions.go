@@ -0,0 +1,106 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+)
+
+// Functions derive a series from the points of a read, before they are
+// downsampled, so that the aggregation reduces the derived values (the avg
+// of rate is the mean rate of a bucket). Each derived point is a float at
+// the timestamp of the point it was computed at:
+//
+//   - rate: per-second increase since the previous point. A counter that
+//     went down was reset, and its new value is the increase.
+//   - irate: rate; downsampled, the rate between the last two points of
+//     each bucket, whatever the aggregation.
+//   - derivative: per-second change since the previous point.
+//   - delta: change since the previous point.
+//   - integral: running trapezoidal integral in value-seconds, 0 at the
+//     first point.
+//   - cumulative_sum: running sum of the values.
+//
+// The first point of the range has no previous point: rate, irate,
+// derivative and delta start at the second.
+var seriesFunctions = map[string]bool{
+	"rate": true, "irate": true, "derivative": true, "delta": true, "integral": true, "cumulative_sum": true,
+}
+
+// ValidateFunction checks that function can be applied to the points of
+// key: numeric keys without fields.
+func ValidateFunction(key, function string) error {
+	if function == "" {
+		return nil
+	}
+	if !seriesFunctions[function] {
+		return fmt.Errorf("function must be rate, irate, derivative, delta, integral or cumulative_sum")
+	}
+	if KeyType(key) == models.TypeString || KeyFields(key) != nil {
+		return fmt.Errorf("function %s needs a numeric key without fields", function)
+	}
+	return nil
+}
+
+// ReadFunctionDataPoints reads [startTime, endTime] of id, applies function
+// to the points and downsamples the result as for ReadAlignedDataPoints.
+func ReadFunctionDataPoints(id string, startTime, endTime int64, downsample int, aggregation string, align Alignment, function string) []models.DataPoint {
+	if function == "" {
+		return ReadAlignedDataPoints(id, startTime, endTime, downsample, aggregation, align)
+	}
+	// Raw points: a rollup holds no derived values
+	derived := ApplyFunction(ReadAlignedDataPoints(id, startTime, endTime, 0, "", Alignment{}), function)
+	if !align.Downsamples(downsample) {
+		return derived
+	}
+	if function == "irate" {
+		aggregation = "last"
+	}
+	return downsampleAligned(derived, downsample, aggregation, align)
+}
+
+// ApplyFunction returns the series function derives from sorted points of
+// one key.
+func ApplyFunction(points []models.DataPoint, function string) []models.DataPoint {
+	if function == "" || len(points) == 0 {
+		return points
+	}
+	perSecond := float64(KeyPrecision(points[0].Key).PerSecond())
+	derived := make([]models.DataPoint, 0, len(points))
+	emit := func(p models.DataPoint, v float64) {
+		derived = append(derived, models.DataPoint{Key: p.Key, Timestamp: p.Timestamp, Value: v})
+	}
+	total := 0.0
+	for i, p := range points {
+		switch function {
+		case "cumulative_sum":
+			total += p.Value
+			emit(p, total)
+			continue
+		case "integral":
+			if i > 0 {
+				prev := points[i-1]
+				total += (prev.Value + p.Value) / 2 * float64(p.Timestamp-prev.Timestamp) / perSecond
+			}
+			emit(p, total)
+			continue
+		}
+		if i == 0 {
+			continue
+		}
+		prev := points[i-1]
+		change := p.Value - prev.Value
+		if function == "delta" {
+			emit(p, change)
+			continue
+		}
+		seconds := float64(p.Timestamp-prev.Timestamp) / perSecond
+		if seconds <= 0 {
+			continue // duplicate timestamp
+		}
+		if change < 0 && function != "derivative" {
+			change = p.Value // counter reset
+		}
+		emit(p, change/seconds)
+	}
+	return derived
+}
@@ -0,0 +1,67 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"testing"
+)
+
+func TestApplyFunction(t *testing.T) {
+	key := "TestApplyFunction"
+	// A counter reset between 30 and 40
+	var points []models.DataPoint
+	for i, v := range []float64{10, 20, 40, 5, 15} {
+		points = append(points, models.DataPoint{Key: key, Timestamp: int64(10 * i), Value: v})
+	}
+	for _, tc := range []struct {
+		function string
+		want     []float64
+	}{
+		{"rate", []float64{1, 2, 0.5, 1}},
+		{"irate", []float64{1, 2, 0.5, 1}},
+		{"derivative", []float64{1, 2, -3.5, 1}},
+		{"delta", []float64{10, 20, -35, 10}},
+		{"integral", []float64{0, 150, 450, 675, 775}},
+		{"cumulative_sum", []float64{10, 30, 70, 75, 90}},
+	} {
+		got := ApplyFunction(points, tc.function)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: expected %d points, got %d", tc.function, len(tc.want), len(got))
+		}
+		for i, p := range got {
+			if p.Value != tc.want[i] || p.Timestamp != points[len(points)-len(got)+i].Timestamp {
+				t.Errorf("%s: point %d is %d=%v, expected %v", tc.function, i, p.Timestamp, p.Value, tc.want[i])
+			}
+		}
+	}
+	if err := ValidateFunction(key, "increase"); err == nil {
+		t.Error("Expected function increase rejected")
+	}
+}
+
+func TestReadFunctionDataPoints(t *testing.T) {
+	cleanup()
+	defer cleanup()
+
+	// A counter growing by 1 every second, then by 3
+	key := "TestReadFunctionDataPoints"
+	var points []models.DataPoint
+	v := 0.0
+	for ts := int64(1699999980); ts < 1700000100; ts++ {
+		if ts >= 1700000040 {
+			v += 3
+		} else {
+			v++
+		}
+		points = append(points, models.DataPoint{Key: key, Timestamp: ts, Value: v})
+	}
+	StoreDataPointsBuffer(points)
+
+	got := ReadFunctionDataPoints(key, 1699999980, 1700000099, 60, "avg", Alignment{Unit: "epoch"}, "rate")
+	if len(got) != 2 || got[0].Timestamp != 1699999980 || got[0].Value != 1 || got[1].Value != 3 {
+		t.Errorf("Unexpected rates %+v", got)
+	}
+	got = ReadFunctionDataPoints(key, 1699999980, 1700000099, 60, "avg", Alignment{}, "delta")
+	if len(got) != 2 || got[0].Timestamp != 1699999981 || got[1].Value != 3 {
+		t.Errorf("Unexpected deltas %+v", got)
+	}
+}
@@ -92,28 +92,10 @@ func EncodeBlock(points []models.DataPoint) ([]byte, error) {
 	for i := 1; i < len(points); i++ {
 		// --- Timestamp: delta-of-delta ---
 		delta := points[i].Timestamp - prevTs
-		dod := delta - prevDelta
+		writeDoD(w, delta-prevDelta, 32)
 		prevTs = points[i].Timestamp
 		prevDelta = delta
 
-		switch {
-		case dod == 0:
-			w.writeBit(0) // 1 bit
-		case dod >= -63 && dod <= 64:
-			w.writeBits(0x2, 2) // '10'
-			// 7 bits for value (zigzag-like: add 63 offset)
-			w.writeBits(uint64(dod+63), 7)
-		case dod >= -255 && dod <= 256:
-			w.writeBits(0x6, 3) // '110'
-			w.writeBits(uint64(dod+255), 9)
-		case dod >= -2047 && dod <= 2048:
-			w.writeBits(0xE, 4) // '1110'
-			w.writeBits(uint64(dod+2047), 12)
-		default:
-			w.writeBits(0xF, 4) // '1111'
-			w.writeBits(uint64(dod), 32)
-		}
-
 		// --- Value: XOR ---
 		currVal := math.Float64bits(points[i].Value)
 		xor := currVal ^ prevVal
@@ -181,34 +163,7 @@ func DecodeBlock(data []byte) ([]models.DataPoint, error) {
 	// Decode exactly numRecords-1 more points (first already added above)
 	for i := 1; i < numRecords; i++ {
 		// --- Timestamp ---
-		firstBit := r.readBit()
-		var dod int64
-		if firstBit == 0 {
-			dod = 0
-		} else {
-			secondBit := r.readBit()
-			if secondBit == 0 {
-				// '10' pattern: 7-bit value in [-63, 64]
-				dod = int64(r.readBits(7)) - 63
-			} else {
-				thirdBit := r.readBit()
-				if thirdBit == 0 {
-					// '110' pattern: 9-bit value in [-255, 256]
-					dod = int64(r.readBits(9)) - 255
-				} else {
-					fourthBit := r.readBit()
-					if fourthBit == 0 {
-						// '1110' pattern: 12-bit value in [-2047, 2048]
-						dod = int64(r.readBits(12)) - 2047
-					} else {
-						// '1111' pattern: full 32-bit
-						dod = int64(int32(r.readBits(32)))
-					}
-				}
-			}
-		}
-
-		delta := prevDelta + dod
+		delta := prevDelta + readDoD(r, 32)
 		ts := prevTs + delta
 		prevTs = ts
 		prevDelta = delta
@@ -239,6 +194,141 @@ func DecodeBlock(data []byte) ([]models.DataPoint, error) {
 	return result, nil
 }
 
+// writeDoD writes a delta-of-delta with Gorilla's variable-length buckets.
+// Values outside the 12-bit bucket are written in wide bits (32 for
+// timestamps, 64 for integer values).
+func writeDoD(w *bitWriter, dod int64, wide int) {
+	switch {
+	case dod == 0:
+		w.writeBit(0) // 1 bit
+	case dod >= -63 && dod <= 64:
+		w.writeBits(0x2, 2) // '10'
+		// 7 bits for value (zigzag-like: add 63 offset)
+		w.writeBits(uint64(dod+63), 7)
+	case dod >= -255 && dod <= 256:
+		w.writeBits(0x6, 3) // '110'
+		w.writeBits(uint64(dod+255), 9)
+	case dod >= -2047 && dod <= 2048:
+		w.writeBits(0xE, 4) // '1110'
+		w.writeBits(uint64(dod+2047), 12)
+	default:
+		w.writeBits(0xF, 4) // '1111'
+		w.writeBits(uint64(dod), wide)
+	}
+}
+
+// readDoD reads a value written by writeDoD with the same width.
+func readDoD(r *bitReader, wide int) int64 {
+	if r.readBit() == 0 {
+		return 0
+	}
+	if r.readBit() == 0 {
+		// '10' pattern: 7-bit value in [-63, 64]
+		return int64(r.readBits(7)) - 63
+	}
+	if r.readBit() == 0 {
+		// '110' pattern: 9-bit value in [-255, 256]
+		return int64(r.readBits(9)) - 255
+	}
+	if r.readBit() == 0 {
+		// '1110' pattern: 12-bit value in [-2047, 2048]
+		return int64(r.readBits(12)) - 2047
+	}
+	// '1111' pattern: full width
+	v := r.readBits(wide)
+	if wide == 32 {
+		return int64(int32(v))
+	}
+	return int64(v)
+}
+
+// EncodeIntBlock compresses int (or bool, as 0/1) points. The header has the
+// same shape as EncodeBlock's with the first value stored as int64; values
+// are delta-of-delta encoded like timestamps, which makes counters and
+// slowly changing gauges cost a bit or two per point.
+func EncodeIntBlock(points []models.DataPoint) ([]byte, error) {
+	return encodeIntegerBlock(points, func(w *bitWriter, prev, prevDelta, curr int64) {
+		writeDoD(w, (curr-prev)-prevDelta, 64)
+	})
+}
+
+// EncodeBoolBlock compresses bool points: one bit per point, set when the
+// value flips.
+func EncodeBoolBlock(points []models.DataPoint) ([]byte, error) {
+	return encodeIntegerBlock(points, func(w *bitWriter, prev, _, curr int64) {
+		if curr != prev {
+			w.writeBit(1)
+		} else {
+			w.writeBit(0)
+		}
+	})
+}
+
+func encodeIntegerBlock(points []models.DataPoint, writeValue func(w *bitWriter, prev, prevDelta, curr int64)) ([]byte, error) {
+	if len(points) == 0 {
+		return nil, fmt.Errorf("empty block")
+	}
+
+	w := newBitWriter(256)
+	prevTs, prevVal := points[0].Timestamp, points[0].Int
+	var prevTsDelta, prevValDelta int64
+	for i := 1; i < len(points); i++ {
+		tsDelta := points[i].Timestamp - prevTs
+		writeDoD(w, tsDelta-prevTsDelta, 32)
+		prevTs, prevTsDelta = points[i].Timestamp, tsDelta
+
+		writeValue(w, prevVal, prevValDelta, points[i].Int)
+		prevVal, prevValDelta = points[i].Int, points[i].Int-prevVal
+	}
+
+	result := make([]byte, 20, 20+len(w.bytes()))
+	binary.LittleEndian.PutUint64(result[0:8], uint64(points[0].Timestamp))
+	binary.LittleEndian.PutUint64(result[8:16], uint64(points[0].Int))
+	binary.LittleEndian.PutUint32(result[16:20], uint32(len(points)))
+	return append(result, w.bytes()...), nil
+}
+
+// DecodeIntBlock decompresses an EncodeIntBlock block into points of type t.
+func DecodeIntBlock(data []byte, t models.ValueType) ([]models.DataPoint, error) {
+	return decodeIntegerBlock(data, t, func(r *bitReader, prev, prevDelta int64) int64 {
+		return prev + prevDelta + readDoD(r, 64)
+	})
+}
+
+// DecodeBoolBlock decompresses an EncodeBoolBlock block.
+func DecodeBoolBlock(data []byte) ([]models.DataPoint, error) {
+	return decodeIntegerBlock(data, models.TypeBool, func(r *bitReader, prev, _ int64) int64 {
+		if r.readBit() == 1 {
+			return 1 - prev
+		}
+		return prev
+	})
+}
+
+func decodeIntegerBlock(data []byte, t models.ValueType, readValue func(r *bitReader, prev, prevDelta int64) int64) ([]models.DataPoint, error) {
+	if len(data) < 20 {
+		return nil, fmt.Errorf("block too short: %d bytes", len(data))
+	}
+	prevTs := int64(binary.LittleEndian.Uint64(data[0:8]))
+	prevVal := int64(binary.LittleEndian.Uint64(data[8:16]))
+	numRecords := int(binary.LittleEndian.Uint32(data[16:20]))
+
+	result := make([]models.DataPoint, 0, numRecords)
+	result = append(result, models.IntPoint("", prevTs, t, prevVal))
+	var prevTsDelta, prevValDelta int64
+	r := newBitReader(data[20:])
+	for i := 1; i < numRecords; i++ {
+		tsDelta := prevTsDelta + readDoD(r, 32)
+		ts := prevTs + tsDelta
+		prevTs, prevTsDelta = ts, tsDelta
+
+		val := readValue(r, prevVal, prevValDelta)
+		prevVal, prevValDelta = val, val-prevVal
+		result = append(result, models.IntPoint("", ts, t, val))
+	}
+	return result, nil
+}
+
 // clz returns count of leading zeros in a uint64.
 func clz(x uint64) int {
 	if x == 0 {
@@ -41,6 +41,7 @@ func writeCompressedWAL(key string, dataPoints []models.DataPoint) error {
 	}
 	defer idxHandle.Close()
 
+	layout := layoutOf(key)
 	byteOffset := int64(0)
 
 	// Split into blocks of gorillaBlockSize and compress each
@@ -51,7 +52,7 @@ func writeCompressedWAL(key string, dataPoints []models.DataPoint) error {
 		}
 		block := dataPoints[start:end]
 
-		compressed, err := EncodeBlock(block)
+		compressed, err := encodeKeyBlock(key, layout, block)
 		if err != nil {
 			return fmt.Errorf("failed to encode block: %w", err)
 		}
@@ -151,6 +152,7 @@ func readCompressedDataPoints(id string, startTime, endTime int64) ([]models.Dat
 		return nil, err
 	}
 
+	layout := layoutOf(id)
 	var allPoints []models.DataPoint
 
 	// Read blocks sequentially, decompress, and filter by time range
@@ -173,13 +175,14 @@ func readCompressedDataPoints(id string, startTime, endTime int64) ([]models.Dat
 			return nil, err
 		}
 
-		points, err := DecodeBlock(blockData)
+		points, err := decodeKeyBlock(id, layout, blockData)
 		if err != nil {
 			return nil, fmt.Errorf("failed to decode block: %w", err)
 		}
 
 		// Filter by time range
 		for _, p := range points {
+			p.Key = id
 			if p.Timestamp >= startTime && p.Timestamp <= endTime {
 				allPoints = append(allPoints, p)
 			}
@@ -191,3 +194,50 @@ func readCompressedDataPoints(id string, startTime, endTime int64) ([]models.Dat
 
 	return allPoints, nil
 }
+
+// encodeKeyBlock picks the block encoding for the key's value type. Strings
+// are stored as their dictionary ids.
+func encodeKeyBlock(key string, layout *walLayout, block []models.DataPoint) ([]byte, error) {
+	switch layout.valueType {
+	case models.TypeInt:
+		return EncodeIntBlock(block)
+	case models.TypeBool:
+		return EncodeBoolBlock(block)
+	case models.TypeString:
+		dict := dictFor(key)
+		ids := make([]models.DataPoint, len(block))
+		for i, p := range block {
+			id, err := dict.intern(p.Str)
+			if err != nil {
+				return nil, err
+			}
+			ids[i] = models.IntPoint(key, p.Timestamp, models.TypeInt, int64(id))
+		}
+		return EncodeIntBlock(ids)
+	}
+	return EncodeBlock(block)
+}
+
+func decodeKeyBlock(key string, layout *walLayout, data []byte) ([]models.DataPoint, error) {
+	switch layout.valueType {
+	case models.TypeInt:
+		return DecodeIntBlock(data, models.TypeInt)
+	case models.TypeBool:
+		return DecodeBoolBlock(data)
+	case models.TypeString:
+		points, err := DecodeIntBlock(data, models.TypeInt)
+		if err != nil {
+			return nil, err
+		}
+		dict := dictFor(key)
+		for i, p := range points {
+			s, ok := dict.lookup(uint64(p.Int))
+			if !ok {
+				return nil, fmt.Errorf("unknown string id %d", p.Int)
+			}
+			points[i] = models.StringPoint(key, p.Timestamp, s)
+		}
+		return points, nil
+	}
+	return DecodeBlock(data)
+}
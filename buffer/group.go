@@ -0,0 +1,57 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"math"
+	"sort"
+)
+
+// groupAggregations reduce the values several keys have at one timestamp.
+var groupAggregations = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true, "count": true,
+	"median": true, "p50": true, "p95": true, "p99": true,
+}
+
+// ValidateGroupAggregation checks an aggregation across keys.
+func ValidateGroupAggregation(aggregation string) error {
+	if !groupAggregations[aggregation] {
+		return fmt.Errorf("group aggregation must be avg, sum, min, max, count, median, p50, p95 or p99")
+	}
+	return nil
+}
+
+// ReduceSeries merges the sorted series of several keys into one series of
+// key: at each timestamp any of them has a value at, the aggregation of
+// those values. NaN values (empty buckets filled with null) are left out.
+// Downsampled into the same aligned buckets, the series meet at the bucket
+// starts.
+func ReduceSeries(key string, series [][]models.DataPoint, aggregation string) []models.DataPoint {
+	byTime := make(map[int64][]float64)
+	for _, points := range series {
+		for _, p := range points {
+			if !math.IsNaN(p.Value) {
+				byTime[p.Timestamp] = append(byTime[p.Timestamp], p.Value)
+			}
+		}
+	}
+	timestamps := make([]int64, 0, len(byTime))
+	for ts := range byTime {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	reduced := make([]models.DataPoint, 0, len(timestamps))
+	for _, ts := range timestamps {
+		values := byTime[ts]
+		sum, lo, hi := 0.0, values[0], values[0]
+		for _, v := range values {
+			sum += v
+			lo = math.Min(lo, v)
+			hi = math.Max(hi, v)
+		}
+		value := computeAggregate(aggregation, sum, float64(len(values)), lo, hi, values[0], values[len(values)-1], values)
+		reduced = append(reduced, models.DataPoint{Key: key, Timestamp: ts, Value: value})
+	}
+	return reduced
+}
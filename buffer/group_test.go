@@ -0,0 +1,39 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"math"
+	"testing"
+)
+
+func TestReduceSeries(t *testing.T) {
+	series := [][]models.DataPoint{
+		{{Timestamp: 0, Value: 1}, {Timestamp: 60, Value: 4}},
+		{{Timestamp: 0, Value: 3}, {Timestamp: 60, Value: math.NaN()}, {Timestamp: 120, Value: 7}},
+		{{Timestamp: 0, Value: 8}},
+	}
+	for _, tc := range []struct {
+		aggregation string
+		want        []float64
+	}{
+		{"avg", []float64{4, 4, 7}},
+		{"sum", []float64{12, 4, 7}},
+		{"min", []float64{1, 4, 7}},
+		{"max", []float64{8, 4, 7}},
+		{"count", []float64{3, 1, 1}},
+		{"median", []float64{3, 4, 7}},
+	} {
+		got := ReduceSeries("fleet", series, tc.aggregation)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%s: expected %d points, got %d", tc.aggregation, len(tc.want), len(got))
+		}
+		for i, p := range got {
+			if p.Value != tc.want[i] || p.Timestamp != int64(60*i) || p.Key != "fleet" {
+				t.Errorf("%s: point %d is %s %d=%v, expected %v", tc.aggregation, i, p.Key, p.Timestamp, p.Value, tc.want[i])
+			}
+		}
+	}
+	if err := ValidateGroupAggregation("first"); err == nil {
+		t.Error("Expected group aggregation first rejected")
+	}
+}
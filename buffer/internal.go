@@ -141,14 +141,21 @@ func storeDataPoints(dataPointId string, dataPoints []models.DataPoint) {
 		indexFile = indexRef.file
 	}
 
+	layout := layoutOf(dataPointId)
+	if layout.headerSize == 0 && utils.WALChecksums {
+		layout = startChecksummedWAL(dataPointId, dataFile, layout)
+	}
+	recordSize := layout.recordSize
+
 	// Fast path: batch-write all points using a pre-allocated buffer.
-	// This reduces N individual 16-byte Write() syscalls to 1 large write.
+	// This reduces N individual record Write() syscalls to 1 large write.
 	if len(dataPoints) > 1 {
-		buf := make([]byte, len(dataPoints)*16)
+		buf := make([]byte, int64(len(dataPoints))*recordSize)
 		for i, dp := range dataPoints {
-			off := i * 16
-			binary.LittleEndian.PutUint64(buf[off:off+8], uint64(dp.Timestamp))
-			binary.LittleEndian.PutUint64(buf[off+8:off+16], math.Float64bits(dp.Value))
+			if err := layout.encode(dataPointId, buf[int64(i)*recordSize:], dp); err != nil {
+				utils.Error("Failed to encode data point for %s: %v", dataPointId, err)
+				return
+			}
 		}
 		if _, err := dataFile.Write(buf); err != nil {
 			utils.Error("Failed to batch-write data points for %s: %v", dataPointId, err)
@@ -167,7 +174,7 @@ func storeDataPoints(dataPointId string, dataPoints []models.DataPoint) {
 			recordStart := offset - int64(len(buf))
 			for i, dp := range dataPoints {
 				if (newCount-int64(len(dataPoints))+int64(i)+1)%indexInterval == 0 {
-					entryOff := recordStart + int64(i*16)
+					entryOff := recordStart + int64(i)*recordSize
 					if err := writeIndexEntry(indexFile, dp.Timestamp, entryOff); err != nil {
 						utils.Error("Failed to update index for %s: %v", dataPointId, err)
 					}
@@ -187,9 +194,21 @@ func storeDataPoints(dataPointId string, dataPoints []models.DataPoint) {
 
 	// Slow path: single point (original code path for minimal overhead)
 	for _, dataPoint := range dataPoints {
-		if err := writeRecord(dataFile, dataPoint.Timestamp, dataPoint.Value); err != nil {
-			utils.Error("Failed to write data point for %s: %v", dataPointId, err)
-			return
+		if layout.headerSize == 0 {
+			if err := writeRecord(dataFile, dataPoint.Timestamp, dataPoint.Value); err != nil {
+				utils.Error("Failed to write data point for %s: %v", dataPointId, err)
+				return
+			}
+		} else {
+			buf := make([]byte, recordSize)
+			if err := layout.encode(dataPointId, buf, dataPoint); err != nil {
+				utils.Error("Failed to encode data point for %s: %v", dataPointId, err)
+				return
+			}
+			if _, err := dataFile.Write(buf); err != nil {
+				utils.Error("Failed to write data point for %s: %v", dataPointId, err)
+				return
+			}
 		}
 
 		countValue, _ := idToCountMap.Load(dataPointId)
@@ -199,7 +218,7 @@ func storeDataPoints(dataPointId string, dataPoints []models.DataPoint) {
 
 		if newCount%indexInterval == 0 {
 			offset, _ := dataFile.Seek(0, io.SeekEnd)
-			offset -= int64(binary.Size(dataPoint.Timestamp) + binary.Size(dataPoint.Value))
+			offset -= recordSize
 			if err := updateIndexFile(indexFile, dataPoint.Timestamp, offset); err != nil {
 				utils.Error("Failed to update index for %s: %v", dataPointId, err)
 			}
@@ -245,17 +264,23 @@ func acquireFileHandle(fileName string, handleMap *concurrent.LRU[string, *refFi
 
 		if strings.HasSuffix(fileName, ".aof") {
 			key := fileName[:len(fileName)-4]
+			layout, err := readWALLayout(file)
+			if err != nil {
+				utils.Error("Error reading WAL header for %s: %v", fullPath, err)
+				layout = legacyLayout
+			}
+			keyLayouts.Store(key, layout)
 			if _, ok := idToCountMap.Load(key); !ok {
 				fileInfo, err := file.Stat()
 				if err != nil {
 					utils.Error("Error getting file info for %s: %v", fullPath, err)
 					return ref, true
 				}
-				fileLength := fileInfo.Size()
+				records := layout.recordCount(fileInfo.Size())
 				count := &atomic.Int64{}
-				count.Store(fileLength / 16)
+				count.Store(records)
 				idToCountMap.Store(key, count)
-				totalDataPoints.Add(fileLength / 16)
+				totalDataPoints.Add(records)
 			}
 		}
 		return ref, true
@@ -297,11 +322,12 @@ func readLastFiledDataPoints(id string, count int) ([]models.DataPoint, error) {
 	}
 
 	// Seek to last N records and batch-read them in one call
-	bufSize := count * 16
-	buf := make([]byte, bufSize)
+	layout := layoutOf(id)
+	rs := int(layout.recordSize)
+	buf := make([]byte, count*rs)
 
 	// Use ReadAt to avoid O_APPEND seek issues on Windows
-	seekPosition := (actualRecordCount - int64(count)) * 16
+	seekPosition := layout.offsetOf(actualRecordCount - int64(count))
 	n, err := file.ReadAt(buf, seekPosition)
 	if err != nil && err != io.EOF {
 		utils.Error("Error reading file: %v", err)
@@ -309,15 +335,13 @@ func readLastFiledDataPoints(id string, count int) ([]models.DataPoint, error) {
 	}
 
 	// Decode records from buffer
-	dataPoints := make([]models.DataPoint, 0, n/16)
-	for i := 0; i+16 <= n; i += 16 {
-		ts := int64(binary.LittleEndian.Uint64(buf[i : i+8]))
-		val := math.Float64frombits(binary.LittleEndian.Uint64(buf[i+8 : i+16]))
-		dataPoints = append(dataPoints, models.DataPoint{
-			Key:       id,
-			Timestamp: ts,
-			Value:     val,
-		})
+	dataPoints := make([]models.DataPoint, 0, n/rs)
+	for i := 0; i+rs <= n; i += rs {
+		if !layout.verify(buf[i : i+rs]) {
+			reportCorruptRecord(id, seekPosition+int64(i))
+			continue
+		}
+		dataPoints = append(dataPoints, layout.decode(id, buf[i:i+rs]))
 	}
 
 	return dataPoints, nil
@@ -329,30 +353,31 @@ func updateIndexFile(indexFile *os.File, timestamp int64, offset int64) error {
 
 // findStartOffset scans the index file for the last entry whose timestamp is
 // <= target and returns the data-file offset where scanning should begin.
-// A missing or empty index means the scan must start at offset 0.
+// A missing or empty index means the scan must start at the first record.
 func findStartOffset(id string, target int64) int64 {
+	first := layoutOf(id).headerSize
 	indexRef, ok := acquireFileHandle(id+".idx", indexFileHandles)
 	if !ok {
-		return 0
+		return first
 	}
 	defer indexRef.release()
 
 	fileInfo, err := indexRef.file.Stat()
 	if err != nil {
-		return 0
+		return first
 	}
 	size := fileInfo.Size()
 	if size == 0 {
-		return 0
+		return first
 	}
 
 	buf := make([]byte, size)
 	if _, err := indexRef.file.ReadAt(buf, 0); err != nil && err != io.EOF {
 		utils.Error("Error reading index file for %s: %v", id, err)
-		return 0
+		return first
 	}
 
-	offset := int64(0)
+	offset := first
 	for i := 0; i+16 <= len(buf); i += 16 {
 		ts := int64(binary.LittleEndian.Uint64(buf[i : i+8]))
 		if ts > target {
@@ -363,9 +388,15 @@ func findStartOffset(id string, target int64) int64 {
 	return offset
 }
 
-// readFiledDataPoints reads a timestamp range from the on-disk WAL using
-// ReadAt, which is safe for concurrent readers sharing a file handle.
+// readFiledDataPoints reads a timestamp range from the on-disk WAL merged
+// with the key's staged out-of-order points.
 func readFiledDataPoints(id string, startTime int64, endTime int64) []models.DataPoint {
+	return mergeStaged(id, readWALDataPoints(id, startTime, endTime), startTime, endTime)
+}
+
+// readWALDataPoints reads a timestamp range from the on-disk WAL using
+// ReadAt, which is safe for concurrent readers sharing a file handle.
+func readWALDataPoints(id string, startTime int64, endTime int64) []models.DataPoint {
 	dataRef, ok := acquireFileHandle(id+".aof", dataFileHandles)
 	if !ok {
 		return nil
@@ -373,21 +404,24 @@ func readFiledDataPoints(id string, startTime int64, endTime int64) []models.Dat
 	defer dataRef.release()
 
 	// O(1) size from the in-memory counter; 0 means the file is empty.
-	endOffset := int64(0)
+	count := int64(0)
 	if cv, ok := idToCountMap.Load(id); ok {
-		endOffset = cv.Load() * 16
+		count = cv.Load()
 	}
-	if endOffset == 0 {
+	if count == 0 {
 		return nil
 	}
+	layout := layoutOf(id)
+	rs := int(layout.recordSize)
+	endOffset := layout.offsetOf(count)
 
 	startOffset := findStartOffset(id, startTime)
 	if startOffset >= endOffset {
 		return nil
 	}
 
-	dataPoints := make([]models.DataPoint, 0, (endOffset-startOffset)/16)
-	buf := make([]byte, 64*1024)
+	dataPoints := make([]models.DataPoint, 0, (endOffset-startOffset)/layout.recordSize)
+	buf := layout.readBuffer()
 	pos := startOffset
 	for pos < endOffset {
 		toRead := int64(len(buf))
@@ -400,18 +434,17 @@ func readFiledDataPoints(id string, startTime int64, endTime int64) []models.Dat
 			return nil
 		}
 
-		for i := 0; i+16 <= n; i += 16 {
-			ts := int64(binary.LittleEndian.Uint64(buf[i : i+8]))
+		for i := 0; i+rs <= n; i += rs {
+			if !layout.verify(buf[i : i+rs]) {
+				reportCorruptRecord(id, pos+int64(i))
+				continue
+			}
+			ts := timestampAt(buf[i:])
 			if ts > endTime {
 				return dataPoints
 			}
 			if ts >= startTime {
-				val := math.Float64frombits(binary.LittleEndian.Uint64(buf[i+8 : i+16]))
-				dataPoints = append(dataPoints, models.DataPoint{
-					Key:       id,
-					Timestamp: ts,
-					Value:     val,
-				})
+				dataPoints = append(dataPoints, layout.decode(id, buf[i:i+rs]))
 			}
 		}
 		if int64(n) < toRead {
@@ -453,7 +486,7 @@ func checkIfBufferHasEnoughDataPoints(id string, count int) bool {
 }
 
 func readLastBufferedDataPoints(id string, count int) []models.DataPoint {
-	if count == 1 {
+	if count == 1 && !layoutOf(id).hasSchema() {
 		timestampValue, ok := lastTimestamp.Load(id)
 		if ok && timestampValue != 0 {
 			value, _ := lastValue.Load(id)
@@ -474,6 +507,12 @@ func downsampleDataPoints(dataPoints []models.DataPoint, downsample int, aggrega
 	if len(dataPoints) == 0 {
 		return dataPoints
 	}
+	if dataPoints[0].Fields != nil {
+		return downsampleFieldPoints(dataPoints, downsample, aggregation)
+	}
+	if dataPoints[0].Type != models.TypeFloat {
+		return downsampleTypedPoints(dataPoints, downsample, aggregation)
+	}
 
 	needsValueCollection := aggregation == "median" || aggregation == "p50" || aggregation == "p95" || aggregation == "p99"
 
@@ -591,6 +630,9 @@ func InitFileHandles() {
 	capacity := utils.FileHandleLRUCapacity
 
 	// Close handles from a previous initialization (e.g. tests re-initializing)
+	keyLayouts.Clear()
+	keyDicts.Clear()
+	keyStages.Clear()
 	if dataFileHandles != nil {
 		dataFileHandles.Clear()
 	}
@@ -4,6 +4,7 @@ import (
 	"gtsdb/models"
 	"gtsdb/synchronous"
 	"gtsdb/utils"
+	"math"
 	"os"
 	"sync"
 	"testing"
@@ -30,8 +31,10 @@ func TestMain(m *testing.M) {
 }
 
 func cleanTestFiles(id string) {
-	os.Remove(utils.DataDir + "/" + id + ".aof")
-	os.Remove(utils.DataDir + "/" + id + ".idx")
+	for _, suffix := range keyFileSuffixes {
+		os.Remove(utils.DataDir + "/" + id + suffix)
+	}
+	removeStage(id)
 }
 
 func TestStoreDataPoints(t *testing.T) {
@@ -555,9 +558,9 @@ func TestPatchDataPointsEmptyDataset(t *testing.T) {
 }
 
 func TestPatchDataPointsConcurrent(t *testing.T) {
+	cleanup()
 
 	id := "TestPatchDataPointsConcurrent"
-	cleanTestFiles(id)
 
 	// Initial data
 	initialPoints := []models.DataPoint{
@@ -592,6 +595,106 @@ func TestPatchDataPointsConcurrent(t *testing.T) {
 			t.Errorf("Points not properly ordered at index %d", i)
 		}
 	}
+
+	cleanTestFiles(id)
+}
+
+func TestPatchDataPointsStagesLatePoints(t *testing.T) {
+	cleanup()
+	originalCacheSize := cacheSize
+	cacheSize = 0
+	defer func() { cacheSize = originalCacheSize }()
+
+	id := "TestPatchDataPointsStagesLatePoints"
+	base := int64(1700000000)
+	points := make([]models.DataPoint, 0, 12000)
+	for i := int64(0); i < 12000; i++ {
+		points = append(points, models.DataPoint{Key: id, Timestamp: base + i*10, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+	walSize, _ := GetDataFileSize(id + ".aof")
+	total := GetTotalDataPoints()
+
+	// Late points and an overwrite go to the side file; the newer one is appended
+	PatchDataPoints([]models.DataPoint{
+		{Key: id, Timestamp: base + 5, Value: -1},
+		{Key: id, Timestamp: base + 50000, Value: -2},
+		{Key: id, Timestamp: base + 119990, Value: -3},
+		{Key: id, Timestamp: base + 200000, Value: -4},
+	}, id)
+	if size, _ := GetDataFileSize(id + ".aof"); size != walSize+layoutOf(id).recordSize {
+		t.Errorf("Expected only the newer point to be appended, size %d -> %d", walSize, size)
+	}
+	if _, err := os.Stat(stagePath(id)); err != nil {
+		t.Fatalf("Expected a staging file: %v", err)
+	}
+	// Only base+5 and base+200000 are new timestamps
+	if count, _ := GetKeyCount(id); count != 12002 || GetTotalDataPoints() != total+2 {
+		t.Errorf("Unexpected counts after staging: key %d, total %d", count, GetTotalDataPoints()-total)
+	}
+
+	got := ReadDataPoints(id, base, base+10, 0, "")
+	if len(got) != 3 || got[1].Timestamp != base+5 || got[1].Value != -1 {
+		t.Errorf("Unexpected merged range: %+v", got)
+	}
+	if got = ReadDataPoints(id, base+50000, base+50000, 0, ""); len(got) != 1 || got[0].Value != -2 {
+		t.Errorf("Staged point should replace the WAL point: %+v", got)
+	}
+	last := ReadLastDataPoints(id, 2)
+	if len(last) != 2 || last[0].Value != -3 || last[1].Value != -4 {
+		t.Errorf("Unexpected last points: %+v", last)
+	}
+
+	// Staged points survive a reload and a rename
+	if !ReloadKey(id) {
+		t.Fatal("ReloadKey failed")
+	}
+	renamed := id + "_renamed"
+	RenameKey(id, renamed)
+	if got = ReadDataPoints(renamed, base, base+10, 0, ""); len(got) != 3 || got[1].Value != -1 {
+		t.Fatalf("Unexpected points after rename: %+v", got)
+	}
+	if count, _ := GetKeyCount(renamed); count != 12002 || GetTotalDataPoints() != total+2 {
+		t.Errorf("Unexpected counts after rename: key %d, total %d", count, GetTotalDataPoints()-total)
+	}
+
+	// Compaction folds the staged points into the WAL
+	if err := CompactKey(renamed); err != nil {
+		t.Fatalf("CompactKey failed: %v", err)
+	}
+	if _, err := os.Stat(stagePath(renamed)); !os.IsNotExist(err) {
+		t.Error("Expected compaction to remove the staging file")
+	}
+	if count, _ := GetKeyCount(renamed); count != 12002 || GetTotalDataPoints() != total+2 {
+		t.Errorf("Unexpected counts after compaction: key %d, total %d", count, GetTotalDataPoints()-total)
+	}
+	all := readWALDataPoints(renamed, 0, math.MaxInt64)
+	if len(all) != 12002 || all[1].Timestamp != base+5 || all[5001].Value != -2 {
+		t.Errorf("Unexpected compacted WAL: %d points", len(all))
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i].Timestamp <= all[i-1].Timestamp {
+			t.Fatalf("Compacted WAL out of order at %d", i)
+		}
+	}
+
+	// Expiry folds staged points first so none outlive the cutoff
+	PatchDataPoints([]models.DataPoint{{Key: renamed, Timestamp: base + 1, Value: 1}, {Key: renamed, Timestamp: base + 20001, Value: 1}}, renamed)
+	dropped, err := ExpireDataPoints(renamed, base+20000)
+	if err != nil || dropped != 2002 {
+		t.Errorf("ExpireDataPoints = %d, %v", dropped, err)
+	}
+	if got = ReadDataPoints(renamed, 0, base+20001, 0, ""); len(got) != 2 || got[1].Timestamp != base+20001 {
+		t.Errorf("Unexpected points after expiry: %+v", got)
+	}
+	DeleteKey(renamed)
+
+	// Reads of keys without staged points cache no stage
+	ReadDataPoints(id+"_unstaged", 0, math.MaxInt64, 0, "")
+	GetKeyCount(id + "_unstaged")
+	if _, ok := keyStages.Load(id + "_unstaged"); ok {
+		t.Error("Expected no stage for a read-only key")
+	}
 }
 
 func TestDeleteDataPoints(t *testing.T) {
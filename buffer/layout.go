@@ -0,0 +1,357 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gtsdb/concurrent"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// On-disk layout of a key's .aof.
+//
+// Legacy files are a bare sequence of 16-byte records (int64 timestamp +
+// float64 value). Keys created with a schema start with a header:
+//
+//	[8] magic "GTSDBWAL"
+//	[4] uint32 length of the JSON walHeader that follows
+//	[n] JSON walHeader
+//
+// followed by fixed-size records: int64 timestamp + one float64 per field
+// (NaN = field not written), or for typed keys int64 timestamp + one 8-byte
+// slot holding the int64, the bool (0/1) or the id of the string in the
+// key's .aof.dict. With "checksum":"crc32c" every record ends with the
+// uint32 CRC32C (Castagnoli) of its other bytes. All integers are
+// little-endian. Read as a
+// timestamp the magic is far outside the accepted range, so a legacy file
+// can never be mistaken for a headered one. Offsets in .idx are absolute
+// file offsets in both layouts.
+
+const walMagic = "GTSDBWAL"
+
+// walVersion 2 added typed values, 3 timestamp precision and 4 record
+// checksums; older headers remain readable.
+const walVersion = 4
+
+// walChecksum names the record checksum of version 4 headers.
+const walChecksum = "crc32c"
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maxWALHeader bounds the header length read from disk.
+const maxWALHeader = 64 * 1024
+
+type walHeader struct {
+	Version int      `json:"version"`
+	Fields  []string `json:"fields,omitempty"`
+	Type    string   `json:"type,omitempty"` // int, bool or string; "" = float
+	// Precision is the unit of the record timestamps: ms, us or ns; "" = s.
+	Precision string `json:"precision,omitempty"`
+	Checksum  string `json:"checksum,omitempty"` // crc32c or "" = none
+}
+
+// walLayout describes where a key's records start and how to decode them.
+type walLayout struct {
+	header     walHeader
+	headerSize int64
+	recordSize int64
+	valueType  models.ValueType
+	precision  models.Precision
+	checksum   bool
+}
+
+var legacyLayout = &walLayout{recordSize: 16}
+
+// keyLayouts caches the layout of every key whose .aof has been opened.
+var keyLayouts = concurrent.NewMap[string, *walLayout]()
+
+func newWALLayout(h walHeader) (*walLayout, []byte, error) {
+	valueType, err := models.ParseValueType(h.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	if valueType != models.TypeFloat && len(h.Fields) > 0 {
+		return nil, nil, fmt.Errorf("typed keys cannot have fields")
+	}
+	precision, err := models.ParsePrecision(h.Precision)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.Checksum != "" && h.Checksum != walChecksum {
+		return nil, nil, fmt.Errorf("unsupported WAL checksum %q", h.Checksum)
+	}
+	recordSize := 8 + 8*max(int64(len(h.Fields)), 1)
+	if h.Checksum != "" {
+		recordSize += 4
+	}
+	meta, err := json.Marshal(h)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := make([]byte, 0, len(walMagic)+4+len(meta))
+	raw = append(raw, walMagic...)
+	raw = binary.LittleEndian.AppendUint32(raw, uint32(len(meta)))
+	raw = append(raw, meta...)
+	return &walLayout{
+		header:     h,
+		headerSize: int64(len(raw)),
+		recordSize: recordSize,
+		valueType:  valueType,
+		precision:  precision,
+		checksum:   h.Checksum != "",
+	}, raw, nil
+}
+
+// readWALLayout reads the header of an open .aof. Files without the magic
+// (including empty ones) use the legacy layout.
+func readWALLayout(file *os.File) (*walLayout, error) {
+	var prefix [12]byte
+	n, err := file.ReadAt(prefix[:], 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n < len(walMagic) || string(prefix[:len(walMagic)]) != walMagic {
+		return legacyLayout, nil
+	}
+	if n < len(prefix) {
+		return nil, fmt.Errorf("truncated WAL header")
+	}
+	size := binary.LittleEndian.Uint32(prefix[8:12])
+	if size > maxWALHeader {
+		return nil, fmt.Errorf("WAL header too large: %d bytes", size)
+	}
+	meta := make([]byte, size)
+	if _, err := file.ReadAt(meta, int64(len(prefix))); err != nil {
+		return nil, fmt.Errorf("truncated WAL header: %w", err)
+	}
+	var h walHeader
+	if err := json.Unmarshal(meta, &h); err != nil {
+		return nil, fmt.Errorf("invalid WAL header: %w", err)
+	}
+	if h.Version < 1 || h.Version > walVersion {
+		return nil, fmt.Errorf("unsupported WAL version %d", h.Version)
+	}
+	l, _, err := newWALLayout(h)
+	if err != nil {
+		return nil, err
+	}
+	l.headerSize = int64(len(prefix)) + int64(size)
+	return l, nil
+}
+
+// layoutOf returns the cached layout of a key, reading the header from disk
+// the first time. Missing or unreadable files use the legacy layout.
+func layoutOf(key string) *walLayout {
+	if l, ok := keyLayouts.Load(key); ok {
+		return l
+	}
+	file, err := os.Open(utils.DataDir + "/" + key + ".aof")
+	if err != nil {
+		return legacyLayout
+	}
+	defer file.Close()
+	l, err := readWALLayout(file)
+	if err != nil {
+		utils.Error("Error reading WAL header for %s: %v", key, err)
+		return legacyLayout
+	}
+	keyLayouts.Store(key, l)
+	return l
+}
+
+// recordCount converts a data file size into a record count.
+func (l *walLayout) recordCount(size int64) int64 {
+	if size <= l.headerSize {
+		return 0
+	}
+	return (size - l.headerSize) / l.recordSize
+}
+
+// offsetOf returns the file offset of record i.
+func (l *walLayout) offsetOf(i int64) int64 {
+	return l.headerSize + i*l.recordSize
+}
+
+// readBuffer returns a scratch buffer of about 64 KiB holding whole records.
+func (l *walLayout) readBuffer() []byte {
+	return make([]byte, (64*1024/l.recordSize)*l.recordSize)
+}
+
+// encode writes dp into buf (len >= recordSize). A point without fields
+// written to a multi-field key lands in the first field; a float point
+// written to a typed key is converted.
+func (l *walLayout) encode(key string, buf []byte, dp models.DataPoint) error {
+	if err := l.encodeRecord(key, buf, dp); err != nil {
+		return err
+	}
+	if l.checksum {
+		n := l.recordSize - 4
+		binary.LittleEndian.PutUint32(buf[n:n+4], crc32.Checksum(buf[:n], castagnoli))
+	}
+	return nil
+}
+
+// verify reports whether a record's checksum matches; records of layouts
+// without checksums always verify.
+func (l *walLayout) verify(record []byte) bool {
+	if !l.checksum {
+		return true
+	}
+	n := l.recordSize - 4
+	return binary.LittleEndian.Uint32(record[n:n+4]) == crc32.Checksum(record[:n], castagnoli)
+}
+
+func (l *walLayout) encodeRecord(key string, buf []byte, dp models.DataPoint) error {
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(dp.Timestamp))
+	switch l.valueType {
+	case models.TypeInt, models.TypeBool:
+		v := dp.Int
+		if dp.Type == models.TypeFloat {
+			v = int64(dp.Value)
+		}
+		binary.LittleEndian.PutUint64(buf[8:16], uint64(v))
+		return nil
+	case models.TypeString:
+		s := dp.Str
+		if dp.Type != models.TypeString {
+			s = dp.FormatValue()
+		}
+		id, err := dictFor(key).intern(s)
+		if err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(buf[8:16], id)
+		return nil
+	}
+	if len(l.header.Fields) == 0 {
+		binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(dp.Value))
+		return nil
+	}
+	for i, name := range l.header.Fields {
+		v, ok := dp.Fields[name]
+		if dp.Fields == nil && i == 0 {
+			v, ok = dp.Value, true
+		}
+		if !ok {
+			v = math.NaN()
+		}
+		off := 8 + 8*i
+		binary.LittleEndian.PutUint64(buf[off:off+8], math.Float64bits(v))
+	}
+	return nil
+}
+
+// decode reads one record. For multi-field keys Value holds the first field
+// and Fields the fields that were written.
+func (l *walLayout) decode(key string, buf []byte) models.DataPoint {
+	ts := int64(binary.LittleEndian.Uint64(buf[0:8]))
+	switch l.valueType {
+	case models.TypeInt, models.TypeBool:
+		return models.IntPoint(key, ts, l.valueType, int64(binary.LittleEndian.Uint64(buf[8:16])))
+	case models.TypeString:
+		s, _ := dictFor(key).lookup(binary.LittleEndian.Uint64(buf[8:16]))
+		return models.StringPoint(key, ts, s)
+	}
+	dp := models.DataPoint{Key: key, Timestamp: ts}
+	if len(l.header.Fields) == 0 {
+		dp.Value = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:16]))
+		return dp
+	}
+	dp.Fields = make(map[string]float64, len(l.header.Fields))
+	for i, name := range l.header.Fields {
+		off := 8 + 8*i
+		v := math.Float64frombits(binary.LittleEndian.Uint64(buf[off : off+8]))
+		if i == 0 {
+			dp.Value = v
+		}
+		if !math.IsNaN(v) {
+			dp.Fields[name] = v
+		}
+	}
+	return dp
+}
+
+// timestampAt returns the timestamp of the record starting at buf[0].
+func timestampAt(buf []byte) int64 {
+	return int64(binary.LittleEndian.Uint64(buf[0:8]))
+}
+
+// checksumHeader adds record checksums to h when they are enabled.
+func checksumHeader(h walHeader) walHeader {
+	if utils.WALChecksums {
+		h.Version = walVersion
+		h.Checksum = walChecksum
+	}
+	return h
+}
+
+// startChecksummedWAL gives the empty file of a new key a header with record
+// checksums, so plain keys are checksummed too. Caller must hold the key's
+// file write lock.
+func startChecksummedWAL(key string, file *os.File, l *walLayout) *walLayout {
+	if cv, ok := idToCountMap.Load(key); ok && cv.Load() > 0 {
+		return l
+	}
+	if info, err := file.Stat(); err != nil || info.Size() > 0 {
+		return l
+	}
+	nl, err := writeWALHeader(key, checksumHeader(walHeader{}))
+	if err != nil {
+		utils.Error("Failed to write WAL header for %s: %v", key, err)
+		return l
+	}
+	return nl
+}
+
+// writeWALHeader starts an empty key file with a header and caches its
+// layout. Caller must hold the key's file write lock.
+func writeWALHeader(key string, h walHeader) (*walLayout, error) {
+	l, raw, err := newWALLayout(h)
+	if err != nil {
+		return nil, err
+	}
+	ref, ok := acquireFileHandle(key+".aof", dataFileHandles)
+	if !ok {
+		return nil, fmt.Errorf("cannot open data file for %s", key)
+	}
+	defer ref.release()
+	if err := ref.file.Truncate(0); err != nil {
+		return nil, fmt.Errorf("error truncating data file: %w", err)
+	}
+	if _, err := ref.file.Write(raw); err != nil {
+		return nil, fmt.Errorf("error writing WAL header: %w", err)
+	}
+	if err := ref.file.Sync(); err != nil {
+		return nil, fmt.Errorf("error syncing WAL header: %w", err)
+	}
+	keyLayouts.Store(key, l)
+	return l, nil
+}
+
+// hasSchema reports whether a layout carries more than record checksums:
+// fields, a value type or a precision, which a key keeps even when it holds
+// no points.
+func (l *walLayout) hasSchema() bool {
+	return len(l.header.Fields) > 0 || l.header.Type != "" || l.header.Precision != ""
+}
+
+// restoreWALHeader recreates a deleted key's file with the header it had,
+// so rewrites keep a key's schema. Layouts without a schema need no header;
+// the next write adds checksums if they are enabled.
+func restoreWALHeader(key string, l *walLayout) {
+	if !l.hasSchema() {
+		return
+	}
+	lock, _ := fileWriteLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.Lock()
+	defer lock.Unlock()
+	if _, err := writeWALHeader(key, l.header); err != nil {
+		utils.Error("Failed to restore WAL header for %s: %v", key, err)
+	}
+}
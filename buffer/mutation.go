@@ -0,0 +1,121 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"sync"
+	"sync/atomic"
+)
+
+// Every exported function that changes stored data reports the change as a
+// Mutation to the hook set with SetMutationHook, so a replica can replay it
+// (see package replication). Internal side effects are not reported: a
+// replica replaying a write maintains its own rollups, and replaying a
+// compaction compacts its own files.
+//
+// Mutators hold mutationGate shared from before the change until the hook
+// returns; Snapshot holds it exclusively while it records file sizes. A
+// mutation is therefore either wholly inside a snapshot or reported after its
+// cut. Lock order: dataPatchLock, rollupMu, renameLock, mutationGate,
+// rollup state, fileWriteLock. Mutators never take the gate twice, so
+// exported mutators call the unexported variants of each other.
+
+// MutationOp names a change to stored data.
+type MutationOp string
+
+const (
+	OpWrite         MutationOp = "write"         // StoreDataPointsBuffer
+	OpPatch         MutationOp = "patch"         // PatchDataPoints
+	OpInitKey       MutationOp = "initkey"       // InitKey, InitKeyWithOptions
+	OpDeletePoints  MutationOp = "deletepoints"  // DeleteDataPoints
+	OpDeleteKey     MutationOp = "deletekey"     // DeleteKey
+	OpRenameKey     MutationOp = "renamekey"     // RenameKey
+	OpCompact       MutationOp = "compact"       // CompactKey
+	OpExpire        MutationOp = "expire"        // ExpireDataPoints
+	OpAddRollup     MutationOp = "addrollup"     // AddRollup
+	OpRemoveRollup  MutationOp = "removerollup"  // RemoveRollup
+	OpRemoveRollups MutationOp = "removerollups" // RemoveRollupsFor
+	OpRenameRollups MutationOp = "renamerollups" // RenameRollups
+)
+
+// Mutation is one change to stored data with the arguments needed to replay
+// it. Fields not used by Op are zero.
+type Mutation struct {
+	Op      MutationOp
+	Key     string
+	NewKey  string             // renamekey, renamerollups
+	Points  []models.DataPoint // write, patch (sorted by timestamp)
+	Options *KeyOptions        // initkey; nil for InitKey
+	Rule    RollupRule         // addrollup, removerollup
+
+	// deletepoints: the arguments of DeleteDataPoints
+	Operator string
+	Value    float64
+	HasValue bool
+	From, To int64
+
+	Cutoff int64 // expire
+}
+
+var (
+	mutationGate sync.RWMutex
+	mutationHook atomic.Pointer[func(Mutation)]
+)
+
+// SetMutationHook calls fn after every mutation, or stops reporting when fn
+// is nil. fn runs on the mutating goroutine before the mutator returns, so
+// it must be quick and must not call back into buffer; Points may be reused
+// by the caller afterwards.
+func SetMutationHook(fn func(Mutation)) {
+	if fn == nil {
+		mutationHook.Store(nil)
+		return
+	}
+	mutationHook.Store(&fn)
+}
+
+// ApplyMutation replays a reported mutation with the exported function that
+// produced it (and so reports it again).
+func ApplyMutation(m Mutation) error {
+	switch m.Op {
+	case OpWrite:
+		StoreDataPointsBuffer(m.Points)
+	case OpPatch:
+		PatchDataPoints(m.Points, m.Key)
+	case OpInitKey:
+		if m.Options == nil {
+			InitKey(m.Key)
+			return nil
+		}
+		return InitKeyWithOptions(m.Key, *m.Options)
+	case OpDeletePoints:
+		DeleteDataPoints(m.Key, m.Operator, m.Value, m.HasValue, m.From, m.To)
+	case OpDeleteKey:
+		DeleteKey(m.Key)
+	case OpRenameKey:
+		RenameKey(m.Key, m.NewKey)
+	case OpCompact:
+		return CompactKey(m.Key)
+	case OpExpire:
+		_, err := ExpireDataPoints(m.Key, m.Cutoff)
+		return err
+	case OpAddRollup:
+		return AddRollup(m.Rule)
+	case OpRemoveRollup:
+		return RemoveRollup(m.Rule)
+	case OpRemoveRollups:
+		RemoveRollupsFor(m.Key)
+	case OpRenameRollups:
+		RenameRollups(m.Key, m.NewKey)
+	default:
+		return fmt.Errorf("unknown mutation: %s", m.Op)
+	}
+	return nil
+}
+
+// report passes m to the mutation hook, if one is set.
+func report(m Mutation) {
+	if fn := mutationHook.Load(); fn != nil {
+		(*fn)(m)
+	}
+}
@@ -0,0 +1,156 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"gtsdb/utils"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// corruptRecords counts records skipped because their checksum did not
+// match, for /metrics.
+var corruptRecords atomic.Int64
+
+// corruptKeys maps a key to the value of corruptRecords after the last
+// corrupt record found in it.
+var corruptKeys sync.Map // key -> int64
+
+// reportCorruptRecord logs a record that failed verification. Readers skip
+// such records instead of returning garbage; CorruptKeySince lets the caller
+// of a read find out that it is incomplete.
+func reportCorruptRecord(key string, offset int64) {
+	corruptKeys.Store(key, corruptRecords.Add(1))
+	utils.Error("Checksum mismatch in %s.aof at offset %d; record skipped", key, offset)
+}
+
+// GetCorruptRecordCount returns how many corrupt records readers have skipped
+// since startup.
+func GetCorruptRecordCount() int64 {
+	return corruptRecords.Load()
+}
+
+// CorruptKeySince returns the first of keys in which a corrupt record was
+// skipped after GetCorruptRecordCount returned mark, and whether there is
+// one. A read taking mark before it started thereby learns that it missed
+// records of a key.
+func CorruptKeySince(mark int64, keys ...string) (string, bool) {
+	if corruptRecords.Load() == mark {
+		return "", false
+	}
+	for _, key := range keys {
+		if n, ok := corruptKeys.Load(key); ok && n.(int64) > mark {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// RecoverWALs checks every key's files after a restart. A torn tail left by
+// a crash mid-write is truncated (for checksummed keys, trailing records that
+// fail their checksum as well) and a .idx that does not match its .aof is
+// rebuilt. Returns the number of keys repaired.
+func RecoverWALs() int {
+	repaired := 0
+	for _, key := range allIds.Items() {
+		if recoverKey(key) {
+			ReloadKey(key)
+			repaired++
+		}
+	}
+	if repaired > 0 {
+		utils.Warning("Recovered %d keys after an unclean shutdown", repaired)
+	}
+	return repaired
+}
+
+// recoverKey repairs one key's .aof tail and .idx. Returns true when either
+// file was changed.
+func recoverKey(key string) bool {
+	lock, _ := fileWriteLocks.LoadOrStore(key, &sync.Mutex{})
+	lock.Lock()
+	defer lock.Unlock()
+
+	file, err := os.OpenFile(utils.DataDir+"/"+key+".aof", os.O_RDWR, 0644)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Error("Cannot open %s.aof for recovery: %v", key, err)
+		}
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		utils.Error("Cannot stat %s.aof for recovery: %v", key, err)
+		return false
+	}
+	layout, err := readWALLayout(file)
+	if err != nil {
+		utils.Error("Cannot recover %s: %v", key, err)
+		return false
+	}
+
+	size := info.Size()
+	good := layout.offsetOf(layout.recordCount(size))
+	if size < layout.headerSize {
+		good = size
+	}
+	if layout.checksum {
+		record := make([]byte, layout.recordSize)
+		for good > layout.headerSize {
+			if _, err := file.ReadAt(record, good-layout.recordSize); err != nil {
+				utils.Error("Cannot read %s.aof for recovery: %v", key, err)
+				return false
+			}
+			if layout.verify(record) {
+				break
+			}
+			good -= layout.recordSize
+		}
+	}
+
+	truncated := good < size
+	if truncated {
+		if err := file.Truncate(good); err != nil {
+			utils.Error("Cannot truncate torn tail of %s.aof: %v", key, err)
+			return false
+		}
+		if err := file.Sync(); err != nil {
+			utils.Error("Cannot sync %s.aof: %v", key, err)
+		}
+		utils.Warning("Truncated %d bytes of torn records from %s.aof", size-good, key)
+	}
+	if truncated || !indexMatches(key, file, layout, good) {
+		rebuildIndexFile(key)
+		utils.Warning("Rebuilt index of %s", key)
+		return true
+	}
+	return false
+}
+
+// indexMatches reports whether a key's .idx has one entry per indexInterval
+// records and its last entry points at a record with the entry's timestamp.
+func indexMatches(key string, file *os.File, layout *walLayout, size int64) bool {
+	data, err := os.ReadFile(utils.DataDir + "/" + key + ".idx")
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	entries := layout.recordCount(size) / indexInterval
+	if int64(len(data)) != entries*16 {
+		return false
+	}
+	if entries == 0 {
+		return true
+	}
+	last := data[len(data)-16:]
+	offset := int64(binary.LittleEndian.Uint64(last[8:16]))
+	if offset != layout.offsetOf(entries*indexInterval-1) {
+		return false
+	}
+	var ts [8]byte
+	if _, err := file.ReadAt(ts[:], offset); err != nil {
+		return false
+	}
+	return timestampAt(ts[:]) == int64(binary.LittleEndian.Uint64(last[0:8]))
+}
@@ -0,0 +1,168 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"gtsdb/utils"
+	"os"
+	"testing"
+)
+
+func withWALChecksums(t *testing.T, on bool) {
+	t.Helper()
+	previous := utils.WALChecksums
+	utils.WALChecksums = on
+	t.Cleanup(func() { utils.WALChecksums = previous })
+}
+
+func TestWALChecksums(t *testing.T) {
+	cleanup()
+	withWALChecksums(t, true)
+	originalCacheSize := cacheSize
+	cacheSize = 0
+	defer func() { cacheSize = originalCacheSize }()
+
+	key := "TestWALChecksums"
+	base := int64(1700000000)
+	points := make([]models.DataPoint, 0, 10)
+	for i := int64(0); i < 10; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + i, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+
+	layout := layoutOf(key)
+	if !layout.checksum || layout.recordSize != 20 {
+		t.Fatalf("Expected a checksummed layout, got %+v", layout)
+	}
+	if got := ReadDataPoints(key, base, base+9, 0, ""); len(got) != 10 || got[9].Value != 9 {
+		t.Fatalf("Unexpected points: %+v", got)
+	}
+
+	// Flip a value bit of record 4 and the last record
+	file, err := os.OpenFile(utils.DataDir+"/"+key+".aof", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range []int64{4, 9} {
+		if _, err := file.WriteAt([]byte{0xff}, layout.offsetOf(i)+10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file.Close()
+
+	before := GetCorruptRecordCount()
+	got := ReadDataPoints(key, base, base+9, 0, "")
+	if len(got) != 8 || got[4].Timestamp != base+5 {
+		t.Errorf("Expected corrupt records to be skipped: %+v", got)
+	}
+	if GetCorruptRecordCount()-before != 2 {
+		t.Errorf("Expected 2 corrupt records, got %d", GetCorruptRecordCount()-before)
+	}
+	if got, ok := CorruptKeySince(before, "TestWALChecksums_other", key); !ok || got != key {
+		t.Errorf("Expected the read to be reported incomplete, got %q %v", got, ok)
+	}
+	if _, ok := CorruptKeySince(GetCorruptRecordCount(), key); ok {
+		t.Error("Expected no corrupt records after the mark")
+	}
+	if last := ReadLastDataPoints(key, 2); len(last) != 1 || last[0].Timestamp != base+8 {
+		t.Errorf("Unexpected last points: %+v", last)
+	}
+
+	// Typed keys created with initkey are checksummed too
+	if err := InitKeyType("TestWALChecksums_int", models.TypeInt); err != nil {
+		t.Fatal(err)
+	}
+	if l := layoutOf("TestWALChecksums_int"); !l.checksum || l.recordSize != 20 {
+		t.Errorf("Expected a checksummed int layout, got %+v", l)
+	}
+}
+
+func TestCompactionAddsChecksums(t *testing.T) {
+	cleanup()
+	withWALChecksums(t, false)
+	key := "TestCompactionAddsChecksums"
+	base := int64(1700000000)
+	points := make([]models.DataPoint, 0, 6000)
+	for i := int64(0); i < 6000; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + i, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+	if layoutOf(key).headerSize != 0 {
+		t.Fatal("Expected a legacy layout without checksums enabled")
+	}
+
+	utils.WALChecksums = true
+	if err := CompactKey(key); err != nil {
+		t.Fatalf("CompactKey failed: %v", err)
+	}
+	if !layoutOf(key).checksum {
+		t.Fatal("Expected compaction to add checksums")
+	}
+	if !ReloadKey(key) || !layoutOf(key).checksum {
+		t.Fatal("Checksums lost after reload")
+	}
+	if got := ReadDataPoints(key, base+5990, base+6000, 0, ""); len(got) != 10 || got[9].Value != 5999 {
+		t.Errorf("Unexpected points after compaction: %+v", got)
+	}
+}
+
+func TestRecoverWALs(t *testing.T) {
+	cleanup()
+	withWALChecksums(t, true)
+
+	key := "TestRecoverWALs"
+	base := int64(1700000000)
+	points := make([]models.DataPoint, 0, 6000)
+	for i := int64(0); i < 6000; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + i, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+	legacy := "TestRecoverWALs_legacy"
+	utils.WALChecksums = false
+	StoreDataPointsBuffer([]models.DataPoint{{Key: legacy, Timestamp: base, Value: 1}, {Key: legacy, Timestamp: base + 1, Value: 2}})
+	utils.WALChecksums = true
+	CloseAllHandles()
+
+	// A crash mid-batch: one whole record with a bad checksum plus a torn one
+	layout := layoutOf(key)
+	garbage := make([]byte, layout.recordSize+7)
+	for i := range garbage {
+		garbage[i] = 0xab
+	}
+	appendBytes(t, key+".aof", garbage)
+	appendBytes(t, legacy+".aof", []byte{1, 2, 3})
+	os.Remove(utils.DataDir + "/" + key + ".idx")
+
+	if n := RecoverWALs(); n != 2 {
+		t.Errorf("Expected 2 recovered keys, got %d", n)
+	}
+	if size, _ := GetDataFileSize(key + ".aof"); size != layout.offsetOf(6000) {
+		t.Errorf("Expected the torn tail to be truncated, size %d", size)
+	}
+	if info, err := os.Stat(utils.DataDir + "/" + key + ".idx"); err != nil || info.Size() != 16 {
+		t.Errorf("Expected a rebuilt index with one entry: %v", err)
+	}
+	if count, _ := GetKeyCount(key); count != 6000 {
+		t.Errorf("Expected 6000 points, got %d", count)
+	}
+	if got := ReadDataPoints(key, base+5000, base+5001, 0, ""); len(got) != 2 || got[0].Value != 5000 {
+		t.Errorf("Unexpected indexed read: %+v", got)
+	}
+	if size, _ := GetDataFileSize(legacy + ".aof"); size != 32 {
+		t.Errorf("Expected the legacy tail to be truncated, size %d", size)
+	}
+	if n := RecoverWALs(); n != 0 {
+		t.Errorf("Expected a clean second pass, got %d", n)
+	}
+}
+
+func appendBytes(t *testing.T, name string, data []byte) {
+	t.Helper()
+	file, err := os.OpenFile(utils.DataDir+"/"+name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
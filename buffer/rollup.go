@@ -0,0 +1,562 @@
+package buffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"gtsdb/concurrent"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Continuous aggregates ("rollups").
+//
+// A rollup rule keeps a downsampled copy of a source key up to date as points
+// are written: sensor1 + {60s, avg} is maintained as the ordinary key
+// "sensor1:1m:avg". Buckets are aligned to multiples of the interval since
+// the epoch and are labelled with their start timestamp. A bucket is written
+// to the target key once a point for a later bucket arrives; until then it is
+// held in memory and served from there, and after a restart it is rebuilt
+// from the source WAL when the next point arrives. Points older than the open bucket
+// (late arrivals) are kept in the source key but not folded into the rollup.
+// Intervals are in seconds; for a source with ms/us/ns timestamps buckets are
+// measured in its unit and the target key gets the same precision.
+//
+// A downsampled read of the source is answered from the rollup only when the
+// raw read would give the same buckets: epoch alignment, a range starting
+// at a bucket, a float source, and no bucket of the range touched since it
+// was rolled up. The open bucket, and a bucket the range ends inside, are
+// read from the source. Late arrivals, patches, deletes and expiry mark the buckets up
+// to the point they touched as stale (persisted in rollups-stale.json);
+// reads reaching into them use the raw series.
+
+// RollupRule declares one continuously maintained aggregate of a key.
+type RollupRule struct {
+	Source      string `json:"source"`
+	Interval    int64  `json:"interval"` // bucket width in seconds
+	Aggregation string `json:"aggregation"`
+}
+
+// rollupAggregations are the aggregations that can be maintained
+// incrementally (percentiles would need every value of the bucket).
+var rollupAggregations = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true,
+	"first": true, "last": true, "count": true,
+}
+
+// Target returns the key the rollup is stored under.
+func (r RollupRule) Target() string {
+	return r.Source + ":" + formatRollupInterval(r.Interval) + ":" + r.Aggregation
+}
+
+// formatRollupInterval renders an interval with the largest exact unit.
+func formatRollupInterval(seconds int64) string {
+	switch {
+	case seconds%86400 == 0:
+		return strconv.FormatInt(seconds/86400, 10) + "d"
+	case seconds%3600 == 0:
+		return strconv.FormatInt(seconds/3600, 10) + "h"
+	case seconds%60 == 0:
+		return strconv.FormatInt(seconds/60, 10) + "m"
+	default:
+		return strconv.FormatInt(seconds, 10) + "s"
+	}
+}
+
+// rollupState is the in-memory open bucket of one rule.
+type rollupState struct {
+	rule RollupRule
+	mu   sync.Mutex
+
+	open        bool
+	bucketStart int64
+	sum         float64
+	count       int
+	min         float64
+	max         float64
+	first       float64
+	last        float64
+	latest      int64 // newest timestamp folded in
+
+	// staleUntil is the end of the newest bucket the target may disagree
+	// with the source on; math.MinInt64 when none.
+	staleUntil atomic.Int64
+}
+
+func newRollupState(rule RollupRule) *rollupState {
+	s := &rollupState{rule: rule}
+	s.staleUntil.Store(math.MinInt64)
+	return s
+}
+
+var rollupStates = concurrent.NewMap[string, []*rollupState]()
+var rollupMu sync.Mutex // serializes rule changes and rollups.json writes
+var staleMu sync.Mutex  // serializes rollups-stale.json writes
+
+func rollupsFile() string {
+	return utils.DataDir + "/rollups.json"
+}
+
+func staleRollupsFile() string {
+	return utils.DataDir + "/rollups-stale.json"
+}
+
+// InitRollups loads rollup rules from the data directory, replacing any
+// previously loaded rules.
+func InitRollups() {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	loadRollupsLocked()
+}
+
+// loadRollupsLocked is InitRollups for a caller holding rollupMu.
+func loadRollupsLocked() {
+	rollupStates.Clear()
+	data, err := os.ReadFile(rollupsFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Errorln("Error reading rollups file:", err)
+		}
+		return
+	}
+	var rules []RollupRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		utils.Errorln("Error parsing rollups file:", err)
+		return
+	}
+	stale := map[string]int64{}
+	if data, err := os.ReadFile(staleRollupsFile()); err == nil {
+		if err := json.Unmarshal(data, &stale); err != nil {
+			utils.Errorln("Error parsing stale rollups file:", err)
+		}
+	}
+	for _, rule := range rules {
+		state := newRollupState(rule)
+		if until, ok := stale[rule.Target()]; ok {
+			state.staleUntil.Store(until)
+		}
+		states, _ := rollupStates.Load(rule.Source)
+		rollupStates.Store(rule.Source, append(states, state))
+	}
+}
+
+// saveRollupsLocked persists all rules. Caller must hold rollupMu.
+func saveRollupsLocked() error {
+	rules := []RollupRule{}
+	rollupStates.Range(func(_ string, states []*rollupState) bool {
+		for _, s := range states {
+			rules = append(rules, s.rule)
+		}
+		return true
+	})
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Target() < rules[j].Target()
+	})
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rollupsFile(), data, 0644)
+}
+
+// saveStaleRollups persists the stale marks of all rules by target key.
+func saveStaleRollups() {
+	staleMu.Lock()
+	defer staleMu.Unlock()
+	stale := map[string]int64{}
+	rollupStates.Range(func(_ string, states []*rollupState) bool {
+		for _, s := range states {
+			if until := s.staleUntil.Load(); until != math.MinInt64 {
+				stale[s.rule.Target()] = until
+			}
+		}
+		return true
+	})
+	data, err := json.MarshalIndent(stale, "", "  ")
+	if err == nil {
+		err = os.WriteFile(staleRollupsFile(), data, 0644)
+	}
+	if err != nil {
+		utils.Error("Failed to save stale rollups: %v", err)
+	}
+}
+
+// markStale marks the bucket holding ts, and every earlier one, as possibly
+// differing from the source. It reports whether the mark moved.
+func (s *rollupState) markStale(ts int64) bool {
+	width := s.width()
+	until := bucketFloor(ts, width) + width - 1
+	for {
+		old := s.staleUntil.Load()
+		if until <= old {
+			return false
+		}
+		if s.staleUntil.CompareAndSwap(old, until) {
+			return true
+		}
+	}
+}
+
+// markRollupsStale marks the buckets up to ts of the rollups of key, as
+// source or as target, stale after points of key were patched, deleted or
+// expired.
+func markRollupsStale(key string, ts int64) {
+	changed := false
+	rollupStates.Range(func(_ string, states []*rollupState) bool {
+		for _, s := range states {
+			if (s.rule.Source == key || s.rule.Target() == key) && s.markStale(ts) {
+				changed = true
+			}
+		}
+		return true
+	})
+	if changed {
+		saveStaleRollups()
+	}
+}
+
+// AddRollup registers a rule and backfills its target key from the data the
+// source key already holds.
+func AddRollup(rule RollupRule) error {
+	if rule.Source == "" {
+		return fmt.Errorf("source key required")
+	}
+	if rule.Interval < 2 {
+		return fmt.Errorf("rollup interval must be at least 2 seconds")
+	}
+	if !rollupAggregations[rule.Aggregation] {
+		return fmt.Errorf("unsupported rollup aggregation: %s", rule.Aggregation)
+	}
+	if len(KeyFields(rule.Source)) > 0 {
+		return fmt.Errorf("rollups are not supported on multi-field keys")
+	}
+	if KeyType(rule.Source) == models.TypeString {
+		return fmt.Errorf("rollups are not supported on string keys")
+	}
+
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	renameLock.Lock() // the backfill rewrites the target key
+	defer renameLock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+
+	states, _ := rollupStates.Load(rule.Source)
+	for _, s := range states {
+		if s.rule == rule {
+			return fmt.Errorf("rollup already exists: %s", rule.Target())
+		}
+	}
+
+	if precision := KeyPrecision(rule.Source); precision != models.PrecisionSecond {
+		if err := initKeyWithOptions(rule.Target(), KeyOptions{Precision: precision}); err != nil {
+			return fmt.Errorf("cannot create rollup key: %w", err)
+		}
+	}
+
+	// Publish the rule with its state locked: writers that see it wait for
+	// the backfill and then fold in their points, which it has not read.
+	state := newRollupState(rule)
+	state.mu.Lock()
+	rollupStates.Store(rule.Source, append(states, state))
+	backfillRollup(state)
+	state.mu.Unlock()
+
+	if err := saveRollupsLocked(); err != nil {
+		return err
+	}
+	report(Mutation{Op: OpAddRollup, Key: rule.Source, Rule: rule})
+	return nil
+}
+
+// RemoveRollup drops a rule. The target key keeps the buckets closed so far;
+// the open bucket is discarded.
+func RemoveRollup(rule RollupRule) error {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+
+	states, _ := rollupStates.Load(rule.Source)
+	for i, s := range states {
+		if s.rule == rule {
+			rest := append(append([]*rollupState{}, states[:i]...), states[i+1:]...)
+			if len(rest) == 0 {
+				rollupStates.Delete(rule.Source)
+			} else {
+				rollupStates.Store(rule.Source, rest)
+			}
+			if err := saveRollupsLocked(); err != nil {
+				return err
+			}
+			saveStaleRollups()
+			report(Mutation{Op: OpRemoveRollup, Key: rule.Source, Rule: rule})
+			return nil
+		}
+	}
+	return fmt.Errorf("rollup not found: %s", rule.Target())
+}
+
+// RemoveRollupsFor drops every rule whose source is key.
+func RemoveRollupsFor(key string) {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+
+	if _, ok := rollupStates.Load(key); !ok {
+		return
+	}
+	rollupStates.Delete(key)
+	if err := saveRollupsLocked(); err != nil {
+		utils.Error("Failed to save rollups: %v", err)
+	}
+	saveStaleRollups()
+	report(Mutation{Op: OpRemoveRollups, Key: key})
+}
+
+// RenameRollups moves key's rules, and their target keys, to newKey.
+func RenameRollups(key, newKey string) {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	renameLock.Lock()
+	defer renameLock.Unlock()
+	mutationGate.RLock()
+	defer mutationGate.RUnlock()
+
+	states, ok := rollupStates.Load(key)
+	if !ok {
+		return
+	}
+	rollupStates.Delete(key)
+	for _, s := range states {
+		s.mu.Lock()
+		oldTarget := s.rule.Target()
+		s.rule.Source = newKey
+		if allIds.Contains(oldTarget) {
+			utils.Log("Renaming key: %v to %v", oldTarget, s.rule.Target())
+			renameKeyLocked(oldTarget, s.rule.Target())
+		}
+		s.mu.Unlock()
+	}
+	rollupStates.Store(newKey, states)
+	if err := saveRollupsLocked(); err != nil {
+		utils.Error("Failed to save rollups: %v", err)
+	}
+	saveStaleRollups()
+	report(Mutation{Op: OpRenameRollups, Key: key, NewKey: newKey})
+}
+
+// GetRollups returns the rules maintained for a source key.
+func GetRollups(key string) []RollupRule {
+	states, _ := rollupStates.Load(key)
+	rules := make([]RollupRule, 0, len(states))
+	for _, s := range states {
+		rules = append(rules, s.rule)
+	}
+	return rules
+}
+
+// width returns the bucket width in the source key's timestamp unit.
+func (s *rollupState) width() int64 {
+	return s.rule.Interval * KeyPrecision(s.rule.Source).PerSecond()
+}
+
+// bucketFloor returns the start of the interval-aligned bucket containing ts.
+func bucketFloor(ts, interval int64) int64 {
+	b := ts - ts%interval
+	if ts < 0 && ts%interval != 0 {
+		b -= interval
+	}
+	return b
+}
+
+// backfillRollup rebuilds a rule's target from the full source series and
+// leaves the newest bucket open. Staged points are not in the WAL it reads:
+// their buckets start out stale.
+func backfillRollup(s *rollupState) {
+	points := readFiledDataPoints(s.rule.Source, 0, math.MaxInt64)
+	width := s.width()
+	var closed []models.DataPoint
+	for _, p := range points {
+		b := bucketFloor(p.Timestamp, width)
+		if s.open && p.Timestamp < s.latest {
+			s.markStale(p.Timestamp)
+		}
+		if s.open && b != s.bucketStart {
+			if b < s.bucketStart {
+				continue
+			}
+			closed = append(closed, s.bucketPoint())
+			s.open = false
+		}
+		s.accumulate(b, p.Value)
+		s.latest = p.Timestamp
+	}
+	if staged := existingStage(s.rule.Source).rangeOf(math.MinInt64, math.MaxInt64); len(staged) > 0 {
+		s.markStale(staged[len(staged)-1].Timestamp)
+	}
+	if s.staleUntil.Load() != math.MinInt64 {
+		saveStaleRollups()
+	}
+	target := s.rule.Target()
+	if len(closed) > 0 {
+		rewriteDataPoints(target, closed)
+	}
+}
+
+// updateRollups folds freshly written points of key into its rollups. Called
+// before the points are appended, so a bucket seeded from the WAL never
+// counts them twice.
+func updateRollups(key string, points []models.DataPoint) {
+	states, ok := rollupStates.Load(key)
+	if !ok {
+		return
+	}
+	stale := false
+	for _, s := range states {
+		s.mu.Lock()
+		for _, p := range points {
+			if !s.addLocked(p) {
+				stale = s.markStale(p.Timestamp) || stale
+			}
+		}
+		s.mu.Unlock()
+	}
+	if stale {
+		saveStaleRollups()
+	}
+}
+
+// addLocked folds p into the open bucket. It reports false for a point out
+// of order, which the rollup does not account for as a raw read would.
+func (s *rollupState) addLocked(p models.DataPoint) bool {
+	b := bucketFloor(p.Timestamp, s.width())
+	if !s.open {
+		// First point since startup: the bucket may already be on disk
+		// (flushed at shutdown) or partially in the source WAL.
+		if last := ReadLastDataPoints(s.rule.Target(), 1); len(last) > 0 && b <= last[0].Timestamp {
+			return false
+		}
+		s.seedLocked(b)
+	}
+	inOrder := !s.open || p.Timestamp >= s.latest
+	switch {
+	case b == s.bucketStart:
+		s.accumulate(b, p.Value)
+	case b > s.bucketStart:
+		s.flushLocked()
+		s.accumulate(b, p.Value)
+	default:
+		return false
+	}
+	s.latest = max(s.latest, p.Timestamp)
+	return inOrder
+}
+
+// seedLocked opens bucket b with the source points already stored for it.
+func (s *rollupState) seedLocked(b int64) {
+	for _, p := range readFiledDataPoints(s.rule.Source, b, b+s.width()-1) {
+		s.accumulate(b, p.Value)
+		s.latest = p.Timestamp
+	}
+}
+
+func (s *rollupState) accumulate(b int64, v float64) {
+	if !s.open {
+		s.open = true
+		s.bucketStart = b
+		s.sum, s.count = v, 1
+		s.min, s.max, s.first, s.last = v, v, v, v
+		return
+	}
+	s.sum += v
+	s.count++
+	if v < s.min {
+		s.min = v
+	}
+	if v > s.max {
+		s.max = v
+	}
+	s.last = v
+}
+
+func (s *rollupState) bucketPoint() models.DataPoint {
+	value := computeAggregate(s.rule.Aggregation, s.sum, float64(s.count), s.min, s.max, s.first, s.last, nil)
+	return models.DataPoint{Key: s.rule.Target(), Timestamp: s.bucketStart, Value: value}
+}
+
+// flushLocked appends the open bucket to the target key and closes it.
+func (s *rollupState) flushLocked() {
+	if !s.open || s.count == 0 {
+		return
+	}
+	p := s.bucketPoint()
+	allIds.Add(p.Key)
+	storeDataPoints(p.Key, []models.DataPoint{p})
+	lastValue.Store(p.Key, p.Value)
+	lastTimestamp.Store(p.Key, p.Timestamp)
+	s.open = false
+}
+
+// readRollup serves a downsampled read from a matching rollup. ok is false
+// when no rule matches the interval and aggregation, or the rollup would not
+// give what the raw read gives: buckets not aligned to the epoch, a range
+// starting inside a bucket, a typed source or stale buckets in the range.
+// The complete buckets of the range come from the rollup; the rest (the
+// open bucket, a bucket the range ends inside) is read from the raw series.
+func readRollup(id string, startTime, endTime int64, downsample int, aggregation string, align Alignment) ([]models.DataPoint, bool) {
+	states, found := rollupStates.Load(id)
+	if !found || align.Unit != "epoch" || KeyType(id) != models.TypeFloat {
+		return nil, false
+	}
+	for _, s := range states {
+		width := s.width()
+		if width != int64(downsample) || s.rule.Aggregation != aggregation {
+			continue
+		}
+		if startTime%width != 0 || startTime <= s.staleUntil.Load() {
+			return nil, false
+		}
+		target := s.rule.Target()
+
+		// The target holds the buckets before the open one. After a
+		// restart no bucket is open until the next write; the target then
+		// ends with its last bucket.
+		s.mu.Lock()
+		open, bucketStart := s.open, s.bucketStart
+		s.mu.Unlock()
+		if !open {
+			bucketStart = startTime
+			if last := ReadLastDataPoints(target, 1); len(last) == 1 {
+				bucketStart = max(bucketStart, last[0].Timestamp+width)
+			}
+		}
+		rolledEnd := bucketStart - 1
+		if endTime < math.MaxInt64 {
+			rolledEnd = min(rolledEnd, bucketFloor(endTime+1, width)-1)
+		}
+
+		// A bucket closing meanwhile is appended to the target after
+		// rolledEnd, so the raw part still covers it
+		var points []models.DataPoint
+		if rolledEnd >= startTime {
+			points = readFiledDataPoints(target, startTime, rolledEnd)
+		}
+		if rolledEnd < endTime {
+			from := max(startTime, rolledEnd+1)
+			raw := mergeStaged(id, readFiledDataPoints(id, from, endTime), from, endTime)
+			points = append(points, downsampleAligned(raw, downsample, aggregation, align)...)
+		}
+		for i := range points {
+			points[i].Key = id
+		}
+		return points, true
+	}
+	return nil, false
+}
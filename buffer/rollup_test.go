@@ -0,0 +1,220 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"math"
+	"testing"
+)
+
+func resetRollups(t *testing.T) {
+	t.Helper()
+	cleanup()
+	InitRollups()
+	t.Cleanup(func() {
+		cleanup()
+		InitRollups()
+	})
+}
+
+func TestRollupTargetName(t *testing.T) {
+	tests := []struct {
+		rule RollupRule
+		want string
+	}{
+		{RollupRule{Source: "sensor1", Interval: 60, Aggregation: "avg"}, "sensor1:1m:avg"},
+		{RollupRule{Source: "sensor1", Interval: 3600, Aggregation: "max"}, "sensor1:1h:max"},
+		{RollupRule{Source: "sensor1", Interval: 86400, Aggregation: "sum"}, "sensor1:1d:sum"},
+		{RollupRule{Source: "sensor1", Interval: 90, Aggregation: "min"}, "sensor1:90s:min"},
+	}
+	for _, tt := range tests {
+		if got := tt.rule.Target(); got != tt.want {
+			t.Errorf("Target() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestRollupBackfillAndIncremental(t *testing.T) {
+	resetRollups(t)
+
+	key := "TestRollupSource"
+	base := int64(1700000040) // 1700000040 is a multiple of 60
+	points := make([]models.DataPoint, 0, 150)
+	for i := 0; i < 150; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + int64(i), Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points[:90])
+
+	rule := RollupRule{Source: key, Interval: 60, Aggregation: "avg"}
+	if err := AddRollup(rule); err != nil {
+		t.Fatalf("AddRollup failed: %v", err)
+	}
+	if err := AddRollup(rule); err == nil {
+		t.Error("Expected duplicate rollup to fail")
+	}
+
+	// Backfill closes the first bucket and leaves the second one open
+	stored := ReadDataPoints(rule.Target(), 0, base+1000, 0, "")
+	if len(stored) != 1 || stored[0].Timestamp != base || stored[0].Value != 29.5 {
+		t.Fatalf("Unexpected backfilled rollup: %v", stored)
+	}
+
+	for _, p := range points[90:] {
+		StoreDataPointBuffer(p)
+	}
+
+	stored = ReadDataPoints(rule.Target(), 0, base+1000, 0, "")
+	if len(stored) != 2 || stored[1].Timestamp != base+60 || stored[1].Value != 89.5 {
+		t.Fatalf("Unexpected incremental rollup: %v", stored)
+	}
+
+	// Epoch-aligned reads of whole buckets are served from the rollup,
+	// including the open bucket
+	epoch := Alignment{Unit: "epoch"}
+	if _, ok := readRollup(key, base, base+179, 60, "avg", epoch); !ok {
+		t.Error("Expected the read served from the rollup")
+	}
+	got := ReadAlignedDataPoints(key, base, base+179, 60, "avg", epoch)
+	if len(got) != 3 {
+		t.Fatalf("Expected 3 buckets, got %v", got)
+	}
+	if got[2].Timestamp != base+120 || got[2].Value != 134.5 || got[2].Key != key {
+		t.Errorf("Unexpected open bucket: %+v", got[2])
+	}
+
+	// Rules survive a reload and the open bucket is rebuilt from the source WAL
+	InitRollups()
+	StoreDataPointBuffer(models.DataPoint{Key: key, Timestamp: base + 150, Value: 150})
+	got = ReadAlignedDataPoints(key, base, base+179, 60, "avg", epoch)
+	if len(got) != 3 || got[2].Value != 135 {
+		t.Errorf("Expected open bucket avg 135 after reload, got %v", got)
+	}
+
+	// Other aggregations and intervals fall back to the raw series
+	if _, ok := readRollup(key, base, base+179, 60, "max", epoch); ok {
+		t.Error("Expected no rollup for max")
+	}
+	if _, ok := readRollup(key, base, base+179, 30, "avg", epoch); ok {
+		t.Error("Expected no rollup for a 30s interval")
+	}
+}
+
+// rawRollupRead is the read readRollup stands in for, from the source WAL.
+func rawRollupRead(key string, startTime, endTime int64, aggregation string) []models.DataPoint {
+	points := mergeStaged(key, readFiledDataPoints(key, startTime, endTime), startTime, endTime)
+	return downsampleAligned(points, 60, aggregation, Alignment{Unit: "epoch"})
+}
+
+func TestRollupMatchesRawRead(t *testing.T) {
+	resetRollups(t)
+	originalCacheSize := cacheSize
+	cacheSize = 0 // range reads from the WAL, not a partial ring buffer
+	defer func() { cacheSize = originalCacheSize }()
+
+	key := "TestRollupMatchesRaw"
+	base := int64(1700000040) // a multiple of 60
+	var points []models.DataPoint
+	for i := 0; i < 300; i += 7 {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + int64(i), Value: float64(i % 13)})
+	}
+	StoreDataPointsBuffer(points)
+	for _, agg := range []string{"avg", "sum", "min", "max", "first", "last", "count"} {
+		if err := AddRollup(RollupRule{Source: key, Interval: 60, Aggregation: agg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epoch := Alignment{Unit: "epoch"}
+
+	compare := func(startTime, endTime int64, wantRollup bool) {
+		t.Helper()
+		for _, agg := range []string{"avg", "sum", "min", "max", "first", "last", "count"} {
+			rolled, ok := readRollup(key, startTime, endTime, 60, agg, epoch)
+			if ok != wantRollup {
+				t.Fatalf("%s [%d, %d]: served from rollup = %v, want %v", agg, startTime, endTime, ok, wantRollup)
+			}
+			raw := rawRollupRead(key, startTime, endTime, agg)
+			if !ok {
+				rolled = ReadAlignedDataPoints(key, startTime, endTime, 60, agg, epoch)
+			}
+			if len(rolled) != len(raw) {
+				t.Fatalf("%s [%d, %d]: rollup %v, raw %v", agg, startTime, endTime, rolled, raw)
+			}
+			for i := range raw {
+				if rolled[i].Timestamp != raw[i].Timestamp || rolled[i].Value != raw[i].Value {
+					t.Fatalf("%s [%d, %d]: rollup %v, raw %v", agg, startTime, endTime, rolled, raw)
+				}
+			}
+		}
+	}
+
+	compare(base, base+299, true)
+	compare(base+60, base+239, true)
+	// The open bucket, and one the range ends inside, come from the raw
+	// series
+	compare(base+60, math.MaxInt64, true)
+	compare(base, base+269, true)
+	// So does the last bucket after a restart, until a write reopens it
+	InitRollups()
+	compare(base, math.MaxInt64, true)
+	compare(base+60, base+299, true)
+	// A range starting inside a bucket, or other alignments, use the raw
+	// series
+	compare(base+30, base+299, false)
+	if _, ok := readRollup(key, base, base+299, 60, "avg", Alignment{}); ok {
+		t.Error("Expected first-point buckets not served from the rollup")
+	}
+
+	// A late point makes its bucket and the earlier ones stale
+	PatchDataPoints([]models.DataPoint{{Key: key, Timestamp: base + 61, Value: 100}}, key)
+	compare(base, base+299, false)
+	compare(base+120, base+299, true)
+
+	// Deleting points does too
+	DeleteDataPoints(key, ">", 11, true, 0, 0)
+	compare(base+120, base+299, false)
+
+	// The marks survive a reload
+	InitRollups()
+	compare(base, base+299, false)
+}
+
+func TestRollupRemove(t *testing.T) {
+	resetRollups(t)
+
+	key := "TestRollupRemove"
+	rule := RollupRule{Source: key, Interval: 10, Aggregation: "count"}
+	if err := AddRollup(rule); err != nil {
+		t.Fatal(err)
+	}
+	if rules := GetRollups(key); len(rules) != 1 || rules[0] != rule {
+		t.Fatalf("Unexpected rules: %v", rules)
+	}
+	StoreDataPointsBuffer([]models.DataPoint{
+		{Key: key, Timestamp: 1700000000, Value: 1},
+		{Key: key, Timestamp: 1700000010, Value: 2},
+	})
+	RenameRollups(key, key+"2")
+	rule.Source = key + "2"
+	if rules := GetRollups(key + "2"); len(rules) != 1 || rules[0] != rule {
+		t.Fatalf("Unexpected rules after rename: %v", rules)
+	}
+	if !allIds.Contains(key+"2:10s:count") || allIds.Contains(key+":10s:count") {
+		t.Error("Expected rollup key to follow the rename")
+	}
+
+	if err := RemoveRollup(rule); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveRollup(rule); err == nil {
+		t.Error("Expected removing a missing rollup to fail")
+	}
+	if rules := GetRollups(key); len(rules) != 0 {
+		t.Errorf("Expected no rules, got %v", rules)
+	}
+
+	if err := AddRollup(RollupRule{Source: key, Interval: 10, Aggregation: "p99"}); err == nil {
+		t.Error("Expected unsupported aggregation to fail")
+	}
+	if err := AddRollup(RollupRule{Source: key, Interval: 1, Aggregation: "avg"}); err == nil {
+		t.Error("Expected interval below 2 seconds to fail")
+	}
+}
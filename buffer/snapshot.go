@@ -0,0 +1,171 @@
+package buffer
+
+import (
+	"bytes"
+	"gtsdb/utils"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// keyFileSuffixes lists the files a key may own in the data directory.
+var keyFileSuffixes = []string{".aof", ".idx", ".aof.ooo", ".aof.dict", ".aof.gor", ".aof.gor.idx"}
+
+type snapshotFile struct {
+	name string
+	size int64
+}
+
+// Snapshot copies the files of every key as of a single moment and passes
+// each one to fn as a reader of exactly size bytes; name is relative to the
+// data directory. The cut is taken while mutations are held off (see
+// mutation.go), but only for as long as it takes to stat the files: appends
+// then continue and are cut off by copying each file up to its size at the
+// cut. Patches, compaction and expiry of a key, which rewrite bytes in place,
+// wait until that key has been copied; renames and deletes wait for the
+// whole snapshot. Keys created after the key list was taken are copied whole
+// at the cut, as are rollups.json and rollups-stale.json. cut, if not nil, is called at the cut:
+// mutations reported before it are in the snapshot, later ones are not.
+// Returns the keys in the snapshot.
+func Snapshot(cut func(), fn func(name string, size int64, r io.Reader) error) ([]string, error) {
+	keys := allIds.Items()
+	sort.Strings(keys)
+
+	patchLocks := make([]*sync.Mutex, len(keys))
+	for i, key := range keys {
+		patchLocks[i], _ = dataPatchLocks.LoadOrStore(key, &sync.Mutex{})
+		patchLocks[i].Lock()
+	}
+	copied := 0
+	defer func() {
+		for _, lock := range patchLocks[copied:] {
+			lock.Unlock()
+		}
+	}()
+
+	renameLock.Lock()
+	defer renameLock.Unlock()
+
+	files := make([][]snapshotFile, len(keys))
+	var snapped []string
+	var rollups, staleRollups []byte
+	err := func() error {
+		mutationGate.Lock()
+		defer mutationGate.Unlock()
+
+		for i, key := range keys {
+			files[i] = statKeyFiles(key)
+		}
+		listed := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			listed[key] = true
+		}
+		for _, key := range allIds.Items() {
+			if listed[key] {
+				continue
+			}
+			extra := statKeyFiles(key)
+			for _, f := range extra {
+				if err := copySnapshotFile(f, fn); err != nil {
+					return err
+				}
+			}
+			if len(extra) > 0 {
+				snapped = append(snapped, key)
+			}
+		}
+
+		var err error
+		if rollups, err = os.ReadFile(rollupsFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if staleRollups, err = os.ReadFile(staleRollupsFile()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if cut != nil {
+			cut()
+		}
+		return nil
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		for _, f := range files[i] {
+			if err := copySnapshotFile(f, fn); err != nil {
+				return nil, err
+			}
+		}
+		if len(files[i]) > 0 {
+			snapped = append(snapped, key)
+		}
+		patchLocks[i].Unlock()
+		copied++
+	}
+	if rollups != nil {
+		if err := fn("rollups.json", int64(len(rollups)), bytes.NewReader(rollups)); err != nil {
+			return nil, err
+		}
+	}
+	if staleRollups != nil {
+		if err := fn("rollups-stale.json", int64(len(staleRollups)), bytes.NewReader(staleRollups)); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(snapped)
+	return snapped, nil
+}
+
+// statKeyFiles returns the files a key owns with their current sizes.
+func statKeyFiles(key string) []snapshotFile {
+	var files []snapshotFile
+	for _, suffix := range keyFileSuffixes {
+		info, err := os.Stat(utils.DataDir + "/" + key + suffix)
+		if err != nil {
+			continue
+		}
+		files = append(files, snapshotFile{key + suffix, info.Size()})
+	}
+	return files
+}
+
+func copySnapshotFile(f snapshotFile, fn func(name string, size int64, r io.Reader) error) error {
+	file, err := os.Open(utils.DataDir + "/" + f.name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return fn(f.name, f.size, io.LimitReader(file, f.size))
+}
+
+// Reload swaps the whole data directory under the running database, as a
+// replica does with the leader's snapshot. With mutations and renames held
+// off, it drops every open handle and cached key state, calls replace to
+// move the new files into place and loads keys, WAL layouts and rollup rules
+// as at startup. A snapshot is cut between mutations, so unlike at startup
+// there are no torn tails to recover. Reads running meanwhile may see either
+// directory.
+func Reload(replace func() error) error {
+	rollupMu.Lock()
+	defer rollupMu.Unlock()
+	renameLock.Lock()
+	defer renameLock.Unlock()
+	mutationGate.Lock()
+	defer mutationGate.Unlock()
+
+	CloseAllHandles()
+	idToRingBufferMap.Clear()
+	idToCountMap.Clear()
+	lastValue.Clear()
+	lastTimestamp.Clear()
+	totalDataPoints.Store(0)
+	dirtyKeys.Clear()
+
+	err := replace()
+	InitFileHandles()
+	InitIDSet()
+	loadRollupsLocked()
+	return err
+}
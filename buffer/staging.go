@@ -0,0 +1,319 @@
+package buffer
+
+import (
+	"gtsdb/concurrent"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Out-of-order staging. A patched point at or before a key's last timestamp
+// is appended to the key's .aof.ooo side file instead of rewriting the whole
+// .aof, so a late write costs O(batch). The side file holds records in the
+// key's layout (without a header) in arrival order; its points are kept
+// sorted in memory and merged into reads, a staged point replacing a WAL
+// point with the same timestamp. CompactKey folds the staged points into the
+// WAL and removes the side file.
+//
+// idToCountMap counts WAL records (reads locate records by it), so staged
+// points that add a timestamp are counted in the stage's extra instead, and
+// in totalDataPoints, from when the stage is loaded until it is folded in.
+
+// maxStagedPoints bounds the staging area of a key; a patch that reaches it
+// compacts the key.
+const maxStagedPoints = 50000
+
+type stage struct {
+	mu     sync.Mutex
+	key    string
+	loaded bool
+	points []models.DataPoint // sorted by timestamp, one point per timestamp
+	extra  int64              // staged timestamps the WAL does not hold
+}
+
+var keyStages = concurrent.NewMap[string, *stage]()
+
+func stagePath(key string) string {
+	return utils.DataDir + "/" + key + ".aof.ooo"
+}
+
+func stageFor(key string) *stage {
+	if s, ok := keyStages.Load(key); ok {
+		return s
+	}
+	s, _ := keyStages.LoadOrStore(key, &stage{key: key})
+	return s
+}
+
+// existingStage is stageFor for read paths: it returns nil, and caches
+// nothing, for a key without a stage or staging file, so reads of arbitrary
+// keys do not grow keyStages. The stage methods below treat nil as empty.
+func existingStage(key string) *stage {
+	if s, ok := keyStages.Load(key); ok {
+		return s
+	}
+	if _, err := os.Stat(stagePath(key)); err != nil {
+		return nil
+	}
+	return stageFor(key)
+}
+
+// forgetStage drops a key's stage from the cache and its extra points from
+// totalDataPoints.
+func forgetStage(key string) {
+	if s, ok := keyStages.Load(key); ok {
+		s.mu.Lock()
+		totalDataPoints.Add(-s.extra)
+		s.extra = 0
+		s.mu.Unlock()
+	}
+	keyStages.Delete(key)
+}
+
+// removeStage deletes a key's staging file and cache.
+func removeStage(key string) {
+	forgetStage(key)
+	if err := os.Remove(stagePath(key)); err != nil && !os.IsNotExist(err) {
+		utils.Errorln(err)
+	}
+}
+
+// renameStage moves a key's staging file along with its data file.
+func renameStage(key, newKey string) {
+	forgetStage(key)
+	forgetStage(newKey)
+	if err := os.Rename(stagePath(key), stagePath(newKey)); err != nil && !os.IsNotExist(err) {
+		utils.Errorln("Error renaming staging file:", err)
+	}
+}
+
+// load reads the staging file once. A torn last record is truncated.
+// Caller must hold s.mu.
+func (s *stage) load() error {
+	if s.loaded {
+		return nil
+	}
+	data, err := os.ReadFile(stagePath(s.key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	layout := layoutOf(s.key)
+	rs := int(layout.recordSize)
+	whole := len(data) / rs * rs
+	if whole < len(data) {
+		utils.Warning("Truncating torn staged record in %s", stagePath(s.key))
+		if err := os.Truncate(stagePath(s.key), int64(whole)); err != nil {
+			return err
+		}
+	}
+	points := make([]models.DataPoint, 0, whole/rs)
+	for i := 0; i < whole; i += rs {
+		if !layout.verify(data[i : i+rs]) {
+			utils.Error("Checksum mismatch in %s at offset %d; staged record skipped", stagePath(s.key), i)
+			continue
+		}
+		points = append(points, layout.decode(s.key, data[i:i+rs]))
+	}
+	unique := sortedUnique(points)
+	s.extra = s.countNew(unique) // nothing staged yet
+	totalDataPoints.Add(s.extra)
+	s.points = unique
+	s.loaded = true
+	return nil
+}
+
+// countNew returns how many of the sorted, unique points have a timestamp
+// that is neither staged nor in the WAL. Caller must hold s.mu.
+func (s *stage) countNew(points []models.DataPoint) int64 {
+	var unstaged []models.DataPoint
+	for _, p := range points {
+		i := sort.Search(len(s.points), func(i int) bool { return s.points[i].Timestamp >= p.Timestamp })
+		if i == len(s.points) || s.points[i].Timestamp != p.Timestamp {
+			unstaged = append(unstaged, p)
+		}
+	}
+	if len(unstaged) == 0 {
+		return 0
+	}
+	wal := readWALDataPoints(s.key, unstaged[0].Timestamp, unstaged[len(unstaged)-1].Timestamp)
+	n, j := int64(0), 0
+	for _, p := range unstaged {
+		for j < len(wal) && wal[j].Timestamp < p.Timestamp {
+			j++
+		}
+		if j == len(wal) || wal[j].Timestamp != p.Timestamp {
+			n++
+		}
+	}
+	return n
+}
+
+// add appends points to the staging file and merges them into the sorted
+// set. points must be sorted by timestamp.
+func (s *stage) add(points []models.DataPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return err
+	}
+	layout := layoutOf(s.key)
+	buf := make([]byte, int64(len(points))*layout.recordSize)
+	for i, p := range points {
+		if err := layout.encode(s.key, buf[int64(i)*layout.recordSize:], p); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(stagePath(s.key), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(buf); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	unique := sortedUnique(append([]models.DataPoint(nil), points...))
+	added := s.countNew(unique)
+	s.extra += added
+	totalDataPoints.Add(added)
+	s.points = mergeByTimestamp(s.points, unique)
+	return nil
+}
+
+// extraCount returns the number of staged points that add a timestamp to
+// the WAL.
+func (s *stage) extraCount() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0
+	}
+	return s.extra
+}
+
+// rangeOf returns a copy of the staged points in [startTime, endTime].
+func (s *stage) rangeOf(startTime, endTime int64) []models.DataPoint {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		utils.Error("Error loading staged points for %s: %v", s.key, err)
+		return nil
+	}
+	from := sort.Search(len(s.points), func(i int) bool { return s.points[i].Timestamp >= startTime })
+	to := sort.Search(len(s.points), func(i int) bool { return s.points[i].Timestamp > endTime })
+	if from >= to {
+		return nil
+	}
+	return append([]models.DataPoint(nil), s.points[from:to]...)
+}
+
+// contains reports whether a point with timestamp ts is staged.
+func (s *stage) contains(ts int64) bool {
+	return len(s.rangeOf(ts, ts)) > 0
+}
+
+// size returns the number of staged points.
+func (s *stage) size() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		return 0
+	}
+	return len(s.points)
+}
+
+// clear drops the staged points once they have been folded into the WAL.
+func (s *stage) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.Remove(stagePath(s.key)); err != nil && !os.IsNotExist(err) {
+		utils.Errorln(err)
+	}
+	totalDataPoints.Add(-s.extra)
+	s.points = nil
+	s.extra = 0
+	s.loaded = true
+}
+
+// StagedPointCount returns how many out-of-order points of a key wait to be
+// folded into its WAL.
+func StagedPointCount(key string) int {
+	return existingStage(key).size()
+}
+
+// sortedUnique stable-sorts points by timestamp and keeps the last point
+// written for each timestamp.
+func sortedUnique(points []models.DataPoint) []models.DataPoint {
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+	unique := points[:0]
+	for _, p := range points {
+		if n := len(unique); n > 0 && unique[n-1].Timestamp == p.Timestamp {
+			unique[n-1] = p
+			continue
+		}
+		unique = append(unique, p)
+	}
+	return unique
+}
+
+// mergeByTimestamp merges two sorted point lists; on equal timestamps the
+// point from newer wins.
+func mergeByTimestamp(older, newer []models.DataPoint) []models.DataPoint {
+	merged := make([]models.DataPoint, 0, len(older)+len(newer))
+	i, j := 0, 0
+	for i < len(older) && j < len(newer) {
+		switch {
+		case older[i].Timestamp < newer[j].Timestamp:
+			merged = append(merged, older[i])
+			i++
+		case older[i].Timestamp > newer[j].Timestamp:
+			merged = append(merged, newer[j])
+			j++
+		default:
+			merged = append(merged, newer[j])
+			i++
+			j++
+		}
+	}
+	merged = append(merged, older[i:]...)
+	return append(merged, newer[j:]...)
+}
+
+// mergeStaged merges the staged points in [startTime, endTime] into points
+// read from the WAL, the ring buffer or the compressed copy.
+func mergeStaged(id string, points []models.DataPoint, startTime, endTime int64) []models.DataPoint {
+	staged := existingStage(id).rangeOf(startTime, endTime)
+	if len(staged) == 0 {
+		return points
+	}
+	return mergeByTimestamp(points, staged)
+}
+
+// mergeLastStaged merges staged points into the last count points of a key.
+func mergeLastStaged(id string, points []models.DataPoint, count int) []models.DataPoint {
+	from := int64(math.MinInt64)
+	if len(points) > 0 && len(points) >= count {
+		from = points[0].Timestamp
+	}
+	merged := mergeStaged(id, points, from, math.MaxInt64)
+	if len(merged) > count {
+		merged = merged[len(merged)-count:]
+	}
+	return merged
+}
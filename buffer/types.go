@@ -0,0 +1,290 @@
+package buffer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gtsdb/concurrent"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Typed keys hold int64, bool or string values instead of float64. The type
+// lives in the key's WAL header; each record keeps its 8-byte value slot,
+// which for string keys holds an id into the key's .aof.dict.
+
+// maxStringValue bounds a single string value (and a dictionary entry read
+// from disk).
+const maxStringValue = 64 * 1024
+
+// stringDict maps the distinct values of a string key to ids. On disk it is
+// a sequence of uint32 length + bytes entries; an entry's id is its
+// position. Entries are synced before a record can reference them, so a torn
+// tail is only ever an unreferenced entry and is truncated on load.
+type stringDict struct {
+	mu     sync.Mutex
+	path   string
+	loaded bool
+	ids    map[string]uint64
+	values []string
+}
+
+var keyDicts = concurrent.NewMap[string, *stringDict]()
+
+func dictPath(key string) string {
+	return utils.DataDir + "/" + key + ".aof.dict"
+}
+
+func dictFor(key string) *stringDict {
+	d, _ := keyDicts.LoadOrStore(key, &stringDict{path: dictPath(key)})
+	return d
+}
+
+// removeDict deletes a key's dictionary file and cache.
+func removeDict(key string) {
+	keyDicts.Delete(key)
+	if err := os.Remove(dictPath(key)); err != nil && !os.IsNotExist(err) {
+		utils.Errorln(err)
+	}
+}
+
+// renameDict moves a key's dictionary along with its data file.
+func renameDict(key, newKey string) {
+	keyDicts.Delete(key)
+	keyDicts.Delete(newKey)
+	if err := os.Rename(dictPath(key), dictPath(newKey)); err != nil && !os.IsNotExist(err) {
+		utils.Errorln("Error renaming dictionary:", err)
+	}
+}
+
+// load reads the dictionary file once. Caller must hold d.mu.
+func (d *stringDict) load() error {
+	if d.loaded {
+		return nil
+	}
+	d.ids = make(map[string]uint64)
+	d.values = nil
+	data, err := os.ReadFile(d.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pos := 0
+	for pos+4 <= len(data) {
+		n := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		if n > maxStringValue || pos+4+n > len(data) {
+			break
+		}
+		s := string(data[pos+4 : pos+4+n])
+		d.ids[s] = uint64(len(d.values))
+		d.values = append(d.values, s)
+		pos += 4 + n
+	}
+	if pos < len(data) {
+		utils.Warning("Truncating torn dictionary entry in %s", d.path)
+		if err := os.Truncate(d.path, int64(pos)); err != nil {
+			return err
+		}
+	}
+	d.loaded = true
+	return nil
+}
+
+// intern returns the id of s, appending it to the dictionary if it is new.
+func (d *stringDict) intern(s string) (uint64, error) {
+	if len(s) > maxStringValue {
+		return 0, fmt.Errorf("string value longer than %d bytes", maxStringValue)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.load(); err != nil {
+		return 0, err
+	}
+	if id, ok := d.ids[s]; ok {
+		return id, nil
+	}
+	file, err := os.OpenFile(d.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	entry := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(s)), uint32(len(s)))
+	entry = append(entry, s...)
+	if _, err := file.Write(entry); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	id := uint64(len(d.values))
+	d.ids[s] = id
+	d.values = append(d.values, s)
+	return id, nil
+}
+
+// lookup returns the string with the given id.
+func (d *stringDict) lookup(id uint64) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.load(); err != nil {
+		utils.Error("Error loading dictionary %s: %v", d.path, err)
+		return "", false
+	}
+	if id >= uint64(len(d.values)) {
+		return "", false
+	}
+	return d.values[id], true
+}
+
+// InitKeyType creates a key holding values of type t. Like InitKeyFields it
+// is a no-op when the key already has this type and fails once the key holds
+// data of another layout.
+func InitKeyType(key string, t models.ValueType) error {
+	return InitKeyWithOptions(key, KeyOptions{Type: t})
+}
+
+// KeyType returns the value type of a key (float for keys without a type).
+func KeyType(key string) models.ValueType {
+	return layoutOf(key).valueType
+}
+
+// KeyPrecision returns the unit of a key's timestamps (seconds for keys
+// without a precision).
+func KeyPrecision(key string) models.Precision {
+	return layoutOf(key).precision
+}
+
+// typedPoint converts a numeric write to the key's type: ints must be
+// integral, bools 0 or 1. String keys only accept string values.
+func typedPoint(key string, timestamp int64, t models.ValueType, value float64) (models.DataPoint, error) {
+	switch t {
+	case models.TypeInt:
+		if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+			return models.DataPoint{}, fmt.Errorf("key %s holds integers; %v is not one", key, value)
+		}
+		return models.IntPoint(key, timestamp, t, int64(value)), nil
+	case models.TypeBool:
+		if value != 0 && value != 1 {
+			return models.DataPoint{}, fmt.Errorf("key %s holds booleans; use true, false, 1 or 0", key)
+		}
+		return models.IntPoint(key, timestamp, t, int64(value)), nil
+	case models.TypeString:
+		return models.DataPoint{}, fmt.Errorf("key %s holds strings; write a string value", key)
+	}
+	return models.DataPoint{Key: key, Timestamp: timestamp, Value: value}, nil
+}
+
+// ParseDataPoint builds a point for key from the text of a value: a JSON
+// scalar (5, 2.5, true, "open") or a CSV cell. The text is parsed as the
+// key's type; quoted text is only accepted by string keys.
+func ParseDataPoint(key string, timestamp int64, text string) (models.DataPoint, error) {
+	layout := layoutOf(key)
+	if len(layout.header.Fields) > 0 {
+		return models.DataPoint{}, fmt.Errorf("key %s requires fields [%s]", key, strings.Join(layout.header.Fields, ","))
+	}
+	text = strings.TrimSpace(text)
+	quoted := len(text) >= 2 && text[0] == '"' && text[len(text)-1] == '"'
+	if quoted && layout.valueType != models.TypeString {
+		return models.DataPoint{}, fmt.Errorf("key %s holds %s values; got string %s", key, layout.valueType, text)
+	}
+
+	switch layout.valueType {
+	case models.TypeInt:
+		if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return models.IntPoint(key, timestamp, models.TypeInt, v), nil
+		}
+	case models.TypeBool:
+		switch text {
+		case "true", "1":
+			return models.IntPoint(key, timestamp, models.TypeBool, 1), nil
+		case "false", "0":
+			return models.IntPoint(key, timestamp, models.TypeBool, 0), nil
+		}
+		return models.DataPoint{}, fmt.Errorf("key %s holds booleans; invalid value %s", key, text)
+	case models.TypeString:
+		s := text
+		if quoted {
+			if err := json.Unmarshal([]byte(text), &s); err != nil {
+				return models.DataPoint{}, fmt.Errorf("invalid string value %s", text)
+			}
+		}
+		if len(s) > maxStringValue {
+			return models.DataPoint{}, fmt.Errorf("string value longer than %d bytes", maxStringValue)
+		}
+		return models.StringPoint(key, timestamp, s), nil
+	}
+
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return models.DataPoint{}, fmt.Errorf("invalid value %s for %s key %s", text, layout.valueType, key)
+	}
+	return typedPoint(key, timestamp, layout.valueType, v)
+}
+
+// ValidateAggregation rejects downsampling aggregations that have no meaning
+// for the key's type: string keys support first, last and count only.
+func ValidateAggregation(key, aggregation string) error {
+	if KeyType(key) != models.TypeString {
+		return nil
+	}
+	switch aggregation {
+	case "first", "last", "count":
+		return nil
+	}
+	return fmt.Errorf("string key %s supports first, last and count aggregations", key)
+}
+
+// downsampleTypedPoints downsamples int, bool and string points with the
+// intervals of downsampleDataPoints. first/last/min/max keep the key's type,
+// sum and count are ints, the remaining aggregations are floats. String
+// points support first, last and count (anything else counts).
+func downsampleTypedPoints(dataPoints []models.DataPoint, downsample int, aggregation string) []models.DataPoint {
+	t := dataPoints[0].Type
+	var downsampled []models.DataPoint
+	for _, r := range bucketRanges(dataPoints, downsample) {
+		bucket := dataPoints[r[0]:r[1]]
+		key, ts := bucket[0].Key, bucket[0].Timestamp
+		first, last := bucket[0], bucket[len(bucket)-1]
+
+		var point models.DataPoint
+		switch {
+		case aggregation == "first":
+			point = first
+		case aggregation == "last":
+			point = last
+		case aggregation == "count" || t == models.TypeString:
+			point = models.IntPoint(key, ts, models.TypeInt, int64(len(bucket)))
+		case aggregation == "min" || aggregation == "max":
+			point = first
+			for _, p := range bucket[1:] {
+				if aggregation == "min" && p.Int < point.Int || aggregation == "max" && p.Int > point.Int {
+					point = p
+				}
+			}
+		case aggregation == "sum":
+			var sum int64
+			for _, p := range bucket {
+				sum += p.Int
+			}
+			point = models.IntPoint(key, ts, models.TypeInt, sum)
+		default:
+			values := make([]float64, len(bucket))
+			sum, min, max := 0.0, math.Inf(1), math.Inf(-1)
+			for i, p := range bucket {
+				values[i] = p.Value
+				sum += p.Value
+				min = math.Min(min, p.Value)
+				max = math.Max(max, p.Value)
+			}
+			value := computeAggregate(aggregation, sum, float64(len(values)), min, max, first.Value, last.Value, values)
+			point = models.DataPoint{Key: key, Value: value}
+		}
+		point.Key, point.Timestamp = key, ts
+		downsampled = append(downsampled, point)
+	}
+	return downsampled
+}
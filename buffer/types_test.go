@@ -0,0 +1,282 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"gtsdb/utils"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func parsedPoint(t *testing.T, key string, ts int64, text string) models.DataPoint {
+	t.Helper()
+	dp, err := ParseDataPoint(key, ts, text)
+	if err != nil {
+		t.Fatalf("ParseDataPoint(%s) failed: %v", text, err)
+	}
+	return dp
+}
+
+func TestInitKeyType(t *testing.T) {
+	cleanup()
+	key := "TestInitKeyType"
+	if err := InitKeyType(key, models.TypeInt); err != nil {
+		t.Fatalf("InitKeyType failed: %v", err)
+	}
+	if err := InitKeyType(key, models.TypeInt); err != nil {
+		t.Errorf("Re-initializing with the same type should succeed: %v", err)
+	}
+	if KeyType(key) != models.TypeInt || KeyFields(key) != nil {
+		t.Errorf("KeyType = %v, KeyFields = %v", KeyType(key), KeyFields(key))
+	}
+	StoreDataPointBuffer(parsedPoint(t, key, 1700000000, "5"))
+	if err := InitKeyType(key, models.TypeString); err == nil {
+		t.Error("Expected changing the type of a key with data to fail")
+	}
+	if err := InitKeyFields(key, []string{"a"}); err == nil {
+		t.Error("Expected adding fields to an int key with data to fail")
+	}
+
+	legacy := "TestInitKeyTypeLegacy"
+	StoreDataPointBuffer(models.DataPoint{Key: legacy, Timestamp: 1700000000, Value: 1})
+	if err := InitKeyType(legacy, models.TypeFloat); err != nil {
+		t.Errorf("A float key should accept the float type: %v", err)
+	}
+	if err := InitKeyType(legacy, models.TypeBool); err == nil {
+		t.Error("Expected a float key with data to reject a type")
+	}
+}
+
+func TestParseDataPoint(t *testing.T) {
+	cleanup()
+	for key, typ := range map[string]models.ValueType{"int": models.TypeInt, "bool": models.TypeBool, "string": models.TypeString} {
+		if err := InitKeyType("TestParseDataPoint_"+key, typ); err != nil {
+			t.Fatalf("InitKeyType failed: %v", err)
+		}
+	}
+	tests := []struct {
+		key, text string
+		want      models.DataPoint
+		wantErr   bool
+	}{
+		{key: "int", text: "9007199254740993", want: models.IntPoint("", 0, models.TypeInt, 9007199254740993)},
+		{key: "int", text: "4.0", want: models.IntPoint("", 0, models.TypeInt, 4)},
+		{key: "int", text: "4.5", wantErr: true},
+		{key: "int", text: `"4"`, wantErr: true},
+		{key: "bool", text: "true", want: models.IntPoint("", 0, models.TypeBool, 1)},
+		{key: "bool", text: "0", want: models.IntPoint("", 0, models.TypeBool, 0)},
+		{key: "bool", text: "2", wantErr: true},
+		{key: "string", text: `"OPEN \"A\""`, want: models.StringPoint("", 0, `OPEN "A"`)},
+		{key: "string", text: "FAULT", want: models.StringPoint("", 0, "FAULT")},
+		{key: "float", text: "2.5", want: models.DataPoint{Value: 2.5}},
+		{key: "float", text: "true", wantErr: true},
+	}
+	for _, tt := range tests {
+		key := "TestParseDataPoint_" + tt.key
+		got, err := ParseDataPoint(key, 1700000000, tt.text)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s %s: expected an error, got %+v", tt.key, tt.text, got)
+			}
+			continue
+		}
+		tt.want.Key, tt.want.Timestamp = key, 1700000000
+		if err != nil || got.Type != tt.want.Type || got.Int != tt.want.Int || got.Str != tt.want.Str || (got.Type != models.TypeString && got.Value != tt.want.Value) {
+			t.Errorf("%s %s: got %+v, %v; want %+v", tt.key, tt.text, got, err, tt.want)
+		}
+	}
+
+	if _, err := NewDataPoint("TestParseDataPoint_string", 1700000000, 1, nil); err == nil {
+		t.Error("Expected a numeric write to a string key to fail")
+	}
+	if _, err := NewDataPoint("TestParseDataPoint_bool", 1700000000, 0.5, nil); err == nil {
+		t.Error("Expected 0.5 to be rejected by a bool key")
+	}
+}
+
+func TestTypedStoreAndRead(t *testing.T) {
+	cleanup()
+	originalCacheSize := cacheSize
+	cacheSize = 0
+	defer func() { cacheSize = originalCacheSize }()
+	base := int64(1700000000)
+
+	counter := "TestTypedStoreAndRead_counter"
+	if err := InitKeyType(counter, models.TypeInt); err != nil {
+		t.Fatalf("InitKeyType failed: %v", err)
+	}
+	big := int64(math.MaxInt64 - 10)
+	points := make([]models.DataPoint, 0, 10)
+	for i := int64(0); i < 10; i++ {
+		points = append(points, models.IntPoint(counter, base+i, models.TypeInt, big+i))
+	}
+	StoreDataPointsBuffer(points)
+	got := ReadDataPoints(counter, base, base+9, 0, "")
+	if !reflect.DeepEqual(got, points) {
+		t.Fatalf("Unexpected int points: %+v", got)
+	}
+	if b, _ := got[9].MarshalJSON(); string(b) != `{"key":"TestTypedStoreAndRead_counter","timestamp":1700000009,"value":9223372036854775806}` {
+		t.Errorf("Unexpected JSON: %s", b)
+	}
+	down := ReadDataPoints(counter, base, base+9, 5, "max")
+	if len(down) != 2 || down[0].Type != models.TypeInt || down[0].Int != big+4 || down[1].Int != big+9 {
+		t.Errorf("Unexpected int max: %+v", down)
+	}
+	down = ReadDataPoints(counter, base, base+9, 5, "count")
+	if len(down) != 2 || down[0].Type != models.TypeInt || down[0].Int != 5 {
+		t.Errorf("Unexpected int count: %+v", down)
+	}
+
+	state := "TestTypedStoreAndRead_state"
+	if err := InitKeyType(state, models.TypeString); err != nil {
+		t.Fatalf("InitKeyType failed: %v", err)
+	}
+	values := []string{"OPEN", "CLOSED", "OPEN", "FAULT", "OPEN"}
+	for i, v := range values {
+		StoreDataPointBuffer(models.StringPoint(state, base+int64(i), v))
+	}
+	last := ReadLastDataPoints(state, 2)
+	if len(last) != 2 || last[0].Str != "FAULT" || last[1].Str != "OPEN" {
+		t.Fatalf("Unexpected last strings: %+v", last)
+	}
+	if b, _ := last[0].MarshalJSON(); string(b) != `{"key":"TestTypedStoreAndRead_state","timestamp":1700000003,"value":"FAULT"}` {
+		t.Errorf("Unexpected JSON: %s", b)
+	}
+	// Repeated values share a dictionary entry
+	if data, err := os.ReadFile(utils.DataDir + "/" + state + ".aof.dict"); err != nil || len(data) != 3*4+len("OPENCLOSEDFAULT") {
+		t.Errorf("Unexpected dictionary size: %d, %v", len(data), err)
+	}
+	if err := ValidateAggregation(state, "avg"); err == nil {
+		t.Error("Expected avg on a string key to fail")
+	}
+	down = ReadDataPoints(state, base, base+4, 3, "last")
+	if len(down) != 2 || down[0].Str != "OPEN" || down[1].Str != "OPEN" || down[0].Timestamp != base {
+		t.Errorf("Unexpected string last: %+v", down)
+	}
+
+	// Dictionary and type survive a rename and a reload
+	renamed := state + "_renamed"
+	RenameKey(state, renamed)
+	if !ReloadKey(renamed) {
+		t.Fatal("ReloadKey failed")
+	}
+	got = ReadDataPoints(renamed, base, base+4, 0, "")
+	if len(got) != 5 || got[1].Str != "CLOSED" || KeyType(renamed) != models.TypeString {
+		t.Errorf("Unexpected points after rename: %+v", got)
+	}
+
+	// Out-of-order patch rewrites the file and rebuilds the dictionary
+	PatchDataPoints([]models.DataPoint{models.StringPoint(renamed, base-1, "BOOT")}, renamed)
+	got = ReadDataPoints(renamed, base-1, base+4, 0, "")
+	if len(got) != 6 || got[0].Str != "BOOT" || got[4].Str != "FAULT" {
+		t.Errorf("Unexpected points after patch: %+v", got)
+	}
+
+	DeleteKey(renamed)
+	if _, err := os.Stat(utils.DataDir + "/" + renamed + ".aof.dict"); !os.IsNotExist(err) {
+		t.Error("DeleteKey should remove the dictionary")
+	}
+}
+
+func TestTypedCompression(t *testing.T) {
+	cleanup()
+	base := int64(1700000000)
+	keys := map[models.ValueType]string{
+		models.TypeInt:    "TestTypedCompression_int",
+		models.TypeBool:   "TestTypedCompression_bool",
+		models.TypeString: "TestTypedCompression_string",
+	}
+	names := []string{"idle", "busy", "error"}
+	for typ, key := range keys {
+		if err := InitKeyType(key, typ); err != nil {
+			t.Fatalf("InitKeyType failed: %v", err)
+		}
+		points := make([]models.DataPoint, 0, 7000)
+		for i := int64(0); i < 7000; i++ {
+			switch typ {
+			case models.TypeInt:
+				points = append(points, models.IntPoint(key, base+i*10, typ, 1<<40+i*i))
+			case models.TypeBool:
+				points = append(points, models.IntPoint(key, base+i*10, typ, (i/3)%2))
+			case models.TypeString:
+				points = append(points, models.StringPoint(key, base+i*10, names[i%3]))
+			}
+		}
+		StoreDataPointsBuffer(points)
+
+		utils.CompactionCompression = true
+		err := CompactKey(key)
+		utils.CompactionCompression = false
+		if err != nil {
+			t.Fatalf("CompactKey failed: %v", err)
+		}
+		compressed, err := readCompressedDataPoints(key, base, base+70000)
+		if err != nil {
+			t.Fatalf("readCompressedDataPoints failed: %v", err)
+		}
+		if typ == models.TypeString {
+			// NaN values never compare equal; compare the strings instead
+			for i := range points {
+				points[i].Value, compressed[i].Value = 0, 0
+			}
+		}
+		if !reflect.DeepEqual(compressed, points) {
+			t.Errorf("%s: compressed round trip differs (%d points)", typ, len(compressed))
+		}
+	}
+}
+
+func TestKeyPrecision(t *testing.T) {
+	resetRollups(t)
+	originalCacheSize := cacheSize
+	cacheSize = 0
+	defer func() { cacheSize = originalCacheSize }()
+
+	key := "TestKeyPrecision"
+	opts := KeyOptions{Precision: models.PrecisionMilli}
+	if err := InitKeyWithOptions(key, opts); err != nil {
+		t.Fatalf("InitKeyWithOptions failed: %v", err)
+	}
+	if err := InitKeyWithOptions(key, opts); err != nil {
+		t.Errorf("Re-initializing with the same precision should succeed: %v", err)
+	}
+	base := int64(1700000000000)
+	points := make([]models.DataPoint, 0, 10)
+	for i := int64(0); i < 10; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: base + i*250, Value: float64(i)})
+	}
+	StoreDataPointsBuffer(points)
+	if err := InitKeyWithOptions(key, KeyOptions{}); err == nil {
+		t.Error("Expected changing the precision of a key with data to fail")
+	}
+	if !ReloadKey(key) || KeyPrecision(key) != models.PrecisionMilli {
+		t.Fatalf("Precision lost after reload: %v", KeyPrecision(key))
+	}
+	if got := ReadDataPoints(key, base+250, base+1000, 0, ""); len(got) != 4 || got[0].Value != 1 {
+		t.Errorf("Unexpected range read: %+v", got)
+	}
+	// Downsampling intervals are in milliseconds too
+	down := ReadDataPoints(key, base, base+2250, 1000, "count")
+	if len(down) != 3 || down[0].Value != 4 || down[1].Timestamp != base+1000 || down[2].Value != 2 {
+		t.Errorf("Unexpected downsampled points: %+v", down)
+	}
+
+	// A 2s rollup of an ms key buckets by 2000 and stores ms timestamps
+	rule := RollupRule{Source: key, Interval: 2, Aggregation: "count"}
+	if err := AddRollup(rule); err != nil {
+		t.Fatalf("AddRollup failed: %v", err)
+	}
+	if KeyPrecision(rule.Target()) != models.PrecisionMilli {
+		t.Errorf("Rollup target precision = %v", KeyPrecision(rule.Target()))
+	}
+	stored := ReadDataPoints(rule.Target(), base, base+10000, 0, "")
+	if len(stored) != 1 || stored[0].Timestamp != base || stored[0].Value != 8 {
+		t.Errorf("Unexpected rollup points: %+v", stored)
+	}
+
+	dropped, err := ExpireDataPoints(key, base+1000)
+	if err != nil || dropped != 4 {
+		t.Errorf("ExpireDataPoints = %d, %v", dropped, err)
+	}
+}
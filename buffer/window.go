@@ -0,0 +1,145 @@
+package buffer
+
+import (
+	"fmt"
+	"gtsdb/models"
+	"math"
+	"slices"
+)
+
+// Window is a moving-window transform of the points of a read, applied to
+// what ReadDataPoints returns (downsampled buckets, if any). Each point is
+// replaced by a statistic of the trailing window ending at it: its last
+// Points points, or the points of the last Span timestamp units.
+//
+//   - moving_average: mean of the window.
+//   - ema: exponential moving average with a smoothing factor of
+//     2/(Points+1); over a Span, the factor of each point decays with the
+//     time since the previous one (Span is the time constant).
+//   - moving_median: median of the window.
+//   - moving_stddev: population standard deviation of the window.
+type Window struct {
+	Function string
+	Points   int
+	Span     int64 // in the key's timestamp unit
+}
+
+var windowFunctions = map[string]bool{"moving_average": true, "ema": true, "moving_median": true, "moving_stddev": true}
+
+// ValidateWindow checks that w can be applied to the points of key:
+// numeric keys without fields, and a window of points or of a span.
+func ValidateWindow(key string, w Window) error {
+	if !windowFunctions[w.Function] {
+		return fmt.Errorf("window function must be moving_average, ema, moving_median or moving_stddev")
+	}
+	if (w.Points > 0) == (w.Span > 0) {
+		return fmt.Errorf("window needs either points or seconds")
+	}
+	if w.Points < 0 || w.Span < 0 {
+		return fmt.Errorf("window size must be positive")
+	}
+	if KeyType(key) == models.TypeString || KeyFields(key) != nil {
+		return fmt.Errorf("window %s needs a numeric key without fields", w.Function)
+	}
+	return nil
+}
+
+// windowOperator consumes the points of a series one at a time and returns
+// the value of the window ending at each.
+type windowOperator interface {
+	push(p models.DataPoint) float64
+}
+
+// ApplyWindow returns the series of w over sorted points of one key, as
+// float points at the same timestamps. The zero Window keeps the points.
+func ApplyWindow(points []models.DataPoint, w Window) []models.DataPoint {
+	if w.Function == "" || len(points) == 0 {
+		return points
+	}
+	var op windowOperator
+	switch w.Function {
+	case "ema":
+		op = &emaOperator{alpha: 2 / float64(w.Points+1), span: float64(w.Span)}
+	default:
+		op = &slidingOperator{w: w}
+	}
+	smoothed := make([]models.DataPoint, len(points))
+	for i, p := range points {
+		smoothed[i] = models.DataPoint{Key: p.Key, Timestamp: p.Timestamp, Value: op.push(p)}
+	}
+	return smoothed
+}
+
+// slidingOperator keeps the points of the window, with a running sum for
+// the mean.
+type slidingOperator struct {
+	w      Window
+	window []models.DataPoint
+	sum    float64
+}
+
+func (s *slidingOperator) push(p models.DataPoint) float64 {
+	s.window = append(s.window, p)
+	s.sum += p.Value
+	drop := 0
+	for len(s.window)-drop > 1 && (s.w.Points > 0 && len(s.window)-drop > s.w.Points ||
+		s.w.Span > 0 && s.window[drop].Timestamp <= p.Timestamp-s.w.Span) {
+		s.sum -= s.window[drop].Value
+		drop++
+	}
+	if drop > 0 {
+		s.window = append(s.window[:0], s.window[drop:]...)
+	}
+	n := float64(len(s.window))
+	switch s.w.Function {
+	case "moving_median":
+		values := make([]float64, len(s.window))
+		for i, q := range s.window {
+			values[i] = q.Value
+		}
+		slices.Sort(values)
+		m := len(values) / 2
+		if len(values)%2 == 0 {
+			return (values[m-1] + values[m]) / 2
+		}
+		return values[m]
+	case "moving_stddev":
+		// Two passes over the window: E[x²]-E[x]² cancels catastrophically
+		// for large values with a small spread.
+		mean := 0.0
+		for _, q := range s.window {
+			mean += q.Value
+		}
+		mean /= n
+		variance := 0.0
+		for _, q := range s.window {
+			variance += (q.Value - mean) * (q.Value - mean)
+		}
+		return math.Sqrt(math.Max(0, variance/n))
+	}
+	return s.sum / n
+}
+
+// emaOperator smooths with a fixed factor, or over a span with a factor
+// decaying with the time between points.
+type emaOperator struct {
+	alpha  float64
+	span   float64
+	value  float64
+	lastTs int64
+	primed bool
+}
+
+func (e *emaOperator) push(p models.DataPoint) float64 {
+	if !e.primed {
+		e.value, e.lastTs, e.primed = p.Value, p.Timestamp, true
+		return e.value
+	}
+	alpha := e.alpha
+	if e.span > 0 {
+		alpha = 1 - math.Exp(-float64(p.Timestamp-e.lastTs)/e.span)
+	}
+	e.value += alpha * (p.Value - e.value)
+	e.lastTs = p.Timestamp
+	return e.value
+}
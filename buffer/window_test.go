@@ -0,0 +1,58 @@
+package buffer
+
+import (
+	"gtsdb/models"
+	"math"
+	"testing"
+)
+
+func TestApplyWindow(t *testing.T) {
+	key := "TestApplyWindow"
+	var points []models.DataPoint
+	for i, v := range []float64{2, 4, 9, 3, 7} {
+		points = append(points, models.DataPoint{Key: key, Timestamp: int64(10 * i), Value: v})
+	}
+	for _, tc := range []struct {
+		w    Window
+		want []float64
+	}{
+		{Window{Function: "moving_average", Points: 2}, []float64{2, 3, 6.5, 6, 5}},
+		{Window{Function: "moving_average", Span: 20}, []float64{2, 3, 6.5, 6, 5}},
+		{Window{Function: "moving_median", Points: 3}, []float64{2, 3, 4, 4, 7}},
+		{Window{Function: "moving_stddev", Points: 2}, []float64{0, 1, 2.5, 3, 2}},
+		{Window{Function: "ema", Points: 3}, []float64{2, 3, 6, 4.5, 5.75}},
+	} {
+		got := ApplyWindow(points, tc.w)
+		if len(got) != len(tc.want) {
+			t.Fatalf("%+v: expected %d points, got %d", tc.w, len(tc.want), len(got))
+		}
+		for i, p := range got {
+			if math.Abs(p.Value-tc.want[i]) > 1e-9 || p.Timestamp != points[i].Timestamp {
+				t.Errorf("%+v: point %d is %d=%v, expected %v", tc.w, i, p.Timestamp, p.Value, tc.want[i])
+			}
+		}
+	}
+
+	// Over a span, the factor of a point decays with the time since the
+	// previous one
+	got := ApplyWindow(points[:2], Window{Function: "ema", Span: 10})
+	if want := 2 + 2*(1-math.Exp(-1)); math.Abs(got[1].Value-want) > 1e-9 {
+		t.Errorf("Expected ema %v, got %v", want, got[1].Value)
+	}
+
+	// Large values with a small spread keep their standard deviation
+	var large []models.DataPoint
+	for i, v := range []float64{1e9 + 4, 1e9 + 7, 1e9 + 13, 1e9 + 16} {
+		large = append(large, models.DataPoint{Key: key, Timestamp: int64(i), Value: v})
+	}
+	got = ApplyWindow(large, Window{Function: "moving_stddev", Points: 4})
+	if want := math.Sqrt(22.5); math.Abs(got[3].Value-want) > 1e-6 {
+		t.Errorf("Expected stddev %v, got %v", want, got[3].Value)
+	}
+
+	for _, w := range []Window{{Function: "moving_sum", Points: 3}, {Function: "ema"}, {Function: "ema", Points: 3, Span: 10}} {
+		if err := ValidateWindow(key, w); err == nil {
+			t.Errorf("Expected %+v rejected", w)
+		}
+	}
+}
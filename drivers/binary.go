@@ -0,0 +1,116 @@
+package drivers
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gtsdb/models"
+	"io"
+	"math"
+)
+
+// maxBinaryFrame guards against reading a garbage length as a frame.
+const maxBinaryFrame = 1 << 30
+
+// readBinaryFrame decodes a response_format "binary" reply (see
+// handlers/binary.go):
+//
+//	[uint32 frame length] [uint32 key count]
+//	per key: [uint16 key length] [key] [uint32 point count]
+//	         per point: [int64 timestamp] [float64 value]
+//
+// all big-endian.
+func readBinaryFrame(r *bufio.Reader) (map[string][]models.DataPoint, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size > maxBinaryFrame {
+		return nil, fmt.Errorf("gtsdb: binary frame of %d bytes", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return decodeBinaryFrame(frame)
+}
+
+func decodeBinaryFrame(frame []byte) (map[string][]models.DataPoint, error) {
+	errShort := fmt.Errorf("gtsdb: truncated binary frame")
+	if len(frame) < 4 {
+		return nil, errShort
+	}
+	keys := binary.BigEndian.Uint32(frame)
+	frame = frame[4:]
+	result := make(map[string][]models.DataPoint, min(keys, 1024))
+	for i := uint32(0); i < keys; i++ {
+		if len(frame) < 2 {
+			return nil, errShort
+		}
+		n := int(binary.BigEndian.Uint16(frame))
+		if len(frame) < 2+n+4 {
+			return nil, errShort
+		}
+		key := string(frame[2 : 2+n])
+		count := int(binary.BigEndian.Uint32(frame[2+n:]))
+		frame = frame[2+n+4:]
+		if len(frame)/16 < count {
+			return nil, errShort
+		}
+		points := make([]models.DataPoint, count)
+		for j := range points {
+			points[j] = models.DataPoint{
+				Key:       key,
+				Timestamp: int64(binary.BigEndian.Uint64(frame)),
+				Value:     math.Float64frombits(binary.BigEndian.Uint64(frame[8:])),
+			}
+			frame = frame[16:]
+		}
+		result[key] = points
+	}
+	return result, nil
+}
+
+// maxBinaryWriteFrame is the server's limit on a binary write frame.
+const maxBinaryWriteFrame = 16 << 20
+
+// encodeBinaryWrite encodes points as a binary write frame:
+//
+//	[uint32 frame length] [uint16 key count]
+//	per key: [uint16 key length] [key]
+//	[uint32 point count]
+//	per point: [uint16 key index] [int64 timestamp] [float64 value]
+//
+// all big-endian.
+func encodeBinaryWrite(points []models.DataPoint) ([]byte, error) {
+	index := map[string]int{}
+	var keys []byte
+	for _, p := range points {
+		if _, ok := index[p.Key]; ok {
+			continue
+		}
+		if len(index) == math.MaxUint16 {
+			return nil, errors.New("gtsdb binary-write: too many keys")
+		}
+		index[p.Key] = len(index)
+		keys = binary.BigEndian.AppendUint16(keys, uint16(len(p.Key)))
+		keys = append(keys, p.Key...)
+	}
+	size := 2 + len(keys) + 4 + 18*len(points)
+	if size > maxBinaryWriteFrame {
+		return nil, fmt.Errorf("gtsdb binary-write: frame of %d bytes exceeds %d", size, maxBinaryWriteFrame)
+	}
+	frame := make([]byte, 0, 4+size)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(size))
+	frame = binary.BigEndian.AppendUint16(frame, uint16(len(index)))
+	frame = append(frame, keys...)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(points)))
+	for _, p := range points {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(index[p.Key]))
+		frame = binary.BigEndian.AppendUint64(frame, uint64(p.Timestamp))
+		frame = binary.BigEndian.AppendUint64(frame, math.Float64bits(p.Value))
+	}
+	return frame, nil
+}
@@ -0,0 +1,355 @@
+// Package drivers is the Go client for the GTSDB TCP protocol.
+//
+//	c, err := drivers.New(drivers.Options{Addr: "127.0.0.1:5555", Token: token})
+//	if err != nil { ... }
+//	defer c.Close()
+//	err = c.Write(ctx, "sensor1", 21.5)
+//	points, err := c.Read(ctx, "sensor1", drivers.ReadOptions{LastX: 10})
+//
+// A Client is safe for concurrent use: each request borrows an
+// authenticated connection from a pool (dialing one when none is idle, up
+// to Options.PoolSize at a time) and returns it when the reply has been
+// read. Keys are relative to the token's user, as on the wire. A request
+// is bounded by its context's deadline, or Options.RequestTimeout when it
+// has none; cancelling the context aborts it. A broken connection is
+// dropped and replaced on the next request, and a read that failed on a
+// pooled connection (which the server may have closed while idle) is
+// retried once on a fresh one. Writes are retried only if they were never
+// sent.
+package drivers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gtsdb/models"
+	"net"
+	"time"
+)
+
+// Options configures a Client.
+type Options struct {
+	Addr  string // TCP address of the server, e.g. "127.0.0.1:5555"
+	Token string // user token; empty for a server with no_auth_user
+
+	PoolSize       int           // max open connections (default 4)
+	DialTimeout    time.Duration // default 5s
+	RequestTimeout time.Duration // for contexts without deadline (default 30s)
+
+	// BinaryReads makes Read and MultiRead ask for response_format
+	// "binary", which is faster for large float series but carries only
+	// timestamps and float values: no fields, no typed values.
+	BinaryReads bool
+}
+
+// Error is an operation the server refused.
+type Error struct {
+	Operation string
+	Message   string
+}
+
+func (e *Error) Error() string {
+	return "gtsdb " + e.Operation + ": " + e.Message
+}
+
+// Client is a pooled connection to a server.
+type Client struct {
+	opts  Options
+	slots chan struct{} // one per open or dialing connection
+	idle  chan *conn
+	done  chan struct{}
+}
+
+// New returns a client for opts.Addr. It dials one connection to check the
+// address and token.
+func New(opts Options) (*Client, error) {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 4
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = 30 * time.Second
+	}
+	c := &Client{
+		opts:  opts,
+		slots: make(chan struct{}, opts.PoolSize),
+		idle:  make(chan *conn, opts.PoolSize),
+		done:  make(chan struct{}),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), opts.DialTimeout)
+	defer cancel()
+	cn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.slots <- struct{}{}
+	c.put(cn, true)
+	return c, nil
+}
+
+// Close closes the idle connections; requests in flight close theirs when
+// they finish. The client cannot be used afterwards.
+func (c *Client) Close() error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	close(c.done)
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+var errClosed = errors.New("gtsdb: client closed")
+
+// conn is one authenticated connection.
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// response is a reply line of the server.
+type response struct {
+	Type      string                        `json:"type,omitempty"`
+	More      bool                          `json:"more,omitempty"`
+	Cursor    string                        `json:"cursor,omitempty"`
+	Success   bool                          `json:"success"`
+	Message   string                        `json:"message,omitempty"`
+	Data      json.RawMessage               `json:"data,omitempty"`
+	MultiData map[string][]models.DataPoint `json:"multi_data,omitempty"`
+}
+
+// isPing reports whether r is a keepalive ping rather than a reply.
+func (r *response) isPing() bool {
+	if r.Type != "" {
+		return r.Type == "ping"
+	}
+	return r.Success && r.Message == "ping" && r.Data == nil && r.MultiData == nil
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReaderSize(nc, 64*1024)}
+	if c.opts.Token != "" {
+		var resp response
+		if _, err := c.exchange(ctx, cn, &request{Operation: "auth", Key: c.opts.Token}, &resp, nil); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		if !resp.Success {
+			nc.Close()
+			return nil, &Error{Operation: "auth", Message: resp.Message}
+		}
+	}
+	return cn, nil
+}
+
+// get borrows a connection, dialing one if none is idle. reused reports
+// whether it came from the pool.
+func (c *Client) get(ctx context.Context) (cn *conn, reused bool, err error) {
+	select {
+	case <-c.done:
+		return nil, false, errClosed
+	case cn := <-c.idle:
+		return cn, true, nil
+	default:
+	}
+	select {
+	case <-c.done:
+		return nil, false, errClosed
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	case cn := <-c.idle:
+		return cn, true, nil
+	case c.slots <- struct{}{}:
+	}
+	if cn, err = c.dial(ctx); err != nil {
+		<-c.slots
+		return nil, false, err
+	}
+	return cn, false, nil
+}
+
+// put returns a connection to the pool, or closes it when it is broken.
+func (c *Client) put(cn *conn, ok bool) {
+	if ok {
+		select {
+		case <-c.done:
+		default:
+			select {
+			case c.idle <- cn:
+				return
+			default:
+			}
+		}
+	}
+	cn.Close()
+	<-c.slots
+}
+
+// do sends req and decodes the reply into resp, or into points when the
+// reply is a binary frame. Connection failures are retried once on a fresh
+// connection when the failed one came from the pool and req is idempotent
+// or was never sent.
+func (c *Client) do(ctx context.Context, req *request, resp *response, points *map[string][]models.DataPoint) error {
+	for attempt := 0; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cn, reused, err := c.get(ctx)
+		if err != nil {
+			return err
+		}
+		sent, err := c.exchange(ctx, cn, req, resp, points)
+		c.put(cn, err == nil)
+		if err == nil {
+			if !resp.Success {
+				return &Error{Operation: req.Operation, Message: resp.Message}
+			}
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt > 0 || !reused || (sent && !idempotent[req.Operation]) {
+			return err
+		}
+	}
+}
+
+// idempotent operations can be repeated after a failure whose outcome is
+// unknown.
+var idempotent = map[string]bool{
+	"read": true, "multi-read": true, "export": true, "ids": true, "expression": true, "query": true,
+	"idswithcount": true, "idswithcount-own": true, "serverinfo": true,
+	"getretention": true, "getlabels": true, "listrollups": true,
+	"syncstatus": true, "flush": true, "setlabels": true, "setretention": true,
+	"setquota": true, "setuserretention": true, "initkey": true,
+}
+
+// exchange writes req on cn and reads the reply, skipping pings. sent
+// reports whether the request was written.
+func (c *Client) exchange(ctx context.Context, cn *conn, req *request, resp *response, points *map[string][]models.DataPoint) (sent bool, err error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+	data = append(data, '\n')
+	if req.frame != nil {
+		// The frame and the end of binary mode follow the request line
+		data = append(append(data, req.frame...), 0, 0, 0, 0)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.opts.RequestTimeout)
+	}
+	cn.SetDeadline(deadline)
+	// Cancelling ctx expires the deadline, which aborts the I/O below.
+	stop := context.AfterFunc(ctx, func() { cn.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		// Once fired, the deadline may be expired at any time: cn is
+		// unusable.
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if _, err := cn.Write(data); err != nil {
+		return false, err
+	}
+	if err := cn.readReply(resp, points); err != nil {
+		return true, err
+	}
+	if req.frame != nil {
+		return true, cn.readFrameReplies(resp)
+	}
+	return true, nil
+}
+
+// readReply reads the reply to a request, skipping pings.
+func (cn *conn) readReply(resp *response, points *map[string][]models.DataPoint) error {
+	for {
+		if points != nil {
+			// A binary frame starts with its length; JSON lines with '{'.
+			b, err := cn.r.Peek(1)
+			if err != nil {
+				return err
+			}
+			if b[0] != '{' {
+				*points, err = readBinaryFrame(cn.r)
+				*resp = response{Success: true}
+				return err
+			}
+		}
+		line, err := cn.r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		*resp = response{}
+		if err := json.Unmarshal(line, resp); err != nil {
+			return fmt.Errorf("gtsdb: invalid reply: %w", err)
+		}
+		if !resp.isPing() {
+			return nil
+		}
+	}
+}
+
+// readFrameReplies reads the replies to a binary write frame and to the end
+// of binary mode, after resp, the reply to the switch to binary mode. resp
+// is set to the frame's reply.
+func (cn *conn) readFrameReplies(resp *response) error {
+	if !resp.Success {
+		// The server took the frame for JSON lines: cn is out of step
+		return &Error{Operation: "binary-write", Message: resp.Message}
+	}
+	if err := cn.readReply(resp, nil); err != nil {
+		return err
+	}
+	var end response
+	if err := cn.readReply(&end, nil); err != nil {
+		return err
+	}
+	if !end.Success {
+		return &Error{Operation: "binary-write", Message: end.Message}
+	}
+	return nil
+}
+
+// call runs req and decodes the reply's data into v (if not nil).
+func (c *Client) call(ctx context.Context, req *request, v any) error {
+	var resp response
+	if err := c.do(ctx, req, &resp, nil); err != nil {
+		return err
+	}
+	if v == nil || resp.Data == nil {
+		return nil
+	}
+	if err := json.Unmarshal(resp.Data, v); err != nil {
+		return fmt.Errorf("gtsdb %s: invalid data: %w", req.Operation, err)
+	}
+	return nil
+}
+
+// message runs req and returns the reply's message.
+func (c *Client) message(ctx context.Context, req *request) (string, error) {
+	var resp response
+	if err := c.do(ctx, req, &resp, nil); err != nil {
+		return "", err
+	}
+	return resp.Message, nil
+}
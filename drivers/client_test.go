@@ -0,0 +1,556 @@
+package drivers
+
+import (
+	"context"
+	"errors"
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/fanout"
+	"gtsdb/handlers"
+	"gtsdb/labels"
+	"gtsdb/models"
+	"gtsdb/retention"
+	"gtsdb/utils"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer serves the TCP protocol on a loopback port from a temp data
+// directory.
+type testServer struct {
+	addr  string
+	token string // root's
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	dir := t.TempDir()
+	utils.DataDir = dir
+	buffer.InitFileHandles()
+	buffer.InitIDSet()
+	auth.Init(dir)
+	retention.Init(dir)
+	labels.Init(dir)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := auth.GetUser("root")
+	s := &testServer{addr: ln.Addr().String(), token: root.Token}
+	fanoutManager := fanout.NewFanout()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go handlers.HandleTcpConnection(conn, fanoutManager, "")
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		s.dropConnections()
+		buffer.CloseAllHandles()
+		labels.Init("")
+	})
+	return s
+}
+
+// dropConnections hangs up on every client, as a server restart would.
+func (s *testServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func newClient(t *testing.T, s *testServer, opts Options) *Client {
+	t.Helper()
+	opts.Addr = s.addr
+	if opts.Token == "" {
+		opts.Token = s.token
+	}
+	c, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestWriteAndRead(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	for _, binary := range []bool{false, true} {
+		c := newClient(t, s, Options{BinaryReads: binary})
+		key := "temp"
+		if binary {
+			key = "temp_bin"
+		}
+		for i := range 5 {
+			if err := c.WritePoint(ctx, models.DataPoint{Key: key, Timestamp: 1700000000 + int64(i), Value: float64(i) + 0.5}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		points, err := c.Read(ctx, key, ReadOptions{Start: 1700000000, End: 1700000010})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 5 || points[0].Key != key || points[4].Timestamp != 1700000004 || points[4].Value != 4.5 {
+			t.Errorf("binary=%v: unexpected points %v", binary, points)
+		}
+		last, err := c.Read(ctx, key, ReadOptions{})
+		if err != nil || len(last) != 1 || last[0].Value != 4.5 {
+			t.Errorf("binary=%v: expected the last point, got %v, %v", binary, last, err)
+		}
+	}
+}
+
+func TestBatchWriteAndMultiRead(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{})
+	var batch []models.DataPoint
+	for i := range 10 {
+		batch = append(batch,
+			models.DataPoint{Key: "a", Timestamp: 1700000000 + int64(i), Value: float64(i)},
+			models.DataPoint{Key: "b", Timestamp: 1700000000 + int64(i), Value: float64(-i)})
+	}
+	if err := c.BatchWrite(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetLabels(ctx, "a", map[string]string{"site": "hk"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, binary := range []bool{false, true} {
+		c := newClient(t, s, Options{BinaryReads: binary})
+		multi, err := c.MultiRead(ctx, []string{"a", "b"}, ReadOptions{Start: 1700000000, End: 1700000009, Downsample: 5, Aggregation: "sum"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(multi["a"]) != 2 || multi["a"][0].Value != 10 || multi["b"][1].Value != -35 {
+			t.Errorf("binary=%v: unexpected multi-read %v", binary, multi)
+		}
+		multi, err = c.MultiReadSelector(ctx, "site=hk", ReadOptions{LastX: 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(multi) != 1 || len(multi["a"]) != 3 {
+			t.Errorf("binary=%v: unexpected selector read %v", binary, multi)
+		}
+	}
+
+	ids, err := c.IDs(ctx, "")
+	if err != nil || len(ids) != 2 {
+		t.Errorf("Expected 2 ids, got %v, %v", ids, err)
+	}
+	counts, err := c.IDsWithCount(ctx)
+	if err != nil || len(counts) != 2 || counts[0].Count != 10 {
+		t.Errorf("Expected 2 keys of 10 points, got %v, %v", counts, err)
+	}
+	csv, err := c.Export(ctx, "a", ExportOptions{LastX: 2})
+	if err != nil || !strings.Contains(csv, "1700000009") {
+		t.Errorf("Unexpected export %q, %v", csv, err)
+	}
+}
+
+func TestBatchWriteBinary(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{})
+	var batch []models.DataPoint
+	for i := range 100 {
+		batch = append(batch,
+			models.DataPoint{Key: "bin_x", Timestamp: 1700000000 + int64(i), Value: float64(i)},
+			models.DataPoint{Key: "bin_y", Timestamp: 1700000000 + int64(i), Value: -float64(i)})
+	}
+	if err := c.BatchWriteBinary(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	points, err := c.Read(ctx, "bin_y", ReadOptions{Start: 1700000000, End: 1700000099})
+	if err != nil || len(points) != 100 || points[99].Value != -99 {
+		t.Errorf("Expected 100 points of bin_y, got %d, %v", len(points), err)
+	}
+
+	// A rejected frame leaves the connection usable
+	var e *Error
+	if err := c.BatchWriteBinary(ctx, []models.DataPoint{{Key: "../bad", Value: 1}}); !errors.As(err, &e) || !strings.Contains(e.Message, "Invalid key") {
+		t.Errorf("Expected an invalid key error, got %v", err)
+	}
+	if err := c.Write(ctx, "bin_x", 1); err != nil {
+		t.Errorf("Expected the connection to be back in JSON mode, got %v", err)
+	}
+}
+
+func TestTypedKeysAndPatch(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{})
+	if err := c.InitKey(ctx, "state", KeyOptions{Type: "string"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WritePoint(ctx, models.StringPoint("state", 1700000000, "OPEN")); err != nil {
+		t.Fatal(err)
+	}
+	points, err := c.Read(ctx, "state", ReadOptions{})
+	if err != nil || len(points) != 1 || points[0].Type != models.TypeString || points[0].Str != "OPEN" {
+		t.Errorf("Expected the string point, got %v, %v", points, err)
+	}
+
+	if err := c.InitKey(ctx, "env", KeyOptions{Fields: []string{"temp", "hum"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WritePoint(ctx, models.DataPoint{Key: "env", Timestamp: 1700000000, Fields: map[string]float64{"temp": 21.5, "hum": 40}}); err != nil {
+		t.Fatal(err)
+	}
+	points, err = c.Read(ctx, "env", ReadOptions{Fields: []string{"hum"}})
+	if err != nil || len(points) != 1 || points[0].Fields["hum"] != 40 {
+		t.Errorf("Expected the hum field, got %v, %v", points, err)
+	}
+
+	if err := c.Patch(ctx, "p", []models.DataPoint{{Timestamp: 1700000002, Value: 2}, {Timestamp: 1700000001, Value: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.PatchCSV(ctx, "p", "1700000003,3\n1700000004,4"); err != nil {
+		t.Fatal(err)
+	}
+	three := 2.5
+	n, err := c.DeletePoints(ctx, "p", DeleteOptions{Operator: ">", Value: &three})
+	if err != nil || n != 2 {
+		t.Errorf("Expected 2 points removed, got %d, %v", n, err)
+	}
+	points, err = c.Read(ctx, "p", ReadOptions{Start: 1700000000, End: 1700000010})
+	if err != nil || len(points) != 2 || points[0].Value != 1 {
+		t.Errorf("Expected the 2 patched points left, got %v, %v", points, err)
+	}
+
+	if err := c.RenameKey(ctx, "p", "q"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DeleteKey(ctx, "q"); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := c.IDs(ctx, "")
+	if strings.Contains(strings.Join(ids, ","), "q") {
+		t.Errorf("Expected q deleted, got %v", ids)
+	}
+}
+
+func TestErrorsAndAdmin(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	if _, err := New(Options{Addr: s.addr, Token: "wrong"}); err == nil || !strings.Contains(err.Error(), "Invalid token") {
+		t.Errorf("Expected an auth error, got %v", err)
+	}
+
+	root := newClient(t, s, Options{})
+	var e *Error
+	if err := root.SetRetention(ctx, "x", "bogus"); !errors.As(err, &e) || e.Operation != "setretention" {
+		t.Errorf("Expected a setretention error, got %v", err)
+	}
+
+	u, err := root.AddUser(ctx, "alice", 100)
+	if err != nil || u.Name != "alice" || u.Token == "" || u.MaxPoints != 100 {
+		t.Fatalf("Unexpected user %+v, %v", u, err)
+	}
+	alice := newClient(t, s, Options{Token: u.Token})
+	if _, err := alice.AddUser(ctx, "bob", 0); err == nil {
+		t.Error("Expected adduser to be refused for alice")
+	}
+	if err := alice.Write(ctx, "temp", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetRetention(ctx, "temp", "7d"); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := alice.GetRetention(ctx, "temp"); err != nil || r.Key != 7*86400 {
+		t.Errorf("Expected a 7d retention, got %+v, %v", r, err)
+	}
+	if ids, _ := root.IDs(ctx, ""); len(ids) != 0 {
+		t.Errorf("Expected root to see none of alice's keys, got %v", ids)
+	}
+
+	if err := root.SetQuota(ctx, "alice", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.Write(ctx, "temp", 2); err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Errorf("Expected a quota error, got %v", err)
+	}
+	token, err := root.ResetToken(ctx, "alice")
+	if err != nil || token == u.Token {
+		t.Errorf("Expected a new token, got %q, %v", token, err)
+	}
+	if err := root.AddRollup(ctx, "cpu", "1m", "avg"); err != nil {
+		t.Fatal(err)
+	}
+	if rollups, err := root.ListRollups(ctx, "cpu"); err != nil || len(rollups) != 1 || rollups[0].Interval != 60 {
+		t.Errorf("Expected the rollup, got %v, %v", rollups, err)
+	}
+	if info, err := root.ServerInfo(ctx); err != nil || info["version"] == nil {
+		t.Errorf("Unexpected serverinfo %v, %v", info, err)
+	}
+}
+
+func TestContextAndReconnect(t *testing.T) {
+	s := startServer(t)
+	c := newClient(t, s, Options{PoolSize: 2})
+	ctx := context.Background()
+	if err := c.Write(ctx, "load", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Read(cancelled, "load", ReadOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// Pooled connections die with the server; the next read retries
+	s.dropConnections()
+	if points, err := c.Read(ctx, "load", ReadOptions{}); err != nil || len(points) != 1 {
+		t.Errorf("Expected the read to reconnect, got %v, %v", points, err)
+	}
+
+	// A request is bounded by its deadline
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn) // never answers
+		}
+	}()
+	silent, err := New(Options{Addr: ln.Addr().String(), RequestTimeout: 100 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	start := time.Now()
+	if err := silent.Flush(ctx); err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected a timeout, got %v after %v", err, time.Since(start))
+	}
+
+	c.Close()
+	if err := c.Write(ctx, "load", 2); !errors.Is(err, errClosed) {
+		t.Errorf("Expected errClosed, got %v", err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{})
+	if err := c.WritePoint(ctx, models.DataPoint{Key: "door", Timestamp: 1700000000, Value: 1}); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := c.Subscribe(ctx, []string{"door", "window"}, 1700000000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	next := func() models.DataPoint {
+		t.Helper()
+		select {
+		case p := <-sub.C:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for a point")
+			return models.DataPoint{}
+		}
+	}
+	if p := next(); p.Key != "door" || p.Timestamp != 1700000000 {
+		t.Errorf("Expected the historical point, got %v", p)
+	}
+	if err := c.WritePoint(ctx, models.DataPoint{Key: "window", Timestamp: 1700000001, Value: 40}); err != nil {
+		t.Fatal(err)
+	}
+	if p := next(); p.Key != "window" || p.Value != 40 {
+		t.Errorf("Expected the live point, got %v", p)
+	}
+
+	// After a disconnect the subscription resumes and replays what it missed
+	s.dropConnections()
+	c = newClient(t, s, Options{})
+	if err := c.WritePoint(ctx, models.DataPoint{Key: "door", Timestamp: 1700000002, Value: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if p := next(); p.Key != "door" || p.Timestamp != 1700000002 {
+		t.Errorf("Expected the missed point, got %v", p)
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("Expected C to be closed")
+	}
+}
+
+func TestReadEachAndPages(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{})
+	var batch []models.DataPoint
+	for i := range 2500 {
+		batch = append(batch, models.DataPoint{Key: "streamed", Timestamp: 1700000000 + int64(i), Value: float64(i)})
+	}
+	if err := c.BatchWrite(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks, total int
+	err := c.ReadEach(ctx, "streamed", ReadOptions{Start: 1700000000, End: 1700002499}, func(points []models.DataPoint) error {
+		if points[0].Value != float64(total) {
+			t.Errorf("Chunk %d starts at %v, expected %d", chunks, points[0].Value, total)
+		}
+		chunks++
+		total += len(points)
+		return nil
+	})
+	if err != nil || chunks != 3 || total != 2500 {
+		t.Errorf("Expected 2500 points in 3 chunks, got %d in %d, %v", total, chunks, err)
+	}
+
+	var pages int
+	opts := ReadOptions{Start: 1700000000, End: 1700002499, Limit: 1000, Order: "desc"}
+	for {
+		points, cursor, err := c.ReadPage(ctx, "streamed", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := float64(2499 - 1000*pages); points[0].Value != want {
+			t.Errorf("Page %d starts at %v, expected %v", pages, points[0].Value, want)
+		}
+		pages++
+		if cursor == "" {
+			break
+		}
+		opts.Cursor = cursor
+	}
+	if pages != 3 {
+		t.Errorf("Expected 3 pages, got %d", pages)
+	}
+
+	errStop := errors.New("stop")
+	err = c.ReadEach(ctx, "streamed", ReadOptions{Start: 1700000000, End: 1700002499}, func([]models.DataPoint) error { return errStop })
+	if err != errStop {
+		t.Errorf("Expected the callback's error, got %v", err)
+	}
+	// The aborted stream's connection was dropped, not reused
+	if points, err := c.Read(ctx, "streamed", ReadOptions{LastX: 1}); err != nil || len(points) != 1 || points[0].Value != 2499 {
+		t.Errorf("Unexpected read after abort: %v, %v", points, err)
+	}
+}
+
+func TestExpression(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{})
+	var batch []models.DataPoint
+	for i := range 4 {
+		ts := 1700000000 + 10*int64(i)
+		batch = append(batch, models.DataPoint{Key: "voltage", Timestamp: ts, Value: 230})
+		if i != 1 {
+			ts++
+		}
+		batch = append(batch, models.DataPoint{Key: "current", Timestamp: ts, Value: float64(i + 1)})
+	}
+	if err := c.BatchWrite(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	vars := map[string]string{"v": "voltage", "i": "current"}
+
+	// Exact join: only 1700000010 has both
+	points, err := c.Expression(ctx, "v * i", vars, ReadOptions{Start: 1700000000, End: 1700000040})
+	if err != nil || len(points) != 1 || points[0].Timestamp != 1700000010 || points[0].Value != 460 {
+		t.Errorf("Unexpected exact join: %v, %v", points, err)
+	}
+	// Joined by 20-second bucket
+	points, err = c.Expression(ctx, "v * i", vars, ReadOptions{Start: 1700000000, End: 1700000039, Downsample: 20, Aggregation: "max"})
+	if err != nil || len(points) != 2 || points[0].Value != 460 || points[1].Value != 920 {
+		t.Errorf("Unexpected bucketed join: %v, %v", points, err)
+	}
+	if _, err := c.Expression(ctx, "v * w", vars, ReadOptions{Start: 1700000000, End: 1700000040}); err == nil {
+		t.Error("Expected an unknown variable rejected")
+	}
+}
+
+func TestQuery(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{BinaryReads: true})
+	var batch []models.DataPoint
+	for i := range 6 {
+		ts := 1700000000 + 60*int64(i)
+		batch = append(batch,
+			models.DataPoint{Key: "room1", Timestamp: ts, Value: float64(i)},
+			models.DataPoint{Key: "room2", Timestamp: ts, Value: float64(10 + i)},
+			models.DataPoint{Key: "hall", Timestamp: ts, Value: 1})
+	}
+	if err := c.BatchWrite(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := c.Query(ctx, `SELECT max(value) FROM "room*" WHERE time >= 1700000000 GROUP BY time(3m)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || len(result["room2"]) != 3 || result["room2"][0].Value != 11 {
+		t.Errorf("Unexpected result %+v", result)
+	}
+	if _, err := c.Query(ctx, `SELECT value FROM`); err == nil {
+		t.Error("Expected an incomplete query rejected")
+	}
+}
+
+func TestGroupRead(t *testing.T) {
+	s := startServer(t)
+	ctx := context.Background()
+	c := newClient(t, s, Options{BinaryReads: true})
+	var batch []models.DataPoint
+	for i := range 6 {
+		ts := 1699999920 + 60*int64(i)
+		batch = append(batch,
+			models.DataPoint{Key: "floor1/temp", Timestamp: ts, Value: 20},
+			models.DataPoint{Key: "floor2/temp", Timestamp: ts, Value: 24},
+			models.DataPoint{Key: "floor3/hum", Timestamp: ts, Value: 50})
+	}
+	if err := c.BatchWrite(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := ReadOptions{Start: 1699999920, End: 1700000279, Downsample: 180, GroupAggregation: "avg"}
+	points, err := c.GroupRead(ctx, nil, "floor*/temp", opts)
+	if err != nil || len(points) != 2 || points[0].Value != 22 || points[1].Timestamp != 1700000100 {
+		t.Errorf("Unexpected pattern group: %v, %v", points, err)
+	}
+	opts.GroupAggregation = "max"
+	points, err = c.GroupRead(ctx, []string{"floor1/temp", "floor3/hum"}, "", opts)
+	if err != nil || len(points) != 2 || points[0].Value != 50 {
+		t.Errorf("Unexpected keys group: %v, %v", points, err)
+	}
+	if result, err := c.MultiReadPattern(ctx, "floor*/temp", ReadOptions{LastX: 1}); err != nil || len(result) != 2 {
+		t.Errorf("Unexpected pattern read: %v, %v", result, err)
+	}
+	opts.Downsample = 0
+	if _, err := c.GroupRead(ctx, nil, "floor*/temp", opts); err == nil {
+		t.Error("Expected a group read without downsampling rejected")
+	}
+}
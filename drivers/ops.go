@@ -0,0 +1,451 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gtsdb/models"
+)
+
+// request is an operation line, mirroring handlers.Operation.
+type request struct {
+	Operation      string             `json:"operation"`
+	Key            string             `json:"key,omitempty"`
+	ToKey          string             `json:"tokey,omitempty"`
+	Keys           []string           `json:"keys,omitempty"`
+	Write          *models.DataPoint  `json:"write,omitempty"` // its key is ignored
+	Read           *ReadOptions       `json:"read,omitempty"`
+	Export         *ExportOptions     `json:"export,omitempty"`
+	Payload        *DeleteOptions     `json:"payload,omitempty"`
+	Data           string             `json:"data,omitempty"`
+	Points         []models.DataPoint `json:"points,omitempty"`
+	Since          int64              `json:"since,omitempty"`
+	ResponseFormat string             `json:"response_format,omitempty"`
+	Stream         bool               `json:"stream,omitempty"`
+	MaxPoints      int64              `json:"max_points,omitempty"`
+	Retention      string             `json:"retention,omitempty"`
+	Rollup         *rollupRequest     `json:"rollup,omitempty"`
+	Labels         map[string]string  `json:"labels,omitempty"`
+	Selector       string             `json:"selector,omitempty"`
+	Fields         []string           `json:"fields,omitempty"`
+	Type           string             `json:"type,omitempty"`
+	Precision      string             `json:"precision,omitempty"`
+	Path           string             `json:"path,omitempty"`
+	Expression     string             `json:"expression,omitempty"`
+	Vars           map[string]string  `json:"vars,omitempty"`
+	Query          string             `json:"query,omitempty"`
+	Pattern        string             `json:"pattern,omitempty"`
+
+	frame []byte // binary-write: the frame sent after the request line
+}
+
+// ReadOptions select the points of a read. Without Start/End or LastX the
+// server returns the last point.
+type ReadOptions struct {
+	Start            int64    `json:"start_timestamp,omitempty"`
+	End              int64    `json:"end_timestamp,omitempty"`
+	Downsample       int      `json:"downsampling,omitempty"` // bucket width, in the key's timestamp unit
+	LastX            int      `json:"lastx,omitempty"`
+	Aggregation      string   `json:"aggregation,omitempty"`       // avg (default), sum, min, max, first, last, count, p50, ...
+	Fields           []string `json:"fields,omitempty"`            // multi-field keys: fields to return
+	Limit            int      `json:"limit,omitempty"`             // Start/End: max points per page (see ReadPage)
+	Order            string   `json:"order,omitempty"`             // "asc" (default) or "desc"
+	Cursor           string   `json:"cursor,omitempty"`            // ReadPage: the cursor of the previous page
+	Align            string   `json:"align,omitempty"`             // buckets: "epoch", minute, hour, day, week or month
+	Timezone         string   `json:"timezone,omitempty"`          // IANA zone of calendar buckets (default UTC)
+	Fill             string   `json:"fill,omitempty"`              // empty buckets: "null", "previous", "linear" or a number
+	Function         string   `json:"function,omitempty"`          // rate, irate, derivative, delta, integral or cumulative_sum
+	Window           *Window  `json:"window,omitempty"`            // moving-window transform
+	GroupAggregation string   `json:"group_aggregation,omitempty"` // GroupRead: avg, sum, min, max, count, median, p50, p95 or p99
+}
+
+// ExportOptions select the points of an export.
+type ExportOptions struct {
+	Format      string   `json:"format,omitempty"` // "csv" (default) or "json"
+	Start       int64    `json:"start_timestamp,omitempty"`
+	End         int64    `json:"end_timestamp,omitempty"`
+	Downsample  int      `json:"downsampling,omitempty"`
+	LastX       int      `json:"lastx,omitempty"`
+	Aggregation string   `json:"aggregation,omitempty"`
+	Fields      []string `json:"fields,omitempty"`
+	Align       string   `json:"align,omitempty"`
+	Timezone    string   `json:"timezone,omitempty"`
+	Window      *Window  `json:"window,omitempty"`
+}
+
+// Window is a moving-window transform of a read or export: Function
+// (moving_average, ema, moving_median or moving_stddev) over the last Points
+// points or Seconds seconds.
+type Window struct {
+	Function string  `json:"function"`
+	Points   int     `json:"points,omitempty"`
+	Seconds  float64 `json:"seconds,omitempty"`
+}
+
+// DeleteOptions select the points DeletePoints removes: those above
+// (Operator ">") or below ("<") Value, within [From, To] when both are set.
+type DeleteOptions struct {
+	Operator string   `json:"operator,omitempty"`
+	Value    *float64 `json:"value,omitempty"`
+	From     int64    `json:"timestampFrom,omitempty"`
+	To       int64    `json:"timestampTo,omitempty"`
+}
+
+// KeyOptions give a new key a layout other than float values in seconds.
+type KeyOptions struct {
+	Fields    []string // multi-field key with these float fields
+	Type      string   // "float" (default), "int", "bool" or "string"
+	Precision string   // "s" (default), "ms", "us" or "ns"
+}
+
+type rollupRequest struct {
+	Interval    string `json:"interval"`
+	Aggregation string `json:"aggregation"`
+}
+
+// Rollup is a continuous aggregate of a key.
+type Rollup struct {
+	Key         string `json:"key"`      // key holding the rollup
+	Interval    int64  `json:"interval"` // seconds
+	Aggregation string `json:"aggregation"`
+}
+
+// Retention is a key's retention in seconds.
+type Retention struct {
+	Key       int64 `json:"key_retention"`       // the key's override (0 = inherit, <0 = forever)
+	Effective int64 `json:"effective_retention"` // what applies (<=0 = forever)
+}
+
+// User is an account returned by AddUser.
+type User struct {
+	Name      string `json:"name"`
+	Token     string `json:"token"`
+	MaxPoints int64  `json:"max_points,omitempty"`
+	Retention int64  `json:"retention,omitempty"`
+}
+
+// Write stores value at the current time.
+func (c *Client) Write(ctx context.Context, key string, value float64) error {
+	return c.WritePoint(ctx, models.DataPoint{Key: key, Value: value})
+}
+
+// WritePoint stores one point; a zero timestamp means now. Typed and
+// multi-field points are sent with their value type and fields.
+func (c *Client) WritePoint(ctx context.Context, p models.DataPoint) error {
+	return c.call(ctx, &request{Operation: "write", Key: p.Key, Write: &p}, nil)
+}
+
+// BatchWrite stores points of any keys at once (at most 10,000).
+func (c *Client) BatchWrite(ctx context.Context, points []models.DataPoint) error {
+	return c.call(ctx, &request{Operation: "batch-write", Points: points}, nil)
+}
+
+// BatchWriteBinary is BatchWrite through a binary write frame, which the
+// server stores without parsing JSON. Only the timestamps and float values
+// of the points are sent: typed keys convert the values, multi-field keys
+// refuse them.
+func (c *Client) BatchWriteBinary(ctx context.Context, points []models.DataPoint) error {
+	frame, err := encodeBinaryWrite(points)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, &request{Operation: "binary-write", frame: frame}, nil)
+}
+
+// Read returns points of key.
+func (c *Client) Read(ctx context.Context, key string, opts ReadOptions) ([]models.DataPoint, error) {
+	req := &request{Operation: "read", Key: key, Read: &opts}
+	if c.opts.BinaryReads {
+		req.ResponseFormat = "binary"
+		var resp response
+		var multi map[string][]models.DataPoint
+		if err := c.do(ctx, req, &resp, &multi); err != nil {
+			return nil, err
+		}
+		if multi == nil {
+			return decodePoints(req.Operation, resp.Data)
+		}
+		if points := multi[key]; points != nil {
+			return points, nil
+		}
+		return []models.DataPoint{}, nil
+	}
+	var resp response
+	if err := c.do(ctx, req, &resp, nil); err != nil {
+		return nil, err
+	}
+	return decodePoints(req.Operation, resp.Data)
+}
+
+// ReadPage reads a page of at most opts.Limit points of the range
+// opts.Start..opts.End. cursor is empty on the last page; otherwise it is
+// set as opts.Cursor to read the next one. Pages are read as JSON, even
+// with Options.BinaryReads.
+func (c *Client) ReadPage(ctx context.Context, key string, opts ReadOptions) (points []models.DataPoint, cursor string, err error) {
+	var resp response
+	if err := c.do(ctx, &request{Operation: "read", Key: key, Read: &opts}, &resp, nil); err != nil {
+		return nil, "", err
+	}
+	points, err = decodePoints("read", resp.Data)
+	return points, resp.Cursor, err
+}
+
+func decodePoints(op string, data json.RawMessage) ([]models.DataPoint, error) {
+	points := []models.DataPoint{}
+	if data == nil {
+		return points, nil
+	}
+	if err := json.Unmarshal(data, &points); err != nil {
+		return nil, fmt.Errorf("gtsdb %s: invalid data: %w", op, err)
+	}
+	return points, nil
+}
+
+// MultiRead returns the points of several keys by key.
+func (c *Client) MultiRead(ctx context.Context, keys []string, opts ReadOptions) (map[string][]models.DataPoint, error) {
+	return c.multiRead(ctx, &request{Operation: "multi-read", Keys: keys, Read: &opts})
+}
+
+// MultiReadSelector returns the points of the keys whose labels match
+// selector (e.g. `site=hk,type=~"temp|hum"`).
+func (c *Client) MultiReadSelector(ctx context.Context, selector string, opts ReadOptions) (map[string][]models.DataPoint, error) {
+	return c.multiRead(ctx, &request{Operation: "multi-read", Selector: selector, Read: &opts})
+}
+
+// MultiReadPattern returns the points of the keys matching the glob pattern
+// (e.g. "building3/*") by key.
+func (c *Client) MultiReadPattern(ctx context.Context, pattern string, opts ReadOptions) (map[string][]models.DataPoint, error) {
+	return c.multiRead(ctx, &request{Operation: "multi-read", Pattern: pattern, Read: &opts})
+}
+
+// GroupRead reduces keys, or the keys matching pattern when keys is empty,
+// to one series: per bucket, opts.GroupAggregation of the keys' values.
+// opts must set Start, End and Downsample.
+func (c *Client) GroupRead(ctx context.Context, keys []string, pattern string, opts ReadOptions) ([]models.DataPoint, error) {
+	var resp response
+	if err := c.do(ctx, &request{Operation: "multi-read", Keys: keys, Pattern: pattern, Read: &opts}, &resp, nil); err != nil {
+		return nil, err
+	}
+	return decodePoints("multi-read", resp.Data)
+}
+
+func (c *Client) multiRead(ctx context.Context, req *request) (map[string][]models.DataPoint, error) {
+	var resp response
+	var multi map[string][]models.DataPoint
+	var binary *map[string][]models.DataPoint
+	if c.opts.BinaryReads {
+		req.ResponseFormat = "binary"
+		binary = &multi
+	}
+	if err := c.do(ctx, req, &resp, binary); err != nil {
+		return nil, err
+	}
+	if multi == nil {
+		multi = resp.MultiData
+	}
+	if multi == nil {
+		multi = map[string][]models.DataPoint{}
+	}
+	return multi, nil
+}
+
+// Expression evaluates an arithmetic expression (e.g. "v * i") over the
+// keys vars names, at the timestamps they all have a point at. opts must
+// set Start and End; with Downsample, the keys are joined by bucket.
+func (c *Client) Expression(ctx context.Context, expression string, vars map[string]string, opts ReadOptions) ([]models.DataPoint, error) {
+	var resp response
+	if err := c.do(ctx, &request{Operation: "expression", Expression: expression, Vars: vars, Read: &opts}, &resp, nil); err != nil {
+		return nil, err
+	}
+	return decodePoints("expression", resp.Data)
+}
+
+// Query runs a text query (e.g. `SELECT avg(value) FROM "sensor*" WHERE
+// time > now()-1h GROUP BY time(5m)`) and returns the points of each key it
+// matches.
+func (c *Client) Query(ctx context.Context, text string) (map[string][]models.DataPoint, error) {
+	return c.multiRead(ctx, &request{Operation: "query", Query: text})
+}
+
+// Export returns points of key as CSV or, with Format "json", as a JSON
+// array.
+func (c *Client) Export(ctx context.Context, key string, opts ExportOptions) (string, error) {
+	if opts.Format == "" {
+		opts.Format = "csv"
+	}
+	var resp response
+	if err := c.do(ctx, &request{Operation: "export", Key: key, Export: &opts}, &resp, nil); err != nil {
+		return "", err
+	}
+	var text string
+	if json.Unmarshal(resp.Data, &text) == nil {
+		return text, nil
+	}
+	return string(resp.Data), nil
+}
+
+// Patch inserts or overwrites points of key at their timestamps.
+func (c *Client) Patch(ctx context.Context, key string, points []models.DataPoint) error {
+	data, err := json.Marshal(points)
+	if err != nil {
+		return err
+	}
+	return c.PatchCSV(ctx, key, string(data))
+}
+
+// PatchCSV is Patch with "timestamp,value" lines (or a JSON array).
+func (c *Client) PatchCSV(ctx context.Context, key, data string) error {
+	return c.call(ctx, &request{Operation: "data-patch", Key: key, Data: data}, nil)
+}
+
+// DeletePoints removes points of key and returns how many.
+func (c *Client) DeletePoints(ctx context.Context, key string, opts DeleteOptions) (int, error) {
+	msg, err := c.message(ctx, &request{Operation: "deletedatapoint", Key: key, Payload: &opts})
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	fmt.Sscanf(msg, "Removed %d", &n)
+	return n, nil
+}
+
+// InitKey creates key, with a layout when opts is not zero.
+func (c *Client) InitKey(ctx context.Context, key string, opts KeyOptions) error {
+	return c.call(ctx, &request{Operation: "initkey", Key: key, Fields: opts.Fields, Type: opts.Type, Precision: opts.Precision}, nil)
+}
+
+// RenameKey renames key to newKey.
+func (c *Client) RenameKey(ctx context.Context, key, newKey string) error {
+	return c.call(ctx, &request{Operation: "renamekey", Key: key, ToKey: newKey}, nil)
+}
+
+// DeleteKey deletes key and its data.
+func (c *Client) DeleteKey(ctx context.Context, key string) error {
+	return c.call(ctx, &request{Operation: "deletekey", Key: key}, nil)
+}
+
+// ReloadKey reloads key from disk.
+func (c *Client) ReloadKey(ctx context.Context, key string) error {
+	return c.call(ctx, &request{Operation: "reloadkey", Key: key}, nil)
+}
+
+// Compact compacts the WAL of key.
+func (c *Client) Compact(ctx context.Context, key string) error {
+	return c.call(ctx, &request{Operation: "compact", Key: key}, nil)
+}
+
+// Flush flushes buffered points to disk.
+func (c *Client) Flush(ctx context.Context) error {
+	return c.call(ctx, &request{Operation: "flush"}, nil)
+}
+
+// IDs lists the keys of the user, or those matching a label selector.
+func (c *Client) IDs(ctx context.Context, selector string) ([]string, error) {
+	ids := []string{}
+	err := c.call(ctx, &request{Operation: "ids", Selector: selector}, &ids)
+	return ids, err
+}
+
+// IDsWithCount lists the keys of the user with their point counts.
+func (c *Client) IDsWithCount(ctx context.Context) ([]models.KeyCount, error) {
+	counts := []models.KeyCount{}
+	err := c.call(ctx, &request{Operation: "idswithcount"}, &counts)
+	return counts, err
+}
+
+// SetRetention sets the retention override of key ("90d", "12h",
+// "forever"; "0" inherits).
+func (c *Client) SetRetention(ctx context.Context, key, retention string) error {
+	return c.call(ctx, &request{Operation: "setretention", Key: key, Retention: retention}, nil)
+}
+
+// GetRetention returns the retention of key.
+func (c *Client) GetRetention(ctx context.Context, key string) (Retention, error) {
+	var r Retention
+	err := c.call(ctx, &request{Operation: "getretention", Key: key}, &r)
+	return r, err
+}
+
+// SetLabels replaces the labels of key; nil or empty removes them.
+func (c *Client) SetLabels(ctx context.Context, key string, labels map[string]string) error {
+	return c.call(ctx, &request{Operation: "setlabels", Key: key, Labels: labels}, nil)
+}
+
+// GetLabels returns the labels of key.
+func (c *Client) GetLabels(ctx context.Context, key string) (map[string]string, error) {
+	labels := map[string]string{}
+	err := c.call(ctx, &request{Operation: "getlabels", Key: key}, &labels)
+	return labels, err
+}
+
+// AddRollup maintains a rollup of key ("1m", "avg").
+func (c *Client) AddRollup(ctx context.Context, key, interval, aggregation string) error {
+	return c.call(ctx, &request{Operation: "addrollup", Key: key, Rollup: &rollupRequest{interval, aggregation}}, nil)
+}
+
+// DeleteRollup stops maintaining a rollup; its key keeps the data.
+func (c *Client) DeleteRollup(ctx context.Context, key, interval, aggregation string) error {
+	return c.call(ctx, &request{Operation: "deleterollup", Key: key, Rollup: &rollupRequest{interval, aggregation}}, nil)
+}
+
+// ListRollups lists the rollups of key.
+func (c *Client) ListRollups(ctx context.Context, key string) ([]Rollup, error) {
+	rollups := []Rollup{}
+	err := c.call(ctx, &request{Operation: "listrollups", Key: key}, &rollups)
+	return rollups, err
+}
+
+// ServerInfo returns server diagnostics.
+func (c *Client) ServerInfo(ctx context.Context) (map[string]any, error) {
+	info := map[string]any{}
+	err := c.call(ctx, &request{Operation: "serverinfo"}, &info)
+	return info, err
+}
+
+// SyncStatus returns the store-and-forward sync state of the user's keys.
+func (c *Client) SyncStatus(ctx context.Context) (map[string]any, error) {
+	status := map[string]any{}
+	err := c.call(ctx, &request{Operation: "syncstatus"}, &status)
+	return status, err
+}
+
+// AddUser creates a user (root only); an empty name is generated.
+// maxPoints caps the user's stored points (0 = unlimited).
+func (c *Client) AddUser(ctx context.Context, name string, maxPoints int64) (User, error) {
+	var u User
+	err := c.call(ctx, &request{Operation: "adduser", Key: name, MaxPoints: maxPoints}, &u)
+	return u, err
+}
+
+// ResetToken gives a user a new token and returns it (root only).
+func (c *Client) ResetToken(ctx context.Context, name string) (string, error) {
+	var data struct {
+		Token string `json:"token"`
+	}
+	if err := c.call(ctx, &request{Operation: "resetkey", Key: name}, &data); err != nil {
+		return "", err
+	}
+	if data.Token == "" {
+		return "", errors.New("gtsdb resetkey: no token in reply")
+	}
+	return data.Token, nil
+}
+
+// SetQuota caps a user's stored points (root only; 0 = unlimited).
+func (c *Client) SetQuota(ctx context.Context, name string, maxPoints int64) error {
+	return c.call(ctx, &request{Operation: "setquota", Key: name, MaxPoints: maxPoints}, nil)
+}
+
+// SetUserRetention sets a user's retention override (root only).
+func (c *Client) SetUserRetention(ctx context.Context, name, retention string) error {
+	return c.call(ctx, &request{Operation: "setuserretention", Key: name, Retention: retention}, nil)
+}
+
+// Snapshot writes an online backup tar on the server (root only; empty
+// path for the default) and returns its description.
+func (c *Client) Snapshot(ctx context.Context, path string) (map[string]any, error) {
+	info := map[string]any{}
+	err := c.call(ctx, &request{Operation: "snapshot", Path: path}, &info)
+	return info, err
+}
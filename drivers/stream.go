@@ -0,0 +1,76 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"gtsdb/models"
+	"time"
+)
+
+// ReadEach is a streamed Read: fn is called with each chunk of points as
+// the server sends them, so a long range is never held in memory at once.
+// The request timeout applies to each chunk rather than to the whole read.
+// An error returned by fn aborts the read and is returned. ReadEach is not
+// retried.
+func (c *Client) ReadEach(ctx context.Context, key string, opts ReadOptions, fn func([]models.DataPoint) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cn, _, err := c.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = c.stream(ctx, cn, &request{Operation: "read", Key: key, Read: &opts, Stream: true}, fn)
+	c.put(cn, err == nil)
+	return err
+}
+
+// stream sends a streamed request on cn and passes the points of each
+// reply to fn until the last one.
+func (c *Client) stream(ctx context.Context, cn *conn, req *request, fn func([]models.DataPoint) error) (err error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, hasDeadline := ctx.Deadline()
+	extend := func() {
+		if deadline, ok := ctx.Deadline(); ok {
+			cn.SetDeadline(deadline)
+		} else {
+			cn.SetDeadline(time.Now().Add(c.opts.RequestTimeout))
+		}
+	}
+	extend()
+	stop := context.AfterFunc(ctx, func() { cn.SetDeadline(time.Unix(1, 0)) })
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+
+	if _, err := cn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	for {
+		var resp response
+		if err := cn.readReply(&resp, nil); err != nil {
+			return err
+		}
+		if !resp.Success {
+			return &Error{Operation: req.Operation, Message: resp.Message}
+		}
+		if !resp.More {
+			return nil
+		}
+		points, err := decodePoints(req.Operation, resp.Data)
+		if err != nil {
+			return err
+		}
+		if err := fn(points); err != nil {
+			return err
+		}
+		if !hasDeadline {
+			extend()
+		}
+	}
+}
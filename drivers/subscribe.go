@@ -0,0 +1,231 @@
+package drivers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gtsdb/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// idleTimeout drops a subscription connection that has been silent for
+	// several of the server's 30s pings.
+	idleTimeout = 90 * time.Second
+
+	maxResubscribeWait = 30 * time.Second
+)
+
+// Subscription streams the points written to a set of keys. It holds its
+// own connection, outside the pool, and reconnects when it breaks:
+// each key is subscribed again from just after its last received
+// timestamp, so points written meanwhile are replayed.
+type Subscription struct {
+	// C delivers the points. It is closed after Close or when the context
+	// given to Subscribe is done.
+	C <-chan models.DataPoint
+
+	c      *Client
+	ch     chan models.DataPoint
+	keys   []string
+	since  map[string]int64 // next timestamp to ask for, by key; owned by run
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Subscribe subscribes to keys. When since is not zero, the points from
+// since on are sent first.
+func (c *Client) Subscribe(ctx context.Context, keys []string, since int64) (*Subscription, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("gtsdb subscribe: no keys")
+	}
+	select {
+	case <-c.done:
+		return nil, errClosed
+	default:
+	}
+	ch := make(chan models.DataPoint, 256)
+	s := &Subscription{C: ch, c: c, ch: ch, keys: keys, since: make(map[string]int64, len(keys)), done: make(chan struct{})}
+	for _, key := range keys {
+		s.since[key] = since
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	cn, pending, err := s.connect()
+	if err != nil {
+		s.cancel()
+		return nil, err
+	}
+	go s.run(cn, pending)
+	return s, nil
+}
+
+// Close ends the subscription and closes C.
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// Err returns the error that broke the connection last, if the
+// subscription is reconnecting or gave up; nil while connected.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// connect dials and subscribes to every key. The points sent before the
+// last acknowledgement are returned to be delivered first.
+func (s *Subscription) connect() (*conn, []models.DataPoint, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, s.c.opts.RequestTimeout)
+	defer cancel()
+	cn, err := s.c.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	cn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { cn.SetDeadline(time.Unix(1, 0)) })
+
+	var pending []models.DataPoint
+	err = func() error {
+		for _, key := range s.keys {
+			data, err := json.Marshal(&request{Operation: "subscribe", Key: key, Since: s.since[key]})
+			if err != nil {
+				return err
+			}
+			if _, err := cn.Write(append(data, '\n')); err != nil {
+				return err
+			}
+			for {
+				resp, p, err := readPush(cn)
+				if err != nil {
+					return err
+				}
+				if p != nil {
+					pending = append(pending, *p)
+					continue
+				}
+				if !resp.Success {
+					return &Error{Operation: "subscribe", Message: resp.Message}
+				}
+				if strings.HasPrefix(resp.Message, "Subscribed to") {
+					break
+				}
+			}
+		}
+		return nil
+	}()
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		cn.Close()
+		return nil, nil, err
+	}
+	cn.SetDeadline(time.Time{})
+	return cn, pending, nil
+}
+
+// readPush reads a line of a subscription connection: a pushed point, or
+// another reply. Pings are skipped.
+func readPush(cn *conn) (*response, *models.DataPoint, error) {
+	for {
+		line, err := cn.r.ReadBytes('\n')
+		if err != nil {
+			return nil, nil, err
+		}
+		var resp response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return nil, nil, fmt.Errorf("gtsdb: invalid reply: %w", err)
+		}
+		if resp.isPing() {
+			continue
+		}
+		if resp.Type == "push" || resp.Type == "" && resp.Success && resp.Data != nil {
+			var p models.DataPoint
+			if err := json.Unmarshal(resp.Data, &p); err != nil {
+				return nil, nil, fmt.Errorf("gtsdb subscribe: invalid point: %w", err)
+			}
+			return &resp, &p, nil
+		}
+		return &resp, nil, nil
+	}
+}
+
+func (s *Subscription) run(cn *conn, pending []models.DataPoint) {
+	defer close(s.done)
+	defer close(s.ch)
+	for {
+		err := s.stream(cn, pending)
+		cn.Close()
+		if s.ctx.Err() != nil {
+			return
+		}
+		s.setErr(err)
+		wait := 100 * time.Millisecond
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			if cn, pending, err = s.connect(); err == nil {
+				break
+			}
+			s.setErr(err)
+			wait = min(2*wait, maxResubscribeWait)
+		}
+		s.setErr(nil)
+	}
+}
+
+// stream delivers pending, then the points read from cn until it fails or
+// the subscription ends.
+func (s *Subscription) stream(cn *conn, pending []models.DataPoint) error {
+	stop := context.AfterFunc(s.ctx, func() { cn.Close() })
+	defer stop()
+	for _, p := range pending {
+		if err := s.deliver(p); err != nil {
+			return err
+		}
+	}
+	for {
+		cn.SetReadDeadline(time.Now().Add(idleTimeout))
+		_, p, err := readPush(cn)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			continue
+		}
+		if err := s.deliver(*p); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Subscription) deliver(p models.DataPoint) error {
+	if next, ok := s.since[p.Key]; ok && p.Timestamp >= next {
+		s.since[p.Key] = p.Timestamp + 1
+	}
+	select {
+	case s.ch <- p:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
@@ -2,6 +2,7 @@ package fanout
 
 import (
 	models "gtsdb/models"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -35,7 +36,7 @@ func TestBasicFanout(t *testing.T) {
 
 	mu.Lock()
 	for id, dp := range received {
-		if dp != testPoint {
+		if !reflect.DeepEqual(dp, testPoint) {
 			t.Errorf("Consumer %d received incorrect data point. Got %v, want %v", id, dp, testPoint)
 		}
 	}
@@ -0,0 +1,82 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// callTimeout bounds one request to the remote, including a batch-write of
+// batchSize points.
+const callTimeout = 30 * time.Second
+
+// client is an authenticated TCP connection to the remote.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type reply struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+func dial(addr, token string) (*client, error) {
+	conn, err := net.DialTimeout("tcp", addr, callTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{conn: conn, r: bufio.NewReaderSize(conn, 64*1024)}
+	if token != "" {
+		msg, err := c.call(map[string]string{"operation": "auth", "key": token})
+		if err == nil && msg != "" {
+			err = errors.New("auth: " + msg)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// call sends op and waits for its reply, skipping keepalive pings. It
+// returns the remote's message when the operation failed, and an error
+// when the connection did.
+func (c *client) call(op any) (string, error) {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return "", err
+	}
+	_ = c.conn.SetDeadline(time.Now().Add(callTimeout))
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		return "", err
+	}
+	for {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil {
+			return "", err
+		}
+		var resp reply
+		if err := json.Unmarshal(line, &resp); err != nil {
+			return "", fmt.Errorf("invalid reply: %w", err)
+		}
+		if resp.Success && resp.Message == "ping" {
+			continue
+		}
+		if !resp.Success {
+			if resp.Message == "" {
+				resp.Message = "failed"
+			}
+			return resp.Message, nil
+		}
+		return "", nil
+	}
+}
+
+func (c *client) close() {
+	c.conn.Close()
+}
@@ -0,0 +1,380 @@
+// Package forward implements store-and-forward sync from an edge server to
+// a remote GTSDB: every key under the configured prefixes is copied to the
+// remote with the ordinary TCP batch-write operation.
+//
+// Points are forwarded from the local WAL rather than from the write path,
+// so nothing is lost while the remote is unreachable. Each key has a
+// high-water mark, the timestamp of the last point the remote acknowledged,
+// persisted in <data>/forward.json; every sync round sends the points after
+// it, so after a reconnect (or a restart) the gap is back-filled in order.
+// Points written behind the mark (late out-of-order writes, patches) and
+// deletes are not forwarded.
+package forward
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"gtsdb/utils"
+)
+
+// batchSize is the largest batch-write the remote accepts.
+const batchSize = 10000
+
+// KeyStatus is the sync position of one key.
+type KeyStatus struct {
+	Key       string `json:"key"`
+	RemoteKey string `json:"remote_key"`
+	HighWater int64  `json:"high_water"`      // timestamp of the last forwarded point (0 = none yet)
+	Last      int64  `json:"last"`            // timestamp of the last local point
+	Pending   bool   `json:"pending"`         // Last is past HighWater
+	Error     string `json:"error,omitempty"` // why the remote rejected the key's last batch
+}
+
+// Config is the [forward] section of the configuration. Start takes a copy,
+// so reloading the configuration does not affect a running worker.
+type Config struct {
+	Remote       string        // TCP address of the remote GTSDB ("" = off)
+	Token        string        // token on the remote
+	Prefixes     []string      // local key prefixes to forward
+	RemotePrefix string        // prepended to forwarded keys on the remote
+	Interval     time.Duration // between sync rounds
+}
+
+// Status is the state of the sync worker.
+type Status struct {
+	Enabled   bool        `json:"enabled"`
+	Remote    string      `json:"remote,omitempty"`
+	Connected bool        `json:"connected"`
+	LastSync  int64       `json:"last_sync,omitempty"` // Unix seconds of the last round that reached every key
+	LastError string      `json:"last_error,omitempty"`
+	Forwarded int64       `json:"forwarded"` // points sent since startup
+	Keys      []KeyStatus `json:"keys"`
+}
+
+var (
+	mu         sync.Mutex
+	config     Config // of the running worker
+	highWater  = make(map[string]int64)
+	keyErrors  = make(map[string]string)
+	stateFile  string
+	connected  bool
+	lastSync   int64
+	lastError  string
+	forwarded  int64
+	remoteInit = make(map[string]bool) // keys whose layout the remote has
+)
+
+// Init loads the high-water marks from dataDir/forward.json.
+func Init(dataDir string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	stateFile = dataDir + "/forward.json"
+	highWater = make(map[string]int64)
+	keyErrors = make(map[string]string)
+	remoteInit = make(map[string]bool)
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Errorln("Error reading forward state file:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &highWater); err != nil {
+		utils.Errorln("Error parsing forward state file:", err)
+		highWater = make(map[string]int64)
+	}
+}
+
+// saveLocked persists the high-water marks. Caller must hold mu.
+func saveLocked() {
+	if stateFile == "" {
+		return
+	}
+	data, err := json.Marshal(highWater)
+	if err != nil {
+		utils.Errorln("Error marshalling forward state:", err)
+		return
+	}
+	tmp := stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		utils.Errorln("Error writing forward state file:", err)
+		return
+	}
+	if err := os.Rename(tmp, stateFile); err != nil {
+		utils.Errorln("Error writing forward state file:", err)
+	}
+}
+
+// Enabled reports whether a remote is configured.
+func (cfg Config) Enabled() bool {
+	return cfg.Remote != "" && len(cfg.Prefixes) > 0
+}
+
+// matches reports whether key is under one of the forwarded prefixes.
+func (cfg Config) matches(key string) bool {
+	for _, prefix := range cfg.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoteKey maps a local key to its key on the remote: remote_prefix
+// followed by the whole local key, user namespace included, so the same key
+// name of two local users stays two keys. The remote puts the result under
+// the user of the [forward] token.
+func (cfg Config) RemoteKey(key string) string {
+	return cfg.RemotePrefix + key
+}
+
+// Start runs sync rounds every cfg.Interval until stop is closed, and
+// returns a channel that is closed once the worker has exited. It does
+// nothing (and returns a closed channel) when no remote is configured.
+func Start(cfg Config, stop chan struct{}) <-chan struct{} {
+	cfg.Prefixes = slices.Clone(cfg.Prefixes)
+	mu.Lock()
+	config = cfg
+	mu.Unlock()
+
+	done := make(chan struct{})
+	if !cfg.Enabled() {
+		close(done)
+		return done
+	}
+	utils.Log("Forwarding %s to %s", strings.Join(cfg.Prefixes, ", "), cfg.Remote)
+	go func() {
+		defer close(done)
+		var c *client
+		defer func() {
+			if c != nil {
+				c.close()
+			}
+		}()
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			c = syncRound(cfg, c, stop)
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+// syncRound forwards the new points of every matching key over c, dialing
+// the remote first if c is nil. It returns the connection to reuse, nil
+// after a connection failure.
+func syncRound(cfg Config, c *client, stop <-chan struct{}) *client {
+	if c == nil {
+		var err error
+		if c, err = dial(cfg.Remote, cfg.Token); err != nil {
+			setConnected(false, err)
+			return nil
+		}
+		setConnected(true, nil)
+	}
+
+	keys := buffer.GetAllIds()
+	sort.Strings(keys)
+	present := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		select {
+		case <-stop:
+			return c
+		default:
+		}
+		if !cfg.matches(key) {
+			continue
+		}
+		present[key] = true
+		if err := forwardKey(cfg, c, key); err != nil {
+			c.close()
+			setConnected(false, err)
+			return nil
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for key := range highWater {
+		if !present[key] && cfg.matches(key) {
+			// Deleted or renamed away: a key created under this name later
+			// starts over.
+			delete(highWater, key)
+			delete(keyErrors, key)
+			delete(remoteInit, key)
+		}
+	}
+	saveLocked()
+	lastSync = time.Now().Unix()
+	return c
+}
+
+func setConnected(ok bool, err error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if ok && !connected {
+		utils.Log("Forwarding: connected to %s", config.Remote)
+	}
+	if err != nil && (connected || lastError != err.Error()) {
+		utils.Warning("Forwarding to %s: %v", config.Remote, err)
+	}
+	connected = ok
+	if err != nil {
+		lastError = err.Error()
+	} else {
+		lastError = ""
+	}
+	if !ok {
+		remoteInit = make(map[string]bool)
+	}
+}
+
+// forwardKey sends the points of key past its high-water mark. It returns
+// an error only when the connection failed; a batch the remote rejects is
+// recorded as the key's error and retried next round.
+func forwardKey(cfg Config, c *client, key string) error {
+	last := buffer.ReadLastDataPoints(key, 1)
+	if len(last) == 0 {
+		return nil
+	}
+	mu.Lock()
+	mark, inited := highWater[key], remoteInit[key]
+	mu.Unlock()
+	if last[0].Timestamp <= mark {
+		return nil
+	}
+
+	remoteKey := cfg.RemoteKey(key)
+	if !inited {
+		if op, ok := initKeyOp(key, remoteKey); ok {
+			msg, err := c.call(op)
+			if err != nil {
+				return err
+			}
+			if msg != "" {
+				setKeyError(key, "initkey: "+msg)
+				return nil
+			}
+		}
+		mu.Lock()
+		remoteInit[key] = true
+		mu.Unlock()
+	}
+
+	points := buffer.ReadDataPoints(key, mark+1, math.MaxInt64, 0, "")
+	for start := 0; start < len(points); start += batchSize {
+		batch := append([]models.DataPoint(nil), points[start:min(start+batchSize, len(points))]...)
+		for i := range batch {
+			batch[i].Key = remoteKey
+		}
+		msg, err := c.call(batchWriteOp{Operation: "batch-write", Points: batch})
+		if err != nil {
+			return err
+		}
+		if msg != "" {
+			setKeyError(key, msg)
+			return nil
+		}
+		mu.Lock()
+		highWater[key] = batch[len(batch)-1].Timestamp
+		delete(keyErrors, key)
+		forwarded += int64(len(batch))
+		saveLocked()
+		mu.Unlock()
+	}
+	return nil
+}
+
+func setKeyError(key, msg string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if keyErrors[key] != msg {
+		utils.Warning("Forwarding %s rejected by remote: %s", key, msg)
+	}
+	keyErrors[key] = msg
+}
+
+// batchWriteOp is a batch-write request; DataPoint marshals to the
+// batch-write point format, typed values included.
+type batchWriteOp struct {
+	Operation string             `json:"operation"`
+	Points    []models.DataPoint `json:"points"`
+}
+
+// initKeyOp returns the initkey request giving the remote key the local
+// key's layout, or false for a plain float key in seconds, which the
+// remote creates on the first write.
+func initKeyOp(key, remoteKey string) (map[string]any, bool) {
+	fields := buffer.KeyFields(key)
+	valueType := buffer.KeyType(key)
+	precision := buffer.KeyPrecision(key)
+	if len(fields) == 0 && valueType == models.TypeFloat && precision == models.PrecisionSecond {
+		return nil, false
+	}
+	op := map[string]any{"operation": "initkey", "key": remoteKey}
+	if len(fields) > 0 {
+		op["fields"] = fields
+	}
+	if valueType != models.TypeFloat {
+		op["type"] = valueType.String()
+	}
+	if precision != models.PrecisionSecond {
+		op["precision"] = precision.String()
+	}
+	return op, true
+}
+
+// CurrentStatus returns the sync state of the keys under scope (a key
+// prefix; empty for every key).
+func CurrentStatus(scope string) Status {
+	mu.Lock()
+	cfg := config
+	mu.Unlock()
+	s := Status{Enabled: cfg.Enabled(), Remote: cfg.Remote, Keys: []KeyStatus{}}
+	if !s.Enabled {
+		return s
+	}
+	keys := buffer.GetAllIds()
+	sort.Strings(keys)
+
+	mu.Lock()
+	s.Connected, s.LastSync, s.LastError, s.Forwarded = connected, lastSync, lastError, forwarded
+	marks := make(map[string]int64, len(highWater))
+	errs := make(map[string]string, len(keyErrors))
+	for k, v := range highWater {
+		marks[k] = v
+	}
+	for k, v := range keyErrors {
+		errs[k] = v
+	}
+	mu.Unlock()
+
+	for _, key := range keys {
+		if !cfg.matches(key) || !strings.HasPrefix(key, scope) {
+			continue
+		}
+		ks := KeyStatus{Key: key, RemoteKey: cfg.RemoteKey(key), HighWater: marks[key], Error: errs[key]}
+		if last := buffer.ReadLastDataPoints(key, 1); len(last) > 0 {
+			ks.Last = last[0].Timestamp
+		}
+		ks.Pending = ks.Last > ks.HighWater
+		s.Keys = append(s.Keys, ks)
+	}
+	return s
+}
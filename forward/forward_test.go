@@ -0,0 +1,260 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/json"
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRemote answers auth, initkey and batch-write like a GTSDB TCP port
+// and records what it received. While down it hangs up on every request.
+type fakeRemote struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	down    bool
+	points  []models.DataPoint
+	initkey []map[string]any
+}
+
+func newFakeRemote(t *testing.T) *fakeRemote {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRemote{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRemote) serve(conn net.Conn) {
+	defer conn.Close()
+	conn.Write([]byte(`{"success":true,"message":"ping"}` + "\n"))
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var op struct {
+			Operation string             `json:"operation"`
+			Points    []models.DataPoint `json:"points"`
+		}
+		json.Unmarshal(scanner.Bytes(), &op)
+		r.mu.Lock()
+		if r.down {
+			r.mu.Unlock()
+			return
+		}
+		reply := `{"success":true}`
+		switch op.Operation {
+		case "initkey":
+			var raw map[string]any
+			json.Unmarshal(scanner.Bytes(), &raw)
+			r.initkey = append(r.initkey, raw)
+		case "batch-write":
+			if strings.Contains(op.Points[0].Key, "bad") {
+				reply = `{"success":false,"message":"Storage quota exceeded"}`
+			} else {
+				r.points = append(r.points, op.Points...)
+			}
+		}
+		r.mu.Unlock()
+		conn.Write([]byte(reply + "\n"))
+	}
+}
+
+func (r *fakeRemote) setDown(down bool) {
+	r.mu.Lock()
+	r.down = down
+	r.mu.Unlock()
+}
+
+func (r *fakeRemote) received() []models.DataPoint {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	points := r.points
+	r.points = nil
+	return points
+}
+
+// setup forwards root/ to remote with remote_prefix gw1_ and returns the
+// data directory and the configuration, which CurrentStatus reports on.
+func setup(t *testing.T, remote *fakeRemote) (string, Config) {
+	t.Helper()
+	dir := t.TempDir()
+	utils.DataDir = dir
+	buffer.InitFileHandles()
+	buffer.InitIDSet()
+	Init(dir)
+	cfg := Config{Remote: remote.ln.Addr().String(), Token: "token", Prefixes: []string{"root/"}, RemotePrefix: "gw1_"}
+	mu.Lock()
+	config = cfg
+	mu.Unlock()
+	t.Cleanup(func() {
+		buffer.CloseAllHandles()
+		mu.Lock()
+		config = Config{}
+		mu.Unlock()
+		Init("")
+	})
+	return dir, cfg
+}
+
+func points(key string, base int64, n int) []models.DataPoint {
+	pts := make([]models.DataPoint, n)
+	for i := range pts {
+		pts[i] = models.DataPoint{Key: key, Timestamp: base + int64(i), Value: float64(i)}
+	}
+	return pts
+}
+
+func TestForwardResumesAfterOutage(t *testing.T) {
+	remote := newFakeRemote(t)
+	dir, cfg := setup(t, remote)
+	stop := make(chan struct{})
+	base := int64(1700000000)
+	buffer.StoreDataPointsBuffer(points("root/temp", base, 100))
+	buffer.StoreDataPointsBuffer(points("alice/temp", base, 5)) // not forwarded
+
+	c := syncRound(cfg, nil, stop)
+	if c == nil {
+		t.Fatal("Expected a connection")
+	}
+	got := remote.received()
+	if len(got) != 100 || got[0].Key != "gw1_root/temp" || got[99].Timestamp != base+99 {
+		t.Fatalf("Expected 100 points of gw1_root/temp, got %d", len(got))
+	}
+
+	// Offline: writes pile up locally
+	remote.setDown(true)
+	buffer.StoreDataPointsBuffer(points("root/temp", base+100, 50))
+	if c = syncRound(cfg, c, stop); c != nil {
+		t.Fatal("Expected the connection to be dropped")
+	}
+	s := CurrentStatus("")
+	if s.Connected || s.LastError == "" || len(s.Keys) != 1 || !s.Keys[0].Pending || s.Keys[0].HighWater != base+99 {
+		t.Errorf("Unexpected status while offline: %+v", s)
+	}
+
+	// A restart reloads the high-water mark; the gap is back-filled
+	Init(dir)
+	if _, err := os.Stat(filepath.Join(dir, "forward.json")); err != nil {
+		t.Fatal(err)
+	}
+	remote.setDown(false)
+	if c = syncRound(cfg, nil, stop); c == nil {
+		t.Fatal("Expected to reconnect")
+	}
+	defer c.close()
+	got = remote.received()
+	if len(got) != 50 || got[0].Timestamp != base+100 || got[49].Timestamp != base+149 {
+		t.Fatalf("Expected the 50 missed points, got %d", len(got))
+	}
+	s = CurrentStatus("")
+	if !s.Connected || s.Keys[0].Pending || s.Keys[0].HighWater != base+149 || s.Forwarded != 150 {
+		t.Errorf("Unexpected status after catching up: %+v", s)
+	}
+
+	// Nothing new: nothing sent
+	syncRound(cfg, c, stop)
+	if got := remote.received(); len(got) != 0 {
+		t.Errorf("Expected no points, got %d", len(got))
+	}
+}
+
+func TestForwardTypedAndRejectedKeys(t *testing.T) {
+	remote := newFakeRemote(t)
+	_, cfg := setup(t, remote)
+	stop := make(chan struct{})
+	if err := buffer.InitKeyWithOptions("root/state", buffer.KeyOptions{Type: models.TypeString}); err != nil {
+		t.Fatal(err)
+	}
+	buffer.StoreDataPointsBuffer([]models.DataPoint{models.StringPoint("root/state", 1700000000, "OPEN")})
+	buffer.StoreDataPointsBuffer(points("root/bad", 1700000000, 3))
+
+	c := syncRound(cfg, nil, stop)
+	if c == nil {
+		t.Fatal("Expected a connection")
+	}
+	defer c.close()
+	got := remote.received()
+	if len(got) != 1 || got[0].Type != models.TypeString || got[0].Str != "OPEN" {
+		t.Errorf("Expected the string point, got %v", got)
+	}
+	if len(remote.initkey) != 1 || remote.initkey[0]["key"] != "gw1_root/state" || remote.initkey[0]["type"] != "string" {
+		t.Errorf("Expected initkey of gw1_root/state as string, got %v", remote.initkey)
+	}
+
+	s := CurrentStatus("root/")
+	if len(s.Keys) != 2 || s.Keys[0].Key != "root/bad" || s.Keys[0].Error == "" || !s.Keys[0].Pending || s.Keys[1].Pending {
+		t.Errorf("Unexpected status: %+v", s.Keys)
+	}
+	if s := CurrentStatus("alice/"); len(s.Keys) != 0 {
+		t.Errorf("Expected no keys for alice, got %+v", s.Keys)
+	}
+}
+
+func TestForwardKeepsUserNamespaces(t *testing.T) {
+	remote := newFakeRemote(t)
+	_, cfg := setup(t, remote)
+	cfg.Prefixes = []string{"alice/", "bob/"}
+	stop := make(chan struct{})
+	buffer.StoreDataPointsBuffer(points("alice/hum", 1700000000, 2))
+	buffer.StoreDataPointsBuffer(points("bob/hum", 1700000000, 3))
+
+	c := syncRound(cfg, nil, stop)
+	if c == nil {
+		t.Fatal("Expected a connection")
+	}
+	defer c.close()
+	counts := make(map[string]int)
+	for _, p := range remote.received() {
+		counts[p.Key]++
+	}
+	if len(counts) != 2 || counts["gw1_alice/hum"] != 2 || counts["gw1_bob/hum"] != 3 {
+		t.Errorf("Expected each user's hum under its own remote key, got %v", counts)
+	}
+}
+
+func TestStartWaitsForWorker(t *testing.T) {
+	remote := newFakeRemote(t)
+	_, cfg := setup(t, remote)
+	cfg.Interval = time.Hour
+	buffer.StoreDataPointsBuffer(points("root/temp", 1700000000, 1))
+
+	stop := make(chan struct{})
+	done := Start(cfg, stop)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the worker to exit after stop")
+	}
+	if s := CurrentStatus(""); !s.Enabled || s.Remote != cfg.Remote {
+		t.Errorf("Expected the status of the started configuration, got %+v", s)
+	}
+
+	// Without a remote there is no worker to wait for
+	select {
+	case <-Start(Config{}, make(chan struct{})):
+	default:
+		t.Error("Expected a closed channel when forwarding is off")
+	}
+}
@@ -2,9 +2,18 @@ package handlers
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"gtsdb/buffer"
 	"gtsdb/models"
+	"gtsdb/quota"
+	"gtsdb/replication"
+	"gtsdb/utils"
+	"io"
 	"math"
 	"net"
+	"strings"
+	"time"
 )
 
 // Binary protocol for fast read responses.
@@ -76,3 +85,143 @@ func writeBinaryDataPoints(conn net.Conn, key string, points []models.DataPoint)
 	_, err := conn.Write(buf)
 	return err
 }
+
+// Binary write frames, accepted after a "binary-write" operation. They
+// skip JSON parsing for bulk ingestion.
+// Wire format: [uint32 frame_length (big-endian)] [frame_data...]; a zero
+// frame_length switches the connection back to JSON lines.
+// Frame data:
+//   [uint16] number_of_keys (big-endian)
+//   For each key:
+//     [uint16] key_length (big-endian)
+//     [N bytes] key (UTF-8, as in JSON requests)
+//   [uint32] number_of_points (big-endian)
+//   For each point:
+//     [uint16] key_index into the key table (big-endian)
+//     [int64] timestamp (big-endian, <= 0 for now)
+//     [float64] value (big-endian, IEEE 754)
+
+// maxBinaryWriteFrame bounds a binary write frame.
+const maxBinaryWriteFrame = 16 * 1024 * 1024
+
+var (
+	errWriteFrameTooLarge = fmt.Errorf("Binary write frame exceeds maximum (%d bytes)", maxBinaryWriteFrame)
+	errWriteFrameShort    = errors.New("Truncated binary write frame")
+)
+
+// readBinaryWriteFrame reads the next binary write frame, nil for the
+// zero-length frame ending binary mode.
+func readBinaryWriteFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n == 0 {
+		return nil, nil
+	}
+	if n > maxBinaryWriteFrame {
+		return nil, errWriteFrameTooLarge
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// decodeBinaryWrite decodes a binary write frame into points of keys under
+// prefix. Like batch-write, a frame holds at most maxBatchPoints points and
+// one invalid key, timestamp or value rejects it.
+func decodeBinaryWrite(frame []byte, prefix string) ([]models.DataPoint, error) {
+	if len(frame) < 2 {
+		return nil, errWriteFrameShort
+	}
+	type keyInfo struct {
+		key       string
+		precision models.Precision
+		plain     bool // float values without fields: no conversion
+	}
+	keys := make([]keyInfo, binary.BigEndian.Uint16(frame))
+	frame = frame[2:]
+	for i := range keys {
+		if len(frame) < 2 {
+			return nil, errWriteFrameShort
+		}
+		n := int(binary.BigEndian.Uint16(frame))
+		if len(frame) < 2+n {
+			return nil, errWriteFrameShort
+		}
+		key := string(frame[2 : 2+n])
+		frame = frame[2+n:]
+		if key == "" || !validateKey(key) {
+			return nil, fmt.Errorf("Invalid key in batch: %s", key)
+		}
+		key = prefix + key
+		keys[i] = keyInfo{
+			key:       key,
+			precision: buffer.KeyPrecision(key),
+			plain:     buffer.KeyType(key) == models.TypeFloat && len(buffer.KeyFields(key)) == 0,
+		}
+	}
+	if len(frame) < 4 {
+		return nil, errWriteFrameShort
+	}
+	count := int(binary.BigEndian.Uint32(frame))
+	frame = frame[4:]
+	if count > maxBatchPoints {
+		return nil, fmt.Errorf("Batch size exceeds maximum (%d)", maxBatchPoints)
+	}
+	if len(frame) != count*18 {
+		return nil, errWriteFrameShort
+	}
+
+	now := time.Now().UnixNano()
+	points := make([]models.DataPoint, count)
+	for i := range points {
+		index := int(binary.BigEndian.Uint16(frame))
+		ts := int64(binary.BigEndian.Uint64(frame[2:]))
+		value := math.Float64frombits(binary.BigEndian.Uint64(frame[10:]))
+		frame = frame[18:]
+		if index >= len(keys) {
+			return nil, fmt.Errorf("Key index %d out of range", index)
+		}
+		k := &keys[index]
+		if ts <= 0 {
+			ts = k.precision.FromNanos(now)
+		} else if !validateKeyTimestamp(k.key, ts) {
+			return nil, fmt.Errorf("Timestamp out of valid range for key: %s", strings.TrimPrefix(k.key, prefix))
+		}
+		if k.plain {
+			points[i] = models.DataPoint{Key: k.key, Timestamp: ts, Value: value}
+			continue
+		}
+		p, err := buffer.NewDataPoint(k.key, ts, value, nil)
+		if err != nil {
+			return nil, err
+		}
+		points[i] = p
+	}
+	return points, nil
+}
+
+// storeBinaryWrite stores the points of a binary write frame for userName,
+// whose keys are under prefix.
+func storeBinaryWrite(userName, prefix string, frame []byte) Response {
+	if replication.IsFollower() {
+		return Response{Success: false, Message: "Read-only replica: write to the leader at " + utils.ReplicationLeader}
+	}
+	points, err := decodeBinaryWrite(frame, prefix)
+	if err != nil {
+		return Response{Success: false, Message: err.Error()}
+	}
+	if len(points) == 0 {
+		return Response{Success: false, Message: "Points array required"}
+	}
+	if !quota.CheckWrite(userName, int64(len(points))) {
+		return Response{Success: false, Message: quotaExceededMessage(userName)}
+	}
+	buffer.StoreDataPointsBuffer(points)
+	quota.AddPoints(userName, int64(len(points)))
+	return Response{Success: true, Message: fmt.Sprintf("Stored %d data points", len(points))}
+}
@@ -1,12 +1,22 @@
 package handlers
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"gtsdb/buffer"
+	"gtsdb/forward"
+	"gtsdb/labels"
 	"gtsdb/models"
+	"gtsdb/query"
 	"gtsdb/quota"
+	"gtsdb/replication"
+	"gtsdb/retention"
+	"gtsdb/snapshot"
 	"gtsdb/utils"
+	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -17,17 +27,74 @@ import (
 var serverStartTime = time.Now()
 
 type WriteRequest struct {
-	Value     float64 `json:"value"`
-	Timestamp int64   `json:"timestamp,omitempty"`
+	Value     float64            `json:"value"`
+	Timestamp int64              `json:"timestamp,omitempty"`
+	Fields    map[string]float64 `json:"fields,omitempty"` // multi-field keys: values by field name
+
+	raw string // JSON text of value, parsed as the key's type
+}
+
+// rawValue returns the JSON text of a value (5, true, "OPEN"), or "" when
+// it is missing or null. The text is converted once, by newPoint, as the
+// key's type, so typed keys get the exact value instead of a float64.
+func rawValue(v json.RawMessage) string {
+	if text := string(v); text != "null" {
+		return text
+	}
+	return ""
+}
+
+// UnmarshalJSON keeps the value as JSON text for newPoint; Value is set
+// from the stored point.
+func (w *WriteRequest) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Value     json.RawMessage    `json:"value"`
+		Timestamp int64              `json:"timestamp"`
+		Fields    map[string]float64 `json:"fields"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*w = WriteRequest{Timestamp: aux.Timestamp, Fields: aux.Fields, raw: rawValue(aux.Value)}
+	return nil
+}
+
+// newPoint builds the point for a write: fields and plain numbers go through
+// buffer.NewDataPoint, JSON text from the wire is parsed as the key's type.
+func newPoint(key string, ts int64, value float64, raw string, fields map[string]float64) (models.DataPoint, error) {
+	if len(fields) > 0 || raw == "" {
+		return buffer.NewDataPoint(key, ts, value, fields)
+	}
+	return buffer.ParseDataPoint(key, ts, raw)
 }
 
 type ReadRequest struct {
-	StartTime   int64  `json:"start_timestamp,omitempty"`
-	EndTime     int64  `json:"end_timestamp,omitempty"`
-	Downsample  int    `json:"downsampling,omitempty"`
-	LastX       int    `json:"lastx,omitempty"`
-	Aggregation string `json:"aggregation,omitempty"`
-	CountOnly   bool   `json:"count_only,omitempty"` // return only counts, not data
+	StartTime        int64          `json:"start_timestamp,omitempty"`
+	EndTime          int64          `json:"end_timestamp,omitempty"`
+	Downsample       int            `json:"downsampling,omitempty"`
+	LastX            int            `json:"lastx,omitempty"`
+	Aggregation      string         `json:"aggregation,omitempty"`
+	CountOnly        bool           `json:"count_only,omitempty"`        // return only counts, not data
+	Fields           []string       `json:"fields,omitempty"`            // multi-field keys: fields to return (default all)
+	Precision        string         `json:"precision,omitempty"`         // response only: timestamp unit of ms/us/ns keys
+	Limit            int            `json:"limit,omitempty"`             // time range: max points per page
+	Order            string         `json:"order,omitempty"`             // "asc" (default) or "desc"
+	Cursor           string         `json:"cursor,omitempty"`            // time range: continue a paged read
+	Align            string         `json:"align,omitempty"`             // buckets: "epoch" or minute, hour, day, week, month (default: first point)
+	Timezone         string         `json:"timezone,omitempty"`          // IANA zone of calendar buckets (default UTC)
+	Fill             string         `json:"fill,omitempty"`              // empty buckets: none (default), null, previous, linear or a number
+	Function         string         `json:"function,omitempty"`          // derived series: rate, irate, derivative, delta, integral, cumulative_sum
+	Window           *WindowRequest `json:"window,omitempty"`            // moving-window transform of the result
+	GroupAggregation string         `json:"group_aggregation,omitempty"` // multi-read: reduce the keys to one series (avg, sum, min, max, count, median, p50, p95, p99)
+}
+
+// WindowRequest selects a moving-window transform: moving_average, ema,
+// moving_median or moving_stddev over the last Points points or Seconds
+// seconds.
+type WindowRequest struct {
+	Function string  `json:"function"`
+	Points   int     `json:"points,omitempty"`
+	Seconds  float64 `json:"seconds,omitempty"`
 }
 
 type DeleteDataPointRequest struct {
@@ -38,18 +105,58 @@ type DeleteDataPointRequest struct {
 }
 
 type ExportRequest struct {
-	Format      string `json:"format,omitempty"` // "csv" or "json"
-	StartTime   int64  `json:"start_timestamp,omitempty"`
-	EndTime     int64  `json:"end_timestamp,omitempty"`
-	Downsample  int    `json:"downsampling,omitempty"`
-	LastX       int    `json:"lastx,omitempty"`
-	Aggregation string `json:"aggregation,omitempty"`
+	Format      string         `json:"format,omitempty"` // "csv" or "json"
+	StartTime   int64          `json:"start_timestamp,omitempty"`
+	EndTime     int64          `json:"end_timestamp,omitempty"`
+	Downsample  int            `json:"downsampling,omitempty"`
+	LastX       int            `json:"lastx,omitempty"`
+	Aggregation string         `json:"aggregation,omitempty"`
+	Fields      []string       `json:"fields,omitempty"`   // multi-field keys: fields to export (default all)
+	Align       string         `json:"align,omitempty"`    // as for ReadRequest
+	Timezone    string         `json:"timezone,omitempty"` // as for ReadRequest
+	Window      *WindowRequest `json:"window,omitempty"`   // as for ReadRequest
 }
 
+// maxBatchPoints is the most points one batch-write (or binary write frame)
+// may carry.
+const maxBatchPoints = 10000
+
 type BatchWritePoint struct {
-	Key       string  `json:"key"`
-	Value     float64 `json:"value"`
-	Timestamp int64   `json:"timestamp,omitempty"`
+	Key       string             `json:"key"`
+	Value     float64            `json:"value"`
+	Timestamp int64              `json:"timestamp,omitempty"`
+	Fields    map[string]float64 `json:"fields,omitempty"`
+
+	raw string // JSON text of value, parsed as the key's type
+}
+
+// UnmarshalJSON keeps the value as JSON text for newPoint, as for
+// WriteRequest.
+func (p *BatchWritePoint) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Key       string             `json:"key"`
+		Value     json.RawMessage    `json:"value"`
+		Timestamp int64              `json:"timestamp"`
+		Fields    map[string]float64 `json:"fields"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*p = BatchWritePoint{Key: aux.Key, Timestamp: aux.Timestamp, Fields: aux.Fields, raw: rawValue(aux.Value)}
+	return nil
+}
+
+// RollupRequest describes a continuous aggregate for addrollup/deleterollup.
+type RollupRequest struct {
+	Interval    string `json:"interval"`    // bucket width: "1m", "1h", "3600"
+	Aggregation string `json:"aggregation"` // avg, sum, min, max, first, last, count
+}
+
+// RollupInfo is one entry of a listrollups response.
+type RollupInfo struct {
+	Key         string `json:"key"`      // target key holding the rollup
+	Interval    int64  `json:"interval"` // seconds
+	Aggregation string `json:"aggregation"`
 }
 
 type Operation struct {
@@ -63,12 +170,35 @@ type Operation struct {
 	Keys           []string                `json:"keys,omitempty"`
 	Data           string                  `json:"data,omitempty"`            // CSV data for patch operation
 	Points         []BatchWritePoint       `json:"points,omitempty"`          // Batch write points
-	Since          int64                   `json:"since,omitempty"`           // Optional timestamp for subscribe operation
+	Since          int64                   `json:"since,omitempty"`           // Optional timestamp for subscribe operation; replicate: last applied seq
 	ResponseFormat string                  `json:"response_format,omitempty"` // "json" (default) or "binary"
+	Stream         bool                    `json:"stream,omitempty"`          // read/export: send the result in chunks
 	MaxPoints      int64                   `json:"max_points,omitempty"`      // setquota: max stored data points (0 = unlimited)
+	Retention      string                  `json:"retention,omitempty"`       // setretention/setuserretention: "90d", "12h", "forever", "0" = inherit
+	Rollup         *RollupRequest          `json:"rollup,omitempty"`          // addrollup/deleterollup
+	Labels         map[string]string       `json:"labels,omitempty"`          // setlabels: label set (empty = remove)
+	Selector       string                  `json:"selector,omitempty"`        // ids/multi-read: label selector, e.g. site=hk,type=~"temp|hum"
+	Fields         []string                `json:"fields,omitempty"`          // initkey: field names of a multi-field key
+	Type           string                  `json:"type,omitempty"`            // initkey: value type (float, int, bool, string)
+	Precision      string                  `json:"precision,omitempty"`       // initkey: timestamp unit (s, ms, us, ns)
+	Path           string                  `json:"path,omitempty"`            // snapshot: server-side file to write
+	Expression     string                  `json:"expression,omitempty"`      // expression: arithmetic over vars, e.g. "v * i"
+	Vars           map[string]string       `json:"vars,omitempty"`            // expression: variable name -> key
+	Query          string                  `json:"query,omitempty"`           // query: text query, e.g. SELECT avg(value) FROM "sensor*"
+	Pattern        string                  `json:"pattern,omitempty"`         // multi-read: key glob, e.g. building3/*
+	Epoch          string                  `json:"epoch,omitempty"`           // replicate: leader epoch of the follower's position
+	ID             json.RawMessage         `json:"id,omitempty"`              // TCP: any JSON value, echoed in the reply; the request may run concurrently
+
+	// scope limits selector matches to keys with this prefix. Set by the
+	// HTTP/TCP handlers to the caller's namespace; empty means every key.
+	scope string
 }
 
 type Response struct {
+	ID              json.RawMessage               `json:"id,omitempty"`     // TCP: the request's id
+	Type            string                        `json:"type,omitempty"`   // TCP: typeReply, typePush or typePing
+	More            bool                          `json:"more,omitempty"`   // TCP: a chunk of a streamed read or export; more follow
+	Cursor          string                        `json:"cursor,omitempty"` // read: continuation of a paged read; absent on the last page
 	Success         bool                          `json:"success"`
 	Message         string                        `json:"message,omitempty"`
 	Data            interface{}                   `json:"data,omitempty"`
@@ -76,6 +206,13 @@ type Response struct {
 	MultiData       map[string][]models.DataPoint `json:"multi_data,omitempty"`
 }
 
+// Types of the lines sent on a TCP connection.
+const (
+	typeReply = "reply" // the answer to a request
+	typePush  = "push"  // a point of a subscription
+	typePing  = "ping"  // keepalive
+)
+
 // MarshalJSON implements json.Marshaler with a fast path for MultiData responses.
 // For multi-read, builds JSON directly without reflection.
 func (r Response) MarshalJSON() ([]byte, error) {
@@ -94,7 +231,18 @@ func (r Response) MarshalJSON() ([]byte, error) {
 	}
 	sb.Grow(totalEst)
 
-	sb.WriteString(`{"success":true,"multi_data":{`)
+	sb.WriteByte('{')
+	if r.ID != nil {
+		sb.WriteString(`"id":`)
+		sb.Write(r.ID)
+		sb.WriteByte(',')
+	}
+	if r.Type != "" {
+		sb.WriteString(`"type":"`)
+		sb.WriteString(r.Type)
+		sb.WriteString(`",`)
+	}
+	sb.WriteString(`"success":true,"multi_data":{`)
 	first := true
 	for k, pts := range r.MultiData {
 		if !first {
@@ -130,6 +278,23 @@ const (
 	maxPatchDataLength int   = 10 * 1024 * 1024 // 10MB
 )
 
+// createSnapshot writes a snapshot to file, by default
+// <data>-snapshot-<time>.tar next to the data directory.
+func createSnapshot(file string) Response {
+	if file == "" {
+		file = fmt.Sprintf("%s-snapshot-%s.tar", filepath.Clean(utils.DataDir), time.Now().Format("20060102-150405"))
+	}
+	m, err := snapshot.Create(file)
+	if err != nil {
+		return Response{Success: false, Message: "Snapshot failed: " + err.Error()}
+	}
+	return Response{
+		Success: true,
+		Message: fmt.Sprintf("Snapshot of %d keys written to %s", len(m.Keys), file),
+		Data:    map[string]interface{}{"path": file, "keys": len(m.Keys), "files": m.Files, "bytes": m.Bytes},
+	}
+}
+
 // validateTimestamp checks if a timestamp is within a reasonable range
 func validateTimestamp(ts int64) bool {
 	if ts > 0 && (ts < minValidTimestamp || ts > maxValidTimestamp) {
@@ -138,6 +303,29 @@ func validateTimestamp(ts int64) bool {
 	return true
 }
 
+// timestampColumn names the CSV export timestamp column, with the unit for
+// keys finer than seconds (timestamp_ms, timestamp_us, timestamp_ns).
+func timestampColumn(key string) string {
+	if precision := buffer.KeyPrecision(key); precision != models.PrecisionSecond {
+		return "timestamp_" + precision.String()
+	}
+	return "timestamp"
+}
+
+// validateKeyTimestamp checks a timestamp given in the key's precision.
+func validateKeyTimestamp(key string, ts int64) bool {
+	return validatePrecisionTimestamp(buffer.KeyPrecision(key), ts)
+}
+
+// validatePrecisionTimestamp is validateKeyTimestamp for a timestamp in unit p.
+func validatePrecisionTimestamp(p models.Precision, ts int64) bool {
+	perSecond := p.PerSecond()
+	if ts > 0 && (ts < minValidTimestamp*perSecond || ts > maxValidTimestamp*perSecond) {
+		return false
+	}
+	return true
+}
+
 // validateKey checks for path traversal and other unsafe characters
 func validateKey(key string) bool {
 	if key == "" {
@@ -170,7 +358,10 @@ var noKeyActions = map[string]bool{
 	"idswithcount":     true,
 	"idswithcount-own": true,
 	"multi-read":       true,
+	"expression":       true,
+	"query":            true,
 	"batch-write":      true,
+	"syncstatus":       true,
 }
 
 // quotaWriteOps are the operations that grow a user's stored data points.
@@ -180,6 +371,37 @@ var quotaWriteOps = map[string]bool{
 	"data-patch":  true,
 }
 
+// replicaReadOnlyOps change stored data, so a follower refuses them: its
+// data comes from the leader only.
+var replicaReadOnlyOps = map[string]bool{
+	"write":           true,
+	"batch-write":     true,
+	"data-patch":      true,
+	"deletedatapoint": true,
+	"initkey":         true,
+	"renamekey":       true,
+	"deletekey":       true,
+	"compact":         true,
+	"addrollup":       true,
+	"deleterollup":    true,
+}
+
+// corruptionCheckedOps read stored points. They fail when a record they
+// met did not match its checksum, instead of answering without it.
+var corruptionCheckedOps = map[string]bool{
+	"read":       true,
+	"multi-read": true,
+	"export":     true,
+	"expression": true,
+	"query":      true,
+}
+
+// corruptReadMessage is the error of a read that skipped corrupt records
+// of key.
+func corruptReadMessage(key string) string {
+	return fmt.Sprintf("Records of %s fail their checksum; compact the key to drop them", key)
+}
+
 // estimateIncoming counts how many data points a write operation would add.
 // Used only for O(1)-ish quota pre-checking (no file IO); the periodic
 // reconciler keeps the authoritative per-user count. O(payload) worst case.
@@ -224,11 +446,15 @@ func quotaCheckBeforeWrite(userName string, op Operation) string {
 		return ""
 	}
 	if incoming := estimateIncoming(op); incoming > 0 && !quota.CheckWrite(userName, incoming) {
-		return fmt.Sprintf("Data point storage quota exceeded (max %d points). Delete data or upgrade.", quota.MaxPoints(userName))
+		return quotaExceededMessage(userName)
 	}
 	return ""
 }
 
+func quotaExceededMessage(userName string) string {
+	return fmt.Sprintf("Data point storage quota exceeded (max %d points). Delete data or upgrade.", quota.MaxPoints(userName))
+}
+
 // quotaAccountAfterWrite records a successful write against the user's counter.
 func quotaAccountAfterWrite(userName string, op Operation, success bool) {
 	if !success || !quotaWriteOps[strings.ToLower(op.Operation)] {
@@ -239,7 +465,329 @@ func quotaAccountAfterWrite(userName string, op Operation, success bool) {
 	}
 }
 
-func HandleOperation(op Operation) Response {
+// selectKeys resolves a label selector to the keys the caller may read. A
+// scope of "<user>/" applies the rule the ids listing filters by
+// (isAllowedKeyForUser), so a selector never sees a key ids would hide; an
+// empty scope selects from every key.
+func selectKeys(selector, scope string) ([]string, error) {
+	matchers, err := labels.ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	if scope == "" {
+		return labels.Select(matchers, nil), nil
+	}
+	userName := strings.TrimSuffix(scope, "/")
+	return labels.Select(matchers, func(key string) bool { return isAllowedKeyForUser(key, userName) }), nil
+}
+
+// projectionFields validates a read's field projection against the key's
+// schema. It returns the fields to report: the requested ones, every schema
+// field when none are requested, or nil for a single-value key.
+func projectionFields(key string, requested []string) ([]string, error) {
+	schema := buffer.KeyFields(key)
+	if schema == nil {
+		if len(requested) > 0 {
+			return nil, fmt.Errorf("key %s has no fields", key)
+		}
+		return nil, nil
+	}
+	if len(requested) == 0 {
+		return schema, nil
+	}
+	for _, name := range requested {
+		found := false
+		for _, f := range schema {
+			if f == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field %s for key %s", name, key)
+		}
+	}
+	return requested, nil
+}
+
+// parseFieldColumns maps CSV columns to schema fields; empty cells are
+// fields that were not written.
+func parseFieldColumns(schema, columns []string) (map[string]float64, bool) {
+	fields := make(map[string]float64, len(schema))
+	for i, cell := range columns {
+		cell = strings.TrimSpace(cell)
+		if cell == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(cell, 64)
+		if err != nil {
+			return nil, false
+		}
+		fields[schema[i]] = v
+	}
+	return fields, len(fields) > 0
+}
+
+// csvCell quotes a CSV value containing a separator, quote or line break.
+func csvCell(s string) string {
+	if !strings.ContainsAny(s, ",\"\r\n") {
+		return s
+	}
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
+
+// checkReadRequest validates the parameters of a read of key, defaulting
+// the aggregation to avg. It returns an error message or "".
+func checkReadRequest(key string, r *ReadRequest) string {
+	if r.Aggregation == "" {
+		r.Aggregation = "avg"
+	}
+	// start time and end time are set either both or none
+	if (r.StartTime == 0 && r.EndTime != 0) || (r.StartTime != 0 && r.EndTime == 0) {
+		return "Both start and end time required or none"
+	}
+	// start time must be less than end time
+	if r.StartTime > 0 && r.EndTime > 0 && r.StartTime > r.EndTime {
+		return "Start time must be less than end time"
+	}
+	// validate timestamps
+	if !validateKeyTimestamp(key, r.StartTime) || !validateKeyTimestamp(key, r.EndTime) {
+		return "Timestamp out of valid range (2000-2100)"
+	}
+	if _, err := projectionFields(key, r.Fields); err != nil {
+		return err.Error()
+	}
+	align, msg := parseAlignment(r.Align, r.Timezone, r.Downsample)
+	if msg != "" {
+		return msg
+	}
+	if align.Downsamples(r.Downsample) {
+		if err := buffer.ValidateAggregation(key, r.Aggregation); err != nil {
+			return err.Error()
+		}
+	}
+	if r.Order != "" && r.Order != "asc" && r.Order != "desc" {
+		return "Order must be 'asc' or 'desc'"
+	}
+	if r.Limit < 0 {
+		return "Limit must not be negative"
+	}
+	if (r.Limit > 0 || r.Cursor != "") && (r.StartTime == 0 || r.LastX > 0) {
+		return "Limit and cursor require start and end time"
+	}
+	if r.Cursor != "" && r.Limit == 0 {
+		return "Cursor requires a limit"
+	}
+	if err := buffer.ValidateFunction(key, r.Function); err != nil {
+		return err.Error()
+	}
+	if r.Function != "" && r.Limit > 0 {
+		return "function cannot be combined with limit"
+	}
+	if _, msg := parseWindow(key, r.Window); msg != "" {
+		return msg
+	}
+	if r.Window != nil && r.Limit > 0 {
+		return "window cannot be combined with limit"
+	}
+	return checkFill(key, r, align)
+}
+
+// checkFill validates the fill of a read of key: it needs a downsampled
+// time range, read at once. It returns an error message or "".
+func checkFill(key string, r *ReadRequest, align buffer.Alignment) string {
+	fill, err := buffer.ParseFill(r.Fill)
+	if err != nil {
+		return err.Error()
+	}
+	if !fill.Active() {
+		return ""
+	}
+	if !align.Downsamples(r.Downsample) || r.StartTime == 0 || r.LastX > 0 {
+		return "fill requires a downsampled time range"
+	}
+	if r.Limit > 0 {
+		return "fill cannot be combined with limit"
+	}
+	align, _ = readAlignment(r)
+	if err := buffer.ValidateFill(key, fill, r.StartTime, r.EndTime, r.Downsample, align); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// parseWindow returns the moving-window transform of a read or export of
+// key, or an error message. A nil request is no transform.
+func parseWindow(key string, w *WindowRequest) (buffer.Window, string) {
+	if w == nil {
+		return buffer.Window{}, ""
+	}
+	window := buffer.Window{
+		Function: w.Function,
+		Points:   w.Points,
+		Span:     int64(w.Seconds * float64(buffer.KeyPrecision(key).PerSecond())),
+	}
+	if err := buffer.ValidateWindow(key, window); err != nil {
+		return buffer.Window{}, err.Error()
+	}
+	return window, ""
+}
+
+// checkGroupRead validates a multi-read of keys reduced to one series: a
+// downsampled time range of numeric keys without fields. It returns an
+// error message or "".
+func checkGroupRead(keys []string, r *ReadRequest, align buffer.Alignment) string {
+	if r.GroupAggregation == "" {
+		return ""
+	}
+	if err := buffer.ValidateGroupAggregation(r.GroupAggregation); err != nil {
+		return err.Error()
+	}
+	if !align.Downsamples(r.Downsample) || r.StartTime == 0 || r.LastX > 0 {
+		return "group_aggregation requires a downsampled time range"
+	}
+	for _, key := range keys {
+		if buffer.KeyType(key) == models.TypeString || buffer.KeyFields(key) != nil {
+			return fmt.Sprintf("group_aggregation needs numeric keys without fields: %s", key)
+		}
+		// Buckets are joined by timestamp, which must count the same unit
+		if p, q := buffer.KeyPrecision(keys[0]), buffer.KeyPrecision(key); p != q {
+			return fmt.Sprintf("group_aggregation needs keys of one timestamp precision: %s is in %s, %s in %s", keys[0], p, key, q)
+		}
+	}
+	return ""
+}
+
+// emptyMultiRead answers a multi-read whose selector or pattern matches no
+// key.
+func emptyMultiRead(r *ReadRequest) Response {
+	if r != nil && r.GroupAggregation != "" {
+		return Response{Success: true, Data: []models.DataPoint{}, Message: "Aggregated 0 keys"}
+	}
+	return Response{Success: true, MultiData: map[string][]models.DataPoint{}}
+}
+
+// readAlignment returns the bucket alignment and fill of a validated read.
+// Filling needs fixed buckets: without an align unit they are aligned to
+// the epoch.
+func readAlignment(r *ReadRequest) (buffer.Alignment, buffer.Fill) {
+	align, _ := parseAlignment(r.Align, r.Timezone, r.Downsample)
+	fill, _ := buffer.ParseFill(r.Fill)
+	if fill.Active() && align.Unit == "" {
+		align.Unit = "epoch"
+	}
+	return align, fill
+}
+
+// parseAlignment returns the bucket alignment of a read or export, or an
+// error message.
+func parseAlignment(align, timezone string, downsample int) (buffer.Alignment, string) {
+	a, err := buffer.ParseAlignment(align, timezone)
+	if err != nil {
+		return a, err.Error()
+	}
+	if a.Unit == "epoch" && downsample <= 1 {
+		return a, "align epoch requires downsampling"
+	}
+	return a, ""
+}
+
+// encodePageCursor returns the cursor of the page of a read whose range
+// starts (ascending) or ends (descending) at next.
+func encodePageCursor(order string, next int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(order + ":" + strconv.FormatInt(next, 10)))
+}
+
+// decodePageCursor reverses encodePageCursor for a read in order.
+func decodePageCursor(cursor, order string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("Invalid cursor")
+	}
+	o, ts, ok := strings.Cut(string(b), ":")
+	next, err := strconv.ParseInt(ts, 10, 64)
+	if !ok || err != nil {
+		return 0, errors.New("Invalid cursor")
+	}
+	if o != order {
+		return 0, errors.New("Cursor is for order " + o)
+	}
+	return next, nil
+}
+
+// checkExportRequest validates the parameters of an export of key and
+// returns its format and CSV field columns, or an error message. A
+// streamed export is written as CSV or NDJSON (the default); otherwise
+// as CSV or JSON.
+func checkExportRequest(key string, e *ExportRequest, stream bool) (format string, fields []string, msg string) {
+	format = e.Format
+	switch {
+	case stream && format == "":
+		format = "ndjson"
+	case stream && format != "csv" && format != "ndjson":
+		return "", nil, "Streamed format must be 'csv' or 'ndjson'"
+	case format == "":
+		format = "json"
+	case !stream && format != "csv" && format != "json":
+		return "", nil, "Format must be 'csv' or 'json'"
+	}
+	fields, err := projectionFields(key, e.Fields)
+	if err != nil {
+		return "", nil, err.Error()
+	}
+	align, msg := parseAlignment(e.Align, e.Timezone, e.Downsample)
+	if msg != "" {
+		return "", nil, msg
+	}
+	if align.Downsamples(e.Downsample) {
+		if err := buffer.ValidateAggregation(key, e.Aggregation); err != nil {
+			return "", nil, err.Error()
+		}
+	}
+	if _, msg := parseWindow(key, e.Window); msg != "" {
+		return "", nil, msg
+	}
+	return format, fields, ""
+}
+
+// writeCSVHeader writes the header line of a CSV export. A multi-field
+// key (fields not nil) has one column per field.
+func writeCSVHeader(sb *strings.Builder, key string, fields []string) {
+	if fields == nil {
+		sb.WriteString("key," + timestampColumn(key) + ",value\n")
+		return
+	}
+	sb.WriteString("key," + timestampColumn(key) + "," + strings.Join(fields, ",") + "\n")
+}
+
+// writeCSVRows writes points as CSV export lines. Fields not written are
+// left empty.
+func writeCSVRows(sb *strings.Builder, points []models.DataPoint, fields []string) {
+	for _, p := range points {
+		if fields == nil {
+			sb.WriteString(fmt.Sprintf("%s,%d,%s\n", p.Key, p.Timestamp, csvCell(p.FormatValue())))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%s,%d", p.Key, p.Timestamp))
+		for _, name := range fields {
+			sb.WriteByte(',')
+			if v, ok := p.Fields[name]; ok {
+				sb.WriteString(fmt.Sprintf("%f", v))
+			}
+		}
+		sb.WriteByte('\n')
+	}
+}
+
+// csvUnquote reverses csvCell.
+func csvUnquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+	}
+	return s
+}
+
+func HandleOperation(op Operation) (resp Response) {
 	loweredOperation := strings.ToLower(op.Operation)
 
 	if !noKeyActions[loweredOperation] && op.Key == "" {
@@ -259,6 +807,29 @@ func HandleOperation(op Operation) Response {
 		}
 	}
 
+	if replicaReadOnlyOps[loweredOperation] && replication.IsFollower() {
+		return Response{Success: false, Message: "Read-only replica: write to the leader at " + utils.ReplicationLeader}
+	}
+
+	if corruptionCheckedOps[loweredOperation] {
+		mark := buffer.GetCorruptRecordCount()
+		defer func() {
+			if !resp.Success {
+				return
+			}
+			keys := append([]string{op.Key}, op.Keys...) // op.Keys: selector matches too
+			for _, key := range op.Vars {
+				keys = append(keys, key)
+			}
+			for key := range resp.MultiData {
+				keys = append(keys, key)
+			}
+			if key, ok := buffer.CorruptKeySince(mark, keys...); ok {
+				resp = Response{Success: false, Message: corruptReadMessage(strings.TrimPrefix(key, op.scope))}
+			}
+		}()
+	}
+
 	switch loweredOperation {
 	case "serverinfo":
 		var m runtime.MemStats
@@ -276,6 +847,7 @@ func HandleOperation(op Operation) Response {
 			"listen_http":     utils.HttpListenAddr,
 			"data_dir":        utils.DataDir,
 			"file_handle_lru": utils.FileHandleLRUCapacity,
+			"replication":     replication.CurrentStatus(),
 		}
 		return Response{Success: true, Data: data}
 	case "export":
@@ -285,42 +857,130 @@ func HandleOperation(op Operation) Response {
 		if op.Key == "" {
 			return Response{Success: false, Message: "Key required"}
 		}
-		format := op.Export.Format
-		if format == "" {
-			format = "json"
-		}
-		if format != "csv" && format != "json" {
-			return Response{Success: false, Message: "Format must be 'csv' or 'json'"}
+		format, fields, msg := checkExportRequest(op.Key, op.Export, false)
+		if msg != "" {
+			return Response{Success: false, Message: msg}
 		}
 
 		var points []models.DataPoint
 		if op.Export.LastX > 0 {
 			points = buffer.ReadLastDataPoints(op.Key, op.Export.LastX)
 		} else if op.Export.StartTime > 0 && op.Export.EndTime > 0 {
-			points = buffer.ReadDataPoints(op.Key, op.Export.StartTime, op.Export.EndTime, op.Export.Downsample, op.Export.Aggregation)
+			align, _ := parseAlignment(op.Export.Align, op.Export.Timezone, op.Export.Downsample)
+			points = buffer.ReadAlignedDataPoints(op.Key, op.Export.StartTime, op.Export.EndTime, op.Export.Downsample, op.Export.Aggregation, align)
 		} else {
 			points = buffer.ReadLastDataPoints(op.Key, 1000)
 		}
+		window, _ := parseWindow(op.Key, op.Export.Window)
+		points = buffer.ApplyWindow(points, window)
+		points = buffer.ProjectFields(points, op.Export.Fields)
 
 		if format == "csv" {
 			var sb strings.Builder
-			sb.WriteString("key,timestamp,value\n")
-			for _, p := range points {
-				sb.WriteString(fmt.Sprintf("%s,%d,%f\n", p.Key, p.Timestamp, p.Value))
-			}
+			writeCSVHeader(&sb, op.Key, fields)
+			writeCSVRows(&sb, points, fields)
 			return Response{Success: true, Data: sb.String()}
 		}
 		return Response{Success: true, Data: points}
 	case "initkey":
-		buffer.InitKey(op.Key)
-		return Response{Success: true, Message: "Key initialized: " + op.Key}
+		valueType, err := models.ParseValueType(op.Type)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		precision, err := models.ParsePrecision(op.Precision)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		if valueType != models.TypeFloat && len(op.Fields) > 0 {
+			return Response{Success: false, Message: "Multi-field keys hold float values; type cannot be combined with fields"}
+		}
+		if len(op.Fields) == 0 && valueType == models.TypeFloat && precision == models.PrecisionSecond {
+			buffer.InitKey(op.Key)
+			return Response{Success: true, Message: "Key initialized: " + op.Key}
+		}
+		opts := buffer.KeyOptions{Fields: op.Fields, Type: valueType, Precision: precision}
+		if err := buffer.InitKeyWithOptions(op.Key, opts); err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		var details []string
+		if len(op.Fields) > 0 {
+			details = append(details, "fields: "+strings.Join(op.Fields, ","))
+		}
+		if valueType != models.TypeFloat {
+			details = append(details, "type: "+valueType.String())
+		}
+		if precision != models.PrecisionSecond {
+			details = append(details, "precision: "+precision.String())
+		}
+		return Response{Success: true, Message: "Key initialized: " + op.Key + " (" + strings.Join(details, ", ") + ")"}
 	case "renamekey":
 		buffer.RenameKey(op.Key, op.ToKey)
+		buffer.RenameRollups(op.Key, op.ToKey)
+		retention.RenameKey(op.Key, op.ToKey)
+		labels.RenameKey(op.Key, op.ToKey)
 		return Response{Success: true, Message: "Key renamed: " + op.Key + " -> " + op.ToKey}
 
 	case "deletekey":
 		buffer.DeleteKey(op.Key)
+		buffer.RemoveRollupsFor(op.Key)
+		retention.DeleteKey(op.Key)
+		labels.DeleteKey(op.Key)
 		return Response{Success: true, Message: "Key deleted: " + op.Key}
+	case "setretention":
+		seconds, err := retention.ParseRetention(op.Retention)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		retention.SetKeyRetention(op.Key, seconds)
+		if seconds == 0 {
+			return Response{Success: true, Message: "Retention override removed: " + op.Key}
+		}
+		return Response{Success: true, Message: "Retention set: " + op.Key}
+	case "getretention":
+		override, _ := retention.KeyRetention(op.Key)
+		return Response{Success: true, Data: map[string]int64{
+			"key_retention":       override,
+			"effective_retention": retention.Resolve(op.Key),
+		}}
+	case "setlabels":
+		if err := labels.SetLabels(op.Key, op.Labels); err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		return Response{Success: true, Message: "Labels set: " + op.Key}
+	case "getlabels":
+		return Response{Success: true, Data: labels.GetLabels(op.Key)}
+	case "addrollup", "deleterollup":
+		if op.Key == "" || op.Rollup == nil {
+			return Response{Success: false, Message: "Key and rollup required"}
+		}
+		interval, err := utils.ParseDurationSeconds(op.Rollup.Interval)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		rule := buffer.RollupRule{Source: op.Key, Interval: interval, Aggregation: op.Rollup.Aggregation}
+		if loweredOperation == "addrollup" {
+			if err := buffer.AddRollup(rule); err != nil {
+				return Response{Success: false, Message: err.Error()}
+			}
+			return Response{Success: true, Message: "Rollup added: " + rule.Target()}
+		}
+		if err := buffer.RemoveRollup(rule); err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		return Response{Success: true, Message: "Rollup removed: " + rule.Target()}
+	case "syncstatus":
+		// root sees the sync state of every forwarded key, users their own
+		scope := op.scope
+		if scope == "root/" {
+			scope = ""
+		}
+		return Response{Success: true, Data: forward.CurrentStatus(scope)}
+	case "listrollups":
+		rollups := []RollupInfo{}
+		for _, rule := range buffer.GetRollups(op.Key) {
+			rollups = append(rollups, RollupInfo{Key: rule.Target(), Interval: rule.Interval, Aggregation: rule.Aggregation})
+		}
+		return Response{Success: true, Data: rollups}
 	case "reloadkey":
 		ok := buffer.ReloadKey(op.Key)
 		if ok {
@@ -332,16 +992,16 @@ func HandleOperation(op Operation) Response {
 			return Response{Success: false, Message: "Write data required"}
 		}
 		if op.Write.Timestamp <= 0 {
-			op.Write.Timestamp = time.Now().Unix()
-		} else if !validateTimestamp(op.Write.Timestamp) {
+			op.Write.Timestamp = buffer.KeyPrecision(op.Key).Now()
+		} else if !validateKeyTimestamp(op.Key, op.Write.Timestamp) {
 			return Response{Success: false, Message: "Timestamp out of valid range (2000-2100)"}
 		}
 
-		dataPoint := models.DataPoint{
-			Key:       op.Key,
-			Timestamp: op.Write.Timestamp,
-			Value:     op.Write.Value,
+		dataPoint, err := newPoint(op.Key, op.Write.Timestamp, op.Write.Value, op.Write.raw, op.Write.Fields)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
 		}
+		op.Write.Value = dataPoint.Value // for the subscribers
 		buffer.StoreDataPointBuffer(dataPoint)
 		return Response{Success: true, Message: "Data point stored"}
 
@@ -349,10 +1009,10 @@ func HandleOperation(op Operation) Response {
 		if len(op.Points) == 0 {
 			return Response{Success: false, Message: "Points array required"}
 		}
-		if len(op.Points) > 10000 {
-			return Response{Success: false, Message: "Batch size exceeds maximum (10000)"}
+		if len(op.Points) > maxBatchPoints {
+			return Response{Success: false, Message: fmt.Sprintf("Batch size exceeds maximum (%d)", maxBatchPoints)}
 		}
-		now := time.Now().Unix()
+		now := time.Now().UnixNano()
 		dataPoints := make([]models.DataPoint, 0, len(op.Points))
 		for _, p := range op.Points {
 			if p.Key == "" {
@@ -363,15 +1023,15 @@ func HandleOperation(op Operation) Response {
 			}
 			ts := p.Timestamp
 			if ts <= 0 {
-				ts = now
-			} else if !validateTimestamp(ts) {
+				ts = buffer.KeyPrecision(p.Key).FromNanos(now)
+			} else if !validateKeyTimestamp(p.Key, ts) {
 				return Response{Success: false, Message: "Timestamp out of valid range for key: " + p.Key}
 			}
-			dataPoints = append(dataPoints, models.DataPoint{
-				Key:       p.Key,
-				Timestamp: ts,
-				Value:     p.Value,
-			})
+			dataPoint, err := newPoint(p.Key, ts, p.Value, p.raw, p.Fields)
+			if err != nil {
+				return Response{Success: false, Message: err.Error()}
+			}
+			dataPoints = append(dataPoints, dataPoint)
 		}
 		buffer.StoreDataPointsBuffer(dataPoints)
 		return Response{Success: true, Message: fmt.Sprintf("Stored %d data points", len(op.Points))}
@@ -380,23 +1040,13 @@ func HandleOperation(op Operation) Response {
 		if op.Read == nil {
 			return Response{Success: false, Message: "Read parameters required"}
 		}
-		if op.Read.Aggregation == "" {
-			op.Read.Aggregation = "avg"
-		}
-		// start time and end time are set either both or none
-		if (op.Read.StartTime == 0 && op.Read.EndTime != 0) || (op.Read.StartTime != 0 && op.Read.EndTime == 0) {
-			return Response{Success: false, Message: "Both start and end time required or none"}
-		}
-		// start time must be less than end time
-		if op.Read.StartTime > 0 && op.Read.EndTime > 0 && op.Read.StartTime > op.Read.EndTime {
-			return Response{Success: false, Message: "Start time must be less than end time"}
-		}
-		// validate timestamps
-		if !validateTimestamp(op.Read.StartTime) || !validateTimestamp(op.Read.EndTime) {
-			return Response{Success: false, Message: "Timestamp out of valid range (2000-2100)"}
+		if msg := checkReadRequest(op.Key, op.Read); msg != "" {
+			return Response{Success: false, Message: msg}
 		}
 		utils.Log("Read request: %v", op.Read)
+		window, _ := parseWindow(op.Key, op.Read.Window)
 		var response []models.DataPoint
+		var cursor string
 		var readQueryParams ReadRequest
 		if op.Read.LastX > 0 {
 			// Use lastx when explicitly specified
@@ -408,7 +1058,8 @@ func HandleOperation(op Operation) Response {
 				LastX:       last,
 				Aggregation: op.Read.Aggregation,
 			}
-			response = buffer.ReadLastDataPoints(op.Key, last)
+			response = buffer.ApplyFunction(buffer.ReadLastDataPoints(op.Key, last), op.Read.Function)
+			response = buffer.ApplyWindow(response, window)
 		} else if op.Read.StartTime > 0 && op.Read.EndTime > 0 {
 			// Use timestamp range when both start and end times are provided
 			readQueryParams = ReadRequest{
@@ -416,16 +1067,61 @@ func HandleOperation(op Operation) Response {
 				EndTime:     op.Read.EndTime,
 				Downsample:  op.Read.Downsample,
 				Aggregation: op.Read.Aggregation,
+				Limit:       op.Read.Limit,
+				Align:       op.Read.Align,
+				Timezone:    op.Read.Timezone,
+				Fill:        op.Read.Fill,
+			}
+			align, fill := readAlignment(op.Read)
+			if op.Read.Limit > 0 {
+				// Paged: a cursor narrows the range to what is left
+				order := op.Read.Order
+				if order == "" {
+					order = "asc"
+				}
+				start, end := op.Read.StartTime, op.Read.EndTime
+				if op.Read.Cursor != "" {
+					next, err := decodePageCursor(op.Read.Cursor, order)
+					if err != nil {
+						return Response{Success: false, Message: err.Error()}
+					}
+					if order == "desc" && next < end {
+						end = next
+					} else if order == "asc" && next > start {
+						start = next
+					}
+				}
+				var next int64
+				var more bool
+				response, next, more = buffer.ReadPage(op.Key, start, end, op.Read.Limit, order == "desc", op.Read.Downsample, op.Read.Aggregation, align)
+				if more {
+					cursor = encodePageCursor(order, next)
+				}
+			} else {
+				response = buffer.ReadFunctionDataPoints(op.Key, op.Read.StartTime, op.Read.EndTime, op.Read.Downsample, op.Read.Aggregation, align, op.Read.Function)
+				response = buffer.ApplyWindow(response, window)
+				response = buffer.FillBuckets(op.Key, response, op.Read.StartTime, op.Read.EndTime, op.Read.Downsample, align, fill)
 			}
-			response = buffer.ReadDataPoints(op.Key, op.Read.StartTime, op.Read.EndTime, op.Read.Downsample, op.Read.Aggregation)
 		} else {
 			// Default to last 1 when no specific parameters are provided
 			readQueryParams = ReadRequest{
 				LastX:       1,
 				Aggregation: op.Read.Aggregation,
 			}
-			response = buffer.ReadLastDataPoints(op.Key, 1)
+			response = buffer.ApplyFunction(buffer.ReadLastDataPoints(op.Key, 1), op.Read.Function)
+			response = buffer.ApplyWindow(response, window)
+		}
+		readQueryParams.Fields = op.Read.Fields
+		readQueryParams.Order = op.Read.Order
+		readQueryParams.Function = op.Read.Function
+		readQueryParams.Window = op.Read.Window
+		if op.Read.Order == "desc" && op.Read.Limit == 0 {
+			slices.Reverse(response)
 		}
+		if precision := buffer.KeyPrecision(op.Key); precision != models.PrecisionSecond {
+			readQueryParams.Precision = precision.String()
+		}
+		response = buffer.ProjectFields(response, op.Read.Fields)
 
 		// Log first record of the response
 		if len(response) > 0 && response[0].Key != "" {
@@ -438,11 +1134,43 @@ func HandleOperation(op Operation) Response {
 			Success:         true,
 			Data:            response,
 			ReadQueryParams: &readQueryParams,
+			Cursor:          cursor,
+		}
+	case "expression":
+		return evaluateExpression(op)
+	case "query":
+		if op.Query == "" {
+			return Response{Success: false, Message: "Query required"}
 		}
+		result, err := query.Run(op.Query, op.scope)
+		if err != nil {
+			return Response{Success: false, Message: err.Error()}
+		}
+		return Response{Success: true, MultiData: result}
 	case "multi-read":
 		if op.Read == nil {
 			return Response{Success: false, Message: "Read parameters required"}
 		}
+		if len(op.Keys) == 0 && op.Selector != "" {
+			keys, err := selectKeys(op.Selector, op.scope)
+			if err != nil {
+				return Response{Success: false, Message: err.Error()}
+			}
+			if len(keys) == 0 {
+				return emptyMultiRead(op.Read)
+			}
+			op.Keys = keys
+		}
+		if len(op.Keys) == 0 && op.Pattern != "" {
+			keys, err := query.ExpandKeys([]string{op.Pattern}, op.scope)
+			if err != nil {
+				return Response{Success: false, Message: err.Error()}
+			}
+			if len(keys) == 0 {
+				return emptyMultiRead(op.Read)
+			}
+			op.Keys = keys
+		}
 		if len(op.Keys) == 0 {
 			return Response{Success: false, Message: "Keys array required"}
 		}
@@ -456,24 +1184,76 @@ func HandleOperation(op Operation) Response {
 			return Response{Success: false, Message: "Start time must be less than end time"}
 		}
 
+		align, msg := parseAlignment(op.Read.Align, op.Read.Timezone, op.Read.Downsample)
+		if msg != "" {
+			return Response{Success: false, Message: msg}
+		}
+		if align.Downsamples(op.Read.Downsample) {
+			for _, key := range op.Keys {
+				if err := buffer.ValidateAggregation(key, op.Read.Aggregation); err != nil {
+					return Response{Success: false, Message: err.Error()}
+				}
+			}
+		}
+		if msg := checkGroupRead(op.Keys, op.Read, align); msg != "" {
+			return Response{Success: false, Message: msg}
+		}
+		for _, key := range op.Keys {
+			if err := buffer.ValidateFunction(key, op.Read.Function); err != nil {
+				return Response{Success: false, Message: err.Error()}
+			}
+			if _, msg := parseWindow(key, op.Read.Window); msg != "" {
+				return Response{Success: false, Message: msg}
+			}
+			if msg := checkFill(key, op.Read, align); msg != "" {
+				return Response{Success: false, Message: msg}
+			}
+		}
+		align, fill := readAlignment(op.Read)
+		if op.Read.GroupAggregation != "" && align.Unit == "" {
+			align.Unit = "epoch" // buckets shared by every key
+		}
+
 		// Sequential reads: for in-memory cache hits, this is faster than goroutine overhead
 		result := make(map[string][]models.DataPoint, len(op.Keys))
 		for _, key := range op.Keys {
+			window, _ := parseWindow(key, op.Read.Window)
 			var response []models.DataPoint
 			if op.Read.LastX > 0 {
 				last := op.Read.LastX
 				if last < 0 {
 					last = last * -1
 				}
-				response = buffer.ReadLastDataPoints(key, last)
+				response = buffer.ApplyFunction(buffer.ReadLastDataPoints(key, last), op.Read.Function)
+				response = buffer.ApplyWindow(response, window)
 			} else if op.Read.StartTime > 0 && op.Read.EndTime > 0 {
-				response = buffer.ReadDataPoints(key, op.Read.StartTime, op.Read.EndTime, op.Read.Downsample, op.Read.Aggregation)
+				response = buffer.ReadFunctionDataPoints(key, op.Read.StartTime, op.Read.EndTime, op.Read.Downsample, op.Read.Aggregation, align, op.Read.Function)
+				response = buffer.ApplyWindow(response, window)
+				response = buffer.FillBuckets(key, response, op.Read.StartTime, op.Read.EndTime, op.Read.Downsample, align, fill)
 			} else {
-				response = buffer.ReadLastDataPoints(key, 1)
+				response = buffer.ApplyFunction(buffer.ReadLastDataPoints(key, 1), op.Read.Function)
+				response = buffer.ApplyWindow(response, window)
+			}
+			if len(op.Read.Fields) > 0 {
+				response = buffer.ProjectFields(response, op.Read.Fields)
 			}
 			result[key] = response
 		}
 
+		// Group read: one series named after the aggregation
+		if op.Read.GroupAggregation != "" {
+			series := make([][]models.DataPoint, 0, len(op.Keys))
+			for _, key := range op.Keys {
+				series = append(series, result[key])
+			}
+			return Response{
+				Success:         true,
+				Message:         fmt.Sprintf("Aggregated %d keys", len(op.Keys)),
+				Data:            buffer.ReduceSeries(op.Read.GroupAggregation, series, op.Read.GroupAggregation),
+				ReadQueryParams: op.Read,
+			}
+		}
+
 		// Count-only mode: return just the count per key (tiny response)
 		if op.Read.CountOnly {
 			counts := make(map[string]int, len(op.Keys))
@@ -493,6 +1273,13 @@ func HandleOperation(op Operation) Response {
 			ReadQueryParams: op.Read,
 		}
 	case "ids":
+		if op.Selector != "" {
+			keys, err := selectKeys(op.Selector, op.scope)
+			if err != nil {
+				return Response{Success: false, Message: err.Error()}
+			}
+			return Response{Success: true, Data: keys}
+		}
 		return Response{Success: true, Data: buffer.GetAllIds()}
 	case "idswithcount":
 		return Response{Success: true, Data: buffer.GetAllIdsWithCount()}
@@ -516,27 +1303,32 @@ func HandleOperation(op Operation) Response {
 		}
 
 		var points []models.DataPoint
+		schema := buffer.KeyFields(op.Key)
+		valueType := buffer.KeyType(op.Key)
 
 		// Check if data is a JSON array
 		trimmedData := strings.TrimSpace(op.Data)
 		if strings.HasPrefix(trimmedData, "[") {
 			// Parse JSON array format: [{"timestamp": 123, "value": 45.6}, ...]
+			// (multi-field keys: [{"timestamp": 123, "fields": {"temp": 21.5}}, ...])
 			var jsonPoints []struct {
-				Timestamp int64   `json:"timestamp"`
-				Value     float64 `json:"value"`
+				Timestamp int64              `json:"timestamp"`
+				Value     json.RawMessage    `json:"value"`
+				Fields    map[string]float64 `json:"fields"`
 			}
 			if err := json.Unmarshal([]byte(trimmedData), &jsonPoints); err != nil {
 				return Response{Success: false, Message: "Invalid JSON array format: " + err.Error()}
 			}
 			for _, jp := range jsonPoints {
-				points = append(points, models.DataPoint{
-					Key:       op.Key,
-					Timestamp: jp.Timestamp,
-					Value:     jp.Value,
-				})
+				dataPoint, err := newPoint(op.Key, jp.Timestamp, 0, rawValue(jp.Value), jp.Fields)
+				if err != nil {
+					return Response{Success: false, Message: err.Error()}
+				}
+				points = append(points, dataPoint)
 			}
 		} else {
 			// Parse CSV format: timestamp,value per line
+			// (multi-field keys: timestamp,<field1>,<field2>,... in schema order, empty = not written)
 			rows := strings.Split(op.Data, "\n")
 			for _, row := range rows {
 				row = strings.TrimSpace(row)
@@ -544,13 +1336,42 @@ func HandleOperation(op Operation) Response {
 					continue
 				}
 				parts := strings.Split(row, ",")
-				if len(parts) != 2 {
+				if valueType == models.TypeString {
+					// The value may itself contain commas (CSV-quoted)
+					parts = strings.SplitN(row, ",", 2)
+				}
+				if len(parts) != 2 && (schema == nil || len(parts) != len(schema)+1) {
 					continue
 				}
 				timestamp, err := strconv.ParseInt(parts[0], 10, 64)
 				if err != nil {
 					continue
 				}
+				if schema != nil {
+					fields, ok := parseFieldColumns(schema, parts[1:])
+					if !ok {
+						continue
+					}
+					dataPoint, err := buffer.NewDataPoint(op.Key, timestamp, 0, fields)
+					if err != nil {
+						continue
+					}
+					points = append(points, dataPoint)
+					continue
+				}
+				if valueType != models.TypeFloat {
+					text := parts[1]
+					if valueType == models.TypeString {
+						quoted, _ := json.Marshal(csvUnquote(text))
+						text = string(quoted)
+					}
+					dataPoint, err := buffer.ParseDataPoint(op.Key, timestamp, text)
+					if err != nil {
+						continue
+					}
+					points = append(points, dataPoint)
+					continue
+				}
 				value, err := strconv.ParseFloat(parts[1], 64)
 				if err != nil {
 					continue
@@ -588,7 +1409,7 @@ func HandleOperation(op Operation) Response {
 		if op.Payload.TimestampFrom > 0 && op.Payload.TimestampTo > 0 && op.Payload.TimestampFrom > op.Payload.TimestampTo {
 			return Response{Success: false, Message: "timestampFrom must be less than or equal to timestampTo"}
 		}
-		if !validateTimestamp(op.Payload.TimestampFrom) || !validateTimestamp(op.Payload.TimestampTo) {
+		if !validateKeyTimestamp(op.Key, op.Payload.TimestampFrom) || !validateKeyTimestamp(op.Key, op.Payload.TimestampTo) {
 			return Response{Success: false, Message: "Timestamp out of valid range (2000-2100)"}
 		}
 
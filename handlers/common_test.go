@@ -1,11 +1,14 @@
 package handlers
 
 import (
+	"encoding/json"
 	"gtsdb/auth"
 	"gtsdb/buffer"
 	"gtsdb/models"
 	"gtsdb/utils"
+	"math"
 	"os"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -1030,3 +1033,430 @@ func TestDataPatchOperation(t *testing.T) {
 	})
 }
 func ptr(f float64) *float64 { return &f }
+
+func TestRetentionOperations(t *testing.T) {
+	key := "retention_op_key"
+	HandleOperation(Operation{Operation: "initkey", Key: key})
+
+	resp := HandleOperation(Operation{Operation: "setretention", Key: key, Retention: "7d"})
+	if !resp.Success {
+		t.Fatalf("setretention failed: %s", resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "getretention", Key: key})
+	if !resp.Success {
+		t.Fatalf("getretention failed: %s", resp.Message)
+	}
+	data, ok := resp.Data.(map[string]int64)
+	if !ok || data["key_retention"] != 7*86400 || data["effective_retention"] != 7*86400 {
+		t.Errorf("unexpected retention data: %v", resp.Data)
+	}
+
+	resp = HandleOperation(Operation{Operation: "setretention", Key: key, Retention: "soon"})
+	if resp.Success {
+		t.Error("invalid retention should fail")
+	}
+
+	resp = HandleOperation(Operation{Operation: "setretention", Key: key, Retention: "0"})
+	if !resp.Success {
+		t.Fatalf("clearing retention failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "getretention", Key: key})
+	if data := resp.Data.(map[string]int64); data["key_retention"] != 0 {
+		t.Errorf("expected override removed, got %v", data)
+	}
+
+	HandleOperation(Operation{Operation: "deletekey", Key: key})
+}
+
+func TestRollupOperations(t *testing.T) {
+	key := "rollup_op_key"
+	HandleOperation(Operation{Operation: "initkey", Key: key})
+	defer HandleOperation(Operation{Operation: "deletekey", Key: key})
+
+	resp := HandleOperation(Operation{Operation: "addrollup", Key: key, Rollup: &RollupRequest{Interval: "1m", Aggregation: "avg"}})
+	if !resp.Success {
+		t.Fatalf("addrollup failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "addrollup", Key: key, Rollup: &RollupRequest{Interval: "1m", Aggregation: "p95"}})
+	if resp.Success {
+		t.Error("addrollup with p95 should fail")
+	}
+
+	resp = HandleOperation(Operation{Operation: "listrollups", Key: key})
+	rollups, ok := resp.Data.([]RollupInfo)
+	if !ok || len(rollups) != 1 || rollups[0].Key != key+":1m:avg" || rollups[0].Interval != 60 {
+		t.Fatalf("unexpected listrollups response: %+v", resp.Data)
+	}
+
+	resp = HandleOperation(Operation{Operation: "deleterollup", Key: key, Rollup: &RollupRequest{Interval: "60", Aggregation: "avg"}})
+	if !resp.Success {
+		t.Fatalf("deleterollup failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "listrollups", Key: key})
+	if rollups := resp.Data.([]RollupInfo); len(rollups) != 0 {
+		t.Errorf("expected no rollups, got %v", rollups)
+	}
+
+	// Operation names are case insensitive
+	resp = HandleOperation(Operation{Operation: "addRollup", Key: key, Rollup: &RollupRequest{Interval: "1m", Aggregation: "avg"}})
+	if !resp.Success || resp.Message != "Rollup added: "+key+":1m:avg" {
+		t.Fatalf("unexpected addRollup response: %+v", resp)
+	}
+	resp = HandleOperation(Operation{Operation: "listrollups", Key: key})
+	if rollups := resp.Data.([]RollupInfo); len(rollups) != 1 {
+		t.Errorf("expected one rollup, got %v", rollups)
+	}
+	resp = HandleOperation(Operation{Operation: "DeleteRollup", Key: key, Rollup: &RollupRequest{Interval: "1m", Aggregation: "avg"}})
+	if !resp.Success || resp.Message != "Rollup removed: "+key+":1m:avg" {
+		t.Errorf("unexpected DeleteRollup response: %+v", resp)
+	}
+}
+
+func TestLabelOperations(t *testing.T) {
+	writeTestData(t, "lbl_alice/t1", []float64{1, 2})
+	writeTestData(t, "lbl_alice/t2", []float64{3})
+	writeTestData(t, "lbl_bob/t1", []float64{4})
+	defer func() {
+		for _, k := range []string{"lbl_alice/t1", "lbl_alice/t2", "lbl_bob/t1"} {
+			HandleOperation(Operation{Operation: "deletekey", Key: k})
+		}
+	}()
+
+	for key, set := range map[string]map[string]string{
+		"lbl_alice/t1": {"site": "hk", "type": "temp"},
+		"lbl_alice/t2": {"site": "hk", "type": "hum"},
+		"lbl_bob/t1":   {"site": "hk", "type": "temp"},
+	} {
+		if resp := HandleOperation(Operation{Operation: "setlabels", Key: key, Labels: set}); !resp.Success {
+			t.Fatalf("setlabels failed: %s", resp.Message)
+		}
+	}
+
+	resp := HandleOperation(Operation{Operation: "getlabels", Key: "lbl_alice/t1"})
+	if got, ok := resp.Data.(map[string]string); !ok || got["site"] != "hk" || got["type"] != "temp" {
+		t.Errorf("unexpected getlabels response: %v", resp.Data)
+	}
+
+	resp = HandleOperation(Operation{Operation: "ids", Selector: `type="temp"`})
+	if ids, _ := resp.Data.([]string); len(ids) != 2 {
+		t.Errorf("expected 2 keys across users, got %v", resp.Data)
+	}
+	resp = HandleOperation(Operation{Operation: "ids", Selector: `type="temp"`, scope: "lbl_alice/"})
+	if ids, _ := resp.Data.([]string); len(ids) != 1 || ids[0] != "lbl_alice/t1" {
+		t.Errorf("expected scoped selector to match lbl_alice/t1, got %v", resp.Data)
+	}
+	// A scoped selector sees exactly the labelled keys the ids listing shows
+	var visible []string
+	for _, key := range []string{"lbl_alice/t1", "lbl_alice/t2", "lbl_bob/t1"} {
+		if isAllowedKeyForUser(key, "lbl_alice") {
+			visible = append(visible, key)
+		}
+	}
+	resp = HandleOperation(Operation{Operation: "ids", Selector: "site=hk", scope: "lbl_alice/"})
+	if ids, _ := resp.Data.([]string); !reflect.DeepEqual(ids, visible) {
+		t.Errorf("selector scope %v differs from ids scope %v", ids, visible)
+	}
+
+	resp = HandleOperation(Operation{Operation: "multi-read", Selector: "site=hk", scope: "lbl_alice/", Read: &ReadRequest{LastX: 10}})
+	if !resp.Success || len(resp.MultiData) != 2 || len(resp.MultiData["lbl_alice/t1"]) != 2 {
+		t.Errorf("unexpected multi-read by selector: %v (%s)", resp.MultiData, resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "multi-read", Selector: "site=nowhere", Read: &ReadRequest{LastX: 10}})
+	if !resp.Success || len(resp.MultiData) != 0 {
+		t.Errorf("expected empty multi-read, got %v (%s)", resp.MultiData, resp.Message)
+	}
+	if resp := HandleOperation(Operation{Operation: "ids", Selector: "site"}); resp.Success {
+		t.Error("invalid selector should fail")
+	}
+
+	// Labels follow renames and go away with the key
+	HandleOperation(Operation{Operation: "renamekey", Key: "lbl_alice/t2", ToKey: "lbl_alice/t3"})
+	resp = HandleOperation(Operation{Operation: "ids", Selector: "type=hum"})
+	if ids, _ := resp.Data.([]string); len(ids) != 1 || ids[0] != "lbl_alice/t3" {
+		t.Errorf("expected renamed key, got %v", resp.Data)
+	}
+	HandleOperation(Operation{Operation: "deletekey", Key: "lbl_alice/t3"})
+	resp = HandleOperation(Operation{Operation: "ids", Selector: "type=hum"})
+	if ids, _ := resp.Data.([]string); len(ids) != 0 {
+		t.Errorf("expected no keys after delete, got %v", resp.Data)
+	}
+}
+
+func TestMultiFieldOperations(t *testing.T) {
+	key := "mf_test/device"
+	defer HandleOperation(Operation{Operation: "deletekey", Key: key})
+
+	resp := HandleOperation(Operation{Operation: "initkey", Key: key, Fields: []string{"temp", "hum", "battery"}})
+	if !resp.Success {
+		t.Fatalf("initkey with fields failed: %s", resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{Value: 1}})
+	if resp.Success {
+		t.Error("expected a plain value write to a multi-field key to fail")
+	}
+	resp = HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{Fields: map[string]float64{"pressure": 1}}})
+	if resp.Success {
+		t.Error("expected an unknown field to fail")
+	}
+
+	resp = HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{
+		Timestamp: 1700000000,
+		Fields:    map[string]float64{"temp": 21.5, "hum": 40, "battery": 98},
+	}})
+	if !resp.Success {
+		t.Fatalf("write with fields failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "batch-write", Points: []BatchWritePoint{
+		{Key: key, Timestamp: 1700000001, Fields: map[string]float64{"temp": 22, "hum": 41}},
+	}})
+	if !resp.Success {
+		t.Fatalf("batch-write with fields failed: %s", resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{
+		StartTime: 1700000000, EndTime: 1700000001, Fields: []string{"hum", "battery"},
+	}})
+	points, ok := resp.Data.([]models.DataPoint)
+	if !resp.Success || !ok || len(points) != 2 {
+		t.Fatalf("unexpected read response: %+v", resp)
+	}
+	if len(points[0].Fields) != 2 || points[0].Fields["battery"] != 98 || points[0].Value != 40 {
+		t.Errorf("unexpected projected point: %+v", points[0])
+	}
+	if _, ok := points[1].Fields["battery"]; ok || points[1].Fields["hum"] != 41 {
+		t.Errorf("unexpected projected point: %+v", points[1])
+	}
+	if b, _ := points[1].MarshalJSON(); string(b) != `{"key":"mf_test/device","timestamp":1700000001,"fields":{"hum":41}}` {
+		t.Errorf("unexpected JSON: %s", b)
+	}
+	// JSON has no NaN or Inf: such fields are null
+	odd := models.DataPoint{Key: key, Timestamp: 1, Fields: map[string]float64{"hum": math.NaN(), "temp": math.Inf(1)}}
+	if b, _ := odd.MarshalJSON(); string(b) != `{"key":"mf_test/device","timestamp":1,"fields":{"hum":null,"temp":null}}` {
+		t.Errorf("unexpected JSON: %s", b)
+	} else if err := odd.UnmarshalJSON(b); err != nil || !math.IsNaN(odd.Fields["hum"]) || !math.IsNaN(odd.Fields["temp"]) {
+		t.Errorf("unexpected decoded point: %+v, %v", odd, err)
+	}
+	// JSON does not say which field is first: Value is NaN, not a made-up 0
+	var decoded models.DataPoint
+	if err := decoded.UnmarshalJSON([]byte(`{"key":"k","timestamp":1,"fields":{"hum":41,"temp":22}}`)); err != nil || !math.IsNaN(decoded.Value) || decoded.Fields["temp"] != 22 {
+		t.Errorf("unexpected decoded point: %+v, %v", decoded, err)
+	}
+
+	resp = HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{LastX: 1, Fields: []string{"nope"}}})
+	if resp.Success {
+		t.Error("expected projecting an unknown field to fail")
+	}
+
+	resp = HandleOperation(Operation{Operation: "data-patch", Key: key, Data: "1700000002,23,,97\n1700000003,24,43,96"})
+	if !resp.Success {
+		t.Fatalf("data-patch with field columns failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "export", Key: key, Export: &ExportRequest{
+		Format: "csv", StartTime: 1700000002, EndTime: 1700000003,
+	}})
+	want := "key,timestamp,temp,hum,battery\n" +
+		"mf_test/device,1700000002,23.000000,,97.000000\n" +
+		"mf_test/device,1700000003,24.000000,43.000000,96.000000\n"
+	if !resp.Success || resp.Data != want {
+		t.Errorf("unexpected CSV export: %q (%s)", resp.Data, resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "initkey", Key: key, Fields: []string{"temp"}})
+	if resp.Success {
+		t.Error("expected changing the fields of a key with data to fail")
+	}
+}
+
+func TestTypedKeyOperations(t *testing.T) {
+	key := "typed_test/door"
+	counter := "typed_test/counter"
+	defer HandleOperation(Operation{Operation: "deletekey", Key: key})
+	defer HandleOperation(Operation{Operation: "deletekey", Key: counter})
+
+	resp := HandleOperation(Operation{Operation: "initkey", Key: key, Type: "string"})
+	if !resp.Success {
+		t.Fatalf("initkey with type failed: %s", resp.Message)
+	}
+	if resp = HandleOperation(Operation{Operation: "initkey", Key: "typed_test/bad", Type: "decimal"}); resp.Success {
+		t.Error("expected an unknown type to fail")
+	}
+	if resp = HandleOperation(Operation{Operation: "initkey", Key: "typed_test/bad", Type: "int", Fields: []string{"a"}}); resp.Success {
+		t.Error("expected type with fields to fail")
+	}
+	if resp = HandleOperation(Operation{Operation: "initkey", Key: counter, Type: "int"}); !resp.Success {
+		t.Fatalf("initkey with type failed: %s", resp.Message)
+	}
+
+	// Values arrive as JSON text and are parsed as the key's type
+	var op Operation
+	if err := json.Unmarshal([]byte(`{"operation":"write","key":"typed_test/door","write":{"timestamp":1700000000,"value":"OPEN"}}`), &op); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if resp = HandleOperation(op); !resp.Success {
+		t.Fatalf("string write failed: %s", resp.Message)
+	}
+	op = Operation{}
+	if err := json.Unmarshal([]byte(`{"operation":"batch-write","points":[{"key":"typed_test/counter","timestamp":1700000000,"value":9007199254740993}]}`), &op); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if resp = HandleOperation(op); !resp.Success {
+		t.Fatalf("int batch-write failed: %s", resp.Message)
+	}
+	op = Operation{}
+	if err := json.Unmarshal([]byte(`{"operation":"write","key":"typed_test/counter","write":{"value":1.5}}`), &op); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if resp = HandleOperation(op); resp.Success {
+		t.Error("expected a fractional write to an int key to fail")
+	}
+	op = Operation{}
+	if err := json.Unmarshal([]byte(`{"operation":"write","key":"typed_test/counter","write":{"timestamp":1700000003,"value":42}}`), &op); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if resp = HandleOperation(op); !resp.Success || op.Write.Value != 42 {
+		t.Errorf("expected the stored value for subscribers, got %v (%s)", op.Write.Value, resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "data-patch", Key: key, Data: "1700000001,\"FAULT, door ajar\"\n1700000002,CLOSED"})
+	if !resp.Success {
+		t.Fatalf("data-patch of strings failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "data-patch", Key: counter, Data: `[{"timestamp":1700000001,"value":9007199254740995}]`})
+	if !resp.Success {
+		t.Fatalf("data-patch of ints failed: %s", resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "read", Key: counter, Read: &ReadRequest{StartTime: 1700000000, EndTime: 1700000001}})
+	points, ok := resp.Data.([]models.DataPoint)
+	if !resp.Success || !ok || len(points) != 2 || points[0].Int != 9007199254740993 || points[1].Int != 9007199254740995 {
+		t.Fatalf("unexpected int read: %+v", resp)
+	}
+
+	resp = HandleOperation(Operation{Operation: "export", Key: key, Export: &ExportRequest{
+		Format: "csv", StartTime: 1700000000, EndTime: 1700000002,
+	}})
+	want := "key,timestamp,value\n" +
+		"typed_test/door,1700000000,OPEN\n" +
+		"typed_test/door,1700000001,\"FAULT, door ajar\"\n" +
+		"typed_test/door,1700000002,CLOSED\n"
+	if !resp.Success || resp.Data != want {
+		t.Errorf("unexpected CSV export: %q (%s)", resp.Data, resp.Message)
+	}
+
+	resp = HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{StartTime: 1700000000, EndTime: 1700000002, Downsample: 10}})
+	if resp.Success {
+		t.Error("expected avg downsampling of a string key to fail")
+	}
+	resp = HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{StartTime: 1700000000, EndTime: 1700000002, Downsample: 10, Aggregation: "count"}})
+	points, ok = resp.Data.([]models.DataPoint)
+	if !resp.Success || !ok || len(points) != 1 || points[0].Type != models.TypeInt || points[0].Int != 3 {
+		t.Errorf("unexpected string count: %+v", resp)
+	}
+}
+
+func TestKeyPrecisionOperations(t *testing.T) {
+	key := "precision_test/vib"
+	defer HandleOperation(Operation{Operation: "deletekey", Key: key})
+
+	if resp := HandleOperation(Operation{Operation: "initkey", Key: "precision_test/bad", Precision: "ps"}); resp.Success {
+		t.Error("expected an unknown precision to fail")
+	}
+	if resp := HandleOperation(Operation{Operation: "initkey", Key: key, Precision: "ms"}); !resp.Success {
+		t.Fatalf("initkey with precision failed: %s", resp.Message)
+	}
+
+	base := int64(1700000000000)
+	for i := int64(0); i < 3; i++ {
+		resp := HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{Timestamp: base + i*400, Value: float64(i)}})
+		if !resp.Success {
+			t.Fatalf("ms write failed: %s", resp.Message)
+		}
+	}
+	// A seconds timestamp is out of range for an ms key
+	if resp := HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{Timestamp: 1700000001, Value: 1}}); resp.Success {
+		t.Error("expected a seconds timestamp on an ms key to fail")
+	}
+
+	resp := HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{StartTime: base, EndTime: base + 1000}})
+	points, ok := resp.Data.([]models.DataPoint)
+	if !resp.Success || !ok || len(points) != 3 || points[2].Timestamp != base+800 {
+		t.Fatalf("unexpected ms read: %+v", resp)
+	}
+	if resp.ReadQueryParams == nil || resp.ReadQueryParams.Precision != "ms" {
+		t.Errorf("expected read_query_params.precision ms, got %+v", resp.ReadQueryParams)
+	}
+	resp = HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{StartTime: base, EndTime: base + 1000, Downsample: 500, Aggregation: "count"}})
+	if points, ok = resp.Data.([]models.DataPoint); !ok || len(points) != 2 || points[0].Value != 2 {
+		t.Errorf("unexpected ms downsampling: %+v", resp)
+	}
+
+	resp = HandleOperation(Operation{Operation: "export", Key: key, Export: &ExportRequest{Format: "csv", LastX: 1}})
+	if want := "key,timestamp_ms,value\nprecision_test/vib,1700000000800,2.000000\n"; resp.Data != want {
+		t.Errorf("unexpected CSV export: %q", resp.Data)
+	}
+
+	// Writes without a timestamp use the current time in the key's unit
+	if resp = HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{Value: 3}}); !resp.Success {
+		t.Fatalf("write without timestamp failed: %s", resp.Message)
+	}
+	if last := buffer.ReadLastDataPoints(key, 1); len(last) != 1 || last[0].Timestamp < base {
+		t.Errorf("expected an ms timestamp, got %+v", last)
+	}
+
+	// Keys of different precisions cannot be joined by timestamp
+	seconds := "precision_test/temp"
+	defer HandleOperation(Operation{Operation: "deletekey", Key: seconds})
+	if resp = HandleOperation(Operation{Operation: "write", Key: seconds, Write: &WriteRequest{Timestamp: 1700000000, Value: 1}}); !resp.Success {
+		t.Fatalf("seconds write failed: %s", resp.Message)
+	}
+	read := &ReadRequest{StartTime: 1700000000, EndTime: 1700000600, Downsample: 300, GroupAggregation: "avg"}
+	if resp = HandleOperation(Operation{Operation: "multi-read", Keys: []string{seconds, key}, Read: read}); resp.Success || !strings.Contains(resp.Message, "precision") {
+		t.Errorf("expected a group of mixed precisions to fail, got %+v", resp)
+	}
+	read = &ReadRequest{StartTime: 1700000000, EndTime: 1700000600}
+	resp = HandleOperation(Operation{Operation: "expression", Expression: "a - b", Vars: map[string]string{"a": seconds, "b": key}, Read: read})
+	if resp.Success || !strings.Contains(resp.Message, "precision") {
+		t.Errorf("expected an expression over mixed precisions to fail, got %+v", resp)
+	}
+}
+
+func TestCorruptRecordFailsRead(t *testing.T) {
+	key := "corrupt_test/temp"
+	defer HandleOperation(Operation{Operation: "deletekey", Key: key})
+	base := int64(1700000000)
+	for i := int64(0); i < 3; i++ {
+		if resp := HandleOperation(Operation{Operation: "write", Key: key, Write: &WriteRequest{Timestamp: base + i, Value: float64(i)}}); !resp.Success {
+			t.Fatalf("write failed: %s", resp.Message)
+		}
+	}
+	HandleOperation(Operation{Operation: "flush"})
+
+	// Flip a value bit of the last record
+	file, err := os.OpenFile(utils.DataDir+"/"+key+".aof", os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _ := file.Stat()
+	if _, err := file.WriteAt([]byte{0xff}, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	resp := HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{StartTime: base, EndTime: base + 2}})
+	if resp.Success || !strings.Contains(resp.Message, "checksum") {
+		t.Errorf("expected the read of a corrupt record to fail, got %+v", resp)
+	}
+	resp = HandleOperation(Operation{Operation: "export", Key: key, Export: &ExportRequest{Format: "json", StartTime: base, EndTime: base + 2}})
+	if resp.Success || !strings.Contains(resp.Message, "checksum") {
+		t.Errorf("expected the export of a corrupt record to fail, got %+v", resp)
+	}
+	if resp = HandleOperation(Operation{Operation: "compact", Key: key}); !resp.Success {
+		t.Fatalf("compact failed: %s", resp.Message)
+	}
+	resp = HandleOperation(Operation{Operation: "read", Key: key, Read: &ReadRequest{StartTime: base, EndTime: base + 2}})
+	if points, ok := resp.Data.([]models.DataPoint); !resp.Success || !ok || len(points) != 2 {
+		t.Errorf("expected compaction to drop the corrupt record, got %+v", resp)
+	}
+}
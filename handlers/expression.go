@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"gtsdb/buffer"
+	"gtsdb/models"
+)
+
+// evaluateExpression answers an "expression" operation: the time range of
+// each key of op.Vars is read as for a read (downsampled, aggregated and
+// derived by a function, if requested) and the expression is evaluated at
+// the timestamps all of them have a point at. Downsampled series are
+// aligned to the epoch unless an align unit is given, so that their
+// buckets meet. The keys must share a timestamp precision. The points of
+// the result have the expression as key.
+func evaluateExpression(op Operation) Response {
+	if op.Read == nil {
+		return Response{Success: false, Message: "Read parameters required"}
+	}
+	if op.Expression == "" {
+		return Response{Success: false, Message: "Expression required"}
+	}
+	expr, err := buffer.ParseExpression(op.Expression)
+	if err != nil {
+		return Response{Success: false, Message: err.Error()}
+	}
+	r := op.Read
+	if r.StartTime == 0 || r.LastX > 0 {
+		return Response{Success: false, Message: "Expression requires start and end time"}
+	}
+	if r.Limit > 0 || r.Cursor != "" || r.Fill != "" || r.Window != nil {
+		return Response{Success: false, Message: "Expression reads take no limit, cursor, fill or window"}
+	}
+	for _, name := range expr.Vars() {
+		key, ok := op.Vars[name]
+		if !ok {
+			return Response{Success: false, Message: fmt.Sprintf("No key for variable %s", name)}
+		}
+		if !validateKey(key) {
+			return Response{Success: false, Message: "Invalid key format"}
+		}
+		if buffer.KeyType(key) == models.TypeString || buffer.KeyFields(key) != nil {
+			return Response{Success: false, Message: fmt.Sprintf("Variable %s needs a numeric key without fields", name)}
+		}
+		// Points are joined by timestamp, which must count the same unit
+		first := op.Vars[expr.Vars()[0]]
+		if p, q := buffer.KeyPrecision(first), buffer.KeyPrecision(key); p != q {
+			return Response{Success: false, Message: fmt.Sprintf("Variables %s and %s have different timestamp precisions (%s, %s)", expr.Vars()[0], name, p, q)}
+		}
+		if msg := checkReadRequest(key, r); msg != "" {
+			return Response{Success: false, Message: msg}
+		}
+	}
+
+	align, _ := parseAlignment(r.Align, r.Timezone, r.Downsample)
+	if align.Unit == "" && align.Downsamples(r.Downsample) {
+		align.Unit = "epoch"
+	}
+	series := make(map[string][]models.DataPoint, len(expr.Vars()))
+	for _, name := range expr.Vars() {
+		series[name] = buffer.ReadFunctionDataPoints(op.Vars[name], r.StartTime, r.EndTime, r.Downsample, r.Aggregation, align, r.Function)
+	}
+	return Response{Success: true, Data: expr.Evaluate(op.Expression, series)}
+}
@@ -6,7 +6,11 @@ import (
 	"gtsdb/auth"
 	"gtsdb/buffer"
 	"gtsdb/fanout"
+	"gtsdb/forward"
 	"gtsdb/models"
+	"gtsdb/replication"
+	"gtsdb/retention"
+	"gtsdb/snapshot"
 	"gtsdb/utils"
 	"net/http"
 	"runtime"
@@ -91,6 +95,80 @@ func isAllowedKeyForUser(key string, userName string) bool {
 	return false
 }
 
+// normalizeIngestAuth rewrites the credential styles of foreign write clients
+// into the Bearer header authenticateRequest expects: "Authorization: Token
+// <t>" (Influx v2), basic auth (Prometheus, Influx v1) and the u/p query
+// parameters (Influx v1). The GTSDB token goes in the password position.
+func normalizeIngestAuth(r *http.Request) {
+	header := r.Header.Get("Authorization")
+	token := ""
+	switch {
+	case strings.HasPrefix(header, "Token "):
+		token = strings.TrimPrefix(header, "Token ")
+	case strings.HasPrefix(header, "Basic "):
+		if _, password, ok := r.BasicAuth(); ok {
+			token = password
+		}
+	case header == "":
+		token = r.URL.Query().Get("p")
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// ingestPoints validates, quota-checks and stores points decoded from a
+// foreign write protocol (Influx line protocol, Prometheus remote write).
+// Keys must already be resolved to the caller's namespace and timestamps in
+// Unix nanoseconds; they are converted to each key's precision, and keys
+// that do not exist yet are created with newKeys precision. Returns 0 on
+// success, otherwise an HTTP status and a message; nothing is stored (or
+// created) unless every point is valid and fits the quota, and then every
+// point is stored at once, however many there are.
+func ingestPoints(userName string, points []BatchWritePoint, newKeys models.Precision) (int, string) {
+	if replication.IsFollower() {
+		return http.StatusForbidden, "Read-only replica: write to the leader at " + utils.ReplicationLeader
+	}
+	dataPoints := make([]models.DataPoint, 0, len(points))
+	var created []string
+	for i := range points {
+		p := &points[i]
+		if !validateKey(p.Key) || !isAllowedKeyForUser(p.Key, userName) {
+			return http.StatusBadRequest, "invalid key: " + p.Key
+		}
+		precision := buffer.KeyPrecision(p.Key)
+		if !buffer.KeyExists(p.Key) {
+			if len(created) == 0 || created[len(created)-1] != p.Key {
+				created = append(created, p.Key)
+			}
+			precision = newKeys
+		}
+		p.Timestamp = precision.FromNanos(p.Timestamp)
+		if !validatePrecisionTimestamp(precision, p.Timestamp) {
+			return http.StatusBadRequest, fmt.Sprintf("timestamp out of range for %s: %d", p.Key, p.Timestamp)
+		}
+		dataPoint, err := newPoint(p.Key, p.Timestamp, p.Value, p.raw, p.Fields)
+		if err != nil {
+			return http.StatusBadRequest, err.Error()
+		}
+		dataPoints = append(dataPoints, dataPoint)
+	}
+	op := Operation{Operation: "batch-write", Points: points}
+	if msg := quotaCheckBeforeWrite(userName, op); msg != "" {
+		return http.StatusForbidden, msg
+	}
+	if newKeys != models.PrecisionSecond {
+		for _, key := range created {
+			if err := buffer.InitKeyWithOptions(key, buffer.KeyOptions{Precision: newKeys}); err != nil {
+				return http.StatusInternalServerError, err.Error()
+			}
+		}
+	}
+	buffer.StoreDataPointsBuffer(dataPoints)
+	quotaAccountAfterWrite(userName, op, true)
+	return 0, ""
+}
+
 func SetupHTTPRoutes(fanoutManager *fanout.Fanout, noAuthUser string) http.Handler {
 	mux := http.NewServeMux()
 
@@ -127,6 +205,10 @@ gtsdb_data_points_total %d
 # TYPE gtsdb_uptime_seconds counter
 gtsdb_uptime_seconds %d
 
+# HELP gtsdb_corrupt_records_total WAL records skipped because their checksum did not match
+# TYPE gtsdb_corrupt_records_total counter
+gtsdb_corrupt_records_total %d
+
 # HELP gtsdb_goroutines Current number of goroutines
 # TYPE gtsdb_goroutines gauge
 gtsdb_goroutines %d
@@ -148,12 +230,57 @@ go_gc_duration_seconds_sum %f
 go_cpu_count %d
 `,
 			keyCount, totalPoints, uptime,
+			buffer.GetCorruptRecordCount(),
 			runtime.NumGoroutine(),
 			m.Alloc, m.HeapInuse,
 			float64(m.PauseTotalNs)/1e9,
 			runtime.NumCPU())
+
+		repl := replication.CurrentStatus()
+		connected := 0
+		if repl.Connected {
+			connected = 1
+		}
+		fmt.Fprintf(w, `
+# HELP gtsdb_replication_lag_seconds How far a follower's applied data trails the leader
+# TYPE gtsdb_replication_lag_seconds gauge
+gtsdb_replication_lag_seconds %f
+
+# HELP gtsdb_replication_lag_mutations Leader mutations a follower has not applied yet
+# TYPE gtsdb_replication_lag_mutations gauge
+gtsdb_replication_lag_mutations %d
+
+# HELP gtsdb_replication_applied_seq Sequence number of the last mutation a follower applied
+# TYPE gtsdb_replication_applied_seq gauge
+gtsdb_replication_applied_seq %d
+
+# HELP gtsdb_replication_connected Whether a follower is connected to its leader
+# TYPE gtsdb_replication_connected gauge
+gtsdb_replication_connected %d
+
+# HELP gtsdb_replication_log_seq Sequence number of the last mutation in a leader's replication log
+# TYPE gtsdb_replication_log_seq gauge
+gtsdb_replication_log_seq %d
+
+# HELP gtsdb_replication_followers Followers streaming from this leader
+# TYPE gtsdb_replication_followers gauge
+gtsdb_replication_followers %d
+`,
+			repl.LagSeconds, repl.LagMutations, repl.AppliedSeq, connected,
+			repl.LogSeq, repl.Followers)
 	})
 
+	// Influx line protocol (v2 and v1 paths) for Telegraf and friends
+	mux.HandleFunc("/api/v2/write", handleLineProtocolWrite(noAuthUser))
+	mux.HandleFunc("/write", handleLineProtocolWrite(noAuthUser))
+
+	// Prometheus remote storage
+	mux.HandleFunc("/api/v1/write", handlePromRemoteWrite(noAuthUser))
+	mux.HandleFunc("/api/v1/read", handlePromRemoteRead(noAuthUser))
+
+	// Online backup: streams a snapshot tar (root only)
+	mux.HandleFunc("/api/snapshot", handleSnapshotDownload(noAuthUser))
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		user, err := authenticateRequest(r, noAuthUser)
 		if err != nil {
@@ -217,6 +344,37 @@ go_cpu_count %d
 			return
 		}
 
+		if op.Operation == "setuserretention" {
+			if user.Name != "root" {
+				writeJSON(w, Response{Success: false, Message: "Unauthorized"})
+				return
+			}
+			if op.Key == "" {
+				writeJSON(w, Response{Success: false, Message: "Username required"})
+				return
+			}
+			seconds, err := retention.ParseRetention(op.Retention)
+			if err != nil {
+				writeJSON(w, Response{Success: false, Message: err.Error()})
+				return
+			}
+			if err := auth.SetUserRetention(op.Key, seconds); err != nil {
+				writeJSON(w, Response{Success: false, Message: err.Error()})
+				return
+			}
+			writeJSON(w, Response{Success: true, Message: fmt.Sprintf("Retention set for %s: %d seconds", op.Key, seconds)})
+			return
+		}
+
+		if op.Operation == "snapshot" {
+			if user.Name != "root" {
+				writeJSON(w, Response{Success: false, Message: "Unauthorized"})
+				return
+			}
+			writeJSON(w, createSnapshot(op.Path))
+			return
+		}
+
 		// Resolve unprefixed request keys to user's folder.
 		if op.Key != "" {
 			op.Key = resolveRequestKeyForUser(op.Key, user.Name)
@@ -229,6 +387,9 @@ go_cpu_count %d
 				op.Keys[i] = resolveRequestKeyForUser(k, user.Name)
 			}
 		}
+		for name, k := range op.Vars {
+			op.Vars[name] = resolveRequestKeyForUser(k, user.Name)
+		}
 		// Resolve keys in batch-write points
 		if len(op.Points) > 0 {
 			for i, p := range op.Points {
@@ -253,6 +414,12 @@ go_cpu_count %d
 				}
 			}
 		}
+		for _, k := range op.Vars {
+			if !isAllowedKeyForUser(k, user.Name) {
+				writeJSON(w, Response{Success: false, Message: "Unauthorized key access"})
+				return
+			}
+		}
 		if len(op.Points) > 0 {
 			for _, p := range op.Points {
 				if !isAllowedKeyForUser(p.Key, user.Name) {
@@ -271,11 +438,17 @@ go_cpu_count %d
 			return
 		}
 
+		if isStreamed(op) {
+			serveHTTPStream(w, op, func(key string) string { return stripAllowedPrefixForUser(key, user.Name) })
+			return
+		}
+
 		if msg := quotaCheckBeforeWrite(user.Name, op); msg != "" {
 			writeJSON(w, Response{Success: false, Message: msg})
 			return
 		}
 
+		op.scope = user.Name + "/"
 		response := HandleOperation(op)
 		quotaAccountAfterWrite(user.Name, op, response.Success)
 
@@ -330,6 +503,18 @@ go_cpu_count %d
 				}
 				response.Data = filtered
 			}
+		case "syncstatus":
+			if status, ok := response.Data.(forward.Status); ok {
+				for i := range status.Keys {
+					status.Keys[i].Key = stripAllowedPrefixForUser(status.Keys[i].Key, user.Name)
+				}
+			}
+		case "listrollups":
+			if rollups, ok := response.Data.([]RollupInfo); ok {
+				for i := range rollups {
+					rollups[i].Key = stripAllowedPrefixForUser(rollups[i].Key, user.Name)
+				}
+			}
 		case "read":
 			if dataPoints, ok := response.Data.([]models.DataPoint); ok {
 				for i := range dataPoints {
@@ -337,7 +522,7 @@ go_cpu_count %d
 				}
 				response.Data = dataPoints
 			}
-		case "multi-read":
+		case "multi-read", "query":
 			if response.MultiData != nil {
 				newMultiData := make(map[string][]models.DataPoint)
 				for k, v := range response.MultiData {
@@ -359,6 +544,29 @@ go_cpu_count %d
 	return mux
 }
 
+// handleSnapshotDownload streams a snapshot of the database as a tar archive.
+// Once streaming has started errors can no longer be reported in the status;
+// the archive then lacks its manifest and restore rejects it.
+func handleSnapshotDownload(noAuthUser string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authenticateRequest(r, noAuthUser)
+		if err != nil || user.Name != "root" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := fmt.Sprintf("gtsdb-snapshot-%s.tar", time.Now().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+		if _, err := snapshot.Write(w); err != nil {
+			utils.Errorln("Snapshot download failed:", err)
+		}
+	}
+}
+
 func handleSSE(w http.ResponseWriter, r *http.Request, key string, fanoutManager *fanout.Fanout) {
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
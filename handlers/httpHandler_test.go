@@ -3,10 +3,16 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"gtsdb/auth"
+	"gtsdb/buffer"
 	"gtsdb/fanout"
 	"gtsdb/models"
+	"gtsdb/snapshot"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -152,7 +158,7 @@ func TestMetricsEndpoint(t *testing.T) {
 	}
 
 	body := rr.Body.String()
-	expectedMetrics := []string{"gtsdb_key_count", "gtsdb_data_points_total", "gtsdb_uptime_seconds", "go_memstats_alloc_bytes"}
+	expectedMetrics := []string{"gtsdb_key_count", "gtsdb_data_points_total", "gtsdb_uptime_seconds", "gtsdb_corrupt_records_total", "go_memstats_alloc_bytes"}
 	for _, metric := range expectedMetrics {
 		if !containsMetric(body, metric) {
 			t.Errorf("metrics response missing: %s", metric)
@@ -360,6 +366,51 @@ func TestHTTPUserManagement(t *testing.T) {
 			t.Errorf("adduser empty returned %d", rr.Code)
 		}
 	})
+
+	t.Run("setuserretention as root", func(t *testing.T) {
+		doPost(Operation{Operation: "adduser", Key: "retained"})
+		rr := doPost(Operation{Operation: "setuserretention", Key: "retained", Retention: "30d"})
+		var resp Response
+		_ = json.Unmarshal(rr.Body.Bytes(), &resp)
+		if !resp.Success {
+			t.Fatalf("setuserretention failed: %s", resp.Message)
+		}
+		if u, _ := auth.GetUser("retained"); u.Retention != 30*86400 {
+			t.Errorf("expected retention %d, got %d", 30*86400, u.Retention)
+		}
+	})
+
+	t.Run("snapshot", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "backup.tar")
+		var resp Response
+		_ = json.Unmarshal(doPost(Operation{Operation: "snapshot", Path: file}).Body.Bytes(), &resp)
+		if !resp.Success {
+			t.Fatalf("snapshot failed: %s", resp.Message)
+		}
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("snapshot file not written: %v", err)
+		}
+
+		req := httptest.NewRequest("GET", "/api/snapshot", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/x-tar" {
+			t.Fatalf("snapshot download returned %d %s", rr.Code, rr.Header().Get("Content-Type"))
+		}
+		if _, err := snapshot.Restore(rr.Body, filepath.Join(t.TempDir(), "data")); err != nil {
+			t.Errorf("downloaded snapshot does not restore: %v", err)
+		}
+
+		user, _ := auth.CreateUser("snapshotter")
+		req = httptest.NewRequest("GET", "/api/snapshot", nil)
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("non-root snapshot download returned %d", rr.Code)
+		}
+	})
 }
 
 func TestHTTPMoreReadOps(t *testing.T) {
@@ -410,3 +461,410 @@ func TestHTTPMoreReadOps(t *testing.T) {
 		}
 	})
 }
+
+func TestHTTPStream(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	var points []BatchWritePoint
+	for i := 0; i < 2500; i++ {
+		points = append(points, BatchWritePoint{Key: "http_stream", Timestamp: 2000000000 + int64(i), Value: float64(i)})
+	}
+	doPost(Operation{Operation: "batch-write", Points: points})
+
+	rr := doPost(Operation{Operation: "read", Key: "http_stream", Stream: true, Read: &ReadRequest{StartTime: 2000000000, EndTime: 2000002499}})
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Expected NDJSON, got %q: %s", ct, rr.Body.String())
+	}
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if len(lines) != 2500 {
+		t.Fatalf("Expected 2500 lines, got %d", len(lines))
+	}
+	var last models.DataPoint
+	if err := json.Unmarshal([]byte(lines[2499]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.Key != "http_stream" || last.Timestamp != 2000002499 || last.Value != 2499 {
+		t.Errorf("Unexpected last line %s", lines[2499])
+	}
+
+	rr = doPost(Operation{Operation: "export", Key: "http_stream", Stream: true, Export: &ExportRequest{Format: "csv", StartTime: 2000000000, EndTime: 2000002499, Downsample: 10, Aggregation: "sum"}})
+	lines = strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if rr.Header().Get("Content-Type") != "text/csv" || len(lines) != 251 || lines[0] != "key,timestamp,value" {
+		t.Fatalf("Unexpected CSV export of %d lines: %.100s", len(lines), rr.Body.String())
+	}
+	if lines[1] != "root/http_stream,2000000000,45.000000" {
+		t.Errorf("Unexpected first row %q", lines[1])
+	}
+
+	var resp Response
+	rr = doPost(Operation{Operation: "export", Key: "http_stream", Stream: true, Export: &ExportRequest{Format: "json"}})
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Success {
+		t.Errorf("Expected the JSON format refused for a stream, got %s", rr.Body.String())
+	}
+}
+
+func TestHTTPReadPages(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	read := func(r ReadRequest) Response {
+		body, _ := json.Marshal(Operation{Operation: "read", Key: "http_pages", Read: &r})
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp struct {
+			Response
+			Data []models.DataPoint `json:"data"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		resp.Response.Data = resp.Data
+		return resp.Response
+	}
+
+	var points []models.DataPoint
+	for i := 0; i < 25; i++ {
+		points = append(points, models.DataPoint{Key: "root/http_pages", Timestamp: 2000000000 + int64(i), Value: float64(i)})
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	for _, order := range []string{"asc", "desc"} {
+		var values []float64
+		r := ReadRequest{StartTime: 2000000000, EndTime: 2000000024, Limit: 10, Order: order}
+		for pages := 1; ; pages++ {
+			resp := read(r)
+			if !resp.Success {
+				t.Fatalf("%s: %s", order, resp.Message)
+			}
+			for _, p := range resp.Data.([]models.DataPoint) {
+				values = append(values, p.Value)
+			}
+			if resp.Cursor == "" {
+				if pages != 3 {
+					t.Errorf("%s: expected 3 pages, got %d", order, pages)
+				}
+				break
+			}
+			r.Cursor = resp.Cursor
+		}
+		if len(values) != 25 {
+			t.Fatalf("%s: expected 25 points, got %v", order, values)
+		}
+		first := 0.0
+		if order == "desc" {
+			first = 24
+		}
+		if values[0] != first || values[24] != 24-first {
+			t.Errorf("%s: unexpected order %v", order, values)
+		}
+	}
+
+	if resp := read(ReadRequest{StartTime: 2000000000, EndTime: 2000000024, Order: "desc"}); len(resp.Data.([]models.DataPoint)) != 25 || resp.Cursor != "" {
+		t.Errorf("Expected a whole descending read, got %+v", resp)
+	}
+	asc := read(ReadRequest{StartTime: 2000000000, EndTime: 2000000024, Limit: 10})
+	for _, tc := range []struct {
+		r       ReadRequest
+		message string
+	}{
+		{ReadRequest{StartTime: 2000000000, EndTime: 2000000024, Limit: 10, Order: "desc", Cursor: asc.Cursor}, "Cursor is for order asc"},
+		{ReadRequest{StartTime: 2000000000, EndTime: 2000000024, Limit: 10, Cursor: "%%"}, "Invalid cursor"},
+		{ReadRequest{LastX: 5, Limit: 2}, "Limit and cursor require start and end time"},
+		{ReadRequest{StartTime: 2000000000, EndTime: 2000000024, Order: "up"}, "Order must be 'asc' or 'desc'"},
+	} {
+		if resp := read(tc.r); resp.Success || resp.Message != tc.message {
+			t.Errorf("Expected %q, got %+v", tc.message, resp)
+		}
+	}
+}
+
+func TestHTTPAlignedBuckets(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) Response {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Every 30 minutes from 2024-03-05T10:00:00Z for 12 hours
+	var points []models.DataPoint
+	for i := int64(0); i < 24; i++ {
+		points = append(points, models.DataPoint{Key: "root/http_days", Timestamp: 1709632800 + 1800*i, Value: 1})
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	// In Tokyo (UTC+9) the day changes at 15:00Z: 10 points on the 5th,
+	// 14 on the 6th
+	resp := doPost(Operation{Operation: "multi-read", Keys: []string{"http_days"}, Read: &ReadRequest{
+		StartTime: 1709632800, EndTime: 1709676000, Aggregation: "count", Align: "day", Timezone: "Asia/Tokyo",
+	}})
+	days := resp.MultiData["http_days"]
+	if len(days) != 2 || days[0].Timestamp != 1709564400 || days[0].Value != 10 || days[1].Timestamp != 1709650800 || days[1].Value != 14 {
+		t.Errorf("Unexpected Tokyo days %+v", resp)
+	}
+
+	resp = doPost(Operation{Operation: "export", Key: "http_days", Export: &ExportRequest{
+		Format: "csv", StartTime: 1709632800, EndTime: 1709676000, Downsample: 14400, Aggregation: "count", Align: "epoch",
+	}})
+	if csv, _ := resp.Data.(string); !strings.Contains(csv, "root/http_days,1709625600,4") || !strings.Contains(csv, "root/http_days,1709640000,8") {
+		t.Errorf("Unexpected 4h export %+v", resp)
+	}
+
+	for _, r := range []ReadRequest{
+		{StartTime: 1709632800, EndTime: 1709676000, Align: "epoch"},
+		{StartTime: 1709632800, EndTime: 1709676000, Align: "day", Timezone: "Nowhere/City"},
+		{StartTime: 1709632800, EndTime: 1709676000, Align: "decade"},
+	} {
+		if resp := doPost(Operation{Operation: "read", Key: "http_days", Read: &r}); resp.Success {
+			t.Errorf("Expected %+v rejected", r)
+		}
+	}
+}
+
+func TestHTTPFill(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) (Response, string) {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp, rr.Body.String()
+	}
+
+	// Points in the minutes starting at 1709632800 and 1709632980
+	buffer.StoreDataPointsBuffer([]models.DataPoint{
+		{Key: "root/http_fill", Timestamp: 1709632810, Value: 2},
+		{Key: "root/http_fill", Timestamp: 1709632990, Value: 8},
+	})
+	read := func(fill string) []models.DataPoint {
+		resp, _ := doPost(Operation{Operation: "multi-read", Keys: []string{"http_fill"}, Read: &ReadRequest{
+			StartTime: 1709632800, EndTime: 1709633099, Downsample: 60, Fill: fill,
+		}})
+		if !resp.Success {
+			t.Fatalf("fill %s: %s", fill, resp.Message)
+		}
+		return resp.MultiData["http_fill"]
+	}
+	if got := read(""); len(got) != 2 {
+		t.Errorf("Expected 2 buckets without fill, got %+v", got)
+	}
+	got := read("linear")
+	if len(got) != 5 || got[1].Timestamp != 1709632860 || got[1].Value != 4 || got[2].Value != 6 || !math.IsNaN(got[4].Value) {
+		t.Errorf("Unexpected linear fill %+v", got)
+	}
+	if got := read("0"); len(got) != 5 || got[4].Value != 0 || got[4].Timestamp != 1709632980+60 {
+		t.Errorf("Unexpected constant fill %+v", got)
+	}
+
+	// Empty buckets filled with null are null in JSON
+	_, body := doPost(Operation{Operation: "read", Key: "http_fill", Read: &ReadRequest{
+		StartTime: 1709632800, EndTime: 1709633099, Downsample: 60, Fill: "null",
+	}})
+	if !strings.Contains(body, `"timestamp":1709632860,"value":null`) {
+		t.Errorf("Expected a null bucket in %s", body)
+	}
+
+	for _, r := range []ReadRequest{
+		{StartTime: 1709632800, EndTime: 1709633099, Downsample: 60, Fill: "zero"},
+		{StartTime: 1709632800, EndTime: 1709633099, Fill: "null"},
+		{StartTime: 1709632800, EndTime: 1709633099, Downsample: 60, Fill: "null", Limit: 2},
+		{LastX: 5, Downsample: 60, Fill: "null"},
+		{StartTime: 946684800, EndTime: 4102444799, Downsample: 60, Fill: "null"},
+	} {
+		if resp, _ := doPost(Operation{Operation: "read", Key: "http_fill", Read: &r}); resp.Success {
+			t.Errorf("Expected %+v rejected", r)
+		}
+	}
+}
+
+func TestHTTPFunction(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) Response {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// A counter counting 2 per 10 seconds, reset after 1709632830
+	var points []models.DataPoint
+	for i, v := range []float64{100, 102, 104, 106, 1, 3} {
+		points = append(points, models.DataPoint{Key: "root/http_counter", Timestamp: 1709632800 + 10*int64(i), Value: v})
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	resp := doPost(Operation{Operation: "multi-read", Keys: []string{"http_counter"}, Read: &ReadRequest{
+		StartTime: 1709632800, EndTime: 1709632850, Function: "rate",
+	}})
+	rates := resp.MultiData["http_counter"]
+	if len(rates) != 5 || rates[0].Value != 0.2 || rates[3].Value != 0.1 || rates[4].Value != 0.2 {
+		t.Errorf("Unexpected rates %+v", resp)
+	}
+
+	for _, r := range []ReadRequest{
+		{StartTime: 1709632800, EndTime: 1709632850, Function: "increase"},
+		{StartTime: 1709632800, EndTime: 1709632850, Function: "rate", Limit: 2},
+	} {
+		if resp := doPost(Operation{Operation: "read", Key: "http_counter", Read: &r}); resp.Success {
+			t.Errorf("Expected %+v rejected", r)
+		}
+	}
+}
+
+func TestHTTPWindow(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) Response {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	var points []models.DataPoint
+	for i, v := range []float64{1, 3, 5, 7} {
+		points = append(points, models.DataPoint{Key: "root/http_window", Timestamp: 1709632800 + 10*int64(i), Value: v})
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	resp := doPost(Operation{Operation: "multi-read", Keys: []string{"http_window"}, Read: &ReadRequest{
+		StartTime: 1709632800, EndTime: 1709632830, Window: &WindowRequest{Function: "moving_average", Seconds: 20},
+	}})
+	smoothed := resp.MultiData["http_window"]
+	if len(smoothed) != 4 || smoothed[0].Value != 1 || smoothed[1].Value != 2 || smoothed[3].Value != 6 {
+		t.Errorf("Unexpected moving average %+v", resp)
+	}
+
+	resp = doPost(Operation{Operation: "export", Key: "http_window", Export: &ExportRequest{
+		Format: "csv", StartTime: 1709632800, EndTime: 1709632830, Window: &WindowRequest{Function: "moving_median", Points: 3},
+	}})
+	if csv, _ := resp.Data.(string); !strings.Contains(csv, "root/http_window,1709632820,3.000000") {
+		t.Errorf("Unexpected moving median export %+v", resp)
+	}
+
+	for _, w := range []*WindowRequest{{Function: "moving_sum", Points: 3}, {Function: "ema"}} {
+		if resp := doPost(Operation{Operation: "read", Key: "http_window", Read: &ReadRequest{LastX: 4, Window: w}}); resp.Success {
+			t.Errorf("Expected window %+v rejected", w)
+		}
+	}
+}
+
+func TestHTTPQuery(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) Response {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	buffer.StoreDataPointsBuffer([]models.DataPoint{
+		{Key: "root/http_query_a", Timestamp: 1709632800, Value: 1},
+		{Key: "root/http_query_a", Timestamp: 1709632860, Value: 3},
+		{Key: "root/http_query_b", Timestamp: 1709632800, Value: 5},
+	})
+	resp := doPost(Operation{Operation: "query", Query: `SELECT sum(value) FROM "http_query_*" WHERE time >= 0 AND time < '2024-03-05T11:00:00Z'`})
+	if !resp.Success || len(resp.MultiData) != 2 || resp.MultiData["http_query_a"][0].Value != 4 || resp.MultiData["http_query_a"][0].Key != "http_query_a" {
+		t.Errorf("Unexpected query response %+v", resp)
+	}
+	if resp := doPost(Operation{Operation: "query", Query: "DROP TABLE x"}); resp.Success {
+		t.Error("Expected an invalid query rejected")
+	}
+}
+
+func TestHTTPGroupAggregation(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+	doPost := func(op Operation) Response {
+		body, _ := json.Marshal(op)
+		req := httptest.NewRequest("POST", "/", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		var resp Response
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Three sensors of building 3 every minute for 10 minutes, sensor i
+	// reading 20+i; one elsewhere
+	var points []models.DataPoint
+	for m := int64(0); m < 10; m++ {
+		for i, key := range []string{"root/b3/temp1", "root/b3/temp2", "root/b3/temp3", "root/b4/temp1"} {
+			points = append(points, models.DataPoint{Key: key, Timestamp: 1709632800 + 60*m, Value: float64(20 + i)})
+		}
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	read := &ReadRequest{StartTime: 1709632800, EndTime: 1709633399, Downsample: 300, GroupAggregation: "avg"}
+	resp := doPost(Operation{Operation: "multi-read", Pattern: "b3/*", Read: read})
+	data, _ := resp.Data.([]interface{})
+	if !resp.Success || resp.Message != "Aggregated 3 keys" || len(data) != 2 {
+		t.Fatalf("Unexpected group response %+v", resp)
+	}
+	if bucket, _ := data[1].(map[string]interface{}); bucket["timestamp"] != float64(1709633100) || bucket["value"] != float64(21) {
+		t.Errorf("Unexpected bucket %v", data[1])
+	}
+
+	read = &ReadRequest{StartTime: 1709632800, EndTime: 1709633399, Downsample: 300, GroupAggregation: "max"}
+	resp = doPost(Operation{Operation: "multi-read", Keys: []string{"root/b3/temp1", "root/b4/temp1"}, Read: read})
+	if data, _ := resp.Data.([]interface{}); len(data) != 2 || data[0].(map[string]interface{})["value"] != float64(23) {
+		t.Errorf("Unexpected max response %+v", resp)
+	}
+
+	for _, r := range []*ReadRequest{
+		{StartTime: 1709632800, EndTime: 1709633399, Downsample: 300, GroupAggregation: "first"},
+		{StartTime: 1709632800, EndTime: 1709633399, GroupAggregation: "avg"},
+		{LastX: 5, Downsample: 300, GroupAggregation: "avg"},
+	} {
+		if resp := doPost(Operation{Operation: "multi-read", Pattern: "b3/*", Read: r}); resp.Success {
+			t.Errorf("Expected %+v rejected", r)
+		}
+	}
+}
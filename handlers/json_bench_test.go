@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"gtsdb/models"
+	"reflect"
 	"testing"
 
 	json "github.com/bytedance/sonic"
@@ -45,7 +46,7 @@ func TestVeloxProducesSameOutput(t *testing.T) {
 			continue
 		}
 		for i := range sonicPts {
-			if sonicPts[i] != veloxPts[i] {
+			if !reflect.DeepEqual(sonicPts[i], veloxPts[i]) {
 				t.Errorf("MultiData[%q][%d] mismatch: %+v vs %+v", k, i, sonicPts[i], veloxPts[i])
 			}
 		}
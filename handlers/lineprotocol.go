@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"gtsdb/models"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	json "github.com/velox-io/json"
+)
+
+// Influx line protocol ingestion (POST /api/v2/write and /write), so Telegraf
+// and other Influx clients can write without a GTSDB-specific output.
+//
+// Each field of each line becomes one data point. The key is the measurement
+// and field joined by a dot, followed by the tags sorted by name:
+//
+//	cpu,host=a,region=eu usage_idle=92.5 1700000000000000000
+//	-> <user>/cpu.usage_idle,host=a,region=eu  ts=1700000000  value=92.5
+//
+// Integer, unsigned and boolean fields are stored as numbers (true=1);
+// string fields cannot be stored and are skipped. Timestamps are converted
+// from the request precision to each key's precision. A request is all-or-nothing: one
+// malformed line rejects the whole body.
+
+// maxLineProtocolBody caps the decompressed request body.
+const maxLineProtocolBody = 32 * 1024 * 1024
+
+// lineProtocolError is the Influx-style error body Telegraf logs verbatim.
+type lineProtocolError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeLineProtocolError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(lineProtocolError{Code: code, Message: message})
+}
+
+// precisionMultiplier returns the length of one unit of the given precision:
+// mul/div seconds.
+func precisionMultiplier(precision string) (div, mul int64, err error) {
+	switch precision {
+	case "", "ns", "n":
+		return 1_000_000_000, 1, nil
+	case "us", "u":
+		return 1_000_000, 1, nil
+	case "ms":
+		return 1_000, 1, nil
+	case "s":
+		return 1, 1, nil
+	case "m":
+		return 1, 60, nil
+	case "h":
+		return 1, 3600, nil
+	}
+	return 0, 0, fmt.Errorf("invalid precision: %s", precision)
+}
+
+func handleLineProtocolWrite(noAuthUser string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		normalizeIngestAuth(r)
+		user, err := authenticateRequest(r, noAuthUser)
+		if err != nil {
+			writeLineProtocolError(w, http.StatusUnauthorized, "unauthorized", "unauthorized access")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeLineProtocolError(w, http.StatusMethodNotAllowed, "method not allowed", "only POST is supported")
+			return
+		}
+
+		query := r.URL.Query()
+		div, mul, err := precisionMultiplier(query.Get("precision"))
+		if err != nil {
+			writeLineProtocolError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeLineProtocolError(w, http.StatusBadRequest, "invalid", "invalid gzip body")
+				return
+			}
+			defer gz.Close()
+			body = gz
+		}
+		data, err := io.ReadAll(io.LimitReader(body, maxLineProtocolBody+1))
+		if err != nil {
+			writeLineProtocolError(w, http.StatusBadRequest, "invalid", "failed to read body")
+			return
+		}
+		if len(data) > maxLineProtocolBody {
+			writeLineProtocolError(w, http.StatusRequestEntityTooLarge, "request too large", fmt.Sprintf("body exceeds %d bytes", maxLineProtocolBody))
+			return
+		}
+
+		// Parse to nanoseconds; ingestPoints converts to each key's precision.
+		unit := int64(time.Second) / div * mul
+		points, err := parseLineProtocol(string(data), 1, unit, time.Now().UnixNano())
+		if err != nil {
+			writeLineProtocolError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		for i := range points {
+			points[i].Key = resolveRequestKeyForUser(points[i].Key, user.Name)
+		}
+		if status, msg := ingestPoints(user.Name, points, models.PrecisionSecond); status != 0 {
+			code := "invalid"
+			switch status {
+			case http.StatusForbidden:
+				code = "forbidden"
+			case http.StatusInternalServerError:
+				code = "internal error"
+			}
+			writeLineProtocolError(w, status, code, msg)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// parseLineProtocol converts a line protocol body into batch-write points.
+// Timestamps are converted with ts/div*mul; lines without one get now.
+func parseLineProtocol(body string, div, mul, now int64) ([]BatchWritePoint, error) {
+	var points []BatchWritePoint
+	for n, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parsed, err := parseLine(line, div, mul, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n+1, err)
+		}
+		points = append(points, parsed...)
+	}
+	return points, nil
+}
+
+func parseLine(line string, div, mul, now int64) ([]BatchWritePoint, error) {
+	seriesEnd := indexUnescaped(line, ' ', false)
+	if seriesEnd < 0 {
+		return nil, errors.New("missing field set")
+	}
+	series := line[:seriesEnd]
+	rest := strings.TrimLeft(line[seriesEnd:], " ")
+	fieldsEnd := indexUnescaped(rest, ' ', true)
+	fieldSet, tsPart := rest, ""
+	if fieldsEnd >= 0 {
+		fieldSet, tsPart = rest[:fieldsEnd], strings.TrimSpace(rest[fieldsEnd:])
+	}
+
+	parts := splitUnescaped(series, ',', false)
+	measurement := unescapeLineProtocol(parts[0])
+	if measurement == "" {
+		return nil, errors.New("missing measurement")
+	}
+	tags := make([][2]string, 0, len(parts)-1)
+	for _, tag := range parts[1:] {
+		eq := indexUnescaped(tag, '=', false)
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid tag: %s", tag)
+		}
+		tags = append(tags, [2]string{unescapeLineProtocol(tag[:eq]), unescapeLineProtocol(tag[eq+1:])})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i][0] < tags[j][0] })
+
+	ts := now
+	if tsPart != "" {
+		raw, err := strconv.ParseInt(tsPart, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp: %s", tsPart)
+		}
+		ts = raw / div * mul
+	}
+
+	var points []BatchWritePoint
+	for _, field := range splitUnescaped(fieldSet, ',', true) {
+		eq := indexUnescaped(field, '=', false)
+		if eq <= 0 {
+			return nil, fmt.Errorf("invalid field: %s", field)
+		}
+		value, ok, err := parseFieldValue(field[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue // string field
+		}
+		points = append(points, BatchWritePoint{
+			Key:       lineProtocolKey(measurement, unescapeLineProtocol(field[:eq]), tags),
+			Value:     value,
+			Timestamp: ts,
+		})
+	}
+	return points, nil
+}
+
+// parseFieldValue returns ok=false for string fields, which have no numeric
+// representation.
+func parseFieldValue(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, errors.New("missing field value")
+	}
+	if s[0] == '"' {
+		return 0, false, nil
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch s[len(s)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid integer field value: %s", s)
+		}
+		return float64(v), true, nil
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid unsigned field value: %s", s)
+		}
+		return float64(v), true, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false, fmt.Errorf("invalid field value: %s", s)
+	}
+	return v, true, nil
+}
+
+// lineProtocolKey builds "measurement.field,tag1=v1,tag2=v2". Path separators
+// are replaced so a tag value cannot escape the caller's namespace.
+func lineProtocolKey(measurement, field string, tags [][2]string) string {
+	var sb strings.Builder
+	sb.WriteString(sanitizeKeyPart(measurement))
+	sb.WriteByte('.')
+	sb.WriteString(sanitizeKeyPart(field))
+	for _, tag := range tags {
+		sb.WriteByte(',')
+		sb.WriteString(sanitizeKeyPart(tag[0]))
+		sb.WriteByte('=')
+		sb.WriteString(sanitizeKeyPart(tag[1]))
+	}
+	return sb.String()
+}
+
+var keyPartReplacer = strings.NewReplacer("/", "_", "\\", "_")
+
+func sanitizeKeyPart(s string) string {
+	return keyPartReplacer.Replace(s)
+}
+
+// indexUnescaped returns the index of the first sep not preceded by a
+// backslash (and, with quotes, not inside a double-quoted string).
+func indexUnescaped(s string, sep byte, quotes bool) int {
+	inQuotes := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			return i
+		}
+	}
+	return -1
+}
+
+func splitUnescaped(s string, sep byte, quotes bool) []string {
+	var parts []string
+	for {
+		i := indexUnescaped(s, sep, quotes)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+var lineProtocolUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ", `\"`, `"`, `\\`, `\`)
+
+func unescapeLineProtocol(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	return lineProtocolUnescaper.Replace(s)
+}
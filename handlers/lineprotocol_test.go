@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/fanout"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	body := `# comment
+cpu,region=eu,host=a usage_idle=92.5,usage_user=3i,up=true,note="a b,c" 1700000000000000000
+disk\ io,path=C:\\x/y read=1u
+
+weather temp=-1.5e1 1700000001
+`
+	points, err := parseLineProtocol(body, 1, 1, 1700000099)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	want := []BatchWritePoint{
+		{Key: "cpu.usage_idle,host=a,region=eu", Value: 92.5, Timestamp: 1700000000000000000},
+		{Key: "cpu.usage_user,host=a,region=eu", Value: 3, Timestamp: 1700000000000000000},
+		{Key: "cpu.up,host=a,region=eu", Value: 1, Timestamp: 1700000000000000000},
+		{Key: "disk io.read,path=C:_x_y", Value: 1, Timestamp: 1700000099},
+		{Key: "weather.temp", Value: -15, Timestamp: 1700000001},
+	}
+	if len(points) != len(want) {
+		t.Fatalf("expected %d points, got %d: %+v", len(want), len(points), points)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(points[i], want[i]) {
+			t.Errorf("point %d = %+v, want %+v", i, points[i], want[i])
+		}
+	}
+
+	for _, bad := range []string{
+		"cpu",
+		"cpu value=abc",
+		"cpu value=NaN",
+		"cpu value=-Inf",
+		"cpu,host value=1",
+		"cpu value=1 notatime",
+		" value=1",
+	} {
+		if _, err := parseLineProtocol(bad, 1, 1, 0); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestPrecisionMultiplier(t *testing.T) {
+	tests := []struct {
+		precision string
+		in, want  int64
+	}{
+		{"", 1700000000123456789, 1700000000},
+		{"ns", 1700000000123456789, 1700000000},
+		{"us", 1700000000123456, 1700000000},
+		{"ms", 1700000000123, 1700000000},
+		{"s", 1700000000, 1700000000},
+		{"h", 472222, 1699999200},
+	}
+	for _, tt := range tests {
+		div, mul, err := precisionMultiplier(tt.precision)
+		if err != nil {
+			t.Fatalf("precision %q: %v", tt.precision, err)
+		}
+		if got := tt.in / div * mul; got != tt.want {
+			t.Errorf("precision %q: got %d, want %d", tt.precision, got, tt.want)
+		}
+	}
+	if _, _, err := precisionMultiplier("fortnight"); err == nil {
+		t.Error("expected error for invalid precision")
+	}
+}
+
+func TestLineProtocolEndpoint(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+
+	post := func(path, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := post("/api/v2/write?org=o&bucket=b&precision=s", "lp_cpu,host=a usage=1 1700000000\nlp_cpu,host=a usage=2 1700000001",
+		map[string]string{"Authorization": "Token " + token})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	points := buffer.ReadLastDataPoints("root/lp_cpu.usage,host=a", 10)
+	if len(points) != 2 || points[1].Value != 2 || points[1].Timestamp != 1700000001 {
+		t.Errorf("unexpected stored points: %+v", points)
+	}
+
+	// v1 path with query credentials and gzip body
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("lp_mem used=42 1700000000000"))
+	zw.Close()
+	req := httptest.NewRequest("POST", "/write?db=x&u=root&p="+token+"&precision=ms", &gz)
+	req.Header.Set("Content-Encoding", "gzip")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 for v1 write, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if v := buffer.ReadLastDataPoints("root/lp_mem.used", 1); len(v) != 1 || v[0].Value != 42 {
+		t.Errorf("unexpected v1 point: %+v", v)
+	}
+
+	// Nanosecond lines keep their milliseconds on an ms key
+	if resp := HandleOperation(Operation{Operation: "initkey", Key: "root/lp_fine.v", Precision: "ms"}); !resp.Success {
+		t.Fatalf("initkey failed: %s", resp.Message)
+	}
+	defer HandleOperation(Operation{Operation: "deletekey", Key: "root/lp_fine.v"})
+	if rr := post("/api/v2/write", "lp_fine v=1 1700000000123456789", map[string]string{"Authorization": "Token " + token}); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if v := buffer.ReadLastDataPoints("root/lp_fine.v", 1); len(v) != 1 || v[0].Timestamp != 1700000000123 {
+		t.Errorf("unexpected ms point: %+v", v)
+	}
+
+	if rr := post("/api/v2/write", "lp_cpu usage=1", nil); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", rr.Code)
+	}
+	if rr := post("/api/v2/write", "lp_cpu usage=", map[string]string{"Authorization": "Bearer " + token}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for malformed line, got %d", rr.Code)
+	}
+	if rr := post("/api/v2/write?precision=s", "lp_old usage=1 5", map[string]string{"Authorization": "Bearer " + token}); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for out-of-range timestamp, got %d", rr.Code)
+	}
+
+	// A request over the batch-write limit is stored at once, or not at all
+	if resp := HandleOperation(Operation{Operation: "initkey", Key: "root/lp_bulk.n", Type: "int"}); !resp.Success {
+		t.Fatalf("initkey failed: %s", resp.Message)
+	}
+	defer HandleOperation(Operation{Operation: "deletekey", Key: "root/lp_bulk.n"})
+	var bulk strings.Builder
+	for i := 0; i < 12000; i++ {
+		fmt.Fprintf(&bulk, "lp_bulk n=%d %d\n", i, 1700000000+i)
+	}
+	rr = post("/api/v2/write?precision=s", bulk.String()+"lp_bulk n=1.5 1700100000", map[string]string{"Authorization": "Token " + token})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a non-integer value, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if v := buffer.ReadLastDataPoints("root/lp_bulk.n", 1); len(v) != 0 {
+		t.Errorf("expected nothing stored from a rejected request, got %+v", v)
+	}
+	if rr := post("/api/v2/write?precision=s", bulk.String(), map[string]string{"Authorization": "Token " + token}); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if v := buffer.ReadLastDataPoints("root/lp_bulk.n", 1); len(v) != 1 || v[0].Timestamp != 1700011999 {
+		t.Errorf("unexpected last bulk point: %+v", v)
+	}
+
+	// Writes count against the caller's quota
+	u, err := auth.CreateUserWithQuota("lp_quota", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = post("/api/v2/write", "lp_q a=1,b=2", map[string]string{"Authorization": "Token " + u.Token})
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 over quota, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if ids := buffer.GetAllIds(); containsString(ids, "lp_quota/lp_q.a") {
+		t.Error("rejected write should not store points")
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
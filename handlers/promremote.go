@@ -0,0 +1,303 @@
+package handlers
+
+import (
+	"fmt"
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"gtsdb/prompb"
+	"gtsdb/snappy"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prometheus remote storage (POST /api/v1/write and /api/v1/read), so
+// Prometheus can keep long-term data in GTSDB.
+//
+// A series maps to one key: the metric name followed by its other labels
+// sorted by name, with ",", "=", "/", "\" and "%" percent-escaped so the key
+// can be parsed back into labels on read:
+//
+//	up{job="node",instance="a:9100"} -> <user>/up,instance=a:9100,job=node
+//
+// Keys that were not written this way are still readable: "sensor1" is the
+// series {__name__="sensor1"}. Sample timestamps are milliseconds on the wire
+// and keys created by remote write have millisecond precision; a key created
+// beforehand keeps its own precision, so samples finer than it collapse onto
+// one timestamp. NaN samples (including staleness markers) are not stored.
+
+// maxRemoteBody caps both the compressed and the decoded request body.
+const maxRemoteBody = 32 * 1024 * 1024
+
+var promKeyEscaper = strings.NewReplacer("%", "%25", ",", "%2C", "=", "%3D", "/", "%2F", "\\", "%5C")
+var promKeyUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%3D", "=", "%2F", "/", "%5C", "\\")
+
+// promSeriesKey returns the GTSDB key for a label set; ok is false when the
+// series has no metric name.
+func promSeriesKey(labels []prompb.Label) (string, bool) {
+	name := ""
+	rest := make([]prompb.Label, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+		} else if l.Value != "" {
+			rest = append(rest, l)
+		}
+	}
+	if name == "" {
+		return "", false
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].Name < rest[j].Name })
+
+	var sb strings.Builder
+	sb.WriteString(promKeyEscaper.Replace(name))
+	for _, l := range rest {
+		sb.WriteByte(',')
+		sb.WriteString(promKeyEscaper.Replace(l.Name))
+		sb.WriteByte('=')
+		sb.WriteString(promKeyEscaper.Replace(l.Value))
+	}
+	return sb.String(), true
+}
+
+// parsePromSeriesKey is the inverse of promSeriesKey. Labels are sorted by
+// name as remote read requires.
+func parsePromSeriesKey(key string) []prompb.Label {
+	parts := strings.Split(key, ",")
+	labels := []prompb.Label{{Name: "__name__", Value: promKeyUnescaper.Replace(parts[0])}}
+	for _, part := range parts[1:] {
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			// Not a label pair: keep the key as one opaque metric name.
+			return []prompb.Label{{Name: "__name__", Value: key}}
+		}
+		labels = append(labels, prompb.Label{Name: promKeyUnescaper.Replace(name), Value: promKeyUnescaper.Replace(value)})
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels
+}
+
+// readSnappyBody reads and decodes a snappy-compressed request body.
+func readSnappyBody(r *http.Request) ([]byte, int, error) {
+	compressed, err := io.ReadAll(io.LimitReader(r.Body, maxRemoteBody+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(compressed) > maxRemoteBody {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %d bytes", maxRemoteBody)
+	}
+	data, err := snappy.Decode(compressed, maxRemoteBody)
+	if err == snappy.ErrTooLarge {
+		return nil, http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	return data, 0, nil
+}
+
+func handlePromRemoteWrite(noAuthUser string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		normalizeIngestAuth(r)
+		user, err := authenticateRequest(r, noAuthUser)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Remote write 2.0 uses a different message; only 1.0 is supported.
+		if strings.Contains(r.Header.Get("Content-Type"), "io.prometheus.write.v2") {
+			http.Error(w, "Remote write 2.0 is not supported", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		data, status, err := readSnappyBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		req, err := prompb.UnmarshalWriteRequest(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var points []BatchWritePoint
+		for _, series := range req.Timeseries {
+			key, ok := promSeriesKey(series.Labels)
+			if !ok {
+				http.Error(w, "Series without metric name", http.StatusBadRequest)
+				return
+			}
+			key = resolveRequestKeyForUser(key, user.Name)
+			for _, s := range series.Samples {
+				if math.IsNaN(s.Value) {
+					continue
+				}
+				points = append(points, BatchWritePoint{Key: key, Value: s.Value, Timestamp: s.Timestamp * int64(time.Millisecond)})
+			}
+		}
+		if status, msg := ingestPoints(user.Name, points, models.PrecisionMilli); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handlePromRemoteRead(noAuthUser string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		normalizeIngestAuth(r)
+		user, err := authenticateRequest(r, noAuthUser)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, status, err := readSnappyBody(r)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		req, err := prompb.UnmarshalReadRequest(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		prefix := user.Name + "/"
+		var ids []string
+		for _, id := range buffer.GetAllIds() {
+			if strings.HasPrefix(normalizeKeyForAccess(id), prefix) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+
+		resp := prompb.ReadResponse{Results: make([]prompb.QueryResult, 0, len(req.Queries))}
+		for _, q := range req.Queries {
+			result, err := promRemoteQuery(q, ids, user.Name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			resp.Results = append(resp.Results, result)
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Header().Set("Content-Encoding", "snappy")
+		_, _ = w.Write(snappy.Encode(resp.Marshal()))
+	}
+}
+
+// promMatcher is a compiled remote read label matcher.
+type promMatcher struct {
+	m  prompb.LabelMatcher
+	re *regexp.Regexp
+}
+
+func (pm promMatcher) matches(labels []prompb.Label) bool {
+	value := ""
+	for _, l := range labels {
+		if l.Name == pm.m.Name {
+			value = l.Value
+			break
+		}
+	}
+	switch pm.m.Type {
+	case prompb.MatchEqual:
+		return value == pm.m.Value
+	case prompb.MatchNotEqual:
+		return value != pm.m.Value
+	case prompb.MatchRegexp:
+		return pm.re.MatchString(value)
+	case prompb.MatchNotRegexp:
+		return !pm.re.MatchString(value)
+	}
+	return false
+}
+
+// promRemoteQuery answers one remote read query against the caller's keys
+// with ReadDataPoints range reads.
+func promRemoteQuery(q prompb.Query, ids []string, userName string) (prompb.QueryResult, error) {
+	matchers := make([]promMatcher, 0, len(q.Matchers))
+	for _, m := range q.Matchers {
+		pm := promMatcher{m: m}
+		switch m.Type {
+		case prompb.MatchEqual, prompb.MatchNotEqual:
+		case prompb.MatchRegexp, prompb.MatchNotRegexp:
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return prompb.QueryResult{}, fmt.Errorf("invalid regexp %q: %v", m.Value, err)
+			}
+			pm.re = re
+		default:
+			return prompb.QueryResult{}, fmt.Errorf("unknown matcher type %d", m.Type)
+		}
+		matchers = append(matchers, pm)
+	}
+
+	result := prompb.QueryResult{Timeseries: []prompb.TimeSeries{}}
+	for _, id := range ids {
+		labels := parsePromSeriesKey(stripAllowedPrefixForUser(id, userName))
+		matched := true
+		for _, pm := range matchers {
+			if !pm.matches(labels) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		precision := buffer.KeyPrecision(id)
+		start := msToKeyTime(q.StartTimestampMs, precision)
+		end := msToKeyTime(q.EndTimestampMs, precision)
+		points := buffer.ReadDataPoints(id, start, end, 0, "")
+		samples := make([]prompb.Sample, 0, len(points))
+		for _, p := range points {
+			ms := keyTimeToMs(p.Timestamp, precision)
+			if ms < q.StartTimestampMs || ms > q.EndTimestampMs {
+				continue
+			}
+			samples = append(samples, prompb.Sample{Value: p.Value, Timestamp: ms})
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		result.Timeseries = append(result.Timeseries, prompb.TimeSeries{Labels: labels, Samples: samples})
+	}
+	return result, nil
+}
+
+// msToKeyTime converts remote-storage milliseconds to a key's timestamp unit.
+func msToKeyTime(ms int64, p models.Precision) int64 {
+	if p.PerSecond() < 1000 {
+		return ms / (1000 / p.PerSecond())
+	}
+	f := p.PerSecond() / 1000
+	if ms > math.MaxInt64/f {
+		return math.MaxInt64
+	}
+	return ms * f
+}
+
+// keyTimeToMs converts a timestamp in a key's unit to milliseconds.
+func keyTimeToMs(ts int64, p models.Precision) int64 {
+	if p.PerSecond() < 1000 {
+		return ts * (1000 / p.PerSecond())
+	}
+	return ts / (p.PerSecond() / 1000)
+}
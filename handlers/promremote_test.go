@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"bytes"
+	"gtsdb/buffer"
+	"gtsdb/fanout"
+	"gtsdb/models"
+	"gtsdb/prompb"
+	"gtsdb/snappy"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPromSeriesKey(t *testing.T) {
+	labels := []prompb.Label{
+		{Name: "job", Value: "node"},
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "path", Value: "/api,v=1%"},
+		{Name: "empty", Value: ""},
+	}
+	key, ok := promSeriesKey(labels)
+	if !ok {
+		t.Fatal("expected key")
+	}
+	if want := "http_requests_total,job=node,path=%2Fapi%2Cv%3D1%25"; key != want {
+		t.Errorf("key = %q, want %q", key, want)
+	}
+	want := []prompb.Label{
+		{Name: "__name__", Value: "http_requests_total"},
+		{Name: "job", Value: "node"},
+		{Name: "path", Value: "/api,v=1%"},
+	}
+	if got := parsePromSeriesKey(key); !reflect.DeepEqual(got, want) {
+		t.Errorf("parse = %+v, want %+v", got, want)
+	}
+
+	if _, ok := promSeriesKey([]prompb.Label{{Name: "job", Value: "x"}}); ok {
+		t.Error("series without a name should be rejected")
+	}
+	if got := parsePromSeriesKey("sensor1"); len(got) != 1 || got[0].Value != "sensor1" {
+		t.Errorf("plain key should map to its name, got %+v", got)
+	}
+}
+
+func TestPromRemoteWriteAndRead(t *testing.T) {
+	handler := SetupHTTPRoutes(fanout.NewFanout(), "")
+	token := testToken()
+
+	post := func(path string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(snappy.Encode(body)))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	write := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "prw_up"}, {Name: "job", Value: "a"}},
+			Samples: []prompb.Sample{
+				{Value: 1, Timestamp: 1700000000000},
+				{Value: math.NaN(), Timestamp: 1700000015000},
+				{Value: 0, Timestamp: 1700000030000},
+			},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "prw_up"}, {Name: "job", Value: "b"}},
+			Samples: []prompb.Sample{{Value: 5, Timestamp: 1700000000000}},
+		},
+	}}
+	if rr := post("/api/v1/write", write.Marshal()); rr.Code != http.StatusNoContent {
+		t.Fatalf("remote write returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if cnt, _ := buffer.GetKeyCount("root/prw_up,job=a"); cnt != 2 {
+		t.Errorf("expected 2 stored points (NaN skipped), got %d", cnt)
+	}
+
+	read := prompb.ReadRequest{Queries: []prompb.Query{
+		{
+			StartTimestampMs: 1700000000000,
+			EndTimestampMs:   1700000060000,
+			Matchers: []prompb.LabelMatcher{
+				{Type: prompb.MatchEqual, Name: "__name__", Value: "prw_up"},
+				{Type: prompb.MatchRegexp, Name: "job", Value: "a|c"},
+			},
+		},
+		{
+			StartTimestampMs: 1700000000000,
+			EndTimestampMs:   1700000060000,
+			Matchers: []prompb.LabelMatcher{
+				{Type: prompb.MatchEqual, Name: "__name__", Value: "prw_up"},
+				{Type: prompb.MatchNotEqual, Name: "job", Value: "a"},
+			},
+		},
+	}}
+	rr := post("/api/v1/read", read.Marshal())
+	if rr.Code != http.StatusOK {
+		t.Fatalf("remote read returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Content-Encoding") != "snappy" {
+		t.Errorf("expected snappy response encoding")
+	}
+	data, err := snappy.Decode(rr.Body.Bytes(), maxRemoteBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := prompb.UnmarshalReadResponse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(resp.Results))
+	}
+	want := prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "prw_up"}, {Name: "job", Value: "a"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}, {Value: 0, Timestamp: 1700000030000}},
+	}
+	if len(resp.Results[0].Timeseries) != 1 || !reflect.DeepEqual(resp.Results[0].Timeseries[0], want) {
+		t.Errorf("unexpected first result: %+v", resp.Results[0].Timeseries)
+	}
+	if ts := resp.Results[1].Timeseries; len(ts) != 1 || ts[0].Samples[0].Value != 5 {
+		t.Errorf("unexpected second result: %+v", ts)
+	}
+
+	// Keys created by remote write keep millisecond samples apart
+	sub := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "prw_sub"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}, {Value: 2, Timestamp: 1700000000500}},
+	}}}
+	if rr := post("/api/v1/write", sub.Marshal()); rr.Code != http.StatusNoContent {
+		t.Fatalf("remote write returned %d: %s", rr.Code, rr.Body.String())
+	}
+	if p := buffer.KeyPrecision("root/prw_sub"); p != models.PrecisionMilli {
+		t.Errorf("expected a ms key, got %s", p)
+	}
+	subRead := prompb.ReadRequest{Queries: []prompb.Query{{
+		StartTimestampMs: 1700000000000,
+		EndTimestampMs:   1700000001000,
+		Matchers:         []prompb.LabelMatcher{{Type: prompb.MatchEqual, Name: "__name__", Value: "prw_sub"}},
+	}}}
+	rr = post("/api/v1/read", subRead.Marshal())
+	data, err = snappy.Decode(rr.Body.Bytes(), maxRemoteBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = prompb.UnmarshalReadResponse(data); err != nil {
+		t.Fatal(err)
+	}
+	wantSub := []prompb.Sample{{Value: 1, Timestamp: 1700000000000}, {Value: 2, Timestamp: 1700000000500}}
+	if ts := resp.Results[0].Timeseries; len(ts) != 1 || !reflect.DeepEqual(ts[0].Samples, wantSub) {
+		t.Errorf("expected both sub-second samples, got %+v", ts)
+	}
+
+	// Invalid regexps and bodies are client errors
+	bad := prompb.ReadRequest{Queries: []prompb.Query{{Matchers: []prompb.LabelMatcher{{Type: prompb.MatchRegexp, Name: "job", Value: "("}}}}}
+	if rr := post("/api/v1/read", bad.Marshal()); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for invalid regexp, got %d", rr.Code)
+	}
+	req := httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader([]byte{0xff}))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for corrupt body, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/read", bytes.NewReader(snappy.Encode(read.Marshal())))
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without token, got %d", rec.Code)
+	}
+}
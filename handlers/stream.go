@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"fmt"
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	json "github.com/velox-io/json"
+)
+
+// Streamed reads and exports ("stream": true) send their result in chunks
+// of streamChunk points as they are read, instead of one response holding
+// the whole range: over HTTP as a chunked NDJSON or CSV body, over TCP as
+// several replies. Time ranges are read through a buffer.Cursor; lastx
+// reads are bounded by the request and read at once.
+
+// streamChunk is the number of points per chunk of a stream.
+const streamChunk = 1000
+
+// isStreamed reports whether op is a streamed read or export.
+func isStreamed(op Operation) bool {
+	return op.Stream && (op.Operation == "read" || op.Operation == "export")
+}
+
+// pointStream yields the points of a streamed read or export.
+type pointStream struct {
+	cursor    *buffer.Cursor     // time range
+	points    []models.DataPoint // lastx
+	requested []string           // fields to project
+	fields    []string           // CSV field columns (nil: value column)
+	format    string             // export: "csv" or "ndjson"; read: ""
+}
+
+// openStream validates a streamed read or export and opens its stream. It
+// returns an error message or "".
+func openStream(op Operation) (*pointStream, string) {
+	var start, end int64
+	var lastX, downsample int
+	var aggregation string
+	var align buffer.Alignment
+	s := &pointStream{}
+	switch op.Operation {
+	case "read":
+		if op.Read == nil {
+			return nil, "Read parameters required"
+		}
+		if msg := checkReadRequest(op.Key, op.Read); msg != "" {
+			return nil, msg
+		}
+		if op.Read.Limit > 0 || op.Read.Order == "desc" {
+			return nil, "Streamed reads take no limit and are in ascending order"
+		}
+		if fill, _ := buffer.ParseFill(op.Read.Fill); fill.Active() || op.Read.Function != "" || op.Read.Window != nil {
+			return nil, "Streamed reads take no fill, function or window"
+		}
+		start, end, lastX = op.Read.StartTime, op.Read.EndTime, op.Read.LastX
+		downsample, aggregation = op.Read.Downsample, op.Read.Aggregation
+		align, _ = parseAlignment(op.Read.Align, op.Read.Timezone, downsample)
+		s.requested = op.Read.Fields
+		if lastX <= 0 && (start <= 0 || end <= 0) {
+			lastX = 1
+		}
+	case "export":
+		if op.Export == nil {
+			return nil, "Export parameters required"
+		}
+		if op.Key == "" {
+			return nil, "Key required"
+		}
+		var msg string
+		if s.format, s.fields, msg = checkExportRequest(op.Key, op.Export, true); msg != "" {
+			return nil, msg
+		}
+		if op.Export.Window != nil {
+			return nil, "Streamed exports take no window"
+		}
+		start, end, lastX = op.Export.StartTime, op.Export.EndTime, op.Export.LastX
+		downsample, aggregation = op.Export.Downsample, op.Export.Aggregation
+		align, _ = parseAlignment(op.Export.Align, op.Export.Timezone, downsample)
+		s.requested = op.Export.Fields
+		if lastX <= 0 && (start <= 0 || end <= 0) {
+			lastX = 1000
+		}
+	}
+	if lastX > 0 {
+		s.points = buffer.ReadLastDataPoints(op.Key, lastX)
+	} else {
+		s.cursor = buffer.NewCursor(op.Key, start, end, downsample, aggregation, align)
+	}
+	return s, ""
+}
+
+// next returns the next chunk; nil at the end.
+func (s *pointStream) next() []models.DataPoint {
+	var chunk []models.DataPoint
+	if s.cursor != nil {
+		chunk = s.cursor.Next(streamChunk)
+	} else if len(s.points) > 0 {
+		n := min(streamChunk, len(s.points))
+		chunk, s.points = s.points[:n], s.points[n:]
+	}
+	if chunk == nil {
+		return nil
+	}
+	return buffer.ProjectFields(chunk, s.requested)
+}
+
+// writeNDJSON writes points one JSON object per line.
+func writeNDJSON(sb *strings.Builder, points []models.DataPoint) {
+	for _, p := range points {
+		b, _ := json.Marshal(p)
+		sb.Write(b)
+		sb.WriteByte('\n')
+	}
+}
+
+// serveHTTPStream writes a streamed read or export as a chunked body,
+// flushed after each chunk. unprefix maps the keys of read points for the
+// response. Errors found once the body has started cannot be reported;
+// the connection is then closed before the end of the body, so that the
+// client sees a truncated response rather than a complete one.
+func serveHTTPStream(w http.ResponseWriter, op Operation, unprefix func(string) string) {
+	mark := buffer.GetCorruptRecordCount()
+	s, msg := openStream(op)
+	if msg != "" {
+		writeJSON(w, Response{Success: false, Message: msg})
+		return
+	}
+	started := false
+	corrupt := func() bool {
+		if _, ok := buffer.CorruptKeySince(mark, op.Key); !ok {
+			return false
+		}
+		if started {
+			panic(http.ErrAbortHandler)
+		}
+		writeJSON(w, Response{Success: false, Message: corruptReadMessage(unprefix(op.Key))})
+		return true
+	}
+	var sb strings.Builder
+	if s.format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writeCSVHeader(&sb, op.Key, s.fields)
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	flusher, _ := w.(http.Flusher)
+	for chunk := s.next(); chunk != nil; chunk = s.next() {
+		if op.Operation == "read" {
+			for i := range chunk {
+				chunk[i].Key = unprefix(chunk[i].Key)
+			}
+		}
+		if s.format == "csv" {
+			writeCSVRows(&sb, chunk, s.fields)
+		} else {
+			writeNDJSON(&sb, chunk)
+		}
+		if corrupt() {
+			return
+		}
+		if _, err := io.WriteString(w, sb.String()); err != nil {
+			return
+		}
+		started = true
+		sb.Reset()
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if corrupt() {
+		return
+	}
+	if sb.Len() > 0 {
+		_, _ = io.WriteString(w, sb.String())
+	}
+}
+
+// serveTcpStream sends a streamed read or export as a series of replies
+// with "more": true, each holding a chunk of points (CSV text for a CSV
+// export), and a final reply without "more" counting the points. A
+// binary read sends a binary frame per chunk instead, and a frame without
+// points at the end. A stream that skipped corrupt records ends with a
+// failed reply instead.
+func serveTcpStream(conn *tcpConn, op Operation, prefix string) {
+	reply := func(resp Response) bool {
+		resp.ID, resp.Type = op.ID, typeReply
+		return writeTCPResponse(conn, resp)
+	}
+	mark := buffer.GetCorruptRecordCount()
+	s, msg := openStream(op)
+	if msg != "" {
+		reply(Response{Success: false, Message: msg})
+		return
+	}
+	key := strings.TrimPrefix(op.Key, prefix)
+	binaryFrames := op.Operation == "read" && op.ResponseFormat == "binary"
+	var sb strings.Builder
+	if s.format == "csv" {
+		writeCSVHeader(&sb, op.Key, s.fields)
+	}
+	total := 0
+	for chunk := s.next(); chunk != nil; chunk = s.next() {
+		total += len(chunk)
+		if op.Operation == "read" {
+			for i := range chunk {
+				chunk[i].Key = strings.TrimPrefix(chunk[i].Key, prefix)
+			}
+		}
+		var ok bool
+		switch {
+		case binaryFrames:
+			ok = writeBinaryReply(conn, op.ID, func(w net.Conn) error { return writeBinaryDataPoints(w, key, chunk) })
+		case s.format == "csv":
+			writeCSVRows(&sb, chunk, s.fields)
+			ok = reply(Response{Success: true, Data: sb.String(), More: true})
+			sb.Reset()
+		default:
+			ok = reply(Response{Success: true, Data: chunk, More: true})
+		}
+		if !ok {
+			return
+		}
+	}
+	if _, ok := buffer.CorruptKeySince(mark, op.Key); ok {
+		reply(Response{Success: false, Message: corruptReadMessage(key)})
+		return
+	}
+	if binaryFrames {
+		writeBinaryReply(conn, op.ID, func(w net.Conn) error { return writeBinaryDataPoints(w, key, nil) })
+		return
+	}
+	end := Response{Success: true, Message: fmt.Sprintf("Streamed %d data points", total)}
+	if sb.Len() > 0 {
+		end.Data = sb.String() // CSV header of an empty export
+	}
+	reply(end)
+}
@@ -2,12 +2,17 @@ package handlers
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"gtsdb/auth"
 	"gtsdb/buffer"
 	"gtsdb/fanout"
+	"gtsdb/forward"
 	"gtsdb/models"
+	"gtsdb/replication"
+	"gtsdb/retention"
 	"gtsdb/utils"
+	"io"
 	"strings"
 	"sync"
 
@@ -40,11 +45,65 @@ func connWriteJSON(conn net.Conn, v interface{}) error {
 	return err
 }
 
-func HandleTcpConnection(conn net.Conn, fanoutManager *fanout.Fanout, noAuthUser string) {
-	defer conn.Close()
+// maxInFlight bounds the requests with an id running at once on one
+// connection; reading pauses while it is reached.
+const maxInFlight = 64
+
+// tcpConn serializes writes to a connection: replies of concurrent
+// requests, subscription pushes and pings would otherwise interleave.
+type tcpConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *tcpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// maxLineSize bounds a JSON request line, batch writes included.
+const maxLineSize = 1024 * 1024
+
+// readLine reads a request line without its line ending, in a new slice:
+// a concurrent request may outlive the reader's buffer.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxLineSize {
+			return nil, bufio.ErrTooLong
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// concurrentOp reports whether a request with an id may run concurrently
+// with the requests after it. Those changing the connection's state (the
+// user, subscriptions, replication) always run in order.
+func concurrentOp(operation string) bool {
+	switch operation {
+	case "auth", "subscribe", "unsubscribe", "replicate", "binary-write":
+		return false
+	}
+	return true
+}
+
+func HandleTcpConnection(rawConn net.Conn, fanoutManager *fanout.Fanout, noAuthUser string) {
+	defer rawConn.Close()
+	conn := &tcpConn{Conn: rawConn}
 	id := rand.Intn(1000) + int(time.Now().UnixNano())
-	scanner := bufio.NewScanner(conn)
-	scanner.Buffer(make([]byte, 0, 1024*1024), 1024*1024) // 1MB max token size for batch writes
+	r := bufio.NewReaderSize(conn, 64*1024)
+	var subMu sync.Mutex // guards subscribingDevices, read by the fanout callback
 	subscribingDevices := []string{}
 
 	var currentUser auth.User
@@ -54,19 +113,28 @@ func HandleTcpConnection(conn net.Conn, fanoutManager *fanout.Fanout, noAuthUser
 		}
 	}
 
+	// Requests with an id run in their own goroutine, up to maxInFlight
+	inFlight := make(chan struct{}, maxInFlight)
+	var requests sync.WaitGroup
+
 	// Use sync.Once to ensure cleanup runs exactly once
 	done := make(chan bool)
 	var cleanupOnce sync.Once
 	cleanup := func() {
 		close(done)
-		if len(subscribingDevices) > 0 {
+		subMu.Lock()
+		subscribed := len(subscribingDevices) > 0
+		subMu.Unlock()
+		if subscribed {
 			utils.Log("Removing consumer %d due to disconnect", id)
 			fanoutManager.RemoveConsumer(id)
 		}
 	}
 
 	// Start ping sender
+	pingerDone := make(chan struct{})
 	go func() {
+		defer close(pingerDone)
 		ticker := time.NewTicker(30 * time.Second)
 		defer ticker.Stop()
 
@@ -76,7 +144,7 @@ func HandleTcpConnection(conn net.Conn, fanoutManager *fanout.Fanout, noAuthUser
 				return
 			case <-ticker.C:
 				_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-				if err := connWriteJSON(conn, Response{Success: true, Message: "ping"}); err != nil {
+				if err := connWriteJSON(conn, Response{Success: true, Message: "ping", Type: typePing}); err != nil {
 					utils.Log("Client %d failed ping", id)
 					cleanupOnce.Do(cleanup)
 					return
@@ -85,83 +153,90 @@ func HandleTcpConnection(conn net.Conn, fanoutManager *fanout.Fanout, noAuthUser
 		}
 	}()
 
-	for scanner.Scan() {
+	// After a binary-write operation the connection carries binary write
+	// frames (see binary.go) for binaryUser until a zero-length frame.
+	var binaryUser auth.User
+	var readErr error
+	for {
+		if binaryUser.Name != "" {
+			frame, err := readBinaryWriteFrame(r)
+			if err == errWriteFrameTooLarge {
+				// The frame can't be skipped: the stream is lost
+				writeTCPResponse(conn, Response{Success: false, Message: err.Error(), Type: typeReply})
+			}
+			if err != nil {
+				readErr = err
+				break
+			}
+			if frame == nil {
+				binaryUser = auth.User{}
+				writeTCPResponse(conn, Response{Success: true, Message: "JSON mode", Type: typeReply})
+				continue
+			}
+			resp := storeBinaryWrite(binaryUser.Name, binaryUser.Name+"/", frame)
+			resp.Type = typeReply
+			writeTCPResponse(conn, resp)
+			continue
+		}
+
+		line, err := readLine(r)
+		if err != nil {
+			readErr = err
+			break
+		}
 		var op Operation
-		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
-			if err := connWriteJSON(conn, Response{Success: false, Message: "Invalid JSON format: " + scanner.Text()}); err != nil {
+		if err := json.Unmarshal(line, &op); err != nil {
+			if err := connWriteJSON(conn, Response{Success: false, Message: "Invalid JSON format: " + string(line), Type: typeReply}); err != nil {
 				utils.Log("Client %d failed to send error response", id)
 			}
 			continue
 		}
+		reply := func(resp Response) bool {
+			resp.ID, resp.Type = op.ID, typeReply
+			return writeTCPResponse(conn, resp)
+		}
 
 		if op.Operation == "auth" {
 			if op.Key == "" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Token required"})
+				reply(Response{Success: false, Message: "Token required"})
 				continue
 			}
 			user, ok := auth.VerifyToken(op.Key)
 			if !ok {
-				writeTCPResponse(conn, Response{Success: false, Message: "Invalid token"})
+				reply(Response{Success: false, Message: "Invalid token"})
 				continue
 			}
 			currentUser = user
-			writeTCPResponse(conn, Response{Success: true, Message: "Authenticated as " + user.Name})
+			reply(Response{Success: true, Message: "Authenticated as " + user.Name})
 			continue
 		}
 
 		if currentUser.Name == "" {
-			writeTCPResponse(conn, Response{Success: false, Message: "Authentication required"})
+			reply(Response{Success: false, Message: "Authentication required"})
 			continue
 		}
 
-		if op.Operation == "adduser" {
+		if op.Operation == "replicate" {
 			if currentUser.Name != "root" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Unauthorized"})
+				reply(Response{Success: false, Message: "Unauthorized"})
 				continue
 			}
-			newUser, err := auth.CreateUserWithQuota(op.Key, op.MaxPoints)
-			if err != nil {
-				writeTCPResponse(conn, Response{Success: false, Message: err.Error()})
-				continue
-			}
-			writeTCPResponse(conn, Response{Success: true, Data: newUser})
-			continue
-		}
-
-		if op.Operation == "resetkey" {
-			if currentUser.Name != "root" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Unauthorized"})
-				continue
-			}
-			token, err := auth.ResetUserToken(op.Key)
-			if err != nil {
-				writeTCPResponse(conn, Response{Success: false, Message: err.Error()})
-				continue
-			}
-			writeTCPResponse(conn, Response{Success: true, Data: map[string]string{"token": token}})
-			continue
-		}
-
-		if op.Operation == "setquota" {
-			if currentUser.Name != "root" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Unauthorized"})
-				continue
-			}
-			if op.Key == "" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Username required"})
-				continue
-			}
-			if err := auth.SetUserQuota(op.Key, op.MaxPoints); err != nil {
-				writeTCPResponse(conn, Response{Success: false, Message: err.Error()})
-				continue
+			// The replication stream owns the connection from here on:
+			// finish the requests in flight and stop the pings before
+			// handing it over.
+			requests.Wait()
+			cleanupOnce.Do(cleanup)
+			<-pingerDone
+			utils.Log("Client %d (%s) is replicating", id, conn.RemoteAddr())
+			if err := replication.Serve(rawConn, op.Epoch, uint64(op.Since)); err != nil {
+				utils.Log("Client %d stopped replicating: %v", id, err)
 			}
-			writeTCPResponse(conn, Response{Success: true, Message: fmt.Sprintf("Quota set for %s: %d points", op.Key, op.MaxPoints)})
-			continue
+			return
 		}
 
 		// Prefix keys
 		prefix := currentUser.Name + "/"
-		if op.Key != "" {
+		if op.Key != "" && !rootOnlyOps[op.Operation] {
 			op.Key = prefix + op.Key
 		}
 		if op.ToKey != "" {
@@ -172,155 +247,292 @@ func HandleTcpConnection(conn net.Conn, fanoutManager *fanout.Fanout, noAuthUser
 				op.Keys[i] = prefix + k
 			}
 		}
+		for name, k := range op.Vars {
+			op.Vars[name] = prefix + k
+		}
 		if len(op.Points) > 0 {
 			for i := range op.Points {
 				op.Points[i].Key = prefix + op.Points[i].Key
 			}
 		}
+		op.scope = prefix
 
 		if op.Operation == "subscribe" {
 			if op.Key == "" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Device ID required"})
+				reply(Response{Success: false, Message: "Device ID required"})
 				continue
 			}
 
 			// If since is provided, send historical data first
 			if op.Since > 0 {
-				historicalData := buffer.ReadDataPoints(op.Key, op.Since, time.Now().Unix(), 0, "")
+				historicalData := buffer.ReadDataPoints(op.Key, op.Since, buffer.KeyPrecision(op.Key).Now(), 0, "")
 				for _, point := range historicalData {
 					point.Key = strings.TrimPrefix(point.Key, prefix)
-					writeTCPResponse(conn, Response{Success: true, Data: point})
+					writeTCPResponse(conn, Response{Success: true, Data: point, Type: typePush})
 				}
 			}
 
+			subMu.Lock()
 			subscribingDevices = append(subscribingDevices, op.Key)
-			if len(subscribingDevices) == 1 {
-				utils.Log("Adding consumer %d %v", id, subscribingDevices)
+			first := len(subscribingDevices) == 1
+			subMu.Unlock()
+			if first {
+				utils.Log("Adding consumer %d %v", id, op.Key)
 				fanoutManager.AddConsumer(id, func(msg models.DataPoint) {
-					if slices.Contains(subscribingDevices, msg.Key) {
+					subMu.Lock()
+					subscribed := slices.Contains(subscribingDevices, msg.Key)
+					subMu.Unlock()
+					if subscribed {
 						msg.Key = strings.TrimPrefix(msg.Key, prefix)
-						writeTCPResponse(conn, Response{Success: true, Data: msg})
+						writeTCPResponse(conn, Response{Success: true, Data: msg, Type: typePush})
 					}
 				})
 			}
-			writeTCPResponse(conn, Response{Success: true, Message: "Subscribed to " + strings.TrimPrefix(op.Key, prefix)})
+			reply(Response{Success: true, Message: "Subscribed to " + strings.TrimPrefix(op.Key, prefix)})
 			continue
 		}
 
 		if op.Operation == "unsubscribe" {
 			if op.Key == "" {
-				writeTCPResponse(conn, Response{Success: false, Message: "Device ID required"})
+				reply(Response{Success: false, Message: "Device ID required"})
 				continue
 			}
+			subMu.Lock()
 			for i, device := range subscribingDevices {
 				if device == op.Key {
 					subscribingDevices = append(subscribingDevices[:i], subscribingDevices[i+1:]...)
 					break
 				}
 			}
-			if len(subscribingDevices) == 0 {
+			last := len(subscribingDevices) == 0
+			subMu.Unlock()
+			if last {
 				utils.Log("Removing consumer %d", id)
 				fanoutManager.RemoveConsumer(id)
 			}
-			writeTCPResponse(conn, Response{Success: true, Message: "Unsubscribed from " + strings.TrimPrefix(op.Key, prefix)})
+			reply(Response{Success: true, Message: "Unsubscribed from " + strings.TrimPrefix(op.Key, prefix)})
 			continue
 		}
 
-		if msg := quotaCheckBeforeWrite(currentUser.Name, op); msg != "" {
-			writeTCPResponse(conn, Response{Success: false, Message: msg})
+		if op.Operation == "binary-write" {
+			binaryUser = currentUser
+			reply(Response{Success: true, Message: "Binary write mode"})
 			continue
 		}
 
-		response := HandleOperation(op)
-		quotaAccountAfterWrite(currentUser.Name, op, response.Success)
+		if op.ID == nil || !concurrentOp(op.Operation) {
+			serveTcpRequest(conn, fanoutManager, currentUser, prefix, op)
+			continue
+		}
+		inFlight <- struct{}{}
+		requests.Add(1)
+		go func(user auth.User, op Operation) {
+			defer func() {
+				<-inFlight
+				requests.Done()
+			}()
+			serveTcpRequest(conn, fanoutManager, user, prefix, op)
+		}(currentUser, op)
+	}
+
+	// Cleanup when the connection ends (safe via sync.Once)
+	if readErr != io.EOF {
+		utils.Log("Client %d read error: %v", id, readErr)
+	}
+	requests.Wait()
+	cleanupOnce.Do(cleanup)
+}
+
+// rootOnlyOps take a user name, not a key, and are refused to other users.
+var rootOnlyOps = map[string]bool{
+	"adduser": true, "resetkey": true, "setquota": true, "setuserretention": true, "snapshot": true,
+}
+
+// serveTcpRequest runs an operation for user, whose keys are under prefix,
+// and writes its reply.
+func serveTcpRequest(conn *tcpConn, fanoutManager *fanout.Fanout, user auth.User, prefix string, op Operation) {
+	reply := func(resp Response) bool {
+		resp.ID, resp.Type = op.ID, typeReply
+		return writeTCPResponse(conn, resp)
+	}
+	if rootOnlyOps[op.Operation] && user.Name != "root" {
+		reply(Response{Success: false, Message: "Unauthorized"})
+		return
+	}
+
+	switch op.Operation {
+	case "adduser":
+		newUser, err := auth.CreateUserWithQuota(op.Key, op.MaxPoints)
+		if err != nil {
+			reply(Response{Success: false, Message: err.Error()})
+			return
+		}
+		reply(Response{Success: true, Data: newUser})
+		return
+
+	case "resetkey":
+		token, err := auth.ResetUserToken(op.Key)
+		if err != nil {
+			reply(Response{Success: false, Message: err.Error()})
+			return
+		}
+		reply(Response{Success: true, Data: map[string]string{"token": token}})
+		return
+
+	case "setquota":
+		if op.Key == "" {
+			reply(Response{Success: false, Message: "Username required"})
+			return
+		}
+		if err := auth.SetUserQuota(op.Key, op.MaxPoints); err != nil {
+			reply(Response{Success: false, Message: err.Error()})
+			return
+		}
+		reply(Response{Success: true, Message: fmt.Sprintf("Quota set for %s: %d points", op.Key, op.MaxPoints)})
+		return
 
-		// if operation is write, broadcast to all consumers
-		if op.Operation == "write" && response.Success {
-			fanoutManager.Publish(models.DataPoint{
-				Key:       op.Key,
-				Timestamp: op.Write.Timestamp,
-				Value:     op.Write.Value,
-			})
+	case "setuserretention":
+		if op.Key == "" {
+			reply(Response{Success: false, Message: "Username required"})
+			return
+		}
+		seconds, err := retention.ParseRetention(op.Retention)
+		if err != nil {
+			reply(Response{Success: false, Message: err.Error()})
+			return
+		}
+		if err := auth.SetUserRetention(op.Key, seconds); err != nil {
+			reply(Response{Success: false, Message: err.Error()})
+			return
 		}
+		reply(Response{Success: true, Message: fmt.Sprintf("Retention set for %s: %d seconds", op.Key, seconds)})
+		return
 
-		// Filter and Unprefix response
-		switch op.Operation {
-		case "ids":
-			if ids, ok := response.Data.([]string); ok {
-				filtered := []string{}
-				for _, id := range ids {
-					if strings.HasPrefix(id, prefix) {
-						filtered = append(filtered, strings.TrimPrefix(id, prefix))
-					}
+	case "snapshot":
+		reply(createSnapshot(op.Path))
+		return
+	}
+
+	if isStreamed(op) {
+		serveTcpStream(conn, op, prefix)
+		return
+	}
+
+	if msg := quotaCheckBeforeWrite(user.Name, op); msg != "" {
+		reply(Response{Success: false, Message: msg})
+		return
+	}
+
+	response := HandleOperation(op)
+	quotaAccountAfterWrite(user.Name, op, response.Success)
+
+	// if operation is write, broadcast to all consumers
+	if op.Operation == "write" && response.Success {
+		fanoutManager.Publish(models.DataPoint{
+			Key:       op.Key,
+			Timestamp: op.Write.Timestamp,
+			Value:     op.Write.Value,
+		})
+	}
+
+	// Filter and Unprefix response
+	switch op.Operation {
+	case "ids":
+		if ids, ok := response.Data.([]string); ok {
+			filtered := []string{}
+			for _, id := range ids {
+				if strings.HasPrefix(id, prefix) {
+					filtered = append(filtered, strings.TrimPrefix(id, prefix))
 				}
-				response.Data = filtered
 			}
-		case "idswithcount":
-			if keyCounts, ok := response.Data.([]models.KeyCount); ok {
-				filtered := []models.KeyCount{}
-				for _, kc := range keyCounts {
-					if strings.HasPrefix(kc.Key, prefix) {
-						kc.Key = strings.TrimPrefix(kc.Key, prefix)
-						filtered = append(filtered, kc)
-					}
+			response.Data = filtered
+		}
+	case "idswithcount":
+		if keyCounts, ok := response.Data.([]models.KeyCount); ok {
+			filtered := []models.KeyCount{}
+			for _, kc := range keyCounts {
+				if strings.HasPrefix(kc.Key, prefix) {
+					kc.Key = strings.TrimPrefix(kc.Key, prefix)
+					filtered = append(filtered, kc)
 				}
-				response.Data = filtered
 			}
-		case "idswithcount-own":
-			if keyCounts, ok := response.Data.([]models.KeyCount); ok {
-				filtered := []models.KeyCount{}
-				for _, kc := range keyCounts {
-					if strings.HasPrefix(kc.Key, prefix) {
-						kc.Key = strings.TrimPrefix(kc.Key, prefix)
-						filtered = append(filtered, kc)
-					}
+			response.Data = filtered
+		}
+	case "idswithcount-own":
+		if keyCounts, ok := response.Data.([]models.KeyCount); ok {
+			filtered := []models.KeyCount{}
+			for _, kc := range keyCounts {
+				if strings.HasPrefix(kc.Key, prefix) {
+					kc.Key = strings.TrimPrefix(kc.Key, prefix)
+					filtered = append(filtered, kc)
 				}
-				response.Data = filtered
 			}
-		case "read":
-			if dataPoints, ok := response.Data.([]models.DataPoint); ok {
-				for i := range dataPoints {
-					dataPoints[i].Key = strings.TrimPrefix(dataPoints[i].Key, prefix)
-				}
-				response.Data = dataPoints
+			response.Data = filtered
+		}
+	case "syncstatus":
+		if status, ok := response.Data.(forward.Status); ok {
+			for i := range status.Keys {
+				status.Keys[i].Key = strings.TrimPrefix(status.Keys[i].Key, prefix)
 			}
-		case "multi-read":
-			if response.MultiData != nil {
-				newMultiData := make(map[string][]models.DataPoint)
-				for k, v := range response.MultiData {
-					if strings.HasPrefix(k, prefix) {
-						newKey := strings.TrimPrefix(k, prefix)
-						for i := range v {
-							v[i].Key = strings.TrimPrefix(v[i].Key, prefix)
-						}
-						newMultiData[newKey] = v
+		}
+	case "listrollups":
+		if rollups, ok := response.Data.([]RollupInfo); ok {
+			for i := range rollups {
+				rollups[i].Key = strings.TrimPrefix(rollups[i].Key, prefix)
+			}
+		}
+	case "read":
+		if dataPoints, ok := response.Data.([]models.DataPoint); ok {
+			for i := range dataPoints {
+				dataPoints[i].Key = strings.TrimPrefix(dataPoints[i].Key, prefix)
+			}
+			response.Data = dataPoints
+		}
+	case "multi-read", "query":
+		if response.MultiData != nil {
+			newMultiData := make(map[string][]models.DataPoint)
+			for k, v := range response.MultiData {
+				if strings.HasPrefix(k, prefix) {
+					newKey := strings.TrimPrefix(k, prefix)
+					for i := range v {
+						v[i].Key = strings.TrimPrefix(v[i].Key, prefix)
 					}
+					newMultiData[newKey] = v
 				}
-				response.MultiData = newMultiData
 			}
+			response.MultiData = newMultiData
 		}
+	}
 
-		// Use binary format if requested (faster than JSON for data-heavy responses)
-		if op.ResponseFormat == "binary" {
-			switch op.Operation {
-			case "multi-read":
-				if response.MultiData != nil {
-					_ = writeBinaryMultiData(conn, response.MultiData)
-					continue
-				}
-			case "read":
-				if dataPoints, ok := response.Data.([]models.DataPoint); ok {
-					_ = writeBinaryDataPoints(conn, strings.TrimPrefix(op.Key, prefix), dataPoints)
-					continue
-				}
+	// Use binary format if requested (faster than JSON for data-heavy responses)
+	if op.ResponseFormat == "binary" {
+		switch op.Operation {
+		case "multi-read", "query":
+			if response.MultiData != nil {
+				writeBinaryReply(conn, op.ID, func(w net.Conn) error { return writeBinaryMultiData(w, response.MultiData) })
+				return
+			}
+		case "read":
+			// A paged read stays JSON, for its cursor
+			if dataPoints, ok := response.Data.([]models.DataPoint); ok && op.Read.Limit == 0 {
+				writeBinaryReply(conn, op.ID, func(w net.Conn) error {
+					return writeBinaryDataPoints(w, strings.TrimPrefix(op.Key, prefix), dataPoints)
+				})
+				return
 			}
 		}
-		writeTCPResponse(conn, response)
 	}
+	reply(response)
+}
 
-	// Cleanup when the connection ends (safe via sync.Once)
-	if err := scanner.Err(); err != nil {
-		utils.Log("Client %d scanner error: %v", id, err)
+// writeBinaryReply writes a binary frame. For a request with an id, a
+// reply line with message "binary" announces it; nothing else is written
+// in between. It reports whether the writes succeeded.
+func writeBinaryReply(conn *tcpConn, id json.RawMessage, frame func(net.Conn) error) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if id != nil && !writeTCPResponse(conn.Conn, Response{Success: true, Message: "binary", ID: id, Type: typeReply}) {
+		return false
 	}
-	cleanupOnce.Do(cleanup)
+	return frame(conn.Conn) == nil
 }
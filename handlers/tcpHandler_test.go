@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"gtsdb/buffer"
 	"gtsdb/fanout"
 	"gtsdb/models"
 	"io"
+	"math"
 	"net"
+	"slices"
 	"strings"
 	"sync"
 	"testing"
@@ -314,3 +320,291 @@ func TestHandleTcpConnection(t *testing.T) {
 		})
 	}
 }
+
+func TestTcpRequestIDs(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			HandleTcpConnection(conn, fanout.NewFanout(), "")
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Pipelined: nothing is read before every request is sent
+	requests := `{"id":1,"operation":"auth","key":"` + testToken() + `"}
+{"id":"sub","operation":"subscribe","key":"tcp_id"}
+{"id":2,"operation":"write","key":"tcp_id","write":{"value":7,"timestamp":2000000000}}
+{"id":3,"operation":"read","key":"tcp_id","read":{"lastx":1}}
+{"id":{"n":4},"operation":"multi-read","keys":["tcp_id"],"read":{"lastx":1}}
+{"id":5,"operation":"read","key":"tcp_id","read":{"lastx":1},"response_format":"binary"}
+{"id":6,"operation":"setquota","key":"root","max_points":0}
+{"operation":"ids"}
+`
+	if _, err := conn.Write([]byte(requests)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	ids := map[string]int{}
+	pushes := 0
+	for len(ids) < 8 {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("After %v: %v", ids, err)
+		}
+		var resp struct {
+			ID      json.RawMessage `json:"id"`
+			Type    string          `json:"type"`
+			Success bool            `json:"success"`
+			Message string          `json:"message"`
+		}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		}
+		switch resp.Type {
+		case "push":
+			pushes++
+			continue
+		case "reply":
+		default:
+			t.Fatalf("Unexpected line %s", line)
+		}
+		if !resp.Success {
+			t.Errorf("Request %s failed: %s", resp.ID, resp.Message)
+		}
+		ids[string(resp.ID)]++
+		if resp.Message == "binary" {
+			var size [4]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint32(size[:]))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, id := range []string{`1`, `"sub"`, `2`, `3`, `{"n":4}`, `5`, `6`, ``} {
+		if ids[id] != 1 {
+			t.Errorf("Expected one reply with id %q, got %v", id, ids)
+		}
+	}
+	if pushes != 1 {
+		t.Errorf("Expected the write pushed to the subscription, got %d pushes", pushes)
+	}
+}
+
+// binaryWriteFrame encodes points as a binary write frame.
+func binaryWriteFrame(keys []string, points []models.DataPoint) []byte {
+	frame := binary.BigEndian.AppendUint16(nil, uint16(len(keys)))
+	for _, k := range keys {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(k)))
+		frame = append(frame, k...)
+	}
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(points)))
+	for _, p := range points {
+		frame = binary.BigEndian.AppendUint16(frame, uint16(slices.Index(keys, p.Key)))
+		frame = binary.BigEndian.AppendUint64(frame, uint64(p.Timestamp))
+		frame = binary.BigEndian.AppendUint64(frame, math.Float64bits(p.Value))
+	}
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(frame))), frame...)
+}
+
+func TestTcpBinaryWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			HandleTcpConnection(conn, fanout.NewFanout(), "")
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := buffer.InitKeyType("root/bin_flag", models.TypeBool); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"bin_a", "bin_flag"}
+	var stream []byte
+	stream = append(stream, `{"operation":"auth","key":"`+testToken()+`"}`+"\n"+`{"operation":"binary-write"}`+"\n"...)
+	stream = append(stream, binaryWriteFrame(keys, []models.DataPoint{
+		{Key: "bin_a", Timestamp: 2000000000, Value: 1.5},
+		{Key: "bin_flag", Timestamp: 2000000000, Value: 1},
+		{Key: "bin_a", Timestamp: 2000000001, Value: 2.5},
+	})...)
+	stream = append(stream, binaryWriteFrame(keys, []models.DataPoint{{Key: "bin_flag", Timestamp: 2000000001, Value: 7}})...)
+	stream = append(stream, binaryWriteFrame([]string{"../x"}, []models.DataPoint{{Key: "../x", Value: 1}})...)
+	oversized := make([]models.DataPoint, maxBatchPoints+1)
+	for i := range oversized {
+		oversized[i] = models.DataPoint{Key: "bin_a", Timestamp: 2000000100 + int64(i), Value: 1}
+	}
+	stream = append(stream, binaryWriteFrame(keys, oversized)...)
+	stream = append(stream, 0, 0, 0, 0)
+	stream = append(stream, `{"operation":"read","key":"bin_a","read":{"start_timestamp":2000000000,"end_timestamp":2000000001}}`+"\n"...)
+	if _, err := conn.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	want := []struct {
+		success bool
+		message string
+	}{
+		{true, "Authenticated as root"},
+		{true, "Binary write mode"},
+		{true, "Stored 3 data points"},
+		{false, "key root/bin_flag holds booleans; use true, false, 1 or 0"},
+		{false, "Invalid key in batch: ../x"},
+		{false, "Batch size exceeds maximum (10000)"},
+		{true, "JSON mode"},
+	}
+	for _, w := range want {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Success != w.success || resp.Message != w.message || resp.Type != "reply" {
+			t.Errorf("Expected %v %q, got %s", w.success, w.message, line)
+		}
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp struct {
+		Data []models.DataPoint `json:"data"`
+	}
+	if err := json.Unmarshal(line, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 2 || resp.Data[0].Value != 1.5 || resp.Data[1].Value != 2.5 {
+		t.Errorf("Expected the 2 points of bin_a, got %s", line)
+	}
+}
+
+func TestTcpStream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			HandleTcpConnection(conn, fanout.NewFanout(), "")
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var points []models.DataPoint
+	for i := 0; i < 2500; i++ {
+		points = append(points, models.DataPoint{Key: "root/tcp_stream", Timestamp: 2000000000 + int64(i), Value: float64(i)})
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	send := func(request string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(request + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := bufio.NewReader(conn)
+	readLine := func() Response {
+		t.Helper()
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	send(`{"operation":"auth","key":"` + testToken() + `"}`)
+	readLine()
+
+	// JSON: chunks with "more", then a reply counting the points
+	send(`{"id":1,"operation":"read","key":"tcp_stream","stream":true,"read":{"start_timestamp":2000000000,"end_timestamp":2000002499}}`)
+	var chunks, total int
+	for {
+		resp := readLine()
+		if string(resp.ID) != "1" || !resp.Success {
+			t.Fatalf("Unexpected reply %+v", resp)
+		}
+		if !resp.More {
+			if resp.Message != "Streamed 2500 data points" {
+				t.Errorf("Unexpected end of stream %q", resp.Message)
+			}
+			break
+		}
+		chunks++
+		total += len(resp.Data.([]interface{}))
+	}
+	if chunks != 3 || total != 2500 {
+		t.Errorf("Expected 2500 points in 3 chunks, got %d in %d", total, chunks)
+	}
+
+	// Binary: a frame per chunk, then a frame without points
+	send(`{"operation":"read","key":"tcp_stream","stream":true,"read":{"start_timestamp":2000000000,"end_timestamp":2000002499},"response_format":"binary"}`)
+	total = 0
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			t.Fatal(err)
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(r, frame); err != nil {
+			t.Fatal(err)
+		}
+		keyLen := int(binary.BigEndian.Uint16(frame[4:]))
+		if key := string(frame[6 : 6+keyLen]); key != "tcp_stream" {
+			t.Fatalf("Unexpected key %q", key)
+		}
+		n := int(binary.BigEndian.Uint32(frame[6+keyLen:]))
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+	if total != 2500 {
+		t.Errorf("Expected 2500 binary points, got %d", total)
+	}
+
+	// CSV: the header comes with the first chunk
+	send(`{"operation":"export","key":"tcp_stream","stream":true,"export":{"format":"csv","lastx":3}}`)
+	resp := readLine()
+	csv, _ := resp.Data.(string)
+	if !resp.More || !strings.HasPrefix(csv, "key,timestamp,value\n") || strings.Count(csv, "\n") != 4 {
+		t.Errorf("Unexpected CSV chunk %+v", resp)
+	}
+	if resp = readLine(); resp.More || resp.Message != "Streamed 3 data points" {
+		t.Errorf("Unexpected end of CSV stream %+v", resp)
+	}
+}
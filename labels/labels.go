@@ -0,0 +1,403 @@
+// Package labels attaches label sets ({site=hk, floor=2, type=temp}) to keys
+// and finds keys by label selector.
+//
+// Labels are stored per user in <data>/<user>/labels.json (keys without a
+// user folder in <data>/labels.json), keyed by the full key. An in-memory
+// inverted index (label name -> value -> keys) answers equality matchers
+// without scanning every key; the remaining matchers filter that candidate
+// set.
+package labels
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gtsdb/utils"
+)
+
+var (
+	mu      sync.RWMutex
+	dataDir string
+	byKey   = make(map[string]map[string]string)
+	index   = make(map[string]map[string]map[string]struct{}) // name -> value -> keys
+)
+
+// labelOwner returns the folder a key's labels are stored in ("" = data root).
+func labelOwner(key string) string {
+	if idx := strings.IndexByte(key, '/'); idx > 0 {
+		return key[:idx]
+	}
+	return ""
+}
+
+func labelsFile(owner string) string {
+	if owner == "" {
+		return filepath.Join(dataDir, "labels.json")
+	}
+	return filepath.Join(dataDir, owner, "labels.json")
+}
+
+// Init loads every labels.json under dir, replacing the in-memory state.
+func Init(dir string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	dataDir = dir
+	byKey = make(map[string]map[string]string)
+	index = make(map[string]map[string]map[string]struct{})
+
+	files := []string{filepath.Join(dir, "labels.json")}
+	if matches, err := filepath.Glob(filepath.Join(dir, "*", "labels.json")); err == nil {
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				utils.Errorln("Error reading labels file:", err)
+			}
+			continue
+		}
+		var stored map[string]map[string]string
+		if err := json.Unmarshal(data, &stored); err != nil {
+			utils.Errorln("Error parsing labels file:", file, err)
+			continue
+		}
+		for key, set := range stored {
+			setLocked(key, set)
+		}
+	}
+}
+
+// saveLocked persists the labels of one owner. Caller must hold mu.
+func saveLocked(owner string) {
+	if dataDir == "" {
+		return
+	}
+	stored := make(map[string]map[string]string)
+	for key, set := range byKey {
+		if labelOwner(key) == owner {
+			stored[key] = set
+		}
+	}
+	file := labelsFile(owner)
+	if len(stored) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			utils.Errorln("Error removing labels file:", err)
+		}
+		return
+	}
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		utils.Errorln("Error marshalling labels:", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		utils.Errorln("Error creating labels folder:", err)
+		return
+	}
+	if err := os.WriteFile(file, data, 0644); err != nil {
+		utils.Errorln("Error writing labels file:", err)
+	}
+}
+
+func setLocked(key string, set map[string]string) {
+	removeLocked(key)
+	if len(set) == 0 {
+		return
+	}
+	copied := make(map[string]string, len(set))
+	for name, value := range set {
+		copied[name] = value
+		values, ok := index[name]
+		if !ok {
+			values = make(map[string]map[string]struct{})
+			index[name] = values
+		}
+		keys, ok := values[value]
+		if !ok {
+			keys = make(map[string]struct{})
+			values[value] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	byKey[key] = copied
+}
+
+func removeLocked(key string) {
+	old, ok := byKey[key]
+	if !ok {
+		return
+	}
+	for name, value := range old {
+		keys := index[name][value]
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(index[name], value)
+		}
+		if len(index[name]) == 0 {
+			delete(index, name)
+		}
+	}
+	delete(byKey, key)
+}
+
+// SetLabels replaces a key's label set. An empty set removes the labels.
+func SetLabels(key string, set map[string]string) error {
+	for name, value := range set {
+		if name == "" {
+			return fmt.Errorf("label name required")
+		}
+		if value == "" {
+			return fmt.Errorf("label %s: value required", name)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	setLocked(key, set)
+	saveLocked(labelOwner(key))
+	return nil
+}
+
+// GetLabels returns a copy of a key's labels (empty when it has none).
+func GetLabels(key string) map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	set := make(map[string]string, len(byKey[key]))
+	for name, value := range byKey[key] {
+		set[name] = value
+	}
+	return set
+}
+
+// RenameKey moves a key's labels to its new name.
+func RenameKey(key, newKey string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	set, ok := byKey[key]
+	if !ok {
+		return
+	}
+	removeLocked(key)
+	setLocked(newKey, set)
+	saveLocked(labelOwner(key))
+	if labelOwner(newKey) != labelOwner(key) {
+		saveLocked(labelOwner(newKey))
+	}
+}
+
+// DeleteKey drops a key's labels.
+func DeleteKey(key string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := byKey[key]; !ok {
+		return
+	}
+	removeLocked(key)
+	saveLocked(labelOwner(key))
+}
+
+// SnapshotFiles returns the content of every labels.json, keyed by its path
+// relative to the data directory with forward slashes.
+func SnapshotFiles() (map[string][]byte, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	files := make(map[string][]byte)
+	if dataDir == "" {
+		return files, nil
+	}
+	owners := map[string]bool{"": true}
+	for key := range byKey {
+		owners[labelOwner(key)] = true
+	}
+	for owner := range owners {
+		data, err := os.ReadFile(labelsFile(owner))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		rel, err := filepath.Rel(dataDir, labelsFile(owner))
+		if err != nil {
+			return nil, err
+		}
+		files[filepath.ToSlash(rel)] = data
+	}
+	return files, nil
+}
+
+// MatchType is a selector operator.
+type MatchType int
+
+const (
+	MatchEqual     MatchType = iota // name="value"
+	MatchNotEqual                   // name!="value"
+	MatchRegexp                     // name=~"regex"
+	MatchNotRegexp                  // name!~"regex"
+)
+
+// Matcher is one clause of a selector. A key without the label is treated
+// as having the empty value.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+// NewMatcher builds a matcher, compiling (fully anchored) regexps.
+func NewMatcher(name string, t MatchType, value string) (Matcher, error) {
+	m := Matcher{Name: name, Type: t, Value: value}
+	if t == MatchRegexp || t == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return m, fmt.Errorf("invalid regexp %q: %v", value, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches reports whether a label value satisfies the matcher.
+func (m Matcher) Matches(value string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return value == m.Value
+	case MatchNotEqual:
+		return value != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(value)
+	case MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// ParseSelector parses `site=hk,floor="2",type=~"temp|hum"`, optionally
+// wrapped in braces. Operators are =, !=, =~ and !~; values may be quoted.
+// At least one matcher must reject the empty value, so a selector never
+// matches every unlabelled key.
+func ParseSelector(s string) ([]Matcher, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	var matchers []Matcher
+	for _, clause := range splitClauses(s) {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+		opAt := strings.IndexAny(clause, "=!")
+		if opAt <= 0 {
+			return nil, fmt.Errorf("invalid selector clause: %s", clause)
+		}
+		name := strings.TrimSpace(clause[:opAt])
+		rest := clause[opAt:]
+		var t MatchType
+		switch {
+		case strings.HasPrefix(rest, "=~"):
+			t, rest = MatchRegexp, rest[2:]
+		case strings.HasPrefix(rest, "!~"):
+			t, rest = MatchNotRegexp, rest[2:]
+		case strings.HasPrefix(rest, "!="):
+			t, rest = MatchNotEqual, rest[2:]
+		case strings.HasPrefix(rest, "="):
+			t, rest = MatchEqual, rest[1:]
+		default:
+			return nil, fmt.Errorf("invalid selector clause: %s", clause)
+		}
+		value := strings.TrimSpace(rest)
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		m, err := NewMatcher(name, t, value)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("empty selector")
+	}
+	for _, m := range matchers {
+		if !m.Matches("") {
+			return matchers, nil
+		}
+	}
+	return nil, fmt.Errorf("selector must contain a matcher that does not match empty values")
+}
+
+// splitClauses splits on commas outside double quotes.
+func splitClauses(s string) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case ',':
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Select returns the sorted keys whose labels satisfy every matcher and that
+// allow accepts (nil = any key).
+func Select(matchers []Matcher, allow func(key string) bool) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	// Start from the smallest equality posting list, else every labelled key.
+	var candidates map[string]struct{}
+	indexed := false
+	for _, m := range matchers {
+		if m.Type != MatchEqual || m.Value == "" {
+			continue
+		}
+		keys := index[m.Name][m.Value]
+		if !indexed || len(keys) < len(candidates) {
+			candidates, indexed = keys, true
+		}
+	}
+
+	var result []string
+	consider := func(key string) {
+		if allow != nil && !allow(key) {
+			return
+		}
+		set := byKey[key]
+		for _, m := range matchers {
+			if !m.Matches(set[m.Name]) {
+				return
+			}
+		}
+		result = append(result, key)
+	}
+	if indexed {
+		for key := range candidates {
+			consider(key)
+		}
+	} else {
+		for key := range byKey {
+			consider(key)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
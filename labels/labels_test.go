@@ -0,0 +1,119 @@
+package labels
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func setupLabels(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	Init(dir)
+	t.Cleanup(func() { Init("") })
+	return dir
+}
+
+func TestSetGetPersist(t *testing.T) {
+	dir := setupLabels(t)
+
+	if err := SetLabels("alice/t1", map[string]string{"site": "hk", "floor": "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLabels("bob/t1", map[string]string{"site": "sg"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLabels("alice/t2", map[string]string{"site": ""}); err == nil {
+		t.Error("expected error for empty label value")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "alice", "labels.json")); err != nil {
+		t.Errorf("expected per-user labels file: %v", err)
+	}
+
+	Init(dir)
+	if got := GetLabels("alice/t1"); !reflect.DeepEqual(got, map[string]string{"site": "hk", "floor": "2"}) {
+		t.Errorf("labels not reloaded: %v", got)
+	}
+
+	RenameKey("alice/t1", "alice/t9")
+	if len(GetLabels("alice/t1")) != 0 || GetLabels("alice/t9")["site"] != "hk" {
+		t.Error("labels should follow rename")
+	}
+	DeleteKey("bob/t1")
+	if _, err := os.Stat(filepath.Join(dir, "bob", "labels.json")); !os.IsNotExist(err) {
+		t.Error("labels file should be removed with its last key")
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	m, err := ParseSelector(`{site="hk", floor!=3, type=~"temp|hum", name!~"x.*"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MatchType{MatchEqual, MatchNotEqual, MatchRegexp, MatchNotRegexp}
+	if len(m) != len(want) {
+		t.Fatalf("expected %d matchers, got %d", len(want), len(m))
+	}
+	for i, mt := range want {
+		if m[i].Type != mt {
+			t.Errorf("matcher %d type = %d, want %d", i, m[i].Type, mt)
+		}
+	}
+	if m[0].Name != "site" || m[0].Value != "hk" || m[1].Value != "3" {
+		t.Errorf("unexpected matchers: %+v", m)
+	}
+	if m, err := ParseSelector(`tag="a,b"`); err != nil || len(m) != 1 || m[0].Value != "a,b" {
+		t.Errorf("quoted comma not kept: %+v, %v", m, err)
+	}
+
+	for _, bad := range []string{"", "{}", "site", "=hk", "site!=hk", "type=~(", "type=~.*"} {
+		if _, err := ParseSelector(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	setupLabels(t)
+
+	SetLabels("alice/a", map[string]string{"site": "hk", "type": "temp"})
+	SetLabels("alice/b", map[string]string{"site": "hk", "type": "hum"})
+	SetLabels("alice/c", map[string]string{"site": "sg", "type": "temp"})
+	SetLabels("bob/a", map[string]string{"site": "hk", "type": "temp"})
+
+	tests := []struct {
+		selector string
+		prefix   string
+		want     []string
+	}{
+		{`site=hk`, "", []string{"alice/a", "alice/b", "bob/a"}},
+		{`site=hk`, "alice/", []string{"alice/a", "alice/b"}},
+		{`site=hk,type=temp`, "alice/", []string{"alice/a"}},
+		{`type=~"t.*",site!=hk`, "", []string{"alice/c"}},
+		{`site=nowhere`, "", nil},
+		{`site=hk,type!~"te.*"`, "", []string{"alice/b"}},
+	}
+	for _, tt := range tests {
+		m, err := ParseSelector(tt.selector)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.selector, err)
+		}
+		var allow func(string) bool
+		if tt.prefix != "" {
+			allow = func(key string) bool { return strings.HasPrefix(key, tt.prefix) }
+		}
+		if got := Select(m, allow); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Select(%s, %q) = %v, want %v", tt.selector, tt.prefix, got, tt.want)
+		}
+	}
+
+	// Replacing a label set updates the index
+	SetLabels("alice/b", map[string]string{"site": "sg"})
+	m, _ := ParseSelector("site=sg")
+	if got := Select(m, nil); !reflect.DeepEqual(got, []string{"alice/b", "alice/c"}) {
+		t.Errorf("index not updated: %v", got)
+	}
+}
@@ -7,8 +7,13 @@ import (
 	"gtsdb/auth"
 	"gtsdb/buffer"
 	"gtsdb/fanout"
+	"gtsdb/forward"
 	"gtsdb/handlers"
+	"gtsdb/labels"
 	"gtsdb/quota"
+	"gtsdb/replication"
+	"gtsdb/retention"
+	"gtsdb/snapshot"
 	"gtsdb/utils"
 	"net"
 	"net/http"
@@ -28,18 +33,57 @@ func main() {
 	// Parse command line arguments
 	flag.Parse()
 	configFile := defaultConfig
-	if args := flag.Args(); len(args) > 0 {
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "restore" {
+		if len(args) < 2 {
+			utils.Errorln("Usage: gtsdb restore <snapshot.tar> [config.ini]")
+			os.Exit(2)
+		}
+		if len(args) > 2 {
+			configFile = args[2]
+		}
+		if err := restore(args[1], configFile); err != nil {
+			utils.Errorln("Restore failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(args) > 0 {
 		configFile = args[0]
 	}
 
 	run(configFile)
 }
 
+// restore extracts a snapshot into the data directory named by the config
+// file. The server must not be running and the directory must be empty.
+func restore(snapshotFile, configFile string) error {
+	if cfg, err := ini.InsensitiveLoad(configFile); err == nil {
+		if dir := cfg.Section("paths").Key("data").String(); dir != "" {
+			utils.DataDir = dir
+		}
+	}
+	f, err := os.Open(snapshotFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	m, err := snapshot.Restore(f, utils.DataDir)
+	if err != nil {
+		return err
+	}
+	utils.Log("Restored %d keys (%d files) from %s into %s", len(m.Keys), m.Files, snapshotFile, utils.DataDir)
+	return nil
+}
+
 func run(configFile string) {
 	loadConfig(configFile)
 	utils.InitDataDirectory()
 	migrateData()
 	auth.Init(utils.DataDir)
+	retention.Init(utils.DataDir)
+	labels.Init(utils.DataDir)
+	forward.Init(utils.DataDir)
 	fanoutManager := fanout.NewFanout()
 
 	// Create stop channels
@@ -49,14 +93,37 @@ func run(configFile string) {
 	go startTCPServerWithStop(utils.TcpListenAddr, utils.NoAuthUser, fanoutManager, tcpStop)
 	go startHTTPServerWithStop(utils.HttpListenAddr, utils.NoAuthUser, fanoutManager, httpStop)
 
-	// Start background compaction (checks every hour, compacts files > 100MB)
-	compactStop := startBackgroundCompaction(1*time.Hour, 100*1024*1024)
+	compactStop := make(chan struct{})
+	retentionStop := make(chan struct{})
+	if utils.ReplicationLeader != "" {
+		// A follower replays the leader's compactions and expiry instead
+		// of running its own.
+		utils.Logln("Following leader", utils.ReplicationLeader)
+		go replication.Follow(utils.ReplicationLeader, utils.ReplicationToken, compactStop)
+	} else {
+		// Start background compaction (checks every hour, compacts files > 100MB
+		// or with > 10000 staged points)
+		compactStop = startBackgroundCompaction(1*time.Hour, 100*1024*1024, 10000)
+
+		// Start retention enforcement (drops points older than each key's policy)
+		retentionStop = startBackgroundRetention(1 * time.Hour)
+	}
 
 	// Start per-user storage quota reconciler (O(1) write checks, exact counts
 	// refreshed every 5 minutes off the hot path).
 	quotaStop := make(chan struct{})
 	quota.StartReconciler(5*time.Minute, quotaStop)
 
+	// Start store-and-forward sync (no-op unless [forward] is configured)
+	forwardStop := make(chan struct{})
+	forwardDone := forward.Start(forward.Config{
+		Remote:       utils.ForwardRemote,
+		Token:        utils.ForwardToken,
+		Prefixes:     utils.ForwardPrefixes,
+		RemotePrefix: utils.ForwardRemotePrefix,
+		Interval:     time.Duration(utils.ForwardIntervalMs) * time.Millisecond,
+	}, forwardStop)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
@@ -65,7 +132,10 @@ func run(configFile string) {
 	close(tcpStop)
 	close(httpStop)
 	close(compactStop)
+	close(retentionStop)
 	close(quotaStop)
+	close(forwardStop)
+	<-forwardDone // the worker reads the WAL being flushed below
 	gracefulShutdown()
 }
 
@@ -145,6 +215,8 @@ func loadConfig(iniFile string) {
 		}
 		// Load WAL compression setting
 		utils.CompactionCompression = cfg.Section("buffer").Key("compaction_compression").MustBool(false)
+		// Load WAL record checksum setting (applies to new and compacted keys)
+		utils.WALChecksums = cfg.Section("buffer").Key("wal_checksums").MustBool(true)
 
 		// Load sync mode: "async" (default) or "sync"
 		syncMode := cfg.Section("buffer").Key("sync_mode").String()
@@ -163,6 +235,36 @@ func loadConfig(iniFile string) {
 		if cacheSize := cfg.Section("buffer").Key("cache_size").MustInt(0); cacheSize > 0 {
 			utils.DataPointCacheSize = cacheSize
 		}
+
+		// Load default retention ("90d", "12h", seconds; empty = keep forever)
+		if r := cfg.Section("retention").Key("default").String(); r != "" {
+			if seconds, err := retention.ParseRetention(r); err != nil {
+				utils.Warningln("無效的保留期限設定：", err)
+			} else {
+				utils.DefaultRetention = seconds
+			}
+		}
+
+		// Load replication: the leader to follow, and the log kept for followers
+		utils.ReplicationLeader = cfg.Section("replication").Key("leader").String()
+		utils.ReplicationToken = cfg.Section("replication").Key("leader_token").String()
+		if mb := cfg.Section("replication").Key("log_size_mb").MustInt(64); mb > 0 {
+			utils.ReplicationLogBytes = int64(mb) << 20
+		}
+
+		// Load store-and-forward sync to a remote GTSDB
+		utils.ForwardRemote = cfg.Section("forward").Key("remote").String()
+		utils.ForwardToken = cfg.Section("forward").Key("token").String()
+		utils.ForwardPrefixes = nil
+		for _, prefix := range strings.Split(cfg.Section("forward").Key("prefixes").String(), ",") {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				utils.ForwardPrefixes = append(utils.ForwardPrefixes, prefix)
+			}
+		}
+		utils.ForwardRemotePrefix = cfg.Section("forward").Key("remote_prefix").String()
+		if interval := cfg.Section("forward").Key("interval_ms").MustInt(5000); interval > 0 {
+			utils.ForwardIntervalMs = interval
+		}
 	}
 
 	utils.Logln(" TCP 監聽地址： ", utils.TcpListenAddr)
@@ -173,6 +275,8 @@ func loadConfig(iniFile string) {
 	buffer.InitFileHandles()
 	buffer.SetCacheSize(utils.DataPointCacheSize)
 	buffer.InitIDSet()
+	buffer.RecoverWALs()
+	buffer.InitRollups()
 
 	// Start async flusher if configured
 	if utils.SyncMode == "async" {
@@ -238,8 +342,10 @@ func migrateData() {
 }
 
 // startBackgroundCompaction runs periodic WAL compaction in the background.
-// It checks all keys and compacts files that exceed the threshold size.
-func startBackgroundCompaction(interval time.Duration, thresholdBytes int64) chan struct{} {
+// It checks all keys and compacts files that exceed the threshold size or
+// hold more staged out-of-order points than stagedThreshold (a patch that
+// reaches the staging limit compacts its key itself).
+func startBackgroundCompaction(interval time.Duration, thresholdBytes int64, stagedThreshold int) chan struct{} {
 	stop := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(interval)
@@ -249,7 +355,7 @@ func startBackgroundCompaction(interval time.Duration, thresholdBytes int64) cha
 			case <-stop:
 				return
 			case <-ticker.C:
-				utils.Log("Starting background compaction check (threshold: %d bytes)", thresholdBytes)
+				utils.Log("Starting background compaction check (threshold: %d bytes, %d staged points)", thresholdBytes, stagedThreshold)
 				ids := buffer.GetAllIds()
 				for _, id := range ids {
 					select {
@@ -261,8 +367,8 @@ func startBackgroundCompaction(interval time.Duration, thresholdBytes int64) cha
 					if !ok {
 						continue
 					}
-					if size > thresholdBytes {
-						utils.Log("Auto-compacting key %s (size: %d bytes)", id, size)
+					if staged := buffer.StagedPointCount(id); size > thresholdBytes || staged > stagedThreshold {
+						utils.Log("Auto-compacting key %s (size: %d bytes, %d staged points)", id, size, staged)
 						if err := buffer.CompactKey(id); err != nil {
 							utils.Error("Auto-compaction failed for %s: %v", id, err)
 						}
@@ -273,3 +379,24 @@ func startBackgroundCompaction(interval time.Duration, thresholdBytes int64) cha
 	}()
 	return stop
 }
+
+// startBackgroundRetention periodically drops data points that have outlived
+// their key's retention policy (see package retention).
+func startBackgroundRetention(interval time.Duration) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if removed := retention.Enforce(time.Now().Unix(), stop); removed > 0 {
+					utils.Log("Retention removed %d expired data points", removed)
+				}
+			}
+		}
+	}()
+	return stop
+}
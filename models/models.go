@@ -1,11 +1,179 @@
 package models
 
-import "strconv"
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
+// ValueType is the type of a key's values.
+type ValueType uint8
+
+const (
+	TypeFloat ValueType = iota
+	TypeInt
+	TypeBool
+	TypeString
+)
+
+var valueTypeNames = [...]string{"float", "int", "bool", "string"}
+
+func (t ValueType) String() string {
+	if int(t) < len(valueTypeNames) {
+		return valueTypeNames[t]
+	}
+	return "unknown"
+}
+
+// ParseValueType parses "float", "int", "bool" or "string" ("" = float).
+func ParseValueType(s string) (ValueType, error) {
+	if s == "" {
+		return TypeFloat, nil
+	}
+	for i, name := range valueTypeNames {
+		if s == name {
+			return ValueType(i), nil
+		}
+	}
+	return TypeFloat, fmt.Errorf("unknown value type: %s", s)
+}
+
+// Precision is the unit of a key's timestamps.
+type Precision uint8
+
+const (
+	PrecisionSecond Precision = iota
+	PrecisionMilli
+	PrecisionMicro
+	PrecisionNano
+)
+
+var precisionNames = [...]string{"s", "ms", "us", "ns"}
+var precisionUnits = [...]int64{1, 1_000, 1_000_000, 1_000_000_000}
+
+func (p Precision) String() string {
+	if int(p) < len(precisionNames) {
+		return precisionNames[p]
+	}
+	return "unknown"
+}
+
+// ParsePrecision parses "s", "ms", "us" or "ns" ("" = s).
+func ParsePrecision(s string) (Precision, error) {
+	if s == "" {
+		return PrecisionSecond, nil
+	}
+	for i, name := range precisionNames {
+		if s == name {
+			return Precision(i), nil
+		}
+	}
+	return PrecisionSecond, fmt.Errorf("unknown precision: %s (use s, ms, us or ns)", s)
+}
+
+// PerSecond returns the number of timestamp units in a second.
+func (p Precision) PerSecond() int64 {
+	return precisionUnits[p]
+}
+
+// FromNanos converts a Unix time in nanoseconds to this precision.
+func (p Precision) FromNanos(ns int64) int64 {
+	return ns / (1_000_000_000 / precisionUnits[p])
+}
+
+// Now returns the current time in this precision.
+func (p Precision) Now() int64 {
+	return p.FromNanos(time.Now().UnixNano())
+}
+
+// DataPoint is one reading. Points of multi-field keys carry their values in
+// Fields (absent fields are omitted) and mirror the first field in Value;
+// JSON does not carry that field, so a decoded multi-field point has a NaN
+// Value.
+//
+// Points of typed keys hold the exact value in Int (int and bool, 0/1) or
+// Str (string) and an approximation in Value (the integer as a float, 0/1,
+// NaN for strings), so aggregations and the binary format keep working.
 type DataPoint struct {
-	Key       string  `json:"key"`
-	Timestamp int64   `json:"timestamp"`
-	Value     float64 `json:"value"`
+	Key       string             `json:"key"`
+	Timestamp int64              `json:"timestamp"`
+	Value     float64            `json:"value"`
+	Fields    map[string]float64 `json:"fields,omitempty"`
+	Type      ValueType          `json:"-"`
+	Int       int64              `json:"-"`
+	Str       string             `json:"-"`
+}
+
+// IntPoint returns an int point (bool points use 0/1 with TypeBool).
+func IntPoint(key string, timestamp int64, t ValueType, v int64) DataPoint {
+	return DataPoint{Key: key, Timestamp: timestamp, Value: float64(v), Type: t, Int: v}
+}
+
+// StringPoint returns a string point.
+func StringPoint(key string, timestamp int64, s string) DataPoint {
+	return DataPoint{Key: key, Timestamp: timestamp, Value: math.NaN(), Type: TypeString, Str: s}
+}
+
+// AppendValue appends the JSON encoding of the point's value; a NaN float
+// (an empty bucket filled with null) or an infinite one is null.
+func (dp DataPoint) AppendValue(buf []byte) []byte {
+	switch dp.Type {
+	case TypeInt:
+		return strconv.AppendInt(buf, dp.Int, 10)
+	case TypeBool:
+		return strconv.AppendBool(buf, dp.Int != 0)
+	case TypeString:
+		return appendJSONString(buf, dp.Str)
+	}
+	return appendFloat(buf, dp.Value)
+}
+
+// appendFloat appends v as a JSON number, or null when it is NaN or
+// infinite, which JSON cannot represent.
+func appendFloat(buf []byte, v float64) []byte {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return append(buf, "null"...)
+	}
+	return strconv.AppendFloat(buf, v, 'f', -1, 64)
+}
+
+// FormatValue returns the value as text (CSV export, logs); a NaN float is
+// empty.
+func (dp DataPoint) FormatValue() string {
+	switch dp.Type {
+	case TypeInt:
+		return strconv.FormatInt(dp.Int, 10)
+	case TypeBool:
+		return strconv.FormatBool(dp.Int != 0)
+	case TypeString:
+		return dp.Str
+	}
+	if math.IsNaN(dp.Value) {
+		return ""
+	}
+	return strconv.FormatFloat(dp.Value, 'f', 6, 64)
+}
+
+// appendJSONString appends s as a JSON string literal.
+func appendJSONString(buf []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	buf = append(buf, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20:
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xF])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '"')
 }
 
 // MarshalJSON implements json.Marshaler with a fast, allocation-minimal path.
@@ -16,12 +184,86 @@ func (dp DataPoint) MarshalJSON() ([]byte, error) {
 	buf = append(buf, dp.Key...)
 	buf = append(buf, `","timestamp":`...)
 	buf = strconv.AppendInt(buf, dp.Timestamp, 10)
+	if dp.Fields != nil {
+		// Multi-field point: the fields replace value, which may be NaN.
+		names := make([]string, 0, len(dp.Fields))
+		for name := range dp.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf = append(buf, `,"fields":{`...)
+		for i, name := range names {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			buf = strconv.AppendQuote(buf, name)
+			buf = append(buf, ':')
+			buf = appendFloat(buf, dp.Fields[name])
+		}
+		buf = append(buf, "}}"...)
+		return buf, nil
+	}
 	buf = append(buf, `,"value":`...)
-	buf = strconv.AppendFloat(buf, dp.Value, 'f', -1, 64)
+	buf = dp.AppendValue(buf)
 	buf = append(buf, '}')
 	return buf, nil
 }
 
+// UnmarshalJSON accepts the output of MarshalJSON, including int, bool and
+// string values.
+func (dp *DataPoint) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Key       string              `json:"key"`
+		Timestamp int64               `json:"timestamp"`
+		Value     json.RawMessage     `json:"value"`
+		Fields    map[string]*float64 `json:"fields"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*dp = DataPoint{Key: raw.Key, Timestamp: raw.Timestamp}
+	if raw.Fields != nil {
+		// The fields are sorted by name, so the first one is unknown
+		dp.Value = math.NaN()
+		dp.Fields = make(map[string]float64, len(raw.Fields))
+		for name, v := range raw.Fields {
+			dp.Fields[name] = math.NaN() // null
+			if v != nil {
+				dp.Fields[name] = *v
+			}
+		}
+		return nil
+	}
+	text := string(raw.Value)
+	switch {
+	case len(text) == 0:
+	case text == "null":
+		dp.Value = math.NaN()
+	case text == "true" || text == "false":
+		*dp = IntPoint(dp.Key, dp.Timestamp, TypeBool, 0)
+		if text == "true" {
+			dp.Int, dp.Value = 1, 1
+		}
+	case text[0] == '"':
+		// Unescaped strings are used as they are; only escapes need the
+		// JSON decoder.
+		s := text[1 : len(text)-1]
+		if strings.IndexByte(s, '\\') >= 0 {
+			if err := json.Unmarshal(raw.Value, &s); err != nil {
+				return err
+			}
+		}
+		*dp = StringPoint(dp.Key, dp.Timestamp, s)
+	default:
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return fmt.Errorf("invalid value %s", text)
+		}
+		dp.Value = v
+	}
+	return nil
+}
+
 type IndexEntry struct {
 	Timestamp int64 `json:"timestamp"`
 	Offset    int64 `json:"offset"`
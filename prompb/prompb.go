@@ -0,0 +1,440 @@
+// Package prompb decodes and encodes the subset of the Prometheus remote
+// storage protobuf messages (prometheus/prompb) that GTSDB serves:
+// WriteRequest, ReadRequest and ReadResponse with float samples.
+//
+// Fields this package does not model (metadata, exemplars, native
+// histograms, read hints, accepted response types) are skipped when decoding
+// and never emitted, so the wire format stays compatible in both directions.
+package prompb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one float value; Timestamp is in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+type MatchType int32
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+}
+
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+type ReadRequest struct {
+	Queries []Query
+}
+
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+var ErrInvalid = errors.New("prompb: invalid protobuf message")
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// decoder walks the fields of one message.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// next returns the next field number and wire type; ok is false at the end
+// of the message or on error.
+func (d *decoder) next() (field int, wire int, ok bool) {
+	if d.err != nil || len(d.buf) == 0 {
+		return 0, 0, false
+	}
+	key := d.varint()
+	if d.err != nil {
+		return 0, 0, false
+	}
+	return int(key >> 3), int(key & 7), true
+}
+
+func (d *decoder) varint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrInvalid
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) fixed64() uint64 {
+	if len(d.buf) < 8 {
+		d.err = ErrInvalid
+		return 0
+	}
+	v := binary.LittleEndian.Uint64(d.buf)
+	d.buf = d.buf[8:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.varint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrInvalid
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) skip(wire int) {
+	switch wire {
+	case wireVarint:
+		d.varint()
+	case wireFixed64:
+		d.fixed64()
+	case wireBytes:
+		d.bytes()
+	case wireFixed32:
+		if len(d.buf) < 4 {
+			d.err = ErrInvalid
+			return
+		}
+		d.buf = d.buf[4:]
+	default:
+		d.err = ErrInvalid
+	}
+}
+
+// expect records an error when a known field arrives with the wrong type.
+func (d *decoder) expect(wire, want int) bool {
+	if wire != want {
+		d.err = ErrInvalid
+		return false
+	}
+	return true
+}
+
+func appendKey(b []byte, field, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendStringField(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = appendKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendKey(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// Label: name=1, value=2
+func decodeLabel(buf []byte) (Label, error) {
+	var l Label
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		switch field {
+		case 1:
+			if d.expect(wire, wireBytes) {
+				l.Name = string(d.bytes())
+			}
+		case 2:
+			if d.expect(wire, wireBytes) {
+				l.Value = string(d.bytes())
+			}
+		default:
+			d.skip(wire)
+		}
+	}
+	return l, d.err
+}
+
+func appendLabel(b []byte, l Label) []byte {
+	b = appendStringField(b, 1, l.Name)
+	return appendStringField(b, 2, l.Value)
+}
+
+// Sample: value=1 (double), timestamp=2 (int64)
+func decodeSample(buf []byte) (Sample, error) {
+	var s Sample
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		switch field {
+		case 1:
+			if d.expect(wire, wireFixed64) {
+				s.Value = math.Float64frombits(d.fixed64())
+			}
+		case 2:
+			if d.expect(wire, wireVarint) {
+				s.Timestamp = int64(d.varint())
+			}
+		default:
+			d.skip(wire)
+		}
+	}
+	return s, d.err
+}
+
+func appendSample(b []byte, s Sample) []byte {
+	if bits := math.Float64bits(s.Value); bits != 0 {
+		b = appendKey(b, 1, wireFixed64)
+		b = binary.LittleEndian.AppendUint64(b, bits)
+	}
+	return appendVarintField(b, 2, uint64(s.Timestamp))
+}
+
+// TimeSeries: labels=1, samples=2
+func decodeTimeSeries(buf []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		switch field {
+		case 1:
+			if d.expect(wire, wireBytes) {
+				l, err := decodeLabel(d.bytes())
+				if err != nil {
+					return ts, err
+				}
+				ts.Labels = append(ts.Labels, l)
+			}
+		case 2:
+			if d.expect(wire, wireBytes) {
+				s, err := decodeSample(d.bytes())
+				if err != nil {
+					return ts, err
+				}
+				ts.Samples = append(ts.Samples, s)
+			}
+		default:
+			d.skip(wire)
+		}
+	}
+	return ts, d.err
+}
+
+func marshalTimeSeries(ts TimeSeries) []byte {
+	var msg []byte
+	for _, l := range ts.Labels {
+		msg = appendBytesField(msg, 1, appendLabel(nil, l))
+	}
+	for _, s := range ts.Samples {
+		msg = appendBytesField(msg, 2, appendSample(nil, s))
+	}
+	return msg
+}
+
+// UnmarshalWriteRequest decodes a WriteRequest (timeseries=1).
+func UnmarshalWriteRequest(buf []byte) (WriteRequest, error) {
+	var req WriteRequest
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		if field == 1 && d.expect(wire, wireBytes) {
+			ts, err := decodeTimeSeries(d.bytes())
+			if err != nil {
+				return req, err
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+			continue
+		}
+		d.skip(wire)
+	}
+	return req, d.err
+}
+
+// Marshal encodes the request.
+func (r WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, ts := range r.Timeseries {
+		b = appendBytesField(b, 1, marshalTimeSeries(ts))
+	}
+	return b
+}
+
+// LabelMatcher: type=1, name=2, value=3
+func decodeMatcher(buf []byte) (LabelMatcher, error) {
+	var m LabelMatcher
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		switch field {
+		case 1:
+			if d.expect(wire, wireVarint) {
+				m.Type = MatchType(d.varint())
+			}
+		case 2:
+			if d.expect(wire, wireBytes) {
+				m.Name = string(d.bytes())
+			}
+		case 3:
+			if d.expect(wire, wireBytes) {
+				m.Value = string(d.bytes())
+			}
+		default:
+			d.skip(wire)
+		}
+	}
+	return m, d.err
+}
+
+// Query: start_timestamp_ms=1, end_timestamp_ms=2, matchers=3
+func decodeQuery(buf []byte) (Query, error) {
+	var q Query
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		switch field {
+		case 1:
+			if d.expect(wire, wireVarint) {
+				q.StartTimestampMs = int64(d.varint())
+			}
+		case 2:
+			if d.expect(wire, wireVarint) {
+				q.EndTimestampMs = int64(d.varint())
+			}
+		case 3:
+			if d.expect(wire, wireBytes) {
+				m, err := decodeMatcher(d.bytes())
+				if err != nil {
+					return q, err
+				}
+				q.Matchers = append(q.Matchers, m)
+			}
+		default:
+			d.skip(wire)
+		}
+	}
+	return q, d.err
+}
+
+// UnmarshalReadRequest decodes a ReadRequest (queries=1).
+func UnmarshalReadRequest(buf []byte) (ReadRequest, error) {
+	var req ReadRequest
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		if field == 1 && d.expect(wire, wireBytes) {
+			q, err := decodeQuery(d.bytes())
+			if err != nil {
+				return req, err
+			}
+			req.Queries = append(req.Queries, q)
+			continue
+		}
+		d.skip(wire)
+	}
+	return req, d.err
+}
+
+// Marshal encodes the request.
+func (r ReadRequest) Marshal() []byte {
+	var b []byte
+	for _, q := range r.Queries {
+		var msg []byte
+		msg = appendVarintField(msg, 1, uint64(q.StartTimestampMs))
+		msg = appendVarintField(msg, 2, uint64(q.EndTimestampMs))
+		for _, m := range q.Matchers {
+			var mb []byte
+			mb = appendVarintField(mb, 1, uint64(m.Type))
+			mb = appendStringField(mb, 2, m.Name)
+			mb = appendStringField(mb, 3, m.Value)
+			msg = appendBytesField(msg, 3, mb)
+		}
+		b = appendBytesField(b, 1, msg)
+	}
+	return b
+}
+
+// Marshal encodes the response (results=1, each with timeseries=1).
+func (r ReadResponse) Marshal() []byte {
+	var b []byte
+	for _, res := range r.Results {
+		var msg []byte
+		for _, ts := range res.Timeseries {
+			msg = appendBytesField(msg, 1, marshalTimeSeries(ts))
+		}
+		b = appendBytesField(b, 1, msg)
+	}
+	return b
+}
+
+// UnmarshalReadResponse decodes a ReadResponse.
+func UnmarshalReadResponse(buf []byte) (ReadResponse, error) {
+	var resp ReadResponse
+	d := decoder{buf: buf}
+	for field, wire, ok := d.next(); ok; field, wire, ok = d.next() {
+		if field != 1 || !d.expect(wire, wireBytes) {
+			d.skip(wire)
+			continue
+		}
+		var res QueryResult
+		rd := decoder{buf: d.bytes()}
+		for f, w, ok := rd.next(); ok; f, w, ok = rd.next() {
+			if f == 1 && rd.expect(w, wireBytes) {
+				ts, err := decodeTimeSeries(rd.bytes())
+				if err != nil {
+					return resp, err
+				}
+				res.Timeseries = append(res.Timeseries, ts)
+				continue
+			}
+			rd.skip(w)
+		}
+		if rd.err != nil {
+			return resp, rd.err
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	return resp, d.err
+}
@@ -0,0 +1,86 @@
+package prompb
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWriteRequestRoundTrip(t *testing.T) {
+	req := WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels:  []Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: "node"}},
+			Samples: []Sample{{Value: 1, Timestamp: 1700000000000}, {Value: 0, Timestamp: 1700000015000}},
+		},
+		{
+			Labels:  []Label{{Name: "__name__", Value: "temp"}},
+			Samples: []Sample{{Value: -3.5, Timestamp: -1000}, {Value: math.Inf(1), Timestamp: 1}},
+		},
+	}}
+	got, err := UnmarshalWriteRequest(req.Marshal())
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, req)
+	}
+}
+
+func TestUnmarshalWriteRequestWire(t *testing.T) {
+	// Hand-encoded: timeseries { labels { name: "a" value: "b" } samples { value: 1.5 timestamp: 300 } }
+	// plus an unknown metadata field (3) that must be skipped.
+	buf := []byte{
+		0x0a, 0x16,
+		0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 'b',
+		0x12, 0x0c, 0x09, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f, 0x10, 0xac, 0x02,
+		0x1a, 0x02, 0x08, 0x01,
+	}
+	req, err := UnmarshalWriteRequest(buf)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	want := WriteRequest{Timeseries: []TimeSeries{{
+		Labels:  []Label{{Name: "a", Value: "b"}},
+		Samples: []Sample{{Value: 1.5, Timestamp: 300}},
+	}}}
+	if !reflect.DeepEqual(req, want) {
+		t.Errorf("got %+v, want %+v", req, want)
+	}
+
+	if _, err := UnmarshalWriteRequest(buf[:10]); err == nil {
+		t.Error("expected error for truncated message")
+	}
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	req := ReadRequest{Queries: []Query{{
+		StartTimestampMs: 1700000000000,
+		EndTimestampMs:   1700003600000,
+		Matchers: []LabelMatcher{
+			{Type: MatchEqual, Name: "__name__", Value: "up"},
+			{Type: MatchNotRegexp, Name: "job", Value: "n.*"},
+		},
+	}}}
+	got, err := UnmarshalReadRequest(req.Marshal())
+	if err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, req) {
+		t.Errorf("round trip mismatch:\n got %+v\nwant %+v", got, req)
+	}
+
+	resp := ReadResponse{Results: []QueryResult{
+		{Timeseries: []TimeSeries{{
+			Labels:  []Label{{Name: "__name__", Value: "up"}},
+			Samples: []Sample{{Value: 1, Timestamp: 1700000000000}},
+		}}},
+		{},
+	}}
+	gotResp, err := UnmarshalReadResponse(resp.Marshal())
+	if err != nil {
+		t.Fatalf("unmarshal response failed: %v", err)
+	}
+	if !reflect.DeepEqual(gotResp, resp) {
+		t.Errorf("response round trip mismatch:\n got %+v\nwant %+v", gotResp, resp)
+	}
+}
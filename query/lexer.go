@@ -0,0 +1,94 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type tokenKind uint8
+
+const (
+	tEOF      tokenKind = iota
+	tIdent              // name or keyword
+	tNumber             // 42, 1.5
+	tString             // "sensor*" or 'sensor*'
+	tDuration           // 5m, 1h, 100ms
+	tOp                 // ( ) , * + - = != < <= > >=
+)
+
+type token struct {
+	kind tokenKind
+	text string // tString: without quotes
+	pos  int
+	dur  time.Duration // tDuration
+}
+
+// durationUnits are the units of a duration literal.
+var durationUnits = map[string]time.Duration{
+	"ns": time.Nanosecond, "us": time.Microsecond, "ms": time.Millisecond,
+	"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour,
+}
+
+// lex splits a query into tokens, ending with a tEOF token.
+func lex(text string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(text) {
+		c := text[i]
+		start := i
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+			continue
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(text[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tString, text: text[i+1 : i+1+end], pos: start})
+			i += end + 2
+			continue
+		case c >= '0' && c <= '9' || c == '.':
+			for i < len(text) && (text[i] >= '0' && text[i] <= '9' || text[i] == '.') {
+				i++
+			}
+			number := text[start:i]
+			unitStart := i
+			for i < len(text) && unicode.IsLetter(rune(text[i])) {
+				i++
+			}
+			if unitStart == i {
+				tokens = append(tokens, token{kind: tNumber, text: number, pos: start})
+				continue
+			}
+			unit, ok := durationUnits[text[unitStart:i]]
+			if !ok || strings.Contains(number, ".") {
+				return nil, fmt.Errorf("invalid duration %s at %d", text[start:i], start)
+			}
+			n, err := strconv.ParseInt(number, 10, 64)
+			if err != nil || n > math.MaxInt64/int64(unit) {
+				return nil, fmt.Errorf("invalid duration %s at %d", text[start:i], start)
+			}
+			tokens = append(tokens, token{kind: tDuration, text: text[start:i], pos: start, dur: time.Duration(n) * unit})
+			continue
+		case c == '_' || unicode.IsLetter(rune(c)):
+			for i < len(text) && (text[i] == '_' || unicode.IsLetter(rune(text[i])) || unicode.IsDigit(rune(text[i]))) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tIdent, text: text[start:i], pos: start})
+			continue
+		case strings.HasPrefix(text[i:], "<=") || strings.HasPrefix(text[i:], ">=") || strings.HasPrefix(text[i:], "!="):
+			i += 2
+		case strings.IndexByte("(),*+-=<>", c) >= 0:
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d", c, i)
+		}
+		tokens = append(tokens, token{kind: tOp, text: text[start:i], pos: start})
+	}
+	return append(tokens, token{kind: tEOF, pos: len(text)}), nil
+}
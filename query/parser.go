@@ -0,0 +1,331 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Statement is a parsed query:
+//
+//	SELECT value | * | <aggregation>(value)
+//	FROM <source> [, <source> ...]
+//	[WHERE <condition> [AND <condition> ...]]
+//	[GROUP BY time(<duration>)]
+//	[ORDER BY time [ASC | DESC]]
+//	[LIMIT <n>]
+//
+// A source is a key or a glob of keys ("sensor*", 'building3/*'), quoted
+// unless it is a plain name. A condition compares time with a time (a Unix
+// timestamp in seconds, an RFC 3339 string or now(), plus or minus
+// durations like 1h or 30s) or value with a number; NewPlan requires a
+// condition on the start time. Keywords are case insensitive.
+type Statement struct {
+	Aggregation string // "" selects the values themselves
+	Sources     []string
+	Conditions  []Condition
+	Interval    time.Duration // GROUP BY time(Interval); 0 = none
+	Desc        bool
+	Limit       int // 0 = none
+}
+
+// Condition is a comparison of time or value with a literal.
+type Condition struct {
+	Field string // "time" or "value"
+	Op    string // =, !=, <, <=, > or >=
+	Time  TimeExpr
+	Value float64
+}
+
+// TimeExpr is a point in time: Nanos since the epoch, or since now when Now
+// is set.
+type TimeExpr struct {
+	Now   bool
+	Nanos int64
+}
+
+// Resolve returns the time in nanoseconds since the epoch.
+func (t TimeExpr) Resolve(now time.Time) (int64, error) {
+	if !t.Now {
+		return t.Nanos, nil
+	}
+	base := now.UnixNano()
+	sum := base + t.Nanos
+	if (t.Nanos > 0) != (sum > base) {
+		return 0, fmt.Errorf("time out of range: now() %+dns", t.Nanos)
+	}
+	return sum, nil
+}
+
+// aggregations are the functions a query can select.
+var aggregations = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true, "first": true, "last": true,
+	"count": true, "median": true, "p50": true, "p95": true, "p99": true,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses a query.
+func Parse(text string) (*Statement, error) {
+	tokens, err := lex(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	stmt, err := p.parseStatement()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, fmt.Errorf("unexpected %s at %d", t.text, t.pos)
+	}
+	return stmt, nil
+}
+
+// peek returns the next token; past the end, the tEOF token.
+func (p *parser) peek() token {
+	return p.tokens[min(p.pos, len(p.tokens)-1)]
+}
+
+// next consumes a token. p.pos-- gives it back.
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// keyword consumes the next token if it is the keyword kw.
+func (p *parser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tIdent && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// op consumes the next token if it is the operator op.
+func (p *parser) op(op string) bool {
+	if t := p.peek(); t.kind == tOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expectKeyword(kw string) error {
+	if !p.keyword(kw) {
+		return p.unexpected(kw)
+	}
+	return nil
+}
+
+func (p *parser) expectOp(op string) error {
+	if !p.op(op) {
+		return p.unexpected(op)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == tEOF {
+		return fmt.Errorf("expected %s at end of query", want)
+	}
+	return fmt.Errorf("expected %s at %d, got %s", want, t.pos, t.text)
+}
+
+func (p *parser) parseStatement() (*Statement, error) {
+	stmt := &Statement{}
+	if err := p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if err := p.parseSelector(stmt); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	for {
+		t := p.next()
+		if t.kind != tString && t.kind != tIdent {
+			p.pos--
+			return nil, p.unexpected("key")
+		}
+		stmt.Sources = append(stmt.Sources, t.text)
+		if !p.op(",") {
+			break
+		}
+	}
+	if p.keyword("WHERE") {
+		for {
+			cond, err := p.parseCondition()
+			if err != nil {
+				return nil, err
+			}
+			stmt.Conditions = append(stmt.Conditions, cond)
+			if !p.keyword("AND") {
+				break
+			}
+		}
+	}
+	if p.keyword("GROUP") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("time"); err != nil {
+			return nil, err
+		}
+		if err := p.expectOp("("); err != nil {
+			return nil, err
+		}
+		t := p.next()
+		if t.kind != tDuration || t.dur <= 0 {
+			p.pos--
+			return nil, p.unexpected("duration")
+		}
+		stmt.Interval = t.dur
+		if err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+	}
+	if p.keyword("ORDER") {
+		if err := p.expectKeyword("BY"); err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("time"); err != nil {
+			return nil, err
+		}
+		if p.keyword("DESC") {
+			stmt.Desc = true
+		} else {
+			p.keyword("ASC")
+		}
+	}
+	if p.keyword("LIMIT") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tNumber || err != nil || n <= 0 {
+			p.pos--
+			return nil, p.unexpected("positive limit")
+		}
+		stmt.Limit = n
+	}
+	return stmt, nil
+}
+
+func (p *parser) parseSelector(stmt *Statement) error {
+	if p.op("*") || p.keyword("value") {
+		return nil
+	}
+	t := p.next()
+	if t.kind != tIdent || !aggregations[strings.ToLower(t.text)] {
+		p.pos--
+		return p.unexpected("value, * or an aggregation")
+	}
+	stmt.Aggregation = strings.ToLower(t.text)
+	if err := p.expectOp("("); err != nil {
+		return err
+	}
+	if err := p.expectKeyword("value"); err != nil {
+		return err
+	}
+	return p.expectOp(")")
+}
+
+var comparisons = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) parseCondition() (Condition, error) {
+	var cond Condition
+	switch {
+	case p.keyword("time"):
+		cond.Field = "time"
+	case p.keyword("value"):
+		cond.Field = "value"
+	default:
+		return cond, p.unexpected("time or value")
+	}
+	t := p.next()
+	if t.kind != tOp || !comparisons[t.text] {
+		p.pos--
+		return cond, p.unexpected("comparison")
+	}
+	cond.Op = t.text
+	if cond.Field == "value" {
+		v, err := p.parseNumber()
+		cond.Value = v
+		return cond, err
+	}
+	if cond.Op == "!=" {
+		return cond, fmt.Errorf("time cannot be compared with !=")
+	}
+	var err error
+	cond.Time, err = p.parseTime()
+	return cond, err
+}
+
+func (p *parser) parseNumber() (float64, error) {
+	sign := 1.0
+	if p.op("-") {
+		sign = -1
+	}
+	t := p.next()
+	v, err := strconv.ParseFloat(t.text, 64)
+	if t.kind != tNumber || err != nil {
+		p.pos--
+		return 0, p.unexpected("number")
+	}
+	return sign * v, nil
+}
+
+func (p *parser) parseTime() (TimeExpr, error) {
+	var te TimeExpr
+	t := p.next()
+	switch {
+	case t.kind == tIdent && strings.EqualFold(t.text, "now"):
+		if err := p.expectOp("("); err != nil {
+			return te, err
+		}
+		if err := p.expectOp(")"); err != nil {
+			return te, err
+		}
+		te.Now = true
+	case t.kind == tNumber:
+		sec, err := strconv.ParseInt(t.text, 10, 64)
+		if err != nil || sec > math.MaxInt64/int64(time.Second) {
+			return te, fmt.Errorf("invalid timestamp %s at %d", t.text, t.pos)
+		}
+		te.Nanos = sec * int64(time.Second)
+	case t.kind == tString:
+		ts, err := time.Parse(time.RFC3339Nano, t.text)
+		if err != nil {
+			return te, fmt.Errorf("invalid time %q at %d (use RFC 3339)", t.text, t.pos)
+		}
+		te.Nanos = ts.UnixNano()
+	default:
+		p.pos--
+		return te, p.unexpected("time")
+	}
+	for {
+		sign := int64(1)
+		if p.op("-") {
+			sign = -1
+		} else if !p.op("+") {
+			return te, nil
+		}
+		d := p.next()
+		if d.kind != tDuration {
+			p.pos--
+			return te, p.unexpected("duration")
+		}
+		sum := te.Nanos + sign*int64(d.dur)
+		if (sign > 0) != (sum > te.Nanos) {
+			return te, fmt.Errorf("time out of range at %d", d.pos)
+		}
+		te.Nanos = sum
+	}
+}
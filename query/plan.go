@@ -0,0 +1,206 @@
+package query
+
+import (
+	"fmt"
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"math"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Plan is a statement resolved against the stored keys: the keys to read,
+// the time range, and how to reduce the points read.
+type Plan struct {
+	Keys        []string
+	Start, End  int64 // inclusive, in nanoseconds since the epoch
+	Aggregation string
+	Interval    time.Duration
+	Filters     []Condition // on value
+	Desc        bool
+	Limit       int
+}
+
+// NewPlan resolves stmt at now over the keys under scope ("" = every key):
+// the sources are expanded to the matching keys, and the time conditions
+// to one range. The range must have a start (time >, >= or =), so that a
+// query does not read the whole history of every key by accident; time >= 0
+// asks for it explicitly.
+func NewPlan(stmt *Statement, scope string, now time.Time) (*Plan, error) {
+	if stmt.Interval > 0 && stmt.Aggregation == "" {
+		return nil, fmt.Errorf("GROUP BY time needs an aggregation")
+	}
+	plan := &Plan{
+		Start:       0,
+		End:         math.MaxInt64,
+		Aggregation: stmt.Aggregation,
+		Interval:    stmt.Interval,
+		Desc:        stmt.Desc,
+		Limit:       stmt.Limit,
+	}
+	bounded := false
+	for _, cond := range stmt.Conditions {
+		if cond.Field == "value" {
+			plan.Filters = append(plan.Filters, cond)
+			continue
+		}
+		t, err := cond.Time.Resolve(now)
+		if err != nil {
+			return nil, err
+		}
+		switch cond.Op {
+		case ">":
+			plan.Start, bounded = max(plan.Start, t+1), true
+		case ">=":
+			plan.Start, bounded = max(plan.Start, t), true
+		case "<":
+			plan.End = min(plan.End, t-1)
+		case "<=":
+			plan.End = min(plan.End, t)
+		case "=":
+			plan.Start, plan.End, bounded = max(plan.Start, t), min(plan.End, t), true
+		}
+	}
+	if !bounded {
+		return nil, fmt.Errorf("a query needs a start time, e.g. WHERE time > now() - 1h (time >= 0 reads everything)")
+	}
+
+	keys, err := ExpandKeys(stmt.Sources, scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		// A query reads value: a multi-field key has one per field
+		if fields := buffer.KeyFields(key); fields != nil {
+			return nil, fmt.Errorf("key %s holds fields [%s]; queries need keys with a single value", key, strings.Join(fields, ","))
+		}
+		if plan.Aggregation != "" {
+			if err := buffer.ValidateAggregation(key, plan.Aggregation); err != nil {
+				return nil, err
+			}
+		}
+		if plan.Interval > 0 && plan.Interval.Nanoseconds() < unitNanos(key) {
+			return nil, fmt.Errorf("GROUP BY interval is shorter than the timestamp unit of %s", key)
+		}
+		if plan.Interval > 0 && plan.Interval.Nanoseconds()%unitNanos(key) != 0 {
+			return nil, fmt.Errorf("GROUP BY interval is not a whole number of timestamp units of %s", key)
+		}
+	}
+	plan.Keys = keys
+	return plan, nil
+}
+
+// ExpandKeys returns the keys under scope whose name (without scope)
+// matches one of the globs (path.Match syntax), sorted.
+func ExpandKeys(sources []string, scope string) ([]string, error) {
+	for _, source := range sources {
+		if _, err := path.Match(source, ""); err != nil {
+			return nil, fmt.Errorf("invalid key pattern %q", source)
+		}
+	}
+	var keys []string
+	for _, id := range buffer.GetAllIds() {
+		if !strings.HasPrefix(id, scope) {
+			continue
+		}
+		name := strings.TrimPrefix(id, scope)
+		for _, source := range sources {
+			if ok, _ := path.Match(source, name); ok {
+				keys = append(keys, id)
+				break
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// unitNanos returns the nanoseconds in a timestamp unit of key.
+func unitNanos(key string) int64 {
+	return int64(time.Second) / buffer.KeyPrecision(key).PerSecond()
+}
+
+// Execute runs the plan and returns the points of each key.
+func (p *Plan) Execute() map[string][]models.DataPoint {
+	result := make(map[string][]models.DataPoint, len(p.Keys))
+	for _, key := range p.Keys {
+		result[key] = p.executeKey(key)
+	}
+	return result
+}
+
+// executeKey reads the range of key, filters the points by value and
+// reduces them: per GROUP BY interval (epoch-aligned buckets), or to one
+// point for the whole range.
+func (p *Plan) executeKey(key string) []models.DataPoint {
+	unit := unitNanos(key)
+	start, end := ceilDiv(p.Start, unit), p.End/unit
+	if start > end {
+		return []models.DataPoint{}
+	}
+	points := buffer.ReadDataPoints(key, start, end, 0, "")
+	if len(p.Filters) > 0 {
+		kept := points[:0:0]
+		for _, point := range points {
+			if p.matches(point.Value) {
+				kept = append(kept, point)
+			}
+		}
+		points = kept
+	}
+	if p.Aggregation != "" && len(points) > 0 {
+		if p.Interval > 0 {
+			width := int(p.Interval.Nanoseconds() / unit)
+			points = buffer.Downsample(points, width, p.Aggregation, buffer.Alignment{Unit: "epoch"})
+		} else {
+			points = buffer.Downsample(points, math.MaxInt, p.Aggregation, buffer.Alignment{})
+		}
+	}
+	if p.Desc {
+		points = slices.Clone(points)
+		slices.Reverse(points)
+	}
+	if p.Limit > 0 && len(points) > p.Limit {
+		points = points[:p.Limit]
+	}
+	if points == nil {
+		points = []models.DataPoint{}
+	}
+	return points
+}
+
+// matches reports whether v satisfies the value conditions.
+func (p *Plan) matches(v float64) bool {
+	for _, cond := range p.Filters {
+		var ok bool
+		switch cond.Op {
+		case "=":
+			ok = v == cond.Value
+		case "!=":
+			ok = v != cond.Value
+		case "<":
+			ok = v < cond.Value
+		case "<=":
+			ok = v <= cond.Value
+		case ">":
+			ok = v > cond.Value
+		case ">=":
+			ok = v >= cond.Value
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func ceilDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && a > 0 {
+		q++
+	}
+	return q
+}
@@ -0,0 +1,29 @@
+// Package query runs text queries over GTSDB keys, for the "query"
+// operation:
+//
+//	SELECT avg(value) FROM "sensor*" WHERE time > now()-1h GROUP BY time(5m)
+//
+// A query is parsed into a Statement (see there for the grammar), planned
+// against the stored keys (the sources are expanded over
+// buffer.GetAllIds, the time conditions resolved to one range) and
+// executed per key with buffer.ReadDataPoints and buffer.Downsample.
+package query
+
+import (
+	"gtsdb/models"
+	"time"
+)
+
+// Run executes text at the current time over the keys under scope ("" =
+// every key) and returns the points of each matching key.
+func Run(text, scope string) (map[string][]models.DataPoint, error) {
+	stmt, err := Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := NewPlan(stmt, scope, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return plan.Execute(), nil
+}
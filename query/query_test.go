@@ -0,0 +1,120 @@
+package query
+
+import (
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"gtsdb/utils"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	stmt, err := Parse(`select P95(value) from "sensor*", temp WHERE time >= now() - 1h + 30s and value != -2.5 GROUP BY time(5m) ORDER BY time DESC LIMIT 10`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt.Aggregation != "p95" || len(stmt.Sources) != 2 || stmt.Sources[0] != "sensor*" || stmt.Sources[1] != "temp" ||
+		stmt.Interval != 5*time.Minute || !stmt.Desc || stmt.Limit != 10 || len(stmt.Conditions) != 2 {
+		t.Fatalf("Unexpected statement %+v", stmt)
+	}
+	if c := stmt.Conditions[0]; c.Field != "time" || c.Op != ">=" || !c.Time.Now || c.Time.Nanos != -int64(time.Hour-30*time.Second) {
+		t.Errorf("Unexpected time condition %+v", c)
+	}
+	if c := stmt.Conditions[1]; c.Field != "value" || c.Op != "!=" || c.Value != -2.5 {
+		t.Errorf("Unexpected value condition %+v", c)
+	}
+
+	stmt, err = Parse(`SELECT * FROM 'a/b' WHERE time > '2024-03-05T10:00:00Z' AND time < 1709636400`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt.Aggregation != "" || stmt.Conditions[0].Time.Nanos != 1709632800*int64(time.Second) || stmt.Conditions[1].Time.Nanos != 1709636400*int64(time.Second) {
+		t.Errorf("Unexpected statement %+v", stmt)
+	}
+
+	for _, text := range []string{
+		"",
+		"SELECT value",
+		"SELECT stddev(value) FROM x",
+		"SELECT value FROM x WHERE time != now()",
+		"SELECT value FROM x WHERE time > now() - 1y",
+		"SELECT value FROM x WHERE time > now() - 9999999999999h",
+		"SELECT value FROM x WHERE time > 99999999999 - 1s",
+		"SELECT value FROM x WHERE time > 9000000000 + 300000000s",
+		"SELECT value FROM x GROUP BY time(5)",
+		"SELECT value FROM x LIMIT 0",
+		"SELECT value FROM x extra",
+		`SELECT value FROM "x`,
+	} {
+		if _, err := Parse(text); err == nil {
+			t.Errorf("Expected %q rejected", text)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	utils.DataDir = t.TempDir()
+	buffer.InitFileHandles()
+	buffer.InitIDSet()
+
+	// Two sensors of alice, one of bob, every minute for 10 minutes
+	base := int64(1709632800)
+	var points []models.DataPoint
+	for i := int64(0); i < 10; i++ {
+		for j, key := range []string{"alice/sensor1", "alice/sensor2", "bob/sensor1"} {
+			points = append(points, models.DataPoint{Key: key, Timestamp: base + 60*i, Value: float64(i + 10*int64(j))})
+		}
+	}
+	buffer.StoreDataPointsBuffer(points)
+
+	result, err := Run(`SELECT avg(value) FROM "sensor*" WHERE time >= 1709632800 AND time < 1709633100 GROUP BY time(5m)`, "alice/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 {
+		t.Fatalf("Expected alice's 2 sensors, got %v", result)
+	}
+	if s := result["alice/sensor2"]; len(s) != 1 || s[0].Timestamp != base || s[0].Value != 12 {
+		t.Errorf("Unexpected buckets %+v", s)
+	}
+
+	result, err = Run(`SELECT value FROM sensor1 WHERE time >= 0 AND value >= 3 AND value < 8 ORDER BY time DESC LIMIT 2`, "alice/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := result["alice/sensor1"]; len(s) != 2 || s[0].Value != 7 || s[1].Value != 6 {
+		t.Errorf("Unexpected points %+v", s)
+	}
+
+	result, err = Run(`SELECT count(value) FROM "*/sensor1" WHERE time > now() - 1000w`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 2 || result["bob/sensor1"][0].Value != 10 {
+		t.Errorf("Unexpected counts %+v", result)
+	}
+
+	if _, err := Run(`SELECT value FROM x GROUP BY time(1m)`, ""); err == nil {
+		t.Error("Expected GROUP BY without aggregation rejected")
+	}
+	if _, err := Run(`SELECT value FROM "[x" WHERE time >= 0`, ""); err == nil {
+		t.Error("Expected a bad pattern rejected")
+	}
+	if _, err := Run(`SELECT value FROM sensor1 WHERE time < now()`, "alice/"); err == nil {
+		t.Error("Expected a query without a start time rejected")
+	}
+	if _, err := Run(`SELECT avg(value) FROM sensor1 WHERE time >= 0 GROUP BY time(1500ms)`, "alice/"); err == nil {
+		t.Error("Expected an interval of a fraction of a second rejected")
+	}
+	if _, err := Run(`SELECT value FROM sensor1 WHERE time > now() + 15000w`, "alice/"); err == nil {
+		t.Error("Expected a time past the int64 range rejected")
+	}
+
+	// Multi-field keys have no single value to query
+	if err := buffer.InitKeyFields("alice/env", []string{"temp", "hum"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Run(`SELECT value FROM env WHERE time >= 0`, "alice/"); err == nil {
+		t.Error("Expected a query of a multi-field key rejected")
+	}
+}
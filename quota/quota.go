@@ -80,6 +80,31 @@ func AddPoints(name string, n int64) {
 	pointsFor(name).Add(n)
 }
 
+// RemovePoints records `n` points dropped from the user's namespace outside
+// the write path (e.g. retention expiry) so the cached counter does not wait
+// for the next reconcile. Never drives the counter below zero.
+func RemovePoints(name string, n int64) {
+	if n <= 0 {
+		return
+	}
+	p := pointsFor(name)
+	for {
+		cur := p.Load()
+		next := cur - n
+		if next < 0 {
+			next = 0
+		}
+		if p.CompareAndSwap(cur, next) {
+			return
+		}
+	}
+}
+
+// UserFromKey returns the user owning a fully-qualified key.
+func UserFromKey(key string) string {
+	return userFromKey(key)
+}
+
 // CurrentPoints returns the cached point count for a user (for observability).
 func CurrentPoints(name string) int64 {
 	if p, ok := userPoints.Load(name); ok {
@@ -70,3 +70,20 @@ func TestSetQuotaUpdatesUser(t *testing.T) {
 		t.Fatalf("expected bob quota 5000000, got %d (ok=%v)", u.MaxPoints, ok)
 	}
 }
+
+func TestRemovePoints(t *testing.T) {
+	setupAuth(t)
+	AddPoints("carol", 100)
+	RemovePoints("carol", 40)
+	if got := CurrentPoints("carol"); got != 60 {
+		t.Errorf("expected 60 points after removal, got %d", got)
+	}
+	// Never goes negative
+	RemovePoints("carol", 1000)
+	if got := CurrentPoints("carol"); got != 0 {
+		t.Errorf("expected counter clamped at 0, got %d", got)
+	}
+	if got := UserFromKey("carol/sensor1"); got != "carol" {
+		t.Errorf("expected owner carol, got %s", got)
+	}
+}
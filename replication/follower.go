@@ -0,0 +1,320 @@
+package replication
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/labels"
+	"gtsdb/retention"
+	"gtsdb/snapshot"
+	"gtsdb/utils"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// followerState is the position of this server in the leader's stream. It
+// lives in memory only: a restarted follower loads a fresh snapshot.
+type followerState struct {
+	leader string
+
+	mu          sync.Mutex
+	connected   bool
+	epoch       string // "" until a snapshot has been loaded
+	applied     uint64 // last seq applied
+	appliedAt   int64  // leader time of the last applied mutation
+	leaderSeq   uint64 // last seq in the leader's log
+	leaderAt    int64  // leader time of the last heartbeat
+	lastContact time.Time
+	lastErr     string
+}
+
+var (
+	followerMu sync.Mutex
+	follower   *followerState
+)
+
+// IsFollower reports whether this server replicates a leader, which makes
+// it a read-only replica.
+func IsFollower() bool {
+	followerMu.Lock()
+	defer followerMu.Unlock()
+	return follower != nil
+}
+
+// Follow replicates the leader at addr, authenticating with its root token,
+// until stop is closed. It reconnects with backoff, resuming the stream
+// where it broke off or loading a new snapshot when the leader cannot.
+func Follow(addr, token string, stop <-chan struct{}) {
+	f := &followerState{leader: addr}
+	followerMu.Lock()
+	follower = f
+	followerMu.Unlock()
+
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := f.session(addr, token, stop)
+		f.mu.Lock()
+		f.connected = false
+		if err != nil {
+			f.lastErr = err.Error()
+		}
+		f.mu.Unlock()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		utils.Warning("Replication from %s interrupted: %v (retrying in %v)", addr, err, backoff)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, 30*time.Second)
+	}
+}
+
+// deadlineReader sets a read deadline before every read: the leader sends
+// a heartbeat every second, so a silent connection is a dead one.
+type deadlineReader struct {
+	conn net.Conn
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	_ = d.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	return d.conn.Read(p)
+}
+
+// session runs one connection to the leader.
+func (f *followerState) session(addr, token string, stop <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", addr, readTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReaderSize(deadlineReader{conn}, 64*1024)
+	var reply ack
+	if err := request(conn, r, map[string]any{"operation": "auth", "key": token}, &reply); err != nil {
+		return err
+	}
+	if !reply.Success {
+		return fmt.Errorf("auth: %s", reply.Message)
+	}
+
+	f.mu.Lock()
+	epoch, since := f.epoch, f.applied
+	f.mu.Unlock()
+	reply = ack{}
+	if err := request(conn, r, map[string]any{"operation": "replicate", "epoch": epoch, "since": since}, &reply); err != nil {
+		return err
+	}
+	if !reply.Success || reply.Data == nil {
+		return fmt.Errorf("replicate: %s", reply.Message)
+	}
+
+	// After a snapshot the first heartbeat gives the seq it was cut at;
+	// only then is the new position known.
+	synced := !reply.Data.Snapshot
+	if reply.Data.Snapshot {
+		f.mu.Lock()
+		f.epoch = ""
+		f.mu.Unlock()
+		start := time.Now()
+		m, err := loadSnapshot(r)
+		if err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+		utils.Log("Replication: loaded snapshot of %d keys from %s in %v", len(m.Keys), addr, time.Since(start).Round(time.Millisecond))
+	}
+	f.mu.Lock()
+	f.connected = true
+	f.lastErr = ""
+	f.mu.Unlock()
+
+	for {
+		data, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var l line
+		if err := json.Unmarshal(data, &l); err != nil {
+			return fmt.Errorf("invalid stream line: %w", err)
+		}
+
+		f.mu.Lock()
+		f.lastContact = time.Now()
+		if l.Mutation == nil {
+			if !synced {
+				f.epoch, f.applied, f.appliedAt = reply.Data.Epoch, l.Seq, l.Time
+				synced = true
+			}
+			f.leaderSeq, f.leaderAt = l.Last, l.Time
+			f.mu.Unlock()
+			continue
+		}
+		if !synced || l.Seq != f.applied+1 {
+			f.epoch = ""
+			f.mu.Unlock()
+			return fmt.Errorf("mutation %d out of sequence", l.Seq)
+		}
+		f.mu.Unlock()
+
+		m, err := fromWire(*l.Mutation)
+		if err != nil {
+			f.mu.Lock()
+			f.epoch = ""
+			f.mu.Unlock()
+			return fmt.Errorf("mutation %d: %w", l.Seq, err)
+		}
+		if err := buffer.ApplyMutation(m); err != nil {
+			utils.Error("Replication: applying mutation %d (%s %s): %v", l.Seq, m.Op, m.Key, err)
+		}
+
+		f.mu.Lock()
+		f.applied, f.appliedAt = l.Seq, l.Time
+		f.mu.Unlock()
+	}
+}
+
+// request sends a JSON line and decodes the reply into v, skipping the pings
+// of the leader's connection keepalive.
+func request(conn net.Conn, r *bufio.Reader, op any, v *ack) error {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	for {
+		data, err := r.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		*v = ack{}
+		if err := json.Unmarshal(data, v); err != nil {
+			return fmt.Errorf("invalid reply: %w", err)
+		}
+		if v.Message != "ping" || v.Data != nil {
+			return nil
+		}
+	}
+}
+
+// loadSnapshot restores the snapshot frames on r next to the data directory
+// and swaps it in for the live one.
+func loadSnapshot(r io.Reader) (snapshot.Manifest, error) {
+	frames := &frameReader{r: r}
+	dir := filepath.Clean(utils.DataDir)
+	replica := dir + ".replica"
+	if err := os.RemoveAll(replica); err != nil {
+		return snapshot.Manifest{}, err
+	}
+	m, err := snapshot.Restore(frames, replica)
+	if err != nil {
+		return m, err
+	}
+	// The tar reader stops at the end of the archive; read up to the
+	// empty frame that ends the snapshot.
+	if _, err := io.Copy(io.Discard, frames); err != nil {
+		os.RemoveAll(replica)
+		return m, err
+	}
+
+	err = buffer.Reload(func() error {
+		old := dir + ".old"
+		if err := os.RemoveAll(old); err != nil {
+			return err
+		}
+		if err := os.Rename(dir, old); err != nil {
+			return err
+		}
+		if err := os.Rename(replica, dir); err != nil {
+			return errors.Join(err, os.Rename(old, dir))
+		}
+		return os.RemoveAll(old)
+	})
+	auth.Init(utils.DataDir)
+	retention.Init(utils.DataDir)
+	labels.Init(utils.DataDir)
+	return m, err
+}
+
+// Status describes the replication role of this server.
+type Status struct {
+	Role string `json:"role"` // "leader" once a follower has connected, "follower" or "standalone"
+
+	// follower
+	Leader       string  `json:"leader,omitempty"`
+	Connected    bool    `json:"connected"`
+	Epoch        string  `json:"epoch,omitempty"`
+	AppliedSeq   uint64  `json:"applied_seq"`
+	LeaderSeq    uint64  `json:"leader_seq"`
+	LagMutations uint64  `json:"lag_mutations"`
+	LagSeconds   float64 `json:"lag_seconds"`
+	Error        string  `json:"error,omitempty"`
+
+	// leader
+	LogSeq    uint64 `json:"log_seq"`
+	Followers int64  `json:"followers"`
+}
+
+// CurrentStatus returns the replication status. A follower's lag is the
+// number of logged mutations it has not applied and how much older (by the
+// leader's clock) the last applied one is than the last heartbeat, plus the
+// time since that heartbeat while disconnected.
+func CurrentStatus() Status {
+	s := Status{Role: "standalone"}
+	if l := leaderLog.Load(); l != nil {
+		s.Role = "leader"
+		s.LogSeq = l.lastSeq()
+		s.Followers = followers.Load()
+	}
+
+	followerMu.Lock()
+	f := follower
+	followerMu.Unlock()
+	if f == nil {
+		return s
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s.Role = "follower"
+	s.Leader = f.leader
+	s.Connected = f.connected
+	s.Epoch = f.epoch
+	s.AppliedSeq = f.applied
+	s.LeaderSeq = f.leaderSeq
+	s.Error = f.lastErr
+	if f.leaderSeq > f.applied {
+		s.LagMutations = f.leaderSeq - f.applied
+		s.LagSeconds = float64(f.leaderAt-f.appliedAt) / float64(time.Second)
+	}
+	if !f.connected && !f.lastContact.IsZero() {
+		s.LagSeconds += time.Since(f.lastContact).Seconds()
+	}
+	return s
+}
@@ -0,0 +1,194 @@
+package replication
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gtsdb/buffer"
+	"gtsdb/snapshot"
+	"gtsdb/utils"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxBatch bounds the mutations sent between two heartbeats.
+const maxBatch = 1024
+
+var errBehind = errors.New("follower fell behind the replication log")
+
+type entry struct {
+	seq  uint64
+	body []byte // the JSON line, without newline
+}
+
+// replLog holds the most recent mutations, up to utils.ReplicationLogBytes
+// of encoded lines.
+type replLog struct {
+	epoch string
+
+	mu      sync.Mutex
+	entries []entry // seq first..last
+	first   uint64
+	last    uint64
+	bytes   int64
+	changed chan struct{} // closed on append
+}
+
+var (
+	logOnce   sync.Once
+	leaderLog atomic.Pointer[replLog]
+	followers atomic.Int64
+)
+
+// startLog creates the log and starts recording mutations on the first
+// follower, so a server without followers pays nothing.
+func startLog() *replLog {
+	logOnce.Do(func() {
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		l := &replLog{epoch: hex.EncodeToString(b[:]), first: 1, changed: make(chan struct{})}
+		buffer.SetMutationHook(l.append)
+		leaderLog.Store(l)
+		utils.Log("Replication log started (epoch %s)", l.epoch)
+	})
+	return leaderLog.Load()
+}
+
+func (l *replLog) append(m buffer.Mutation) {
+	w := toWire(m)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	seq := l.last + 1
+	body, err := json.Marshal(line{Seq: seq, Time: time.Now().UnixNano(), Mutation: &w})
+	if err != nil {
+		utils.Errorln("Replication: cannot encode mutation:", err)
+		return
+	}
+	l.last = seq
+	l.entries = append(l.entries, entry{seq, body})
+	l.bytes += int64(len(body))
+	for len(l.entries) > 1 && l.bytes > utils.ReplicationLogBytes {
+		l.bytes -= int64(len(l.entries[0].body))
+		l.entries[0] = entry{}
+		l.entries = l.entries[1:]
+		l.first++
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *replLog) lastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.last
+}
+
+// canResume reports whether the log still holds every mutation after seq.
+func (l *replLog) canResume(seq uint64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return seq+1 >= l.first && seq <= l.last
+}
+
+// after returns up to maxBatch entries following seq, the last seq and a
+// channel closed on the next append.
+func (l *replLog) after(seq uint64) ([]entry, uint64, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq+1 < l.first {
+		return nil, 0, nil, errBehind
+	}
+	entries := l.entries[min(seq+1-l.first, uint64(len(l.entries))):]
+	if len(entries) > maxBatch {
+		entries = entries[:maxBatch]
+	}
+	return entries, l.last, l.changed, nil
+}
+
+// deadlineWriter sets a write deadline before every write, so a stalled
+// follower cannot hold a stream open forever.
+type deadlineWriter struct {
+	conn net.Conn
+}
+
+func (d deadlineWriter) Write(p []byte) (int, error) {
+	_ = d.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return d.conn.Write(p)
+}
+
+// Serve streams mutations to a follower on conn, which must carry nothing
+// else from now on; epoch and since are the position the follower has
+// applied, empty and 0 on first contact. A follower that cannot resume from
+// there gets a snapshot first. Serve returns when the follower disconnects or
+// falls behind the log; the caller closes conn.
+func Serve(conn net.Conn, epoch string, since uint64) error {
+	l := startLog()
+	followers.Add(1)
+	defer followers.Add(-1)
+
+	resume := epoch == l.epoch && l.canResume(since)
+	w := bufio.NewWriterSize(deadlineWriter{conn}, 64*1024)
+	msg := "Replicating from " + fmt.Sprint(since)
+	if !resume {
+		msg = "Replicating from snapshot"
+	}
+	if err := writeLine(w, ack{Success: true, Message: msg, Data: &ackData{Epoch: l.epoch, Snapshot: !resume}}); err != nil {
+		return err
+	}
+
+	cursor := since
+	if !resume {
+		frames := frameWriter{w}
+		m, err := snapshot.WriteCut(frames, func() { cursor = l.lastSeq() })
+		if err != nil {
+			return fmt.Errorf("snapshot: %w", err)
+		}
+		if err := frames.Close(); err != nil {
+			return err
+		}
+		utils.Log("Replication: sent snapshot of %d keys to %s at seq %d", len(m.Keys), conn.RemoteAddr(), cursor)
+	}
+
+	if err := writeLine(w, line{Seq: cursor, Last: l.lastSeq(), Time: time.Now().UnixNano()}); err != nil {
+		return err
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		entries, last, changed, err := l.after(cursor)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			w.Write(e.body)
+			w.WriteByte('\n')
+			cursor = e.seq
+		}
+		if err := writeLine(w, line{Seq: cursor, Last: last, Time: time.Now().UnixNano()}); err != nil {
+			return err
+		}
+		if cursor < last {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeLine writes v as a JSON line and flushes w.
+func writeLine(w *bufio.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Write(data)
+	w.WriteByte('\n')
+	return w.Flush()
+}
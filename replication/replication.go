@@ -0,0 +1,315 @@
+// Package replication keeps hot standby copies of a server: followers
+// replay every storage mutation of a leader, asynchronously, over the
+// leader's TCP port.
+//
+// A follower connects, authenticates with the leader's root token and sends
+// {"operation":"replicate","epoch":"...","since":N}. The leader answers with
+// one JSON line and from then on owns the connection:
+//
+//	{"success":true,"message":"...","data":{"epoch":"...","snapshot":true}}
+//	snapshot tar in frames (uint32 big-endian length + bytes; 0 ends it)
+//	{"seq":41,"last":45,"time":...}                      heartbeat
+//	{"seq":42,"time":...,"mutation":{"op":"write",...}} mutation
+//
+// Every mutation reported by buffer gets the next sequence number in the
+// leader's log. A heartbeat says the stream has delivered everything up to
+// seq and that the log ends at last; the stream starts with one, whose seq
+// after a snapshot is the snapshot's cut. A follower that reconnects with
+// the epoch and last seq it applied resumes without a snapshot while the
+// leader's log still holds the next mutation. The log is kept in memory, so
+// after a leader restart (new epoch) followers load a fresh snapshot.
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"io"
+	"math"
+	"time"
+)
+
+// heartbeatInterval is how often an idle stream sends a heartbeat;
+// readTimeout is how long a follower waits for any line before it
+// reconnects.
+const (
+	heartbeatInterval = time.Second
+	readTimeout       = 10 * time.Second
+	writeTimeout      = 10 * time.Second
+)
+
+// ack is the leader's answer to replicate, shaped like a TCP response.
+type ack struct {
+	Success bool     `json:"success"`
+	Message string   `json:"message,omitempty"`
+	Data    *ackData `json:"data,omitempty"`
+}
+
+type ackData struct {
+	Epoch    string `json:"epoch"`
+	Snapshot bool   `json:"snapshot"` // snapshot frames follow
+}
+
+// line is a heartbeat (Mutation nil) or a mutation of the stream.
+type line struct {
+	Seq      uint64    `json:"seq"`
+	Last     uint64    `json:"last,omitempty"`
+	Time     int64     `json:"time"` // leader clock, Unix nanoseconds
+	Mutation *mutation `json:"mutation,omitempty"`
+}
+
+// mutation is a buffer.Mutation on the wire. Points are binary (see
+// encodePoints) so int64 values and NaN survive.
+type mutation struct {
+	Op       buffer.MutationOp  `json:"op"`
+	Key      string             `json:"key,omitempty"`
+	NewKey   string             `json:"new_key,omitempty"`
+	Points   []byte             `json:"points,omitempty"`
+	Options  *buffer.KeyOptions `json:"options,omitempty"`
+	Rule     *buffer.RollupRule `json:"rule,omitempty"`
+	Operator string             `json:"operator,omitempty"`
+	Value    float64            `json:"value,omitempty"`
+	HasValue bool               `json:"has_value,omitempty"`
+	From     int64              `json:"from,omitempty"`
+	To       int64              `json:"to,omitempty"`
+	Cutoff   int64              `json:"cutoff,omitempty"`
+}
+
+func toWire(m buffer.Mutation) mutation {
+	w := mutation{
+		Op:       m.Op,
+		Key:      m.Key,
+		NewKey:   m.NewKey,
+		Options:  m.Options,
+		Operator: m.Operator,
+		Value:    m.Value,
+		HasValue: m.HasValue,
+		From:     m.From,
+		To:       m.To,
+		Cutoff:   m.Cutoff,
+	}
+	if m.Points != nil {
+		w.Points = encodePoints(m.Points)
+	}
+	if m.Rule != (buffer.RollupRule{}) {
+		rule := m.Rule
+		w.Rule = &rule
+	}
+	return w
+}
+
+func fromWire(w mutation) (buffer.Mutation, error) {
+	m := buffer.Mutation{
+		Op:       w.Op,
+		Key:      w.Key,
+		NewKey:   w.NewKey,
+		Options:  w.Options,
+		Operator: w.Operator,
+		Value:    w.Value,
+		HasValue: w.HasValue,
+		From:     w.From,
+		To:       w.To,
+		Cutoff:   w.Cutoff,
+	}
+	if w.Points != nil {
+		points, err := decodePoints(w.Points)
+		if err != nil {
+			return m, err
+		}
+		m.Points = points
+	}
+	if w.Rule != nil {
+		m.Rule = *w.Rule
+	}
+	return m, nil
+}
+
+// encodePoints packs points as: uvarint count, then per point the key
+// (uvarint length + bytes), varint timestamp and value type, followed by
+// the float64 bits and fields (uvarint count+1, 0 = no field map; name +
+// float64 bits each) of a float point, the varint of an int or bool point,
+// or the bytes of a string point.
+func encodePoints(points []models.DataPoint) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(points)))
+	for _, p := range points {
+		buf = appendString(buf, p.Key)
+		buf = binary.AppendVarint(buf, p.Timestamp)
+		buf = append(buf, byte(p.Type))
+		switch p.Type {
+		case models.TypeInt, models.TypeBool:
+			buf = binary.AppendVarint(buf, p.Int)
+		case models.TypeString:
+			buf = appendString(buf, p.Str)
+		default:
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(p.Value))
+			if p.Fields == nil {
+				buf = binary.AppendUvarint(buf, 0)
+				continue
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(p.Fields))+1)
+			for name, v := range p.Fields {
+				buf = appendString(buf, name)
+				buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(v))
+			}
+		}
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+var errShortPoints = errors.New("truncated points")
+
+// pointReader decodes the output of encodePoints.
+type pointReader struct {
+	buf []byte
+	err error
+}
+
+func (r *pointReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *pointReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *pointReader) bytes(n uint64) []byte {
+	if uint64(len(r.buf)) < n {
+		r.fail()
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *pointReader) float() float64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b))
+}
+
+func (r *pointReader) string() string {
+	return string(r.bytes(r.uvarint()))
+}
+
+func (r *pointReader) fail() {
+	if r.err == nil {
+		r.err = errShortPoints
+	}
+	r.buf = nil
+}
+
+func decodePoints(data []byte) ([]models.DataPoint, error) {
+	r := &pointReader{buf: data}
+	n := r.uvarint()
+	if n > uint64(len(data)) {
+		return nil, errShortPoints
+	}
+	points := make([]models.DataPoint, 0, n)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		p := models.DataPoint{Key: r.string(), Timestamp: r.varint()}
+		t := r.bytes(1)
+		if t == nil {
+			break
+		}
+		switch p.Type = models.ValueType(t[0]); p.Type {
+		case models.TypeInt, models.TypeBool:
+			p = models.IntPoint(p.Key, p.Timestamp, p.Type, r.varint())
+		case models.TypeString:
+			p = models.StringPoint(p.Key, p.Timestamp, r.string())
+		case models.TypeFloat:
+			p.Value = r.float()
+			if fields := r.uvarint(); fields > 0 {
+				p.Fields = make(map[string]float64, min(fields-1, uint64(len(r.buf))))
+				for j := uint64(1); j < fields && r.err == nil; j++ {
+					name := r.string()
+					p.Fields[name] = r.float()
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown value type %d", t[0])
+		}
+		points = append(points, p)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return points, nil
+}
+
+// frameWriter splits a byte stream into length-prefixed frames; Close
+// writes the empty frame that ends it.
+type frameWriter struct {
+	w io.Writer
+}
+
+func (f frameWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	if _, err := f.w.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	return f.w.Write(p)
+}
+
+func (f frameWriter) Close() error {
+	_, err := f.w.Write(make([]byte, 4))
+	return err
+}
+
+// frameReader reads the byte stream of a frameWriter, returning io.EOF at
+// the empty frame.
+type frameReader struct {
+	r    io.Reader
+	left uint32
+	done bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.done {
+		return 0, io.EOF
+	}
+	if f.left == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if f.left = binary.BigEndian.Uint32(hdr[:]); f.left == 0 {
+			f.done = true
+			return 0, io.EOF
+		}
+	}
+	if uint32(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
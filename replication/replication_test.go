@@ -0,0 +1,282 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/labels"
+	"gtsdb/models"
+	"gtsdb/retention"
+	"gtsdb/snapshot"
+	"gtsdb/utils"
+	"io"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openDataDir points every package at dir.
+func openDataDir(t *testing.T, dir string) {
+	t.Helper()
+	utils.DataDir = dir
+	buffer.InitFileHandles()
+	buffer.InitIDSet()
+	auth.Init(dir)
+	retention.Init(dir)
+	labels.Init(dir)
+	t.Cleanup(func() {
+		buffer.CloseAllHandles()
+		labels.Init("")
+	})
+}
+
+func points(key string, base int64, n int) []models.DataPoint {
+	pts := make([]models.DataPoint, n)
+	for i := range pts {
+		pts[i] = models.DataPoint{Key: key, Timestamp: base + int64(i), Value: float64(i)}
+	}
+	return pts
+}
+
+func TestPointsRoundTrip(t *testing.T) {
+	in := []models.DataPoint{
+		{Key: "a", Timestamp: 1700000000, Value: 1.5},
+		{Key: "a", Timestamp: -5, Value: math.Inf(-1)},
+		{Key: "b", Timestamp: 1700000000123, Value: 2, Fields: map[string]float64{"temp": 21.5, "hum": 40}},
+		{Key: "b", Timestamp: 1700000000124, Fields: map[string]float64{}},
+		models.IntPoint("c", 7, models.TypeInt, math.MaxInt64),
+		models.IntPoint("d", 8, models.TypeBool, 1),
+		models.StringPoint("e", 9, "FAULT"),
+	}
+	data := encodePoints(in)
+	out, err := decodePoints(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(in) != fmt.Sprint(out) { // string points hold a NaN value
+		t.Errorf("Round trip changed points:\n%v\n%v", in, out)
+	}
+
+	nan, err := decodePoints(encodePoints([]models.DataPoint{{Key: "n", Value: math.NaN()}}))
+	if err != nil || !math.IsNaN(nan[0].Value) {
+		t.Errorf("NaN not preserved: %v %v", nan, err)
+	}
+	for i := 1; i < len(data); i++ {
+		if _, err := decodePoints(data[:i]); err == nil {
+			t.Fatalf("Truncation at %d of %d bytes not detected", i, len(data))
+		}
+	}
+}
+
+// dialServe runs Serve on one end of a pipe and returns a reader for the
+// other end, which is closed when the test ends.
+func dialServe(t *testing.T, epoch string, since uint64) (*bufio.Reader, ack) {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Serve(server, epoch, since)
+		server.Close()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	r := bufio.NewReader(client)
+	var a ack
+	readJSON(t, r, &a)
+	if !a.Success || a.Data == nil {
+		t.Fatalf("Unexpected ack: %+v", a)
+	}
+	return r, a
+}
+
+func readJSON(t *testing.T, r *bufio.Reader, v any) {
+	t.Helper()
+	data, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("Invalid line %q: %v", data, err)
+	}
+}
+
+// nextMutation skips heartbeats up to the next mutation.
+func nextMutation(t *testing.T, r *bufio.Reader) line {
+	t.Helper()
+	for {
+		var l line
+		readJSON(t, r, &l)
+		if l.Mutation != nil {
+			return l
+		}
+	}
+}
+
+func TestServeSnapshotThenStream(t *testing.T) {
+	openDataDir(t, t.TempDir())
+	base := int64(1700000000)
+	buffer.StoreDataPointsBuffer(points("root/temp", base, 100))
+
+	r, a := dialServe(t, "", 0)
+	if !a.Data.Snapshot {
+		t.Fatal("First contact must get a snapshot")
+	}
+	frames := &frameReader{r: r}
+	dst := filepath.Join(t.TempDir(), "replica")
+	m, err := snapshot.Restore(frames, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, frames); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Keys, []string{"root/temp"}) {
+		t.Errorf("Unexpected snapshot keys: %v", m.Keys)
+	}
+
+	var hb line
+	readJSON(t, r, &hb)
+	if hb.Mutation != nil {
+		t.Fatal("Stream must start with a heartbeat")
+	}
+	cut := hb.Seq
+
+	buffer.StoreDataPointsBuffer(points("root/temp", base+100, 3))
+	l := nextMutation(t, r)
+	if l.Seq != cut+1 || l.Mutation.Op != buffer.OpWrite {
+		t.Fatalf("Expected write %d, got %d %s", cut+1, l.Seq, l.Mutation.Op)
+	}
+	got, err := fromWire(*l.Mutation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Points, points("root/temp", base+100, 3)) {
+		t.Errorf("Unexpected points: %v", got.Points)
+	}
+
+	buffer.DeleteKey("root/temp")
+	l = nextMutation(t, r)
+	if l.Seq != cut+2 || l.Mutation.Op != buffer.OpDeleteKey || l.Mutation.Key != "root/temp" {
+		t.Errorf("Expected deletekey %d, got %+v", cut+2, l)
+	}
+}
+
+func TestServeResume(t *testing.T) {
+	openDataDir(t, t.TempDir())
+	log := startLog()
+	buffer.InitKey("root/a")
+	buffer.InitKey("root/b")
+	last := log.lastSeq()
+
+	r, a := dialServe(t, log.epoch, last-1)
+	if a.Data.Snapshot || a.Data.Epoch != log.epoch {
+		t.Fatalf("Expected a resume, got %+v", a.Data)
+	}
+	var hb line
+	readJSON(t, r, &hb)
+	if hb.Mutation != nil || hb.Seq != last-1 {
+		t.Fatalf("Expected heartbeat at %d, got %+v", last-1, hb)
+	}
+	l := nextMutation(t, r)
+	if l.Seq != last || l.Mutation.Op != buffer.OpInitKey || l.Mutation.Key != "root/b" {
+		t.Errorf("Expected initkey root/b at %d, got %+v", last, l)
+	}
+
+	if _, a := dialServe(t, "other", last); !a.Data.Snapshot {
+		t.Error("Unknown epoch must get a snapshot")
+	}
+}
+
+func TestFollow(t *testing.T) {
+	// The leader's snapshot
+	openDataDir(t, t.TempDir())
+	base := int64(1700000000)
+	buffer.StoreDataPointsBuffer(points("root/temp", base, 50))
+	var archive bytes.Buffer
+	if _, err := snapshot.Write(&archive); err != nil {
+		t.Fatal(err)
+	}
+	buffer.CloseAllHandles()
+
+	openDataDir(t, filepath.Join(t.TempDir(), "data"))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	write, _ := json.Marshal(line{Seq: 6, Time: time.Now().UnixNano(), Mutation: &mutation{
+		Op: buffer.OpWrite, Points: encodePoints(points("root/temp", base+50, 2)),
+	}})
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		w := bufio.NewWriter(conn)
+		for _, reply := range []string{
+			`{"success":true,"message":"Authenticated as root"}`,
+			`{"success":true,"message":"ping"}`,
+			`{"success":true,"data":{"epoch":"e1","snapshot":true}}`,
+		} {
+			if reply != `{"success":true,"message":"ping"}` {
+				if _, err := r.ReadBytes('\n'); err != nil {
+					return
+				}
+			}
+			w.WriteString(reply + "\n")
+			w.Flush()
+		}
+		frames := frameWriter{w}
+		frames.Write(archive.Bytes())
+		frames.Close()
+		w.WriteString(`{"seq":5,"last":6,"time":1}` + "\n")
+		w.Write(append(write, '\n'))
+		w.WriteString(`{"seq":6,"last":6,"time":2}` + "\n")
+		w.Flush()
+		io.Copy(io.Discard, r) // until the follower hangs up
+	}()
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		Follow(ln.Addr().String(), "token", stop)
+		close(stopped)
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+		followerMu.Lock()
+		follower = nil
+		followerMu.Unlock()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	var s Status
+	for s = CurrentStatus(); s.AppliedSeq != 6 || s.LeaderSeq != 6; s = CurrentStatus() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Follower did not catch up: %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.Role != "follower" || !s.Connected || s.Epoch != "e1" || s.LagMutations != 0 {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+	if !IsFollower() {
+		t.Error("IsFollower must be true while following")
+	}
+	got := buffer.ReadDataPoints("root/temp", base, base+100, 0, "")
+	if len(got) != 52 || got[51].Timestamp != base+51 {
+		t.Errorf("Expected 52 replicated points, got %d", len(got))
+	}
+}
@@ -0,0 +1,188 @@
+// Package retention expires old data points so WAL files stop growing forever.
+//
+// A key's retention is resolved in order:
+//   - a per-key override (setretention), persisted in <data>/retention.json
+//   - the owning user's override (auth.User.Retention)
+//   - the server default ([retention] default in gtsdb.ini)
+//
+// The first non-zero value wins; a negative value means "keep forever".
+// Enforce runs periodically in a background worker and drops each key's
+// expired WAL prefix via buffer.ExpireDataPoints, crediting the freed points
+// back to the owner's quota counter.
+package retention
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/quota"
+	"gtsdb/utils"
+)
+
+// Forever is the stored value for an explicit "never expire" override.
+const Forever int64 = -1
+
+var (
+	overrides     = make(map[string]int64)
+	overridesMu   sync.RWMutex
+	overridesFile string
+)
+
+// Init loads per-key overrides from dataDir/retention.json.
+func Init(dataDir string) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	overridesFile = dataDir + "/retention.json"
+	overrides = make(map[string]int64)
+
+	data, err := os.ReadFile(overridesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			utils.Errorln("Error reading retention file:", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		utils.Errorln("Error parsing retention file:", err)
+		overrides = make(map[string]int64)
+	}
+}
+
+// saveOverrides persists the override map. Caller must hold overridesMu.
+func saveOverrides() {
+	if overridesFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(overrides, "", "  ")
+	if err != nil {
+		utils.Errorln("Error marshalling retention overrides:", err)
+		return
+	}
+	if err := os.WriteFile(overridesFile, data, 0644); err != nil {
+		utils.Errorln("Error writing retention file:", err)
+	}
+}
+
+// ParseRetention parses a retention setting: a duration accepted by
+// utils.ParseDurationSeconds ("90d", "12h", "3600"), or "forever" / "never"
+// for an explicit no-expiry override. "" and "0" mean "no override".
+func ParseRetention(s string) (int64, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "forever", "never", "inf":
+		return Forever, nil
+	}
+	seconds, err := utils.ParseDurationSeconds(s)
+	if err != nil {
+		return 0, err
+	}
+	if seconds < 0 {
+		return Forever, nil
+	}
+	return seconds, nil
+}
+
+// SetKeyRetention sets a per-key override in seconds. 0 removes the override
+// so the key falls back to its user's or the server's retention.
+func SetKeyRetention(key string, seconds int64) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	if seconds == 0 {
+		delete(overrides, key)
+	} else {
+		overrides[key] = seconds
+	}
+	saveOverrides()
+}
+
+// KeyRetention returns a key's own override, if any.
+func KeyRetention(key string) (int64, bool) {
+	overridesMu.RLock()
+	defer overridesMu.RUnlock()
+	seconds, ok := overrides[key]
+	return seconds, ok
+}
+
+// RenameKey moves a key's override to its new name.
+func RenameKey(key, newKey string) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	if seconds, ok := overrides[key]; ok {
+		delete(overrides, key)
+		overrides[newKey] = seconds
+		saveOverrides()
+	}
+}
+
+// DeleteKey drops a key's override.
+func DeleteKey(key string) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	if _, ok := overrides[key]; ok {
+		delete(overrides, key)
+		saveOverrides()
+	}
+}
+
+// Resolve returns the effective retention for a key in seconds. A value <= 0
+// means the key never expires.
+func Resolve(key string) int64 {
+	if seconds, ok := KeyRetention(key); ok && seconds != 0 {
+		return seconds
+	}
+	if u, ok := auth.GetUser(quota.UserFromKey(key)); ok && u.Retention != 0 {
+		return u.Retention
+	}
+	return utils.DefaultRetention
+}
+
+// Enforce drops expired points from every key and returns the total number of
+// points removed. now is a Unix timestamp in seconds; the cutoff is converted
+// to each key's timestamp precision. Returns early when stop is closed.
+func Enforce(now int64, stop <-chan struct{}) int64 {
+	var removed int64
+	for _, id := range buffer.GetAllIds() {
+		select {
+		case <-stop:
+			return removed
+		default:
+		}
+
+		seconds := Resolve(id)
+		if seconds <= 0 {
+			continue
+		}
+		n, err := buffer.ExpireDataPoints(id, (now-seconds)*buffer.KeyPrecision(id).PerSecond())
+		if err != nil {
+			utils.Error("Retention failed for %s: %v", id, err)
+			continue
+		}
+		if n > 0 {
+			quota.RemovePoints(quota.UserFromKey(id), int64(n))
+			removed += int64(n)
+		}
+	}
+	return removed
+}
+
+// SnapshotOverrides returns the content of retention.json, or nil when no
+// override has been saved.
+func SnapshotOverrides() ([]byte, error) {
+	overridesMu.RLock()
+	defer overridesMu.RUnlock()
+	if overridesFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(overridesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
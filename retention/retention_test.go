@@ -0,0 +1,138 @@
+package retention
+
+import (
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/models"
+	"gtsdb/quota"
+	"gtsdb/utils"
+	"os"
+	"testing"
+)
+
+func setupRetention(t *testing.T) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "gtsdb-retention-test")
+	if err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	oldDataDir := utils.DataDir
+	oldDefault := utils.DefaultRetention
+	t.Cleanup(func() {
+		buffer.CloseAllHandles()
+		utils.DataDir = oldDataDir
+		utils.DefaultRetention = oldDefault
+		os.RemoveAll(dir)
+	})
+	utils.DataDir = dir
+	utils.DefaultRetention = 0
+	auth.Init(dir)
+	buffer.InitFileHandles()
+	buffer.InitIDSet()
+	Init(dir)
+}
+
+func writeSeries(key string, from, n int64) {
+	points := make([]models.DataPoint, 0, n)
+	for i := int64(0); i < n; i++ {
+		points = append(points, models.DataPoint{Key: key, Timestamp: from + i, Value: float64(i)})
+	}
+	buffer.StoreDataPointsBuffer(points)
+}
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"90d", 90 * 86400},
+		{"forever", Forever},
+		{"NEVER", Forever},
+		{"-5", Forever},
+	}
+	for _, tt := range tests {
+		got, err := ParseRetention(tt.in)
+		if err != nil {
+			t.Errorf("ParseRetention(%q) unexpected error: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRetention(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+	if _, err := ParseRetention("soon"); err == nil {
+		t.Error("expected error for invalid retention")
+	}
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	setupRetention(t)
+	utils.DefaultRetention = 1000
+
+	if _, err := auth.CreateUser("ret_alice"); err != nil {
+		t.Fatal(err)
+	}
+	if got := Resolve("ret_alice/s1"); got != 1000 {
+		t.Errorf("expected server default 1000, got %d", got)
+	}
+
+	if err := auth.SetUserRetention("ret_alice", 500); err != nil {
+		t.Fatal(err)
+	}
+	if got := Resolve("ret_alice/s1"); got != 500 {
+		t.Errorf("expected user override 500, got %d", got)
+	}
+
+	SetKeyRetention("ret_alice/s1", Forever)
+	if got := Resolve("ret_alice/s1"); got != Forever {
+		t.Errorf("expected key override forever, got %d", got)
+	}
+
+	// Overrides persist and follow renames
+	Init(utils.DataDir)
+	RenameKey("ret_alice/s1", "ret_alice/s2")
+	if _, ok := KeyRetention("ret_alice/s1"); ok {
+		t.Error("old key should no longer have an override")
+	}
+	if got, _ := KeyRetention("ret_alice/s2"); got != Forever {
+		t.Errorf("expected renamed override forever, got %d", got)
+	}
+
+	SetKeyRetention("ret_alice/s2", 0)
+	if got := Resolve("ret_alice/s2"); got != 500 {
+		t.Errorf("expected fallback to user override 500, got %d", got)
+	}
+}
+
+func TestEnforceExpiresAndAdjustsQuota(t *testing.T) {
+	setupRetention(t)
+
+	now := int64(1700000000)
+	writeSeries("root/ret_keep", now-100, 100)
+	writeSeries("root/ret_trim", now-100, 100)
+	quota.AddPoints("root", 200)
+	before := quota.CurrentPoints("root")
+
+	SetKeyRetention("root/ret_trim", 30)
+
+	removed := Enforce(now, make(chan struct{}))
+	if removed != 70 {
+		t.Fatalf("expected 70 points removed, got %d", removed)
+	}
+	if cnt, _ := buffer.GetKeyCount("root/ret_trim"); cnt != 30 {
+		t.Errorf("expected 30 points kept, got %d", cnt)
+	}
+	if cnt, _ := buffer.GetKeyCount("root/ret_keep"); cnt != 100 {
+		t.Errorf("key without retention should keep 100 points, got %d", cnt)
+	}
+	if got := quota.CurrentPoints("root"); got != before-70 {
+		t.Errorf("expected quota counter %d, got %d", before-70, got)
+	}
+
+	points := buffer.ReadDataPoints("root/ret_trim", 0, now, 0, "")
+	if len(points) != 30 || points[0].Timestamp != now-30 {
+		t.Errorf("unexpected surviving points: %d, first=%v", len(points), points)
+	}
+}
@@ -0,0 +1,194 @@
+// Package snappy implements the Snappy block format used by Prometheus
+// remote write/read bodies (not the framed stream format).
+//
+// The encoder is a simple greedy matcher over 64 KiB blocks; its output is
+// valid Snappy that any decoder accepts, though not byte-identical to the
+// reference implementation.
+package snappy
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	ErrCorrupt  = errors.New("snappy: corrupt input")
+	ErrTooLarge = errors.New("snappy: decoded block is too large")
+)
+
+const (
+	maxBlockSize = 65536
+	hashBits     = 14
+
+	tagLiteral = 0x00
+	tagCopy1   = 0x01
+	tagCopy2   = 0x02
+	tagCopy4   = 0x03
+)
+
+// DecodedLen returns the length of the decoded block without decoding it.
+func DecodedLen(src []byte) (int, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > 0xffffffff {
+		return 0, ErrCorrupt
+	}
+	return int(n), nil
+}
+
+// Decode returns the decoded form of src. maxLen bounds the declared decoded
+// length so a small body cannot make the server allocate gigabytes.
+func Decode(src []byte, maxLen int) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > 0xffffffff {
+		return nil, ErrCorrupt
+	}
+	if int(n) > maxLen {
+		return nil, ErrTooLarge
+	}
+	dst := make([]byte, 0, n)
+	s := k
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 0x03 {
+		case tagLiteral:
+			x := int(tag >> 2)
+			s++
+			if x >= 60 {
+				nb := x - 59
+				if s+nb > len(src) {
+					return nil, ErrCorrupt
+				}
+				x = 0
+				for i := 0; i < nb; i++ {
+					x |= int(src[s+i]) << (8 * i)
+				}
+				s += nb
+			}
+			length = x + 1
+			if length <= 0 || s+length > len(src) || len(dst)+length > int(n) {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[s:s+length]...)
+			s += length
+			continue
+		case tagCopy1:
+			if s+2 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = int(tag>>2&0x07) + 4
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case tagCopy2:
+			if s+3 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case tagCopy4:
+			if s+5 > len(src) {
+				return nil, ErrCorrupt
+			}
+			length = int(tag>>2) + 1
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, ErrCorrupt
+		}
+		// Byte by byte: copies may overlap their own output (run-length).
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// Encode returns the Snappy block encoding of src.
+func Encode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	for len(src) > 0 {
+		block := src
+		if len(block) > maxBlockSize {
+			block = block[:maxBlockSize]
+		}
+		dst = encodeBlock(dst, block)
+		src = src[len(block):]
+	}
+	return dst
+}
+
+func hash(u uint32) uint32 {
+	return (u * 0x1e35a7bd) >> (32 - hashBits)
+}
+
+// encodeBlock appends src (at most maxBlockSize bytes, so every offset fits
+// in a 2-byte copy) to dst.
+func encodeBlock(dst, src []byte) []byte {
+	if len(src) < 16 {
+		return emitLiteral(dst, src)
+	}
+	var table [1 << hashBits]int32 // position+1 of the last occurrence
+	lit := 0
+	i := 0
+	for i+4 <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := hash(cur)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+		dst = emitLiteral(dst, src[lit:i])
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = emitCopy(dst, i-candidate, length)
+		i += length
+		lit = i
+	}
+	return emitLiteral(dst, src[lit:])
+}
+
+func emitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|tagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|tagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|tagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|tagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// emitCopy emits a back-reference; length may exceed the 64-byte limit of a
+// single copy element.
+func emitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|tagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|tagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|tagCopy1, byte(offset))
+}
@@ -0,0 +1,67 @@
+package snappy
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte, 200000)
+	rng.Read(random)
+
+	inputs := map[string][]byte{
+		"empty":      {},
+		"short":      []byte("hello"),
+		"repetitive": bytes.Repeat([]byte("gtsdb remote write "), 10000),
+		"runs":       bytes.Repeat([]byte{'a'}, 100000),
+		"random":     random,
+		"mixed":      append(bytes.Repeat([]byte("abcd"), 5000), random[:70000]...),
+	}
+	for name, in := range inputs {
+		enc := Encode(in)
+		if n, err := DecodedLen(enc); err != nil || n != len(in) {
+			t.Errorf("%s: DecodedLen = %d, %v", name, n, err)
+		}
+		out, err := Decode(enc, len(in))
+		if err != nil {
+			t.Errorf("%s: decode failed: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(in, out) {
+			t.Errorf("%s: round trip mismatch", name)
+		}
+	}
+
+	if enc := Encode(inputs["repetitive"]); len(enc) > len(inputs["repetitive"])/10 {
+		t.Errorf("repetitive input compressed poorly: %d bytes", len(enc))
+	}
+}
+
+func TestDecodeReference(t *testing.T) {
+	// "aaaaaaaaaa" from the reference encoder: literal "a" + copy1(offset 1, len 9)
+	enc := []byte{0x0a, 0x00, 'a', 0x15, 0x01}
+	out, err := Decode(enc, 100)
+	if err != nil || string(out) != "aaaaaaaaaa" {
+		t.Errorf("Decode = %q, %v", out, err)
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	cases := map[string][]byte{
+		"no length":      {},
+		"short literal":  {0x05, 0x10, 'a'},
+		"bad offset":     {0x04, 0x00, 'a', 0x09, 0x05},
+		"length too big": {0x02, 0x08, 'a', 'b', 'c'},
+		"truncated copy": {0x05, 0x00, 'a', 0x02},
+	}
+	for name, in := range cases {
+		if _, err := Decode(in, 100); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if _, err := Decode(Encode(make([]byte, 1000)), 999); err != ErrTooLarge {
+		t.Errorf("expected ErrTooLarge, got %v", err)
+	}
+}
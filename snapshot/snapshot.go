@@ -0,0 +1,258 @@
+// Package snapshot writes online backups of the data directory as tar
+// archives and restores them.
+//
+// A snapshot holds every key's files (.aof, .idx and side files) as of one
+// moment, taken by buffer.Snapshot without stopping writers, plus users.json,
+// retention.json, rollups.json, rollups-stale.json and every labels.json.
+// Paths inside the archive are relative to the data directory. The last
+// entry is a manifest (gtsdb-snapshot.json); Restore refuses archives
+// without one, so a truncated download is never restored.
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/labels"
+	"gtsdb/retention"
+)
+
+// ManifestName is the archive entry describing a snapshot.
+const ManifestName = "gtsdb-snapshot.json"
+
+// Version is the snapshot format version written to the manifest.
+const Version = 1
+
+// Manifest describes a snapshot.
+type Manifest struct {
+	Version int      `json:"version"`
+	Created int64    `json:"created"` // unix seconds
+	Keys    []string `json:"keys"`
+	Files   int      `json:"files"` // archive entries besides the manifest
+	Bytes   int64    `json:"bytes"` // total size of those entries
+}
+
+// Write streams a snapshot of the running database to w as a tar archive.
+func Write(w io.Writer) (Manifest, error) {
+	return WriteCut(w, nil)
+}
+
+// WriteCut is Write calling cut at the moment the snapshot captures, while
+// storage mutations are held off (see buffer.Snapshot). Replication uses it
+// to learn which mutations the snapshot already holds.
+func WriteCut(w io.Writer, cut func()) (Manifest, error) {
+	m := Manifest{Version: Version, Created: time.Now().Unix(), Keys: []string{}}
+	tw := tar.NewWriter(w)
+
+	meta, err := metadataFiles()
+	if err != nil {
+		return m, err
+	}
+	keys, err := buffer.Snapshot(cut, func(name string, size int64, r io.Reader) error {
+		return m.add(tw, name, size, r)
+	})
+	if err != nil {
+		return m, err
+	}
+	if keys != nil {
+		m.Keys = keys
+	}
+
+	names := make([]string, 0, len(meta))
+	for name := range meta {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data := meta[name]
+		if err := m.add(tw, name, int64(len(data)), bytes.NewReader(data)); err != nil {
+			return m, err
+		}
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return m, err
+	}
+	if err := writeEntry(tw, ManifestName, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return m, err
+	}
+	return m, tw.Close()
+}
+
+// Create writes a snapshot to file. The archive is written next to it
+// and renamed into place once complete.
+func Create(file string) (Manifest, error) {
+	tmp := file + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return Manifest{}, err
+	}
+	m, err := Write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+func (m *Manifest) add(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	if err := writeEntry(tw, name, size, r); err != nil {
+		return err
+	}
+	m.Files++
+	m.Bytes += size
+	return nil
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("copying %s: %w", name, err)
+	}
+	return nil
+}
+
+// metadataFiles collects the files of the data directory that do not belong
+// to buffer, which snapshots its own.
+func metadataFiles() (map[string][]byte, error) {
+	files, err := labels.SnapshotFiles()
+	if err != nil {
+		return nil, err
+	}
+	for name, read := range map[string]func() ([]byte, error){
+		"users.json":     auth.SnapshotUsers,
+		"retention.json": retention.SnapshotOverrides,
+	} {
+		data, err := read()
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			files[name] = data
+		}
+	}
+	return files, nil
+}
+
+// Restore extracts a snapshot into dataDir, which must be empty or not
+// exist. Files are extracted into a sibling directory that is renamed to
+// dataDir only after the manifest has been read, so a failed restore leaves
+// nothing behind.
+func Restore(r io.Reader, dataDir string) (Manifest, error) {
+	var m Manifest
+	dataDir = filepath.Clean(dataDir)
+	if entries, err := os.ReadDir(dataDir); err == nil && len(entries) > 0 {
+		return m, fmt.Errorf("data directory %s is not empty", dataDir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return m, err
+	}
+
+	tmp := dataDir + ".restore"
+	if err := os.RemoveAll(tmp); err != nil {
+		return m, err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return m, err
+	}
+	m, err := extract(tar.NewReader(r), tmp)
+	if err == nil {
+		if err = os.Remove(dataDir); err != nil && os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, dataDir)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return Manifest{}, err
+	}
+	return m, nil
+}
+
+func extract(tr *tar.Reader, dir string) (Manifest, error) {
+	var m Manifest
+	found := false
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return m, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return m, fmt.Errorf("unexpected entry %s in snapshot", hdr.Name)
+		}
+		name := path.Clean(hdr.Name)
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return m, fmt.Errorf("unsafe path %s in snapshot", hdr.Name)
+		}
+		if name == ManifestName {
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return m, fmt.Errorf("invalid manifest: %w", err)
+			}
+			found = true
+			continue
+		}
+		if err := extractFile(tr, filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return m, err
+		}
+	}
+	if !found {
+		return m, errors.New("not a gtsdb snapshot or truncated: manifest missing")
+	}
+	if m.Version < 1 || m.Version > Version {
+		return m, fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+	return m, nil
+}
+
+func extractFile(r io.Reader, file string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
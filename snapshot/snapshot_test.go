@@ -0,0 +1,164 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"bytes"
+	"gtsdb/auth"
+	"gtsdb/buffer"
+	"gtsdb/labels"
+	"gtsdb/models"
+	"gtsdb/retention"
+	"gtsdb/utils"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// openDataDir points every package at dir.
+func openDataDir(t *testing.T, dir string) {
+	t.Helper()
+	utils.DataDir = dir
+	buffer.InitFileHandles()
+	buffer.InitIDSet()
+	auth.Init(dir)
+	retention.Init(dir)
+	labels.Init(dir)
+	t.Cleanup(func() {
+		buffer.CloseAllHandles()
+		labels.Init("")
+	})
+}
+
+func points(key string, base int64, n int) []models.DataPoint {
+	pts := make([]models.DataPoint, n)
+	for i := range pts {
+		pts[i] = models.DataPoint{Key: key, Timestamp: base + int64(i), Value: float64(i)}
+	}
+	return pts
+}
+
+func TestWriteAndRestore(t *testing.T) {
+	src := t.TempDir()
+	openDataDir(t, src)
+	if _, err := auth.CreateUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	base := int64(1700000000)
+	buffer.StoreDataPointsBuffer(points("alice/temp", base, 12000))
+	buffer.StoreDataPointsBuffer(points("bob/hum", base, 10))
+	buffer.PatchDataPoints([]models.DataPoint{
+		{Key: "alice/temp", Timestamp: base - 1, Value: -1}, // staged
+		{Key: "alice/temp", Timestamp: base + 5, Value: 42}, // overwritten in place
+	}, "alice/temp")
+	if err := labels.SetLabels("alice/temp", map[string]string{"site": "hk"}); err != nil {
+		t.Fatal(err)
+	}
+	retention.SetKeyRetention("bob/hum", 3600)
+
+	// Appends keep flowing while the snapshot is written
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			buffer.StoreDataPointsBuffer(points("bob/hum", base+10+int64(i)*10, 10))
+		}
+	}()
+	var archive bytes.Buffer
+	m, err := Write(&archive)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m.Keys, []string{"alice/temp", "bob/hum"}) {
+		t.Errorf("Unexpected keys: %v", m.Keys)
+	}
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	restored, err := Restore(bytes.NewReader(archive.Bytes()), dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Files != m.Files || restored.Bytes != m.Bytes {
+		t.Errorf("Manifest mismatch: wrote %+v, restored %+v", m, restored)
+	}
+	for _, name := range []string{"users.json", "retention.json", "alice/labels.json", "alice/temp.aof.ooo"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Errorf("Expected %s in restored directory: %v", name, err)
+		}
+	}
+
+	alice, _ := auth.GetUser("alice")
+	openDataDir(t, dst)
+	got := buffer.ReadDataPoints("alice/temp", base-1, base+12000, 0, "")
+	if len(got) != 12001 || got[0].Value != -1 || got[6].Value != 42 {
+		t.Errorf("Unexpected restored points: %d", len(got))
+	}
+	hum := buffer.ReadDataPoints("bob/hum", base, base+2000, 0, "")
+	if len(hum) < 10 || len(hum)%10 != 0 {
+		t.Errorf("Expected whole batches of bob/hum, got %d points", len(hum))
+	}
+	if u, ok := auth.GetUser("alice"); !ok || u.Token != alice.Token {
+		t.Error("Users not restored")
+	}
+	if got := labels.GetLabels("alice/temp"); got["site"] != "hk" {
+		t.Errorf("Labels not restored: %v", got)
+	}
+	if seconds, ok := retention.KeyRetention("bob/hum"); !ok || seconds != 3600 {
+		t.Errorf("Retention override not restored: %d", seconds)
+	}
+}
+
+func TestRestoreRejects(t *testing.T) {
+	tarOf := func(names ...string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, name := range names {
+			data := []byte(`{"version":1}`)
+			tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(data)), Mode: 0644})
+			tw.Write(data)
+		}
+		tw.Close()
+		return buf.Bytes()
+	}
+
+	t.Run("missing manifest", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "data")
+		if _, err := Restore(bytes.NewReader(tarOf("users.json")), dst); err == nil {
+			t.Fatal("Expected an error for an archive without manifest")
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Error("Failed restore left the data directory behind")
+		}
+	})
+
+	t.Run("unsafe path", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "data")
+		if _, err := Restore(bytes.NewReader(tarOf("../evil.json", ManifestName)), dst); err == nil {
+			t.Fatal("Expected an error for a path outside the data directory")
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(dst), "evil.json")); !os.IsNotExist(err) {
+			t.Error("Unsafe entry was extracted")
+		}
+	})
+
+	t.Run("non-empty target", func(t *testing.T) {
+		dst := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dst, "users.json"), []byte("[]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Restore(bytes.NewReader(tarOf(ManifestName)), dst); err == nil {
+			t.Fatal("Expected an error for a non-empty data directory")
+		}
+	})
+
+	t.Run("empty target", func(t *testing.T) {
+		dst := t.TempDir()
+		m, err := Restore(bytes.NewReader(tarOf(ManifestName)), dst)
+		if err != nil || m.Version != 1 {
+			t.Fatalf("Restore into empty directory: %+v, %v", m, err)
+		}
+	})
+}
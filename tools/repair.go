@@ -155,6 +155,13 @@ func analyzeFile(key string, repair bool, writeFixed bool) (corrupted bool, proc
 		return false, 0, 0, 0
 	}
 
+	// Files with a GTSDB header (multi-field keys) are not 16-byte records.
+	var magic [8]byte
+	if n, _ := file.ReadAt(magic[:], 0); n == len(magic) && string(magic[:]) == "GTSDBWAL" {
+		fmt.Printf("  SKIPPED: %s (headered WAL)\n", key)
+		return false, 0, 0, 0
+	}
+
 	fileSize := fileInfo.Size()
 	actualRecordCount := fileSize / 16
 
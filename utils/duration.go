@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseDurationSeconds parses a human-friendly duration into whole seconds.
+// Accepts plain integers (seconds), Go durations ("90m", "12h") and the
+// day/week suffixes Go lacks ("90d", "2w"). An empty string parses as 0.
+func ParseDurationSeconds(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+
+	unit := int64(0)
+	switch s[len(s)-1] {
+	case 'd':
+		unit = 86400
+	case 'w':
+		unit = 7 * 86400
+	}
+	if unit > 0 {
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil || n > math.MaxInt64/unit || n < math.MinInt64/unit {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return n * unit, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return int64(d / time.Second), nil
+}
@@ -23,9 +23,19 @@ var (
 	NoAuthUser            = ""
 	RootToken             = ""
 	CompactionCompression = false
+	WALChecksums          = true                // new key files get per-record CRC32C
 	SyncMode              = "async"             // "sync" or "async" — default async for better throughput
 	SyncIntervalMs        = 1000                // ms between periodic flushes in async mode
 	DataPointCacheSize    = 0                   // in-memory ring buffer per key for reads (0=disabled)
+	DefaultRetention      = int64(0)            // seconds of data to keep per key (0=forever)
+	ReplicationLeader     = ""                  // TCP address of the leader this server follows ("" = not a follower)
+	ReplicationToken      = ""                  // root token of the leader
+	ReplicationLogBytes   = int64(64 << 20)     // mutations kept in memory for followers to catch up
+	ForwardRemote         = ""                  // TCP address of the GTSDB to forward writes to ("" = off)
+	ForwardToken          = ""                  // token on the forward remote
+	ForwardPrefixes       []string              // local key prefixes to forward
+	ForwardRemotePrefix   = ""                  // prepended to forwarded keys on the remote
+	ForwardIntervalMs     = 5000                // ms between forward sync rounds
 	LogLevel              = int32(LogLevelInfo) // default: info and above
 )
 
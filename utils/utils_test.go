@@ -115,3 +115,32 @@ func TestSetLogLevel(t *testing.T) {
 		t.Errorf("Expected log level %d, got %d", LogLevelDebug, atomic.LoadInt32(&LogLevel))
 	}
 }
+
+func TestParseDurationSeconds(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"3600", 3600, false},
+		{"90m", 5400, false},
+		{"12h", 43200, false},
+		{"90d", 90 * 86400, false},
+		{"2w", 14 * 86400, false},
+		{"abc", 0, true},
+		{"xd", 0, true},
+		{"200000000000000w", 0, true},
+		{"-200000000000000d", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDurationSeconds(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDurationSeconds(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDurationSeconds(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}